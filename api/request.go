@@ -20,6 +20,7 @@ type VolumeCreateRequest struct {
 	Type           string
 	IOPS           int64
 	PrepareForVM   bool
+	Async          bool
 	Verbose        bool
 }
 
@@ -51,12 +52,29 @@ type BackupListRequest struct {
 	Endpoint     string
 	VolumeName   string
 	SnapshotName string
+	// Only list backups with all the labels
+	Labels map[string]string
 }
 
 type BackupCreateRequest struct {
 	URL          string
 	Endpoint     string
 	SnapshotName string
+	Labels       map[string]string
+	Description  string
+	// Override the limits of objectstore options if specified
+	BandwidthLimit string
+	IOPSLimit      int64
+	Async          bool
+	Verbose        bool
+}
+
+type BackupCopyRequest struct {
+	URL          string
+	Endpoint     string
+	DestURL      string
+	DestEndpoint string
+	Async        bool
 	Verbose      bool
 }
 
@@ -64,3 +82,74 @@ type BackupDeleteRequest struct {
 	URL      string
 	Endpoint string
 }
+
+type BackupGCRequest struct {
+	URL      string
+	Endpoint string
+	DryRun   bool
+}
+
+type BackupVerifyRequest struct {
+	URL      string
+	Endpoint string
+}
+
+type BackupPruneRequest struct {
+	URL         string
+	Endpoint    string
+	VolumeName  string
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      string
+	DryRun      bool
+}
+
+type BackupCatalogRequest struct {
+	URL      string
+	Endpoint string
+}
+
+type BackupExportRequest struct {
+	URL      string
+	Endpoint string
+}
+
+type BackupMigrateRequest struct {
+	URL        string
+	Endpoint   string
+	VolumeName string
+}
+
+type ScheduleCreateRequest struct {
+	Name       string
+	Cron       string
+	VolumeName string
+	URL        string
+	Endpoint   string
+	Retention  int
+	Verbose    bool
+}
+
+type ScheduleRequest struct {
+	Name string
+}
+
+type JobRequest struct {
+	ID string
+}
+
+type TargetCreateRequest struct {
+	Name      string
+	URL       string
+	Endpoint  string
+	Options   map[string]string
+	AccessKey string
+	SecretKey string
+	Verbose   bool
+}
+
+type TargetRequest struct {
+	Name string
+}
@@ -21,6 +21,9 @@ type VolumeResponse struct {
 	CreatedTime string
 	DriverInfo  map[string]string
 	Snapshots   map[string]SnapshotResponse
+	// Set while the volume is being created, e.g. restoring from backup by the job
+	Creating bool   `json:",omitempty"`
+	JobID    string `json:",omitempty"`
 }
 
 type SnapshotResponse struct {
@@ -35,6 +38,53 @@ type BackupURLResponse struct {
 	URL string
 }
 
+type ScheduleResponse struct {
+	Name        string
+	Cron        string
+	VolumeName  string
+	DestURL     string `json:",omitempty"`
+	Endpoint    string `json:",omitempty"`
+	Retention   int
+	Paused      bool
+	Running     bool
+	CreatedTime string
+	NextRunTime string
+	LastRunTime string
+	LastError   string
+	LastJobID   string `json:",omitempty"`
+	Snapshots   []string
+	Backups     []string
+}
+
+// TargetResponse never contains the secrets of target, only the names of credentials
+type TargetResponse struct {
+	Name        string
+	URL         string
+	Endpoint    string `json:",omitempty"`
+	Options     map[string]string
+	Credentials []string
+	CreatedTime string
+}
+
+type JobResponse struct {
+	ID              string
+	Type            string
+	State           string
+	VolumeName      string
+	SnapshotName    string `json:",omitempty"`
+	BackupURL       string `json:",omitempty"`
+	DestURL         string `json:",omitempty"`
+	Result          string `json:",omitempty"`
+	Error           string `json:",omitempty"`
+	CreatedTime     string
+	FinishedTime    string `json:",omitempty"`
+	TotalBlocks     int
+	ProcessedBlocks int
+	TotalBytes      int64
+	ProcessedBytes  int64
+	ETA             string `json:",omitempty"`
+}
+
 // ResponseError would generate a error information in JSON format for output
 func ResponseError(format string, a ...interface{}) {
 	response := ErrorResponse{Error: fmt.Sprintf(format, a...)}
@@ -150,6 +150,9 @@ func NewCli(version string) *cli.App {
 		volumeInspectCmd,
 		snapshotCmd,
 		backupCmd,
+		scheduleCmd,
+		jobCmd,
+		targetCmd,
 	}
 	return app
 }
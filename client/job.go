@@ -0,0 +1,71 @@
+package client
+
+import (
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+)
+
+var (
+	jobListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list running jobs and records of finished jobs",
+		Action: cmdJobList,
+	}
+
+	jobInspectCmd = cli.Command{
+		Name:   "inspect",
+		Usage:  "inspect the progress or result of a job: inspect <job>",
+		Action: cmdJobInspect,
+	}
+
+	jobCancelCmd = cli.Command{
+		Name:   "cancel",
+		Usage:  "cancel a running job: cancel <job>",
+		Action: cmdJobCancel,
+	}
+
+	jobCmd = cli.Command{
+		Name:  "job",
+		Usage: "backup and restore job related operations",
+		Subcommands: []cli.Command{
+			jobListCmd,
+			jobInspectCmd,
+			jobCancelCmd,
+		},
+	}
+)
+
+func cmdJobList(c *cli.Context) {
+	if err := doJobList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doJobList(c *cli.Context) error {
+	url := "/jobs/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdJobInspect(c *cli.Context) {
+	if err := doJobRequest(c, "GET", "/jobs/inspect"); err != nil {
+		panic(err)
+	}
+}
+
+func cmdJobCancel(c *cli.Context) {
+	if err := doJobRequest(c, "POST", "/jobs/cancel"); err != nil {
+		panic(err)
+	}
+}
+
+func doJobRequest(c *cli.Context, method, url string) error {
+	jobID, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.JobRequest{
+		ID: jobID,
+	}
+	return sendRequestAndPrint(method, url, request)
+}
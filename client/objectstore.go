@@ -1,6 +1,12 @@
 package client
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+
 	"github.com/codegangsta/cli"
 	"github.com/rancher/convoy/api"
 	"github.com/rancher/convoy/util"
@@ -20,10 +26,47 @@ var (
 				Name:  "dest",
 				Usage: "destination of backup if driver supports, would be url like s3://bucket@region/path/ or vfs:///path/",
 			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of backup in the format of key=value, can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "description",
+				Usage: "description of backup",
+			},
+			cli.StringFlag{
+				Name:  "bandwidth-limit",
+				Usage: "max bytes per second transferred to objectstore, like 10M, overrides objectstore.bandwidthlimit of daemon",
+			},
+			cli.IntFlag{
+				Name:  "iops-limit",
+				Usage: "max blocks per second read from snapshot, overrides objectstore.iopslimit of daemon",
+			},
+			cli.BoolFlag{
+				Name:  "async",
+				Usage: "return the job ID without waiting for the backup, see `convoy job`",
+			},
 		},
 		Action: cmdBackupCreate,
 	}
 
+	backupCopyCmd = cli.Command{
+		Name:  "copy",
+		Usage: "copy a backup to another objectstore: copy <backup> <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "dest-s3-endpoint",
+				Usage: "custom S3 endpoint URL of destination, like http://minio.example.com:9000",
+			},
+			cli.BoolFlag{
+				Name:  "async",
+				Usage: "return the job ID without waiting for the copy, see `convoy job`",
+			},
+		},
+		Action: cmdBackupCopy,
+	}
+
 	backupDeleteCmd = cli.Command{
 		Name:   "delete",
 		Usage:  "delete a backup in objectstore: delete <backup>",
@@ -38,6 +81,11 @@ var (
 				Name:  "volume-name",
 				Usage: "name of volume",
 			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "only list backups with the label in the format of key=value, can be specified multiple times",
+			},
 		},
 		Action: cmdBackupList,
 	}
@@ -48,14 +96,112 @@ var (
 		Action: cmdBackupInspect,
 	}
 
+	backupVerifyCmd = cli.Command{
+		Name:   "verify",
+		Usage:  "verify a backup, or check consistency of backups in objectstore: verify <backup|dest>",
+		Action: cmdBackupVerify,
+	}
+
+	backupGCCmd = cli.Command{
+		Name:  "gc",
+		Usage: "remove blocks not referenced by any backup in objectstore: gc <dest>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only report the blocks would be removed",
+			},
+		},
+		Action: cmdBackupGC,
+	}
+
+	backupMigrateCmd = cli.Command{
+		Name:  "migrate",
+		Usage: "move blocks of volumes in objectstore to the shared block pool of destination: migrate <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume-name",
+				Usage: "name of volume, all the volumes in destination would be migrated if not specified",
+			},
+		},
+		Action: cmdBackupMigrate,
+	}
+
+	backupCatalogCmd = cli.Command{
+		Name:   "catalog",
+		Usage:  "rebuild the catalog of backups in objectstore, if it's missing or stale: catalog <dest>",
+		Action: cmdBackupCatalog,
+	}
+
+	backupExportCmd = cli.Command{
+		Name:  "export",
+		Usage: "export a backup to an archive, which can be imported to any objectstore: export <backup> -o <file>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "file the archive would be written to",
+			},
+		},
+		Action: cmdBackupExport,
+	}
+
+	backupImportCmd = cli.Command{
+		Name:   "import",
+		Usage:  "import a backup from the archive created by export: import <file> <dest>",
+		Action: cmdBackupImport,
+	}
+
+	backupPruneCmd = cli.Command{
+		Name:  "prune",
+		Usage: "remove backups in objectstore according to retention policy: prune <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume-name",
+				Usage: "name of volume, all the volumes in destination would be processed if not specified",
+			},
+			cli.IntFlag{
+				Name:  "keep-last",
+				Usage: "keep the latest N backups",
+			},
+			cli.IntFlag{
+				Name:  "keep-daily",
+				Usage: "keep the latest backup of each day, for the latest N days which have backups",
+			},
+			cli.IntFlag{
+				Name:  "keep-weekly",
+				Usage: "keep the latest backup of each week, for the latest N weeks which have backups",
+			},
+			cli.IntFlag{
+				Name:  "keep-monthly",
+				Usage: "keep the latest backup of each month, for the latest N months which have backups",
+			},
+			cli.StringFlag{
+				Name:  "max-age",
+				Usage: "remove backups older than it, e.g. 30d or 12h",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only list the backups would be removed",
+			},
+		},
+		Action: cmdBackupPrune,
+	}
+
 	backupCmd = cli.Command{
 		Name:  "backup",
 		Usage: "backup related operations",
 		Subcommands: []cli.Command{
 			backupCreateCmd,
+			backupCopyCmd,
 			backupDeleteCmd,
 			backupListCmd,
 			backupInspectCmd,
+			backupVerifyCmd,
+			backupGCCmd,
+			backupPruneCmd,
+			backupMigrateCmd,
+			backupCatalogCmd,
+			backupExportCmd,
+			backupImportCmd,
 		},
 		Flags: []cli.Flag{
 			S3EndpointFlag,
@@ -77,12 +223,17 @@ func doBackupList(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	labels, err := util.ParseLabels(c.StringSlice("label"))
+	if err != nil {
+		return err
+	}
 
 	endpointURL := c.GlobalString("s3-endpoint")
 	request := &api.BackupListRequest{
 		URL:        destURL,
 		Endpoint:   endpointURL,
 		VolumeName: volumeName,
+		Labels:     labels,
 	}
 	url := "/backups/list"
 	return sendRequestAndPrint("GET", url, request)
@@ -129,19 +280,59 @@ func doBackupCreate(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	labels, err := util.ParseLabels(c.StringSlice("label"))
+	if err != nil {
+		return err
+	}
 
 	endpointURL := c.GlobalString("s3-endpoint")
 	request := &api.BackupCreateRequest{
-		URL:          destURL,
-		Endpoint:     endpointURL,
-		SnapshotName: snapshotName,
-		Verbose:      c.GlobalBool(verboseFlag),
+		URL:            destURL,
+		Endpoint:       endpointURL,
+		SnapshotName:   snapshotName,
+		Labels:         labels,
+		Description:    c.String("description"),
+		BandwidthLimit: c.String("bandwidth-limit"),
+		IOPSLimit:      int64(c.Int("iops-limit")),
+		Async:          c.Bool("async"),
+		Verbose:        c.GlobalBool(verboseFlag),
 	}
 
 	url := "/backups/create"
 	return sendRequestAndPrint("POST", url, request)
 }
 
+func cmdBackupCopy(c *cli.Context) {
+	if err := doBackupCopy(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupCopy(c *cli.Context) error {
+	var err error
+
+	backupURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+	destURL := c.Args().Get(1)
+	if destURL == "" {
+		return util.RequiredMissingError("dest")
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupCopyRequest{
+		URL:          backupURL,
+		Endpoint:     endpointURL,
+		DestURL:      destURL,
+		DestEndpoint: c.String("dest-s3-endpoint"),
+		Async:        c.Bool("async"),
+		Verbose:      c.GlobalBool(verboseFlag),
+	}
+	url := "/backups/copy"
+	return sendRequestAndPrint("POST", url, request)
+}
+
 func cmdBackupDelete(c *cli.Context) {
 	if err := doBackupDelete(c); err != nil {
 		panic(err)
@@ -163,3 +354,216 @@ func doBackupDelete(c *cli.Context) error {
 	url := "/backups"
 	return sendRequestAndPrint("DELETE", url, request)
 }
+
+func cmdBackupVerify(c *cli.Context) {
+	if err := doBackupVerify(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupVerify(c *cli.Context) error {
+	var err error
+
+	verifyURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupVerifyRequest{
+		URL:      verifyURL,
+		Endpoint: endpointURL,
+	}
+	url := "/backups/verify"
+	return sendRequestAndPrint("GET", url, request)
+}
+
+func cmdBackupGC(c *cli.Context) {
+	if err := doBackupGC(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupGC(c *cli.Context) error {
+	var err error
+
+	destURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupGCRequest{
+		URL:      destURL,
+		Endpoint: endpointURL,
+		DryRun:   c.Bool("dry-run"),
+	}
+	url := "/backups/gc"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupMigrate(c *cli.Context) {
+	if err := doBackupMigrate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupMigrate(c *cli.Context) error {
+	var err error
+
+	destURL, err := util.GetFlag(c, "", true, err)
+	volumeName, err := util.GetName(c, "volume-name", false, err)
+	if err != nil {
+		return err
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupMigrateRequest{
+		URL:        destURL,
+		Endpoint:   endpointURL,
+		VolumeName: volumeName,
+	}
+	url := "/backups/migrate"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupCatalog(c *cli.Context) {
+	if err := doBackupCatalog(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupCatalog(c *cli.Context) error {
+	var err error
+
+	destURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupCatalogRequest{
+		URL:      destURL,
+		Endpoint: endpointURL,
+	}
+	url := "/backups/catalog"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupExport(c *cli.Context) {
+	if err := doBackupExport(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupExport(c *cli.Context) error {
+	var err error
+
+	backupURL, err := util.GetFlag(c, "", true, err)
+	output, err := util.GetFlag(c, "output", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.BackupExportRequest{
+		URL:      backupURL,
+		Endpoint: c.GlobalString("s3-endpoint"),
+	}
+	rc, err := sendRequest("GET", "/backups/export", request)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(output)
+		return fmt.Errorf("Failed to export backup: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(output)
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+func cmdBackupImport(c *cli.Context) {
+	if err := doBackupImport(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupImport(c *cli.Context) error {
+	var err error
+
+	file, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+	destURL := c.Args().Get(1)
+	if destURL == "" {
+		return util.RequiredMissingError("dest")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	query := url.Values{}
+	query.Set("url", destURL)
+	query.Set("endpoint", c.GlobalString("s3-endpoint"))
+	query.Set("verbose", fmt.Sprint(c.GlobalBool(verboseFlag)))
+	headers := map[string][]string{
+		"Content-Type": {"application/x-tar"},
+	}
+	rc, _, _, err := client.clientRequest("POST", "/backups/import?"+query.Encode(), f, headers)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func cmdBackupPrune(c *cli.Context) {
+	if err := doBackupPrune(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupPrune(c *cli.Context) error {
+	var err error
+
+	destURL, err := util.GetFlag(c, "", true, err)
+	volumeName, err := util.GetName(c, "volume-name", false, err)
+	if err != nil {
+		return err
+	}
+
+	endpointURL := c.GlobalString("s3-endpoint")
+	request := &api.BackupPruneRequest{
+		URL:         destURL,
+		Endpoint:    endpointURL,
+		VolumeName:  volumeName,
+		KeepLast:    c.Int("keep-last"),
+		KeepDaily:   c.Int("keep-daily"),
+		KeepWeekly:  c.Int("keep-weekly"),
+		KeepMonthly: c.Int("keep-monthly"),
+		MaxAge:      c.String("max-age"),
+		DryRun:      c.Bool("dry-run"),
+	}
+	url := "/backups/prune"
+	return sendRequestAndPrint("POST", url, request)
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	scheduleAddCmd = cli.Command{
+		Name:  "add",
+		Usage: "add a schedule to snapshot and backup certain volume periodically: schedule add <volume>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "name of schedule",
+			},
+			cli.StringFlag{
+				Name:  "cron",
+				Usage: "cron expression of the schedule, like \"0 2 * * *\" or @daily",
+			},
+			cli.StringFlag{
+				Name:  "dest",
+				Usage: "destination of backup, would only create snapshot if not specified",
+			},
+			cli.IntFlag{
+				Name:  "retention",
+				Usage: "number of snapshots and backups created by the schedule would be kept, keep all if not specified",
+			},
+		},
+		Action: cmdScheduleAdd,
+	}
+
+	scheduleListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list all schedules",
+		Action: cmdScheduleList,
+	}
+
+	schedulePauseCmd = cli.Command{
+		Name:   "pause",
+		Usage:  "pause a schedule: schedule pause <schedule>",
+		Action: cmdSchedulePause,
+	}
+
+	scheduleResumeCmd = cli.Command{
+		Name:   "resume",
+		Usage:  "resume a paused schedule: schedule resume <schedule>",
+		Action: cmdScheduleResume,
+	}
+
+	scheduleDeleteCmd = cli.Command{
+		Name:   "delete",
+		Usage:  "delete a schedule: schedule delete <schedule>",
+		Action: cmdScheduleDelete,
+	}
+
+	scheduleCmd = cli.Command{
+		Name:  "schedule",
+		Usage: "schedule related operations",
+		Subcommands: []cli.Command{
+			scheduleAddCmd,
+			scheduleListCmd,
+			schedulePauseCmd,
+			scheduleResumeCmd,
+			scheduleDeleteCmd,
+		},
+		Flags: []cli.Flag{
+			S3EndpointFlag,
+		},
+	}
+)
+
+func cmdScheduleAdd(c *cli.Context) {
+	if err := doScheduleAdd(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleAdd(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+	scheduleName, err := util.GetName(c, "name", false, err)
+	cron, err := util.GetFlag(c, "cron", true, err)
+	destURL, err := util.GetFlag(c, "dest", false, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ScheduleCreateRequest{
+		Name:       scheduleName,
+		Cron:       cron,
+		VolumeName: volumeName,
+		URL:        destURL,
+		Endpoint:   c.GlobalString("s3-endpoint"),
+		Retention:  c.Int("retention"),
+		Verbose:    c.GlobalBool(verboseFlag),
+	}
+	url := "/schedules/create"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdScheduleList(c *cli.Context) {
+	if err := doScheduleList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleList(c *cli.Context) error {
+	url := "/schedules/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdSchedulePause(c *cli.Context) {
+	if err := doScheduleUpdate(c, "/schedules/pause"); err != nil {
+		panic(err)
+	}
+}
+
+func cmdScheduleResume(c *cli.Context) {
+	if err := doScheduleUpdate(c, "/schedules/resume"); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleUpdate(c *cli.Context, url string) error {
+	scheduleName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ScheduleRequest{
+		Name: scheduleName,
+	}
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdScheduleDelete(c *cli.Context) {
+	if err := doScheduleDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleDelete(c *cli.Context) error {
+	scheduleName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ScheduleRequest{
+		Name: scheduleName,
+	}
+	url := "/schedules"
+	return sendRequestAndPrint("DELETE", url, request)
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	targetCreateCmd = cli.Command{
+		Name:  "create",
+		Usage: "create a named backup target, which can be used instead of URL: target create <target>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "url",
+				Usage: "destination of backup, would be url like s3://bucket@region/path/ or vfs:///path/",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "option added to the query of url in the format of key=value, like sse=AES256, can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:   "access-key",
+				Usage:  "access key of the target, used instead of the one of daemon",
+				EnvVar: "CONVOY_TARGET_ACCESS_KEY",
+			},
+			cli.StringFlag{
+				Name:   "secret-key",
+				Usage:  "secret key of the target, used instead of the one of daemon",
+				EnvVar: "CONVOY_TARGET_SECRET_KEY",
+			},
+		},
+		Action: cmdTargetCreate,
+	}
+
+	targetListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list all targets",
+		Action: cmdTargetList,
+	}
+
+	targetInspectCmd = cli.Command{
+		Name:   "inspect",
+		Usage:  "inspect a target: target inspect <target>",
+		Action: cmdTargetInspect,
+	}
+
+	targetDeleteCmd = cli.Command{
+		Name:   "delete",
+		Usage:  "delete a target, backups in it would be kept: target delete <target>",
+		Action: cmdTargetDelete,
+	}
+
+	targetCmd = cli.Command{
+		Name:  "target",
+		Usage: "backup target related operations",
+		Subcommands: []cli.Command{
+			targetCreateCmd,
+			targetListCmd,
+			targetInspectCmd,
+			targetDeleteCmd,
+		},
+		Flags: []cli.Flag{
+			S3EndpointFlag,
+		},
+	}
+)
+
+// parseTargetOptions parses options in the format of key=value, value may contain '='
+func parseTargetOptions(opts []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, opt := range opts {
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("Invalid option %v, must be key=value", opt)
+		}
+		result[pair[0]] = pair[1]
+	}
+	return result, nil
+}
+
+func cmdTargetCreate(c *cli.Context) {
+	if err := doTargetCreate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTargetCreate(c *cli.Context) error {
+	var err error
+
+	targetName, err := getName(c, "", true)
+	destURL, err := util.GetFlag(c, "url", true, err)
+	if err != nil {
+		return err
+	}
+	options, err := parseTargetOptions(c.StringSlice("opt"))
+	if err != nil {
+		return err
+	}
+
+	request := &api.TargetCreateRequest{
+		Name:      targetName,
+		URL:       destURL,
+		Endpoint:  c.GlobalString("s3-endpoint"),
+		Options:   options,
+		AccessKey: c.String("access-key"),
+		SecretKey: c.String("secret-key"),
+		Verbose:   c.GlobalBool(verboseFlag),
+	}
+	url := "/targets/create"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdTargetList(c *cli.Context) {
+	if err := doTargetList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTargetList(c *cli.Context) error {
+	url := "/targets/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdTargetInspect(c *cli.Context) {
+	if err := doTargetInspect(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTargetInspect(c *cli.Context) error {
+	targetName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.TargetRequest{
+		Name: targetName,
+	}
+	url := "/targets/inspect"
+	return sendRequestAndPrint("GET", url, request)
+}
+
+func cmdTargetDelete(c *cli.Context) {
+	if err := doTargetDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTargetDelete(c *cli.Context) error {
+	targetName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.TargetRequest{
+		Name: targetName,
+	}
+	url := "/targets"
+	return sendRequestAndPrint("DELETE", url, request)
+}
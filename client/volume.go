@@ -43,6 +43,10 @@ var (
 				Name:  "vm",
 				Usage: "Prepare volume for Rancher VM if driver supports",
 			},
+			cli.BoolFlag{
+				Name:  "async",
+				Usage: "return the job ID without waiting for restoring the backup, see `convoy job`",
+			},
 		},
 		Action: cmdVolumeCreate,
 	}
@@ -137,6 +141,7 @@ func doVolumeCreate(c *cli.Context) error {
 		Type:           volumeType,
 		IOPS:           int64(iops),
 		PrepareForVM:   prepareForVM,
+		Async:          c.Bool("async"),
 		Verbose:        c.GlobalBool(verboseFlag),
 	}
 
@@ -71,7 +71,12 @@ type SnapshotOperations interface {
 BackupOperations is Convoy Driver backup related operations interface. Any
 Convoy Driver want to provide backup functionality must implement this
 interface. Restore would need to be implemented in
-VolumeOperations.CreateVolume() with opts[OPT_BACKUP_URL]
+VolumeOperations.CreateVolume() with opts[OPT_BACKUP_URL]. Backups created by
+other drivers would be restored by Convoy into the block device reported as
+OPT_DEVICE in VolumeOperations.GetVolumeInfo(), or the filesystem mounted by
+VolumeOperations.MountVolume() otherwise. Drivers backed by objectstore should
+report progress to objectstore.GetProgress(opts[OPT_JOB_ID]), so the job can be
+tracked and cancelled.
 */
 type BackupOperations interface {
 	Name() string
@@ -97,6 +102,10 @@ const (
 	OPT_REFERENCE_ONLY        = "ReferenceOnly"
 	OPT_PREPARE_FOR_VM        = "PrepareForVM"
 	OPT_FILESYSTEM            = "Filesystem"
+	OPT_DEVICE                = "Device"
+	OPT_JOB_ID                = "JobID"
+	OPT_BACKUP_LABELS         = "BackupLabels"
+	OPT_BACKUP_DESCRIPTION    = "BackupDescription"
 )
 
 var (
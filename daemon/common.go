@@ -55,6 +55,17 @@ func (s *daemon) doInfo(version string, w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return err
 	}
+	// Secrets of targets are never included
+	if _, err := w.Write([]byte(fmt.Sprint(",\n\"Targets\": "))); err != nil {
+		return err
+	}
+	data, err = api.ResponseOutput(s.listTargetResponses())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
 	for _, driver := range s.ConvoyDrivers {
 		if _, err := w.Write([]byte(fmt.Sprintf(",\n\"%v\": ", driver.Name()))); err != nil {
 			return err
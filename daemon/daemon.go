@@ -8,12 +8,14 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/gorilla/mux"
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 
 	. "github.com/rancher/convoy/convoydriver"
@@ -27,6 +29,14 @@ type daemon struct {
 	NameUUIDIndex       *util.Index
 	SnapshotVolumeIndex *util.Index
 	daemonConfig
+
+	scheduler *scheduler
+	jobs      *jobManager
+	targets   *targetManager
+
+	// Volumes being created, e.g. restoring from backups
+	creatingVolumes     map[string]*volumeReservation
+	creatingVolumesLock sync.Mutex
 }
 
 const (
@@ -35,6 +45,8 @@ const (
 
 	CONFIGFILE = "convoy.cfg"
 	LOCKFILE   = "lock"
+
+	OBJECTSTORE_OPTS_PREFIX = "objectstore."
 )
 
 var (
@@ -52,6 +64,7 @@ type daemonConfig struct {
 	IgnoreDockerDelete  bool
 	CreateOnDockerMount bool
 	CmdTimeout          string
+	ObjectStoreOpts     map[string]string
 }
 
 func (c *daemonConfig) ConfigFile() (string, error) {
@@ -71,6 +84,13 @@ func createRouter(s *daemon) *mux.Router {
 			"/snapshots/":      s.doSnapshotInspect,
 			"/backups/list":    s.doBackupList,
 			"/backups/inspect": s.doBackupInspect,
+			"/backups/verify":  s.doBackupVerify,
+			"/backups/export":  s.doBackupExport,
+			"/schedules/list":  s.doScheduleList,
+			"/jobs/list":       s.doJobList,
+			"/jobs/inspect":    s.doJobInspect,
+			"/targets/list":    s.doTargetList,
+			"/targets/inspect": s.doTargetInspect,
 		},
 		"POST": {
 			"/volumes/create":   s.doVolumeCreate,
@@ -78,11 +98,24 @@ func createRouter(s *daemon) *mux.Router {
 			"/volumes/umount":   s.doVolumeUmount,
 			"/snapshots/create": s.doSnapshotCreate,
 			"/backups/create":   s.doBackupCreate,
+			"/backups/copy":     s.doBackupCopy,
+			"/backups/gc":       s.doBackupGC,
+			"/backups/prune":    s.doBackupPrune,
+			"/backups/migrate":  s.doBackupMigrate,
+			"/backups/catalog":  s.doBackupCatalog,
+			"/backups/import":   s.doBackupImport,
+			"/schedules/create": s.doScheduleCreate,
+			"/schedules/pause":  s.doSchedulePause,
+			"/schedules/resume": s.doScheduleResume,
+			"/jobs/cancel":      s.doJobCancel,
+			"/targets/create":   s.doTargetCreate,
 		},
 		"DELETE": {
 			"/volumes/":   s.doVolumeDelete,
 			"/snapshots/": s.doSnapshotDelete,
 			"/backups":    s.doBackupDelete,
+			"/schedules":  s.doScheduleDelete,
+			"/targets":    s.doTargetDelete,
 		},
 	}
 	for method, routes := range m {
@@ -222,6 +255,7 @@ func environmentCleanup() {
 func (s *daemon) finializeInitialization() error {
 	s.NameUUIDIndex = util.NewIndex()
 	s.SnapshotVolumeIndex = util.NewIndex()
+	s.creatingVolumes = make(map[string]*volumeReservation)
 
 	s.updateIndex()
 	return nil
@@ -252,6 +286,31 @@ func (s *daemon) initDrivers(driverOpts map[string]string) error {
 	return nil
 }
 
+// getObjectStoreOpts picks up objectstore options from driver options. Secret
+// won't be saved to config file.
+func getObjectStoreOpts(driverOpts map[string]string) map[string]string {
+	opts := map[string]string{}
+	for k, v := range driverOpts {
+		if !strings.HasPrefix(k, OBJECTSTORE_OPTS_PREFIX) || k == objectstore.OBJECTSTORE_PASSPHRASE {
+			continue
+		}
+		opts[k] = v
+	}
+	return opts
+}
+
+func (s *daemon) initObjectStore(driverOpts map[string]string) error {
+	opts := map[string]string{}
+	for k, v := range s.ObjectStoreOpts {
+		opts[k] = v
+	}
+	// Passphrase has to be specified every time daemon starts
+	if passphrase, exists := driverOpts[objectstore.OBJECTSTORE_PASSPHRASE]; exists {
+		opts[objectstore.OBJECTSTORE_PASSPHRASE] = passphrase
+	}
+	return objectstore.Init(s.Root, opts)
+}
+
 // Start the daemon
 func Start(sockFile string, c *cli.Context) error {
 	var err error
@@ -303,6 +362,7 @@ func Start(sockFile string, c *cli.Context) error {
 		config.IgnoreDockerDelete = c.Bool("ignore-docker-delete")
 		config.CreateOnDockerMount = c.Bool("create-on-docker-mount")
 		config.CmdTimeout = c.String("cmd-timeout")
+		config.ObjectStoreOpts = getObjectStoreOpts(util.SliceToMap(c.StringSlice("driver-opts")))
 	}
 
 	s.daemonConfig = *config
@@ -315,6 +375,9 @@ func Start(sockFile string, c *cli.Context) error {
 
 	// driverOpts would be ignored by Convoy Drivers if config already exists
 	driverOpts := util.SliceToMap(c.StringSlice("driver-opts"))
+	if err := s.initObjectStore(driverOpts); err != nil {
+		return err
+	}
 	if err := s.initDrivers(driverOpts); err != nil {
 		return err
 	}
@@ -324,6 +387,15 @@ func Start(sockFile string, c *cli.Context) error {
 	if err := util.ObjectSave(config); err != nil {
 		return err
 	}
+	if err := s.loadTargets(); err != nil {
+		return err
+	}
+	if err := s.loadSchedules(); err != nil {
+		return err
+	}
+	if err := s.loadJobs(); err != nil {
+		return err
+	}
 
 	s.Router = createRouter(s)
 
@@ -354,6 +426,8 @@ func Start(sockFile string, c *cli.Context) error {
 		done <- true
 	}()
 
+	go s.runScheduler()
+
 	go func() {
 		err = http.Serve(l, s.Router)
 		if err != nil {
@@ -95,7 +95,7 @@ func (s *daemon) createDockerVolume(request *pluginRequest) (*Volume, error) {
 		PrepareForVM:   prepareForVM,
 		IOPS:           int64(iops),
 	}
-	return s.processVolumeCreate(createReq)
+	return s.processVolumeCreate(createReq, "")
 }
 
 func (s *daemon) getDockerVolume(r *http.Request) (*Volume, *pluginRequest, error) {
@@ -1,8 +1,14 @@
 package daemon
 
 import (
+	// Involve GCS objecstore drivers for registeration
+	_ "github.com/rancher/convoy/gcs"
+	// Involve HTTP(S) objecstore drivers for registeration
+	_ "github.com/rancher/convoy/httpstore"
 	// Involve S3 objecstore drivers for registeration
 	_ "github.com/rancher/convoy/s3"
+	// Involve SFTP objecstore drivers for registeration
+	_ "github.com/rancher/convoy/sftp"
 	// Involve VFS convoy driver/objectstore driver for registeration
 	_ "github.com/rancher/convoy/vfs"
 )
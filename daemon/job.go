@@ -0,0 +1,314 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	JOB_CFG_PREFIX = "job_"
+
+	JOB_TYPE_BACKUP_CREATE = "backup-create"
+	JOB_TYPE_VOLUME_CREATE = "volume-create"
+	JOB_TYPE_BACKUP_COPY   = "backup-copy"
+
+	JOB_STATE_RUNNING   = "running"
+	JOB_STATE_COMPLETED = "completed"
+	JOB_STATE_FAILED    = "failed"
+	JOB_STATE_CANCELLED = "cancelled"
+
+	// Records of finished jobs beyond this would be removed, the oldest first
+	JOB_RECORDS_LIMIT = 100
+)
+
+/*
+Job is a backup, restore or copy of backup running in the background. The
+record is kept in daemon root after the job finished, with the final progress
+and the result, which is the URL of the backup created or copied, or the name
+of the volume created.
+*/
+type Job struct {
+	ID           string
+	Type         string
+	State        string
+	VolumeName   string
+	SnapshotName string `json:",omitempty"`
+	BackupURL    string `json:",omitempty"`
+	DestURL      string `json:",omitempty"`
+	Result       string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	CreatedTime  string
+	FinishedTime string `json:",omitempty"`
+	Progress     objectstore.ProgressStatus
+
+	configPath string
+}
+
+func (j *Job) ConfigFile() (string, error) {
+	if j.ID == "" {
+		return "", fmt.Errorf("BUG: Invalid empty job ID")
+	}
+	if j.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty job config path")
+	}
+	return filepath.Join(j.configPath, JOB_CFG_PREFIX+j.ID+CFG_POSTFIX), nil
+}
+
+type jobEntry struct {
+	job      *Job
+	progress *objectstore.Progress
+	started  time.Time
+	finished time.Time
+	err      error
+	// Closed when the job finished
+	done chan struct{}
+}
+
+type jobManager struct {
+	entries map[string]*jobEntry
+	lock    sync.Mutex
+}
+
+// loadJobs loads the job records, jobs still running when daemon stopped are marked as failed
+func (s *daemon) loadJobs() error {
+	s.jobs = &jobManager{
+		entries: make(map[string]*jobEntry),
+	}
+	ids, err := util.ListConfigIDs(s.Root, JOB_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		job := &Job{
+			ID:         id,
+			configPath: s.Root,
+		}
+		if err := util.ObjectLoad(job); err != nil {
+			return err
+		}
+		if job.State == JOB_STATE_RUNNING {
+			job.State = JOB_STATE_FAILED
+			job.Error = "Interrupted by daemon restart"
+			job.FinishedTime = util.Now()
+			if err := util.ObjectSave(job); err != nil {
+				return err
+			}
+		}
+		entry := &jobEntry{
+			job:  job,
+			done: make(chan struct{}),
+		}
+		entry.finished, _ = time.Parse(time.RubyDate, job.FinishedTime)
+		close(entry.done)
+		s.jobs.entries[id] = entry
+	}
+	return nil
+}
+
+/*
+startJob runs f in the background as job. f would be called with the ID of
+job, which should be passed to drivers as OPT_JOB_ID to report progress.
+*/
+func (s *daemon) startJob(job *Job, f func(jobID string) (string, error)) (*jobEntry, error) {
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+
+	job.ID = util.GenerateName("job")
+	for s.jobs.entries[job.ID] != nil {
+		job.ID = util.GenerateName("job")
+	}
+	job.State = JOB_STATE_RUNNING
+	job.CreatedTime = util.Now()
+	job.configPath = s.Root
+	if err := util.ObjectSave(job); err != nil {
+		return nil, err
+	}
+	entry := &jobEntry{
+		job:      job,
+		progress: objectstore.NewProgress(job.ID),
+		started:  time.Now(),
+		done:     make(chan struct{}),
+	}
+	s.jobs.entries[job.ID] = entry
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_VOLUME: job.VolumeName,
+	}).Debugf("Started %v job %v", job.Type, job.ID)
+
+	go s.runJob(entry, f)
+	return entry, nil
+}
+
+func (s *daemon) runJob(entry *jobEntry, f func(jobID string) (string, error)) {
+	id := entry.job.ID
+	result, err := f(id)
+
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+
+	job := entry.job
+	job.Progress = entry.progress.Status()
+	job.FinishedTime = util.Now()
+	if err == nil {
+		job.State = JOB_STATE_COMPLETED
+		job.Result = result
+	} else {
+		job.State = JOB_STATE_FAILED
+		if entry.progress.Cancelled() {
+			job.State = JOB_STATE_CANCELLED
+		}
+		job.Error = err.Error()
+	}
+	if err := util.ObjectSave(job); err != nil {
+		log.Errorf("Failed to save job %v: %v", id, err)
+	}
+	objectstore.RemoveProgress(id)
+	entry.err = err
+	entry.finished = time.Now()
+	close(entry.done)
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_VOLUME: job.VolumeName,
+	}).Debugf("Job %v %v", id, job.State)
+
+	s.pruneJobRecords()
+}
+
+// pruneJobRecords removes the oldest records of finished jobs beyond JOB_RECORDS_LIMIT, caller must hold the lock
+func (s *daemon) pruneJobRecords() {
+	finished := []*jobEntry{}
+	for _, entry := range s.jobs.entries {
+		if entry.job.State != JOB_STATE_RUNNING {
+			finished = append(finished, entry)
+		}
+	}
+	if len(finished) <= JOB_RECORDS_LIMIT {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].finished.Before(finished[j].finished)
+	})
+	for _, entry := range finished[:len(finished)-JOB_RECORDS_LIMIT] {
+		if err := util.ObjectDelete(entry.job); err != nil {
+			log.Warnf("Failed to remove record of job %v: %v", entry.job.ID, err)
+			continue
+		}
+		delete(s.jobs.entries, entry.job.ID)
+	}
+}
+
+// waitJob waits for the job to finish, and returns its error
+func (s *daemon) waitJob(entry *jobEntry) error {
+	<-entry.done
+	return entry.err
+}
+
+// getJobETA estimates the time left according to the bytes processed so far
+func getJobETA(status objectstore.ProgressStatus, elapsed time.Duration) string {
+	if status.ProcessedBytes <= 0 || status.TotalBytes <= status.ProcessedBytes {
+		return ""
+	}
+	left := float64(elapsed) * float64(status.TotalBytes-status.ProcessedBytes) / float64(status.ProcessedBytes)
+	return time.Duration(left).Round(time.Second).String()
+}
+
+// getJobResponse must be called with the lock held
+func (s *daemon) getJobResponse(entry *jobEntry) api.JobResponse {
+	job := entry.job
+	status := job.Progress
+	eta := ""
+	if job.State == JOB_STATE_RUNNING {
+		status = entry.progress.Status()
+		eta = getJobETA(status, time.Since(entry.started))
+	}
+	return api.JobResponse{
+		ID:              job.ID,
+		Type:            job.Type,
+		State:           job.State,
+		VolumeName:      job.VolumeName,
+		SnapshotName:    job.SnapshotName,
+		BackupURL:       job.BackupURL,
+		DestURL:         job.DestURL,
+		Result:          job.Result,
+		Error:           job.Error,
+		CreatedTime:     job.CreatedTime,
+		FinishedTime:    job.FinishedTime,
+		TotalBlocks:     status.TotalBlocks,
+		ProcessedBlocks: status.ProcessedBlocks,
+		TotalBytes:      status.TotalBytes,
+		ProcessedBytes:  status.ProcessedBytes,
+		ETA:             eta,
+	}
+}
+
+func (s *daemon) writeJobResponse(w http.ResponseWriter, entry *jobEntry, verbose bool) error {
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+	if verbose {
+		return writeResponseOutput(w, s.getJobResponse(entry))
+	}
+	return writeStringResponse(w, entry.job.ID)
+}
+
+func (s *daemon) doJobList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+
+	resp := make(map[string]api.JobResponse)
+	for id, entry := range s.jobs.entries {
+		resp[id] = s.getJobResponse(entry)
+	}
+	return writeResponseOutput(w, resp)
+}
+
+func (s *daemon) doJobInspect(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.JobRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+
+	entry, exists := s.jobs.entries[request.ID]
+	if !exists {
+		return fmt.Errorf("Job %v doesn't exist", request.ID)
+	}
+	return writeResponseOutput(w, s.getJobResponse(entry))
+}
+
+func (s *daemon) doJobCancel(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.JobRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+
+	entry, exists := s.jobs.entries[request.ID]
+	if !exists {
+		return fmt.Errorf("Job %v doesn't exist", request.ID)
+	}
+	if entry.job.State != JOB_STATE_RUNNING {
+		return fmt.Errorf("Job %v is not running", request.ID)
+	}
+	// The job would stop at the next block, it may still complete if it's
+	// already finishing
+	entry.progress.Cancel()
+	log.Debugf("Cancelling job %v", request.ID)
+	return nil
+}
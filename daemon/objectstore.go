@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/api"
@@ -21,6 +21,10 @@ func (s *daemon) doBackupList(version string, w http.ResponseWriter, r *http.Req
 		return err
 	}
 	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
 
 	opts := map[string]string{
 		OPT_VOLUME_NAME: request.VolumeName,
@@ -37,7 +41,9 @@ func (s *daemon) doBackupList(version string, w http.ResponseWriter, r *http.Req
 			return err
 		}
 		for k, v := range infos {
-			result[k] = v
+			if matchBackupLabels(v, request.Labels) {
+				result[k] = v
+			}
 		}
 	}
 
@@ -49,12 +55,26 @@ func (s *daemon) doBackupList(version string, w http.ResponseWriter, r *http.Req
 	return err
 }
 
+// matchBackupLabels returns true if the backup has all the labels
+func matchBackupLabels(info map[string]string, labels map[string]string) bool {
+	for k, v := range labels {
+		if value, exists := info[objectstore.BACKUP_LABEL_PREFIX+k]; !exists || value != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *daemon) doBackupInspect(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.BackupListRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
 	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
 	backupOps, err := s.getBackupOpsForBackup(request.URL, request.Endpoint)
 	if err != nil {
 		return err
@@ -79,37 +99,96 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 		return err
 	}
 	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	volumeName := s.SnapshotVolumeIndex.Get(request.SnapshotName)
+	if volumeName == "" {
+		return fmt.Errorf("Cannot find volume of snapshot %v", request.SnapshotName)
+	}
+	if err := util.CheckLabels(request.Labels); err != nil {
+		return err
+	}
+	entry, err := s.startJob(&Job{
+		Type:         JOB_TYPE_BACKUP_CREATE,
+		VolumeName:   volumeName,
+		SnapshotName: request.SnapshotName,
+		DestURL:      request.URL,
+	}, func(jobID string) (string, error) {
+		return s.processBackupCreate(request, jobID)
+	})
+	if err != nil {
+		return err
+	}
+	if request.Async {
+		return s.writeJobResponse(w, entry, request.Verbose)
+	}
+	if err := s.waitJob(entry); err != nil {
+		return err
+	}
+	backupURL := entry.job.Result
+
+	backup := &api.BackupURLResponse{
+		URL: backupURL,
+	}
+	if request.Verbose {
+		return sendResponse(w, backup)
+	}
+	escapedURL := util.EscapeURL(backupURL)
+	return writeStringResponse(w, escapedURL)
+}
 
+func (s *daemon) processBackupCreate(request *api.BackupCreateRequest, jobID string) (string, error) {
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return "", err
+	}
 	snapshotName := request.SnapshotName
 	volumeName := s.SnapshotVolumeIndex.Get(snapshotName)
 	if volumeName == "" {
-		return fmt.Errorf("Cannot find volume of snapshot %v", snapshotName)
+		return "", fmt.Errorf("Cannot find volume of snapshot %v", snapshotName)
 	}
 
 	if !s.snapshotExists(volumeName, snapshotName) {
-		return fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotName, volumeName)
+		return "", fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotName, volumeName)
 	}
 
 	volume := s.getVolume(volumeName)
 	backupOps, err := s.getBackupOpsForVolume(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	volumeInfo, err := s.getVolumeDriverInfo(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	snapshot, err := s.getSnapshotDriverInfo(snapshotName, volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	opts := map[string]string{
 		OPT_VOLUME_NAME:           volumeName,
 		OPT_VOLUME_CREATED_TIME:   volumeInfo[OPT_VOLUME_CREATED_TIME],
 		OPT_SNAPSHOT_CREATED_TIME: snapshot[OPT_SNAPSHOT_CREATED_TIME],
+		OPT_JOB_ID:                jobID,
+		OPT_BACKUP_DESCRIPTION:    request.Description,
+	}
+	if opts[OPT_BACKUP_LABELS], err = util.EncodeLabels(request.Labels); err != nil {
+		return "", err
+	}
+	if request.BandwidthLimit != "" || request.IOPSLimit != 0 {
+		iopsLimit := ""
+		if request.IOPSLimit != 0 {
+			iopsLimit = strconv.FormatInt(request.IOPSLimit, 10)
+		}
+		if err := objectstore.GetProgress(jobID).SetLimits(request.BandwidthLimit, iopsLimit); err != nil {
+			return "", err
+		}
 	}
 
 	log.WithFields(logrus.Fields{
@@ -124,7 +203,7 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 	}).Debug()
 	backupURL, err := backupOps.CreateBackup(snapshotName, volumeName, request.URL, request.Endpoint, opts)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:       LOG_REASON_COMPLETE,
@@ -136,6 +215,89 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 		LOG_FIELD_DEST_URL:     request.URL,
 		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
 	}).Debug()
+	s.mirrorBackup(volumeName, backupURL, request)
+	return backupURL, nil
+}
+
+/*
+mirrorBackup starts jobs copying the backup to the mirrors in objectstore
+options. Mirrors can be targets, or URLs using the endpoint of the target of
+the same destination, resolved every time. The backup is already created, so
+failures of the copies would only be recorded in the jobs.
+*/
+func (s *daemon) mirrorBackup(volumeName, backupURL string, request *api.BackupCreateRequest) {
+	if !objectstore.IsBackupURL(backupURL) {
+		// Not in objectstore, e.g. EBS snapshot
+		return
+	}
+	for _, mirror := range objectstore.GetMirrorURLs() {
+		destURL, destEndpoint, err := s.resolveTarget(mirror, "")
+		if err != nil {
+			log.Errorf("Failed to resolve mirror %v for backup %v: %v", mirror, backupURL, err)
+			continue
+		}
+		if objectstore.GetDestination(destURL) == objectstore.GetDestination(request.URL) {
+			continue
+		}
+		copyRequest := &api.BackupCopyRequest{
+			URL:          backupURL,
+			Endpoint:     request.Endpoint,
+			DestURL:      destURL,
+			DestEndpoint: destEndpoint,
+		}
+		if _, err := s.startJob(&Job{
+			Type:       JOB_TYPE_BACKUP_COPY,
+			VolumeName: volumeName,
+			BackupURL:  backupURL,
+			DestURL:    destURL,
+		}, func(jobID string) (string, error) {
+			return s.processBackupCopy(copyRequest, jobID)
+		}); err != nil {
+			log.Errorf("Failed to start mirroring backup %v to %v: %v", backupURL, mirror, err)
+		}
+	}
+}
+
+func (s *daemon) doBackupCopy(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupCopyRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	request.DestURL = util.UnescapeURL(request.DestURL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+	if request.DestURL, request.DestEndpoint, err = s.resolveTarget(request.DestURL, request.DestEndpoint); err != nil {
+		return err
+	}
+
+	if !objectstore.IsBackupURL(request.URL) {
+		return fmt.Errorf("Only backups in objectstore can be copied, got %v", request.URL)
+	}
+	info, err := objectstore.GetBackupInfo(request.URL, request.Endpoint)
+	if err != nil {
+		return err
+	}
+	entry, err := s.startJob(&Job{
+		Type:       JOB_TYPE_BACKUP_COPY,
+		VolumeName: info["VolumeName"],
+		BackupURL:  request.URL,
+		DestURL:    request.DestURL,
+	}, func(jobID string) (string, error) {
+		return s.processBackupCopy(request, jobID)
+	})
+	if err != nil {
+		return err
+	}
+	if request.Async {
+		return s.writeJobResponse(w, entry, request.Verbose)
+	}
+	if err := s.waitJob(entry); err != nil {
+		return err
+	}
+	backupURL := entry.job.Result
 
 	backup := &api.BackupURLResponse{
 		URL: backupURL,
@@ -143,17 +305,46 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 	if request.Verbose {
 		return sendResponse(w, backup)
 	}
-	escapedURL := strings.Replace(backupURL, "&", "\\u0026", 1)
+	escapedURL := util.EscapeURL(backupURL)
 	return writeStringResponse(w, escapedURL)
 }
 
+func (s *daemon) processBackupCopy(request *api.BackupCopyRequest, jobID string) (string, error) {
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: request.URL,
+		LOG_FIELD_DEST_URL:   request.DestURL,
+	}).Debug("Copying backup")
+	result, err := objectstore.CopyBackup(request.URL, request.Endpoint, request.DestURL, request.DestEndpoint, objectstore.GetProgress(jobID))
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: request.URL,
+		LOG_FIELD_DEST_URL:   request.DestURL,
+	}).Debugf("Copied backup, %v blocks copied, %v blocks already existed", result.CopiedBlocks, result.ExistingBlocks)
+	return result.BackupURL, nil
+}
+
 func (s *daemon) doBackupDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.BackupDeleteRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
 	request.URL = util.UnescapeURL(request.URL)
+	return s.processBackupDelete(request)
+}
 
+func (s *daemon) processBackupDelete(request *api.BackupDeleteRequest) error {
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
 	backupOps, err := s.getBackupOpsForBackup(request.URL, request.Endpoint)
 	if err != nil {
 		return err
@@ -181,6 +372,239 @@ func (s *daemon) doBackupDelete(version string, w http.ResponseWriter, r *http.R
 	return nil
 }
 
+func (s *daemon) doBackupVerify(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupVerifyRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	// Verify the content of the backup, or the consistency of the whole destination
+	if objectstore.IsBackupURL(request.URL) {
+		result, err := objectstore.VerifyBackup(request.URL, request.Endpoint)
+		if err != nil {
+			return err
+		}
+		return writeResponseOutput(w, result)
+	}
+	result, err := objectstore.VerifyObjectStore(request.URL, request.Endpoint)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doBackupGC(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupGCRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:        LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debug("Collecting unreferenced blocks")
+	result, err := objectstore.CollectGarbage(request.URL, request.Endpoint, request.DryRun)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:        LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debugf("Collected %v unreferenced blocks", len(result.UnreferencedBlocks))
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doBackupMigrate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupMigrateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:        LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:       request.VolumeName,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debug("Migrating blocks to shared block pool")
+	result, err := objectstore.MigrateToBlockPool(request.VolumeName, request.URL, request.Endpoint)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:        LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:       request.VolumeName,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debugf("Migrated %v volumes to shared block pool", len(result.Volumes))
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doBackupCatalog(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupCatalogRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:        LOG_EVENT_LIST,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debug("Rebuilding catalog of backups")
+	result, err := objectstore.RebuildCatalog(request.URL, request.Endpoint)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:        LOG_EVENT_LIST,
+		LOG_FIELD_OBJECT:       LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL:     request.URL,
+		LOG_FIELD_ENDPOINT_URL: request.Endpoint,
+	}).Debugf("Rebuilt catalog with %v backups of %v volumes", result.Backups, result.Volumes)
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doBackupExport(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupExportRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	if !objectstore.IsBackupURL(request.URL) {
+		return fmt.Errorf("Only backups in objectstore can be exported, got %v", request.URL)
+	}
+	if _, err := objectstore.GetBackupInfo(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: request.URL,
+	}).Debug("Exporting backup")
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := objectstore.ExportBackup(request.URL, request.Endpoint, w, nil); err != nil {
+		// Part of archive may have been sent, abort the response so client won't take it as complete
+		log.Errorf("Failed to export backup %v: %v", request.URL, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: request.URL,
+	}).Debug("Exported backup")
+	return nil
+}
+
+// doBackupImport reads the archive from the body of request, so the destination is passed in query
+func (s *daemon) doBackupImport(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	query := r.URL.Query()
+	destURL := util.UnescapeURL(query.Get("url"))
+	endpoint := query.Get("endpoint")
+	verbose := query.Get("verbose") == "true"
+	var err error
+	if destURL, endpoint, err = s.resolveTarget(destURL, endpoint); err != nil {
+		return err
+	}
+	if destURL == "" {
+		return fmt.Errorf("Destination of import is required")
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debug("Importing backup")
+	result, err := objectstore.ImportBackup(r.Body, destURL, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: result.BackupURL,
+		LOG_FIELD_DEST_URL:   destURL,
+	}).Debugf("Imported backup, %v blocks copied, %v blocks already existed", result.CopiedBlocks, result.ExistingBlocks)
+
+	backup := &api.BackupURLResponse{
+		URL: result.BackupURL,
+	}
+	if verbose {
+		return sendResponse(w, backup)
+	}
+	escapedURL := util.EscapeURL(result.BackupURL)
+	return writeStringResponse(w, escapedURL)
+}
+
+func (s *daemon) doBackupPrune(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupPruneRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	var err error
+	if request.URL, request.Endpoint, err = s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	maxAge, err := objectstore.ParseRetentionAge(request.MaxAge)
+	if err != nil {
+		return err
+	}
+	policy := &objectstore.RetentionPolicy{
+		KeepLast:    request.KeepLast,
+		KeepDaily:   request.KeepDaily,
+		KeepWeekly:  request.KeepWeekly,
+		KeepMonthly: request.KeepMonthly,
+		MaxAge:      maxAge,
+	}
+	result, err := objectstore.ApplyRetention(request.VolumeName, request.URL, request.Endpoint, policy, request.DryRun)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, result)
+}
+
 func (s *daemon) getBackupOpsForBackup(requestURL, endpointURL string) (BackupOperations, error) {
 	driverName := ""
 
@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	RESTORE_DIRECTORY = "restore"
+)
+
+/*
+restoreImage is the image of a delta block backup restored locally, attached
+as a loopback device, so the filesystem inside can be mounted by
+util.VolumeMount().
+*/
+type restoreImage struct {
+	Name       string
+	MountPoint string
+	Device     string
+	mountDir   string
+}
+
+func (img *restoreImage) GetDevice() (string, error) {
+	return img.Device, nil
+}
+
+func (img *restoreImage) GetMountOpts() []string {
+	return []string{"-o", "ro"}
+}
+
+func (img *restoreImage) GenerateDefaultMountPoint() string {
+	return img.mountDir
+}
+
+/*
+getForeignBackupVolume returns the objectstore volume of backupURL if it was
+created by a driver other than driverName, which means the driver cannot
+restore it by itself. It returns nil for backups not in objectstore, e.g.
+EBS snapshots, or whose volume cannot be found in objectstore, leaving them to
+the driver. Other failures of loading the volume are returned.
+*/
+func getForeignBackupVolume(backupURL, endpointURL, driverName string) (*objectstore.Volume, error) {
+	if _, err := objectstore.GetCapabilities(backupURL); err != nil {
+		// Not handled by any objectstore driver
+		return nil, nil
+	}
+	objVolume, err := objectstore.LoadVolume(backupURL, endpointURL)
+	if err != nil {
+		if objectstore.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if objVolume.Driver == driverName {
+		return nil, nil
+	}
+	return objVolume, nil
+}
+
+/*
+restoreBackup restores backup created by another driver into the newly
+created volume. Delta block backups are written directly to the block device
+of the volume if there is one. Otherwise the files in the backup would be
+copied to the mounted filesystem of the volume.
+*/
+func (s *daemon) restoreBackup(volOps VolumeOperations, volumeName, backupURL, endpointURL string, progress *objectstore.Progress) error {
+	format, err := objectstore.GetBackupFormat(backupURL, endpointURL)
+	if err != nil {
+		return err
+	}
+	info, err := volOps.GetVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_RESTORE,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debugf("Restoring %v backup to volume of %v", format, volOps.Name())
+	if format == objectstore.BACKUP_FORMAT_DELTA_BLOCK && info[OPT_DEVICE] != "" {
+		err = objectstore.RestoreDeltaBlockBackup(backupURL, endpointURL, info[OPT_DEVICE], progress)
+	} else {
+		err = s.restoreBackupFiles(volOps, volumeName, format, backupURL, endpointURL, progress)
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_RESTORE,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debug("Restored backup to volume")
+	return nil
+}
+
+func (s *daemon) restoreBackupFiles(volOps VolumeOperations, volumeName, format, backupURL, endpointURL string, progress *objectstore.Progress) error {
+	req := Request{
+		Name:    volumeName,
+		Options: map[string]string{},
+	}
+	mountPoint, err := volOps.MountVolume(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := volOps.UmountVolume(req); err != nil {
+			log.Warnf("Failed to umount volume %v after restoring: %v", volumeName, err)
+		}
+	}()
+
+	switch format {
+	case objectstore.BACKUP_FORMAT_SINGLE_FILE:
+		return restoreSingleFileBackupFiles(backupURL, endpointURL, mountPoint, progress)
+	case objectstore.BACKUP_FORMAT_DELTA_BLOCK:
+		return s.restoreDeltaBlockBackupFiles(volumeName, backupURL, endpointURL, mountPoint, progress)
+	}
+	return fmt.Errorf("BUG: Unknown backup format %v", format)
+}
+
+// restoreSingleFileBackupFiles extracts the backup into dir while downloading it
+func restoreSingleFileBackupFiles(backupURL, endpointURL, dir string, progress *objectstore.Progress) error {
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := objectstore.StreamSingleFileBackup(backupURL, endpointURL, w, progress)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	extractErr := util.DecompressDirFromStream(r, dir)
+	// Unblock the writer in case extracting stopped early
+	r.Close()
+	if err := <-errCh; err != nil && err != io.ErrClosedPipe {
+		return err
+	}
+	return extractErr
+}
+
+/*
+restoreDeltaBlockBackupFiles restores the backup to an image file, and copies
+the files in it to dir. The image is attached read-write, so the journal of
+the filesystem can be replayed when mounting. The image is saved in daemon
+root temporarily, which needs free space up to the size of the volume.
+*/
+func (s *daemon) restoreDeltaBlockBackupFiles(volumeName, backupURL, endpointURL, dir string, progress *objectstore.Progress) error {
+	restoreDir := filepath.Join(s.Root, RESTORE_DIRECTORY)
+	if err := util.MkdirIfNotExists(restoreDir); err != nil {
+		return err
+	}
+	objVolume, err := objectstore.LoadVolume(backupURL, endpointURL)
+	if err != nil {
+		return err
+	}
+	available, err := util.GetAvailableSpace(restoreDir)
+	if err != nil {
+		return err
+	}
+	if available < objVolume.Size {
+		return fmt.Errorf("Not enough space in %v to restore the image of volume %v, need %v bytes, only %v bytes available",
+			restoreDir, objVolume.Name, objVolume.Size, available)
+	}
+	imageFile := filepath.Join(restoreDir, volumeName+".img")
+	defer os.Remove(imageFile)
+	if err := objectstore.RestoreDeltaBlockBackup(backupURL, endpointURL, imageFile, progress); err != nil {
+		return err
+	}
+
+	dev, err := util.AttachLoopbackDevice(imageFile, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := util.DetachLoopbackDevice(imageFile, dev); err != nil {
+			log.Warnf("Failed to detach loopback device %v of %v: %v", dev, imageFile, err)
+		}
+	}()
+
+	image := &restoreImage{
+		Name:     volumeName,
+		Device:   dev,
+		mountDir: filepath.Join(restoreDir, volumeName),
+	}
+	if _, err := util.VolumeMount(image, "", false); err != nil {
+		return err
+	}
+	defer func() {
+		if err := util.VolumeUmount(image); err != nil {
+			log.Warnf("Failed to umount image %v: %v", imageFile, err)
+		}
+	}()
+	return util.CopyDir(image.MountPoint, dir)
+}
@@ -0,0 +1,415 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	SCHEDULE_CFG_PREFIX = "schedule_"
+
+	SCHEDULE_CHECK_INTERVAL = 30 * time.Second
+)
+
+/*
+Schedule creates snapshot of the volume periodically, and backup the snapshot
+if DestURL is specified. Only the latest Retention snapshots and backups
+created by the schedule would be kept, if Retention is not zero.
+*/
+type Schedule struct {
+	Name        string
+	Cron        string
+	VolumeName  string
+	DestURL     string
+	Endpoint    string
+	Retention   int
+	Paused      bool
+	CreatedTime string
+
+	// Created by the schedule, the oldest first
+	Snapshots []string
+	Backups   []string
+
+	LastRunTime string
+	LastError   string
+	// Backup job of the last run
+	LastJobID string `json:",omitempty"`
+
+	configPath string
+}
+
+func (s *Schedule) ConfigFile() (string, error) {
+	if s.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty schedule name")
+	}
+	if s.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty schedule config path")
+	}
+	return filepath.Join(s.configPath, SCHEDULE_CFG_PREFIX+s.Name+CFG_POSTFIX), nil
+}
+
+type scheduleEntry struct {
+	schedule *Schedule
+	cron     *util.CronSchedule
+	next     time.Time
+	running  bool
+	deleted  bool
+}
+
+type scheduler struct {
+	entries map[string]*scheduleEntry
+	lock    sync.Mutex
+}
+
+func (s *daemon) loadSchedules() error {
+	s.scheduler = &scheduler{
+		entries: make(map[string]*scheduleEntry),
+	}
+	names, err := util.ListConfigIDs(s.Root, SCHEDULE_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, name := range names {
+		schedule := &Schedule{
+			Name:       name,
+			configPath: s.Root,
+		}
+		if err := util.ObjectLoad(schedule); err != nil {
+			return err
+		}
+		cron, err := util.ParseCron(schedule.Cron)
+		if err != nil {
+			return err
+		}
+		next := cron.Next(now)
+		if next.IsZero() {
+			log.Warnf("Schedule %v would never run, cron expression %v matches no time", name, schedule.Cron)
+		}
+		s.scheduler.entries[name] = &scheduleEntry{
+			schedule: schedule,
+			cron:     cron,
+			next:     next,
+		}
+		log.Debugf("Loaded schedule %v for volume %v", name, schedule.VolumeName)
+	}
+	return nil
+}
+
+// runScheduler starts the schedules which are due, and never returns
+func (s *daemon) runScheduler() {
+	ticker := time.NewTicker(SCHEDULE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.scheduler.lock.Lock()
+		for _, entry := range s.scheduler.entries {
+			if entry.schedule.Paused || entry.running || entry.next.IsZero() || now.Before(entry.next) {
+				continue
+			}
+			entry.running = true
+			go s.runSchedule(entry)
+		}
+		s.scheduler.lock.Unlock()
+	}
+}
+
+func (s *daemon) runSchedule(entry *scheduleEntry) {
+	// Only the running schedule would update its snapshots and backups
+	s.scheduler.lock.Lock()
+	schedule := *entry.schedule
+	s.scheduler.lock.Unlock()
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME: schedule.VolumeName,
+	}).Debugf("Running schedule %v", schedule.Name)
+	snapshotName, backupURL, err := s.processSchedule(entry, &schedule)
+	if err != nil {
+		log.Errorf("Failed to run schedule %v: %v", schedule.Name, err)
+	}
+
+	snapshots := schedule.Snapshots
+	if snapshotName != "" {
+		snapshots = append(snapshots, snapshotName)
+	}
+	backups := schedule.Backups
+	if backupURL != "" {
+		backups = append(backups, backupURL)
+	}
+	snapshots = s.applyScheduleRetention(snapshots, schedule.Retention, func(name string) (bool, error) {
+		volumeName := s.SnapshotVolumeIndex.Get(name)
+		if volumeName == "" || !s.snapshotExists(volumeName, name) {
+			return true, nil
+		}
+		return false, s.processSnapshotDelete(&api.SnapshotDeleteRequest{
+			SnapshotName: name,
+		})
+	})
+	backups = s.applyScheduleRetention(backups, schedule.Retention, func(url string) (bool, error) {
+		err := s.processBackupDelete(&api.BackupDeleteRequest{
+			URL:      url,
+			Endpoint: schedule.Endpoint,
+		})
+		return objectstore.IsNotFound(err), err
+	})
+
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+	entry.running = false
+	entry.next = entry.cron.Next(time.Now())
+	if entry.deleted {
+		return
+	}
+	entry.schedule.Snapshots = snapshots
+	entry.schedule.Backups = backups
+	entry.schedule.LastRunTime = util.Now()
+	entry.schedule.LastError = ""
+	if err != nil {
+		entry.schedule.LastError = err.Error()
+	}
+	if err := util.ObjectSave(entry.schedule); err != nil {
+		log.Errorf("Failed to save schedule %v: %v", entry.schedule.Name, err)
+	}
+}
+
+/*
+processSchedule creates the snapshot, and backs it up as a job like "backup
+create", which can be listed and cancelled by users. The ID of the job is
+recorded in the entry once started.
+*/
+func (s *daemon) processSchedule(entry *scheduleEntry, schedule *Schedule) (string, string, error) {
+	snapshotName, err := s.processSnapshotCreate(&api.SnapshotCreateRequest{
+		VolumeName: schedule.VolumeName,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if schedule.DestURL == "" {
+		return snapshotName, "", nil
+	}
+	request := &api.BackupCreateRequest{
+		URL:          schedule.DestURL,
+		Endpoint:     schedule.Endpoint,
+		SnapshotName: snapshotName,
+	}
+	job, err := s.startJob(&Job{
+		Type:         JOB_TYPE_BACKUP_CREATE,
+		VolumeName:   schedule.VolumeName,
+		SnapshotName: snapshotName,
+		DestURL:      schedule.DestURL,
+	}, func(jobID string) (string, error) {
+		return s.processBackupCreate(request, jobID)
+	})
+	if err != nil {
+		return snapshotName, "", err
+	}
+	s.scheduler.lock.Lock()
+	entry.schedule.LastJobID = job.job.ID
+	s.scheduler.lock.Unlock()
+	if err := s.waitJob(job); err != nil {
+		return snapshotName, "", err
+	}
+	return snapshotName, job.job.Result, nil
+}
+
+/*
+applyScheduleRetention removes the oldest items beyond retention, and returns
+the remaining. remove returns true if the item no longer exists, e.g. removed
+by user, so it won't be tracked anymore. Items failed to be removed are kept,
+and would be removed by the next run.
+*/
+func (s *daemon) applyScheduleRetention(items []string, retention int, remove func(string) (bool, error)) []string {
+	if retention == 0 || len(items) <= retention {
+		return items
+	}
+	result := []string{}
+	expired := items[:len(items)-retention]
+	for _, item := range expired {
+		gone, err := remove(item)
+		if gone {
+			log.Debugf("%v no longer exists, stop tracking it", item)
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to remove %v according to retention, would retry next time: %v", item, err)
+			result = append(result, item)
+		}
+	}
+	return append(result, items[len(items)-retention:]...)
+}
+
+func (s *daemon) getScheduleResponse(entry *scheduleEntry) api.ScheduleResponse {
+	schedule := entry.schedule
+	resp := api.ScheduleResponse{
+		Name:        schedule.Name,
+		Cron:        schedule.Cron,
+		VolumeName:  schedule.VolumeName,
+		DestURL:     schedule.DestURL,
+		Endpoint:    schedule.Endpoint,
+		Retention:   schedule.Retention,
+		Paused:      schedule.Paused,
+		Running:     entry.running,
+		CreatedTime: schedule.CreatedTime,
+		LastRunTime: schedule.LastRunTime,
+		LastError:   schedule.LastError,
+		LastJobID:   schedule.LastJobID,
+		Snapshots:   schedule.Snapshots,
+		Backups:     schedule.Backups,
+	}
+	if !schedule.Paused && !entry.next.IsZero() {
+		resp.NextRunTime = entry.next.Format(time.RubyDate)
+	}
+	return resp
+}
+
+func (s *daemon) doScheduleCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.ScheduleCreateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+
+	if err := util.CheckName(request.VolumeName); err != nil {
+		return err
+	}
+	if s.getVolume(request.VolumeName) == nil {
+		return fmt.Errorf("volume %v doesn't exist", request.VolumeName)
+	}
+	cron, err := util.ParseCron(request.Cron)
+	if err != nil {
+		return err
+	}
+	if cron.Next(time.Now()).IsZero() {
+		return fmt.Errorf("Cron expression %v matches no time, the schedule would never run", request.Cron)
+	}
+	if request.Retention < 0 {
+		return fmt.Errorf("Invalid retention %v", request.Retention)
+	}
+	// Target would be resolved every time the schedule runs
+	if _, _, err := s.resolveTarget(request.URL, request.Endpoint); err != nil {
+		return err
+	}
+
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+
+	name := request.Name
+	if name != "" {
+		if err := util.CheckName(name); err != nil {
+			return err
+		}
+		if _, exists := s.scheduler.entries[name]; exists {
+			return fmt.Errorf("Schedule %v already exists", name)
+		}
+	} else {
+		name = util.GenerateName("schedule")
+		for s.scheduler.entries[name] != nil {
+			name = util.GenerateName("schedule")
+		}
+	}
+
+	schedule := &Schedule{
+		Name:        name,
+		Cron:        request.Cron,
+		VolumeName:  request.VolumeName,
+		DestURL:     request.URL,
+		Endpoint:    request.Endpoint,
+		Retention:   request.Retention,
+		CreatedTime: util.Now(),
+		Snapshots:   []string{},
+		Backups:     []string{},
+		configPath:  s.Root,
+	}
+	if err := util.ObjectSave(schedule); err != nil {
+		return err
+	}
+	entry := &scheduleEntry{
+		schedule: schedule,
+		cron:     cron,
+		next:     cron.Next(time.Now()),
+	}
+	s.scheduler.entries[name] = entry
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_VOLUME: request.VolumeName,
+	}).Debugf("Created schedule %v", name)
+
+	if request.Verbose {
+		return writeResponseOutput(w, s.getScheduleResponse(entry))
+	}
+	return writeStringResponse(w, name)
+}
+
+func (s *daemon) doScheduleList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+
+	resp := make(map[string]api.ScheduleResponse)
+	for name, entry := range s.scheduler.entries {
+		resp[name] = s.getScheduleResponse(entry)
+	}
+	return writeResponseOutput(w, resp)
+}
+
+func (s *daemon) doSchedulePause(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return s.updateSchedulePaused(r, true)
+}
+
+func (s *daemon) doScheduleResume(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return s.updateSchedulePaused(r, false)
+}
+
+func (s *daemon) updateSchedulePaused(r *http.Request, paused bool) error {
+	request := &api.ScheduleRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+
+	entry, exists := s.scheduler.entries[request.Name]
+	if !exists {
+		return fmt.Errorf("Schedule %v doesn't exist", request.Name)
+	}
+	entry.schedule.Paused = paused
+	// Don't catch up the runs missed when paused
+	entry.next = entry.cron.Next(time.Now())
+	return util.ObjectSave(entry.schedule)
+}
+
+func (s *daemon) doScheduleDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.ScheduleRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+
+	entry, exists := s.scheduler.entries[request.Name]
+	if !exists {
+		return fmt.Errorf("Schedule %v doesn't exist", request.Name)
+	}
+	if err := util.ObjectDelete(entry.schedule); err != nil {
+		return err
+	}
+	// Snapshots and backups created by the schedule would be kept
+	entry.deleted = true
+	delete(s.scheduler.entries, request.Name)
+	log.Debugf("Deleted schedule %v", request.Name)
+	return nil
+}
@@ -26,23 +26,44 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
+	snapshotName, err := s.processSnapshotCreate(request)
+	if err != nil {
+		return err
+	}
+	if request.Verbose {
+		volume := s.getVolume(request.VolumeName)
+		driverInfo, err := s.getSnapshotDriverInfo(snapshotName, volume)
+		if err != nil {
+			return err
+		}
+		return writeResponseOutput(w, api.SnapshotResponse{
+			Name:        snapshotName,
+			VolumeName:  volume.Name,
+			CreatedTime: driverInfo[OPT_SNAPSHOT_CREATED_TIME],
+			DriverInfo:  driverInfo,
+		})
+	}
+	return writeStringResponse(w, snapshotName)
+}
+
+func (s *daemon) processSnapshotCreate(request *api.SnapshotCreateRequest) (string, error) {
 	volumeName := request.VolumeName
 	if err := util.CheckName(volumeName); err != nil {
-		return err
+		return "", err
 	}
 	volume := s.getVolume(volumeName)
 	if volume == nil {
-		return fmt.Errorf("volume %v doesn't exist", volumeName)
+		return "", fmt.Errorf("volume %v doesn't exist", volumeName)
 	}
 
 	snapshotName := request.Name
 	if snapshotName != "" {
 		if err := util.CheckName(snapshotName); err != nil {
-			return err
+			return "", err
 		}
 		existName := s.NameUUIDIndex.Get(snapshotName)
 		if existName != "" {
-			return fmt.Errorf("Snapshot name %v already exists", snapshotName)
+			return "", fmt.Errorf("Snapshot name %v already exists", snapshotName)
 		}
 	} else {
 		snapshotName = util.GenerateName("snapshot")
@@ -53,7 +74,7 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 
 	snapOps, err := s.getSnapshotOpsForVolume(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	req := Request{
@@ -71,7 +92,7 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 		LOG_FIELD_VOLUME:   volumeName,
 	}).Debug()
 	if err := snapOps.CreateSnapshot(req); err != nil {
-		return err
+		return "", err
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
@@ -83,24 +104,12 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 
 	//TODO: error handling
 	if err := s.SnapshotVolumeIndex.Add(snapshotName, volume.Name); err != nil {
-		return err
+		return "", err
 	}
 	if err := s.NameUUIDIndex.Add(snapshotName, "exists"); err != nil {
-		return err
-	}
-	driverInfo, err := s.getSnapshotDriverInfo(snapshotName, volume)
-	if err != nil {
-		return err
-	}
-	if request.Verbose {
-		return writeResponseOutput(w, api.SnapshotResponse{
-			Name:        snapshotName,
-			VolumeName:  volume.Name,
-			CreatedTime: driverInfo[OPT_SNAPSHOT_CREATED_TIME],
-			DriverInfo:  driverInfo,
-		})
+		return "", err
 	}
-	return writeStringResponse(w, snapshotName)
+	return snapshotName, nil
 }
 
 func (s *daemon) getSnapshotDriverInfo(snapshotName string, volume *Volume) (map[string]string, error) {
@@ -142,6 +151,10 @@ func (s *daemon) doSnapshotDelete(version string, w http.ResponseWriter, r *http
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
+	return s.processSnapshotDelete(request)
+}
+
+func (s *daemon) processSnapshotDelete(request *api.SnapshotDeleteRequest) error {
 	snapshotName := request.SnapshotName
 	if err := util.CheckName(snapshotName); err != nil {
 		return err
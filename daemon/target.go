@@ -0,0 +1,342 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	TARGET_CFG_PREFIX = "target_"
+)
+
+/*
+Target is a named backup destination, which can be used wherever a
+destination or backup URL is accepted, e.g. "mytarget" for the destination,
+or "mytarget?backup=xxx&volume=yyy" for a backup in it. Options would be
+added to the query of URL, and Credentials would be used by the objectstore
+driver instead of the ones from the environment of daemon. The config file
+contains the secrets, so it's only accessible by owner.
+*/
+type Target struct {
+	Name        string
+	URL         string
+	Endpoint    string
+	Options     map[string]string
+	Credentials map[string]string
+	CreatedTime string
+
+	configPath string
+}
+
+func (t *Target) ConfigFile() (string, error) {
+	if t.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty target name")
+	}
+	if t.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty target config path")
+	}
+	return filepath.Join(t.configPath, TARGET_CFG_PREFIX+t.Name+CFG_POSTFIX), nil
+}
+
+// GetURL returns URL of the target with options added to the query
+func (t *Target) GetURL() (string, error) {
+	return addURLQuery(t.URL, t.Options, nil)
+}
+
+type targetManager struct {
+	targets map[string]*Target
+	lock    sync.RWMutex
+}
+
+func (s *daemon) loadTargets() error {
+	s.targets = &targetManager{
+		targets: make(map[string]*Target),
+	}
+	names, err := util.ListConfigIDs(s.Root, TARGET_CFG_PREFIX, CFG_POSTFIX)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		target := &Target{
+			Name:       name,
+			configPath: s.Root,
+		}
+		if err := util.ObjectLoad(target); err != nil {
+			return err
+		}
+		if len(target.Credentials) != 0 {
+			objectstore.SetCredentials(target.URL, target.Credentials)
+		}
+		s.targets.targets[name] = target
+		log.Debugf("Loaded target %v for %v", name, target.URL)
+	}
+	for _, mirror := range objectstore.GetMirrorURLs() {
+		if name := getTargetName(mirror); name != "" && s.targets.targets[name] == nil {
+			log.Warnf("Target %v of mirror doesn't exist, backups won't be mirrored to it until it's created", name)
+		}
+	}
+	return nil
+}
+
+// addURLQuery returns rawURL with options and query added, the latter take precedence
+func addURLQuery(rawURL string, options map[string]string, query url.Values) (string, error) {
+	values := url.Values{}
+	if i := strings.Index(rawURL, "?"); i >= 0 {
+		var err error
+		if values, err = url.ParseQuery(rawURL[i+1:]); err != nil {
+			return "", err
+		}
+		rawURL = rawURL[:i]
+	}
+	for k, v := range options {
+		values.Set(k, v)
+	}
+	for k, v := range query {
+		values[k] = v
+	}
+	if len(values) == 0 {
+		return rawURL, nil
+	}
+	return rawURL + "?" + values.Encode(), nil
+}
+
+// getTargetName returns the target name referenced by destURL, or "" if it's an URL
+func getTargetName(destURL string) string {
+	if strings.Contains(destURL, "://") {
+		return ""
+	}
+	if i := strings.Index(destURL, "?"); i >= 0 {
+		return destURL[:i]
+	}
+	return destURL
+}
+
+/*
+resolveTarget returns URL and endpoint of the target if destURL references a
+target by name. Otherwise destURL is returned as is, with the endpoint of
+the target of the same destination if endpoint is not specified, so the
+backup URLs returned by a target can be used without repeating the endpoint.
+*/
+func (s *daemon) resolveTarget(destURL, endpoint string) (string, string, error) {
+	if destURL == "" {
+		return destURL, endpoint, nil
+	}
+	s.targets.lock.RLock()
+	defer s.targets.lock.RUnlock()
+
+	name := getTargetName(destURL)
+	if name == "" {
+		if endpoint != "" {
+			return destURL, endpoint, nil
+		}
+		destination := objectstore.GetDestination(destURL)
+		for _, target := range s.targets.targets {
+			if objectstore.GetDestination(target.URL) == destination {
+				return destURL, target.Endpoint, nil
+			}
+		}
+		return destURL, endpoint, nil
+	}
+
+	target, exists := s.targets.targets[name]
+	if !exists {
+		return "", "", fmt.Errorf("Target %v doesn't exist", name)
+	}
+	if endpoint != "" {
+		return "", "", fmt.Errorf("Endpoint cannot be specified for target %v", name)
+	}
+	query := url.Values{}
+	if i := strings.Index(destURL, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(destURL[i+1:]); err != nil {
+			return "", "", err
+		}
+	}
+	resolvedURL, err := addURLQuery(target.URL, target.Options, query)
+	if err != nil {
+		return "", "", err
+	}
+	return resolvedURL, target.Endpoint, nil
+}
+
+func (s *daemon) getTargetResponse(target *Target) api.TargetResponse {
+	credentials := []string{}
+	for k := range target.Credentials {
+		credentials = append(credentials, k)
+	}
+	sort.Strings(credentials)
+	options := target.Options
+	if options == nil {
+		options = map[string]string{}
+	}
+	return api.TargetResponse{
+		Name:        target.Name,
+		URL:         target.URL,
+		Endpoint:    target.Endpoint,
+		Options:     options,
+		Credentials: credentials,
+		CreatedTime: target.CreatedTime,
+	}
+}
+
+func (s *daemon) listTargetResponses() map[string]api.TargetResponse {
+	s.targets.lock.RLock()
+	defer s.targets.lock.RUnlock()
+
+	resp := make(map[string]api.TargetResponse)
+	for name, target := range s.targets.targets {
+		resp[name] = s.getTargetResponse(target)
+	}
+	return resp
+}
+
+func (s *daemon) doTargetCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.TargetCreateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+
+	if request.Name == "" {
+		return fmt.Errorf("Target name is required")
+	}
+	if err := util.CheckName(request.Name); err != nil {
+		return err
+	}
+	if (request.AccessKey == "") != (request.SecretKey == "") {
+		return fmt.Errorf("Both access key and secret key need to be specified")
+	}
+	capabilities, err := objectstore.GetCapabilities(request.URL)
+	if err != nil {
+		return err
+	}
+	if request.Endpoint != "" {
+		if !capabilities.Endpoint {
+			return fmt.Errorf("Unsupported backup protocol for custom endpoint: %v", request.URL)
+		}
+		if _, err := url.Parse(request.Endpoint); err != nil {
+			return fmt.Errorf("Invalid endpoint URL: %v", err)
+		}
+	}
+
+	s.targets.lock.Lock()
+	defer s.targets.lock.Unlock()
+
+	if _, exists := s.targets.targets[request.Name]; exists {
+		return fmt.Errorf("Target %v already exists", request.Name)
+	}
+	// Credentials are looked up by destination
+	destination := objectstore.GetDestination(request.URL)
+	for _, t := range s.targets.targets {
+		if objectstore.GetDestination(t.URL) == destination {
+			return fmt.Errorf("Destination %v is already used by target %v", destination, t.Name)
+		}
+	}
+
+	target := &Target{
+		Name:        request.Name,
+		URL:         request.URL,
+		Endpoint:    request.Endpoint,
+		Options:     request.Options,
+		Credentials: map[string]string{},
+		CreatedTime: util.Now(),
+		configPath:  s.Root,
+	}
+	if request.AccessKey != "" {
+		target.Credentials[objectstore.CREDENTIAL_ACCESS_KEY] = request.AccessKey
+		target.Credentials[objectstore.CREDENTIAL_SECRET_KEY] = request.SecretKey
+	}
+	targetURL, err := target.GetURL()
+	if err != nil {
+		return err
+	}
+
+	// Make sure the target is accessible with the credentials
+	if len(target.Credentials) != 0 {
+		objectstore.SetCredentials(target.URL, target.Credentials)
+	}
+	if _, err := objectstore.GetObjectStoreDriver(targetURL, target.Endpoint); err != nil {
+		objectstore.RemoveCredentials(target.URL)
+		return err
+	}
+	if err := util.ObjectSaveSecret(target); err != nil {
+		objectstore.RemoveCredentials(target.URL)
+		return err
+	}
+	s.targets.targets[target.Name] = target
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:       LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:        LOG_EVENT_CREATE,
+		LOG_FIELD_DEST_URL:     target.URL,
+		LOG_FIELD_ENDPOINT_URL: target.Endpoint,
+	}).Debugf("Created target %v", target.Name)
+
+	if request.Verbose {
+		return writeResponseOutput(w, s.getTargetResponse(target))
+	}
+	return writeStringResponse(w, target.Name)
+}
+
+func (s *daemon) doTargetList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, s.listTargetResponses())
+}
+
+func (s *daemon) doTargetInspect(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.TargetRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.targets.lock.RLock()
+	defer s.targets.lock.RUnlock()
+
+	target, exists := s.targets.targets[request.Name]
+	if !exists {
+		return fmt.Errorf("Target %v doesn't exist", request.Name)
+	}
+	return writeResponseOutput(w, s.getTargetResponse(target))
+}
+
+func (s *daemon) doTargetDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.TargetRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	s.targets.lock.Lock()
+	defer s.targets.lock.Unlock()
+
+	target, exists := s.targets.targets[request.Name]
+	if !exists {
+		return fmt.Errorf("Target %v doesn't exist", request.Name)
+	}
+	s.scheduler.lock.Lock()
+	for name, entry := range s.scheduler.entries {
+		if getTargetName(entry.schedule.DestURL) == target.Name {
+			s.scheduler.lock.Unlock()
+			return fmt.Errorf("Target %v is used by schedule %v", target.Name, name)
+		}
+	}
+	s.scheduler.lock.Unlock()
+
+	if err := util.ObjectDelete(target); err != nil {
+		return err
+	}
+	objectstore.RemoveCredentials(target.URL)
+	// Backups in the target would be kept
+	delete(s.targets.targets, target.Name)
+	log.Debugf("Deleted target %v", target.Name)
+	return nil
+}
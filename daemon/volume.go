@@ -8,6 +8,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 
 	. "github.com/rancher/convoy/convoydriver"
@@ -58,6 +59,49 @@ func (s *daemon) volumeExists(name string) (bool, error) {
 	return false, nil
 }
 
+// volumeReservation holds the name of a volume being created
+type volumeReservation struct {
+	driverName string
+	jobID      string
+}
+
+/*
+reserveVolumeName returns false if the volume exists or is being created,
+otherwise the name is reserved until releaseVolumeName, so the restoring
+volume is listed, and won't be created again by others meanwhile.
+*/
+func (s *daemon) reserveVolumeName(name, driverName, jobID string) (bool, error) {
+	s.creatingVolumesLock.Lock()
+	defer s.creatingVolumesLock.Unlock()
+	if s.creatingVolumes[name] != nil {
+		return false, nil
+	}
+	exists, err := s.volumeExists(name)
+	if err != nil {
+		return false, fmt.Errorf("Error occurred while checking if volume %v exists: %v", name, err)
+	}
+	if exists {
+		return false, nil
+	}
+	s.creatingVolumes[name] = &volumeReservation{
+		driverName: driverName,
+		jobID:      jobID,
+	}
+	return true, nil
+}
+
+func (s *daemon) releaseVolumeName(name string) {
+	s.creatingVolumesLock.Lock()
+	defer s.creatingVolumesLock.Unlock()
+	delete(s.creatingVolumes, name)
+}
+
+func (s *daemon) getVolumeReservation(name string) *volumeReservation {
+	s.creatingVolumesLock.Lock()
+	defer s.creatingVolumesLock.Unlock()
+	return s.creatingVolumes[name]
+}
+
 func (s *daemon) generateName() (string, error) {
 	name := util.GenerateName("volume")
 	for {
@@ -72,26 +116,45 @@ func (s *daemon) generateName() (string, error) {
 	}
 }
 
-func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume, error) {
+// processVolumeCreate creates the volume, jobID is the job restoring the backup if any
+func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest, jobID string) (*Volume, error) {
 	volumeName := request.Name
 	driverName := request.DriverName
+	if driverName == "" {
+		driverName = s.DefaultDriver
+	}
 
 	var err error
 	if volumeName == "" {
-		volumeName, err = s.generateName()
-		if err != nil {
-			return nil, err
+		for {
+			if volumeName, err = s.generateName(); err != nil {
+				return nil, err
+			}
+			reserved, err := s.reserveVolumeName(volumeName, driverName, jobID)
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				break
+			}
 		}
 	} else {
-		exists, err := s.volumeExists(volumeName)
+		reserved, err := s.reserveVolumeName(volumeName, driverName, jobID)
 		if err != nil {
-			return nil, fmt.Errorf("Error occurred while checking if volume %v exists: %v", volumeName, err)
+			return nil, err
 		}
-		if exists {
+		if !reserved {
 			return nil, fmt.Errorf("Volume %v already exists ", volumeName)
 		}
 	}
+	defer s.releaseVolumeName(volumeName)
 
+	if request.BackupURL != "" {
+		backupURL := util.UnescapeURL(request.BackupURL)
+		if request.BackupURL, request.Endpoint, err = s.resolveTarget(backupURL, request.Endpoint); err != nil {
+			return nil, err
+		}
+	}
 	if request.Endpoint != "" && request.BackupURL == "" {
 		return nil, fmt.Errorf("Endpoint option can only be used when creating a volume from a backup.")
 	}
@@ -101,8 +164,12 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 			return nil, fmt.Errorf("Invalid format for backup URL: %s", request.BackupURL)
 		}
 		if request.Endpoint != "" {
-			if u.Scheme != "s3" {
-				return nil, fmt.Errorf("Unsupported backup protocol for custom endpoint: %s. Only s3:// is supported.", u.Scheme)
+			capabilities, err := objectstore.GetCapabilities(request.BackupURL)
+			if err != nil {
+				return nil, err
+			}
+			if !capabilities.Endpoint {
+				return nil, fmt.Errorf("Unsupported backup protocol for custom endpoint: %s", u.Scheme)
 			}
 			_, endpointErr := url.Parse(request.Endpoint)
 			if endpointErr != nil {
@@ -111,9 +178,6 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		}
 	}
 
-	if driverName == "" {
-		driverName = s.DefaultDriver
-	}
 	driver, err := s.getDriver(driverName)
 	if err != nil {
 		return nil, err
@@ -123,17 +187,39 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		return nil, err
 	}
 
+	backupURL := util.UnescapeURL(request.BackupURL)
+	endpointURL := request.Endpoint
+	size := request.Size
+	// Backups of other drivers would be restored by daemon after the volume
+	// is created, rather than by the driver
+	restoreURL := ""
+	if backupURL != "" {
+		objVolume, err := getForeignBackupVolume(backupURL, endpointURL, driverName)
+		if err != nil {
+			return nil, err
+		}
+		if objVolume != nil {
+			restoreURL = backupURL
+			backupURL = ""
+			endpointURL = ""
+			if size == 0 {
+				size = objVolume.Size
+			}
+		}
+	}
+
 	req := Request{
 		Name: volumeName,
 		Options: map[string]string{
-			OPT_SIZE:             strconv.FormatInt(request.Size, 10),
-			OPT_BACKUP_URL:       util.UnescapeURL(request.BackupURL),
-			OPT_ENDPOINT_URL:     request.Endpoint,
+			OPT_SIZE:             strconv.FormatInt(size, 10),
+			OPT_BACKUP_URL:       backupURL,
+			OPT_ENDPOINT_URL:     endpointURL,
 			OPT_VOLUME_NAME:      volumeName,
 			OPT_VOLUME_DRIVER_ID: request.DriverVolumeID,
 			OPT_VOLUME_TYPE:      request.Type,
 			OPT_VOLUME_IOPS:      strconv.FormatInt(request.IOPS, 10),
 			OPT_PREPARE_FOR_VM:   strconv.FormatBool(request.PrepareForVM),
+			OPT_JOB_ID:           jobID,
 		},
 	}
 	log.WithFields(logrus.Fields{
@@ -153,6 +239,20 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		LOG_FIELD_VOLUME: volumeName,
 	}).Debug("Created volume")
 
+	if restoreURL != "" {
+		if err := s.restoreBackup(volOps, volumeName, restoreURL, request.Endpoint, objectstore.GetProgress(jobID)); err != nil {
+			if err := volOps.DeleteVolume(Request{
+				Name: volumeName,
+				Options: map[string]string{
+					OPT_REFERENCE_ONLY: "false",
+				},
+			}); err != nil {
+				log.Errorf("Failed to cleanup volume %v after restoring failed: %v", volumeName, err)
+			}
+			return nil, err
+		}
+	}
+
 	volume := &Volume{
 		Name:       volumeName,
 		DriverName: driverName,
@@ -170,9 +270,45 @@ func (s *daemon) doVolumeCreate(version string, w http.ResponseWriter, r *http.R
 		return err
 	}
 
-	volume, err := s.processVolumeCreate(request)
-	if err != nil {
-		return err
+	var (
+		volume *Volume
+		err    error
+	)
+	if request.BackupURL == "" {
+		volume, err = s.processVolumeCreate(request, "")
+		if err != nil {
+			return err
+		}
+	} else {
+		// Restoring would take a while, run it as a job
+		if request.Name == "" {
+			name, err := s.generateName()
+			if err != nil {
+				return err
+			}
+			request.Name = name
+		}
+		entry, err := s.startJob(&Job{
+			Type:       JOB_TYPE_VOLUME_CREATE,
+			VolumeName: request.Name,
+			BackupURL:  util.UnescapeURL(request.BackupURL),
+		}, func(jobID string) (string, error) {
+			v, err := s.processVolumeCreate(request, jobID)
+			if err != nil {
+				return "", err
+			}
+			volume = v
+			return v.Name, nil
+		})
+		if err != nil {
+			return err
+		}
+		if request.Async {
+			return s.writeJobResponse(w, entry, request.Verbose)
+		}
+		if err := s.waitJob(entry); err != nil {
+			return err
+		}
 	}
 
 	driverInfo, err := s.getVolumeDriverInfo(volume)
@@ -200,6 +336,9 @@ func (s *daemon) doVolumeDelete(version string, w http.ResponseWriter, r *http.R
 	if err := util.CheckName(request.VolumeName); err != nil {
 		return err
 	}
+	if reservation := s.getVolumeReservation(request.VolumeName); reservation != nil {
+		return fmt.Errorf("Volume %v is being created by job %v, cancel the job instead", request.VolumeName, reservation.jobID)
+	}
 
 	return s.processVolumeDelete(request)
 }
@@ -313,6 +452,24 @@ func (s *daemon) listVolume() ([]byte, error) {
 		resp[name] = *r
 	}
 
+	s.creatingVolumesLock.Lock()
+	defer s.creatingVolumesLock.Unlock()
+	for name, reservation := range s.creatingVolumes {
+		r, exists := resp[name]
+		if !exists {
+			// Not created by the driver yet
+			r = api.VolumeResponse{
+				Name:       name,
+				Driver:     reservation.driverName,
+				DriverInfo: map[string]string{},
+				Snapshots:  map[string]api.SnapshotResponse{},
+			}
+		}
+		r.Creating = true
+		r.JobID = reservation.jobID
+		resp[name] = r
+	}
+
 	return api.ResponseOutput(resp)
 }
 
@@ -358,6 +515,10 @@ func (s *daemon) inspectVolume(name string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if reservation := s.getVolumeReservation(name); reservation != nil {
+		resp.Creating = true
+		resp.JobID = reservation.jobID
+	}
 	return api.ResponseOutput(*resp)
 }
 
@@ -137,11 +137,18 @@ func (d *Driver) CreateBackup(snapshotID, volumeID, destURL, endpointURL string,
 		Size:        volume.Size,
 		CreatedTime: opts[convoydriver.OPT_VOLUME_CREATED_TIME],
 	}
+	labels, err := util.DecodeLabels(opts[convoydriver.OPT_BACKUP_LABELS])
+	if err != nil {
+		return "", err
+	}
 	objSnapshot := &objectstore.Snapshot{
 		Name:        snapshotID,
 		CreatedTime: opts[convoydriver.OPT_SNAPSHOT_CREATED_TIME],
+		Labels:      labels,
+		Description: opts[convoydriver.OPT_BACKUP_DESCRIPTION],
 	}
-	return objectstore.CreateDeltaBlockBackup(objVolume, objSnapshot, destURL, endpointURL, d)
+	return objectstore.CreateDeltaBlockBackup(objVolume, objSnapshot, destURL, endpointURL, d,
+		objectstore.GetProgress(opts[convoydriver.OPT_JOB_ID]))
 }
 
 func (d *Driver) DeleteBackup(backupURL, endpointURL string) error {
@@ -539,7 +539,7 @@ func (d *Driver) CreateVolume(req Request) error {
 			return err
 		}
 	} else {
-		if err := objectstore.RestoreDeltaBlockBackup(backupURL, endpointURL, dev); err != nil {
+		if err := objectstore.RestoreDeltaBlockBackup(backupURL, endpointURL, dev, objectstore.GetProgress(opts[OPT_JOB_ID])); err != nil {
 			return err
 		}
 	}
@@ -917,7 +917,7 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 	}
 	result := map[string]string{
 		"DevID":                 strconv.Itoa(volume.DevID),
-		"Device":                dev,
+		OPT_DEVICE:              dev,
 		OPT_VOLUME_NAME:         volume.Name,
 		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
 		OPT_MOUNT_POINT:         volume.MountPoint,
@@ -518,7 +518,7 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		iops = strconv.FormatInt(*ebsVolume.Iops, 10)
 	}
 	info := map[string]string{
-		"Device":                volume.Device,
+		OPT_DEVICE:              volume.Device,
 		"MountPoint":            volume.MountPoint,
 		"EBSVolumeID":           volume.EBSID,
 		"KmsKeyId":              aws.StringValue(ebsVolume.KmsKeyId),
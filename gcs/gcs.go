@@ -0,0 +1,189 @@
+package gcs
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "gcs"})
+)
+
+type GCSObjectStoreDriver struct {
+	destURL string
+	path    string
+	service GCSService
+}
+
+const (
+	KIND = "gs"
+)
+
+func init() {
+	if err := objectstore.RegisterDriver(KIND, initFunc, objectstore.Capabilities{
+		Endpoint: true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL, endpoint string) (objectstore.ObjectStoreDriver, error) {
+	return initFuncWithConnectionCheck(destURL, endpoint, func(d objectstore.ObjectStoreDriver) error {
+		_, err := d.List("")
+		return err
+	})
+}
+
+func initFuncWithConnectionCheck(destURL, endpoint string, connectionTest func(d objectstore.ObjectStoreDriver) error) (objectstore.ObjectStoreDriver, error) {
+	b := &GCSObjectStoreDriver{}
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	b.service.Endpoint = endpoint
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	b.service.Bucket = u.Host
+	b.path = u.Path
+	if b.service.Bucket == "" || b.path == "" {
+		return nil, fmt.Errorf("Invalid URL. Must be gs://bucket/path/")
+	}
+	// Object names don't start with '/'
+	b.path = strings.TrimLeft(b.path, "/")
+
+	if err := b.service.init(); err != nil {
+		return nil, err
+	}
+
+	//Test connection
+	if err := connectionTest(b); err != nil {
+		return nil, err
+	}
+
+	b.destURL = KIND + "://" + b.service.Bucket + "/" + b.path
+
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (s *GCSObjectStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *GCSObjectStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *GCSObjectStoreDriver) updatePath(path string) string {
+	return filepath.Join(s.path, path)
+}
+
+func (s *GCSObjectStoreDriver) List(listPath string) ([]string, error) {
+	var result []string
+
+	path := s.updatePath(listPath) + "/"
+	// Bucket root
+	if path == "/" {
+		path = ""
+	}
+	names, prefixes, err := s.service.ListObjects(path, "/")
+	if err != nil {
+		log.Error("Fail to list gcs: ", err)
+		return result, err
+	}
+
+	if len(names) == 0 && len(prefixes) == 0 {
+		return result, nil
+	}
+	result = []string{}
+	for _, name := range names {
+		r := strings.TrimPrefix(name, path)
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+	for _, p := range prefixes {
+		r := strings.TrimPrefix(p, path)
+		r = strings.TrimSuffix(r, "/")
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *GCSObjectStoreDriver) FileExists(filePath string) bool {
+	return s.FileSize(filePath) >= 0
+}
+
+func (s *GCSObjectStoreDriver) FileSize(filePath string) int64 {
+	path := s.updatePath(filePath)
+	size, err := s.service.GetObjectSize(path)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (s *GCSObjectStoreDriver) Remove(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = s.updatePath(name)
+	}
+	return s.service.DeleteObjects(paths)
+}
+
+func (s *GCSObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	path := s.updatePath(src)
+	return s.service.GetObject(path)
+}
+
+func (s *GCSObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	path := s.updatePath(dst)
+	return s.service.PutObject(path, rs)
+}
+
+func (s *GCSObjectStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	path := s.updatePath(dst)
+	return s.service.PutObject(path, file)
+}
+
+func (s *GCSObjectStoreDriver) Download(src, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	path := s.updatePath(src)
+	rc, err := s.service.GetObject(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
@@ -0,0 +1,450 @@
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+const (
+	ENV_CREDENTIALS   = "GOOGLE_APPLICATION_CREDENTIALS"
+	ENV_EMULATOR_HOST = "STORAGE_EMULATOR_HOST"
+
+	DEFAULT_ENDPOINT   = "https://storage.googleapis.com"
+	STORAGE_SCOPE      = "https://www.googleapis.com/auth/devstorage.read_write"
+	DEFAULT_TOKEN_URL  = "https://oauth2.googleapis.com/token"
+	METADATA_TOKEN_URL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// Objects larger than it would be uploaded in chunks of the size, must be
+	// multiples of 256KiB
+	UPLOAD_CHUNK_SIZE = 8 * 1024 * 1024
+	// Times to retry an upload chunk before giving up
+	UPLOAD_RETRIES = 3
+)
+
+var (
+	// Token of the service account is reused by drivers
+	clients     = map[string]*http.Client{}
+	clientsLock sync.Mutex
+)
+
+type GCSService struct {
+	Bucket   string
+	Endpoint string
+	client   *http.Client
+}
+
+type serviceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+type gcsObject struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+type gcsError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// metadataTokenSource gets the token of the default service account of the GCE instance
+type metadataTokenSource struct{}
+
+func (metadataTokenSource) Token() (*oauth2.Token, error) {
+	req, err := http.NewRequest("GET", METADATA_TOKEN_URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get token from GCE metadata server, set %v for service account credentials: %v", ENV_CREDENTIALS, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cannot get token from GCE metadata server, status %v", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+/*
+getClient returns the HTTP client authorized by the service account in the
+credentials file, or the default service account of the GCE instance if no
+file was specified. Emulator doesn't need authorization.
+*/
+func getClient(credentialsFile string, emulator bool) (*http.Client, error) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	if emulator && credentialsFile == "" {
+		return http.DefaultClient, nil
+	}
+	if client, exists := clients[credentialsFile]; exists {
+		return client, nil
+	}
+	var src oauth2.TokenSource
+	if credentialsFile == "" {
+		src = oauth2.ReuseTokenSource(nil, metadataTokenSource{})
+	} else {
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		account := &serviceAccount{}
+		if err := json.Unmarshal(data, account); err != nil {
+			return nil, fmt.Errorf("Invalid service account credentials file %v: %v", credentialsFile, err)
+		}
+		if account.ClientEmail == "" || account.PrivateKey == "" {
+			return nil, fmt.Errorf("Invalid service account credentials file %v: missing client_email or private_key", credentialsFile)
+		}
+		config := &jwt.Config{
+			Email:        account.ClientEmail,
+			PrivateKey:   []byte(account.PrivateKey),
+			PrivateKeyID: account.PrivateKeyID,
+			Scopes:       []string{STORAGE_SCOPE},
+			TokenURL:     account.TokenURI,
+		}
+		if config.TokenURL == "" {
+			config.TokenURL = DEFAULT_TOKEN_URL
+		}
+		src = config.TokenSource(oauth2.NoContext)
+	}
+	client := oauth2.NewClient(oauth2.NoContext, src)
+	clients[credentialsFile] = client
+	return client, nil
+}
+
+func (s *GCSService) init() error {
+	emulator := false
+	if s.Endpoint == "" {
+		if host := os.Getenv(ENV_EMULATOR_HOST); host != "" {
+			s.Endpoint = host
+			emulator = true
+		} else {
+			s.Endpoint = DEFAULT_ENDPOINT
+		}
+	}
+	if !strings.Contains(s.Endpoint, "://") {
+		s.Endpoint = "http://" + s.Endpoint
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+
+	client, err := getClient(os.Getenv(ENV_CREDENTIALS), emulator)
+	if err != nil {
+		return err
+	}
+	s.client = client
+	return nil
+}
+
+func (s *GCSService) objectURL(key string) string {
+	return s.Endpoint + "/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (s *GCSService) uploadURL() string {
+	return s.Endpoint + "/upload/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o"
+}
+
+func parseGCSError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	e := &gcsError{}
+	if err := json.Unmarshal(body, e); err == nil && e.Error.Message != "" {
+		return fmt.Errorf("GCS Error: %v %v", e.Error.Code, e.Error.Message)
+	}
+	return fmt.Errorf("GCS Error: %v %v", resp.Status, strings.TrimSpace(string(body)))
+}
+
+/*
+do sends the request and checks the status of response. Redirects are not
+followed, since GCS replies 308 for incomplete resumable uploads.
+*/
+func (s *GCSService) do(req *http.Request, expected ...int) (*http.Response, error) {
+	transport := s.client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, parseGCSError(resp)
+}
+
+// ListObjects returns the names of objects and the common prefixes under prefix
+func (s *GCSService) ListObjects(prefix, delimiter string) ([]string, []string, error) {
+	names := []string{}
+	prefixes := []string{}
+	pageToken := ""
+	for {
+		v := url.Values{}
+		v.Set("prefix", prefix)
+		if delimiter != "" {
+			v.Set("delimiter", delimiter)
+		}
+		if pageToken != "" {
+			v.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest("GET", s.Endpoint+"/storage/v1/b/"+url.PathEscape(s.Bucket)+"/o?"+v.Encode(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return nil, nil, err
+		}
+		list := &gcsObjectList{}
+		err = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+		prefixes = append(prefixes, list.Prefixes...)
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+	return names, prefixes, nil
+}
+
+// GetObjectSize returns the size of object, or error if it doesn't exist
+func (s *GCSService) GetObjectSize(key string) (int64, error) {
+	req, err := http.NewRequest("GET", s.objectURL(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	obj := &gcsObject{}
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(obj.Size, 10, 64)
+}
+
+func (s *GCSService) GetObject(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+/*
+PutObject uploads the content of rs as key. Small objects are uploaded in one
+request, and larger ones are uploaded by resumable upload, so a failed chunk
+would be retried from where the server has received rather than from the
+beginning.
+*/
+func (s *GCSService) PutObject(key string, rs io.ReadSeeker) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if size <= UPLOAD_CHUNK_SIZE {
+		return s.putObjectSimple(key, rs, size)
+	}
+	return s.putObjectResumable(key, rs, size)
+}
+
+func (s *GCSService) putObjectSimple(key string, r io.Reader, size int64) error {
+	v := url.Values{}
+	v.Set("uploadType", "media")
+	v.Set("name", key)
+	req, err := http.NewRequest("POST", s.uploadURL()+"?"+v.Encode(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *GCSService) startResumableUpload(key string) (string, error) {
+	v := url.Values{}
+	v.Set("uploadType", "resumable")
+	v.Set("name", key)
+	req, err := http.NewRequest("POST", s.uploadURL()+"?"+v.Encode(), strings.NewReader("{}"))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("GCS Error: no session URL returned for resumable upload of %v", key)
+	}
+	return session, nil
+}
+
+/*
+putUploadChunk sends the chunk starting from offset, or only queries the
+status of the upload if chunk is nil. It returns the offset the server
+expects next, or size if the upload has completed.
+*/
+func (s *GCSService) putUploadChunk(session string, chunk io.Reader, offset, length, size int64) (int64, error) {
+	var body io.Reader
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if chunk != nil {
+		body = ioutil.NopCloser(chunk)
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+	}
+	req, err := http.NewRequest("PUT", session, body)
+	if err != nil {
+		return 0, err
+	}
+	if chunk != nil {
+		req.ContentLength = length
+	}
+	req.Header.Set("Content-Range", contentRange)
+	// 308 means the upload is incomplete
+	resp, err := s.do(req, http.StatusOK, http.StatusCreated, http.StatusPermanentRedirect)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return size, nil
+	}
+	// Range is like "bytes=0-1048575", nothing has been received without it
+	received := resp.Header.Get("Range")
+	if received == "" {
+		return 0, nil
+	}
+	i := strings.LastIndex(received, "-")
+	last, err := strconv.ParseInt(received[i+1:], 10, 64)
+	if i < 0 || err != nil {
+		return 0, fmt.Errorf("GCS Error: invalid range %v returned for resumable upload", received)
+	}
+	return last + 1, nil
+}
+
+func (s *GCSService) putObjectResumable(key string, rs io.ReadSeeker, size int64) error {
+	session, err := s.startResumableUpload(key)
+	if err != nil {
+		return err
+	}
+	offset := int64(0)
+	retries := 0
+	for offset < size {
+		length := int64(UPLOAD_CHUNK_SIZE)
+		if offset+length > size {
+			length = size - offset
+		}
+		if _, err := rs.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		next, err := s.putUploadChunk(session, io.LimitReader(rs, length), offset, length, size)
+		if err == nil {
+			offset = next
+			retries = 0
+			continue
+		}
+		retries++
+		if retries > UPLOAD_RETRIES {
+			return err
+		}
+		log.Warnf("Failed to upload %v at offset %v, would resume: %v", key, offset, err)
+		// Find out how much the server has received
+		if next, err = s.putUploadChunk(session, nil, 0, 0, size); err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+func (s *GCSService) DeleteObject(key string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteObjects removes the objects, and all the objects under them if they're directories
+func (s *GCSService) DeleteObjects(keys []string) error {
+	for _, key := range keys {
+		names, _, err := s.ListObjects(key, "")
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if name != key && !strings.HasPrefix(name, strings.TrimSuffix(key, "/")+"/") {
+				continue
+			}
+			if err := s.DeleteObject(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rancher/convoy/objectstore"
+	"gopkg.in/check.v1"
+)
+
+var (
+	errFakeConnection = errors.New("Simulated connection error")
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type TestSuite struct {
+	server *fakeGCSServer
+}
+
+var _ = check.Suite(&TestSuite{})
+
+/*
+fakeGCSServer implements the part of GCS JSON API used by the driver, with
+objects of all buckets kept in memory.
+*/
+type fakeGCSServer struct {
+	*httptest.Server
+	objects  map[string][]byte
+	sessions map[string][]byte
+	// Number of upload chunks to fail
+	failChunks int
+	lock       sync.Mutex
+}
+
+func newFakeGCSServer() *fakeGCSServer {
+	f := &fakeGCSServer{
+		objects:  map[string][]byte{},
+		sessions: map[string][]byte{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeGCSServer) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, "/upload/session/"):
+		f.handleUploadChunk(w, r, strings.TrimPrefix(path, "/upload/session/"))
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o")
+		key := bucket + "/" + r.URL.Query().Get("name")
+		if r.URL.Query().Get("uploadType") == "resumable" {
+			f.sessions[key] = []byte{}
+			w.Header().Set("Location", f.URL+"/upload/session/"+url.PathEscape(key))
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		writeJSON(w, map[string]string{"name": key})
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/storage/v1/b/"), "/o", 2)
+		bucket := parts[0]
+		if parts[1] == "" {
+			f.handleList(w, r, bucket)
+			return
+		}
+		name, _ := url.PathUnescape(strings.TrimPrefix(parts[1], "/"))
+		key := bucket + "/" + name
+		data, exists := f.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "Not Found"}})
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		} else if r.URL.Query().Get("alt") == "media" {
+			w.Write(data)
+		} else {
+			writeJSON(w, map[string]string{"name": name, "size": strconv.Itoa(len(data))})
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCSServer) handleList(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	list := gcsObjectList{}
+	prefixSet := map[string]bool{}
+	for key := range f.objects {
+		if !strings.HasPrefix(key, bucket+"/") {
+			continue
+		}
+		name := strings.TrimPrefix(key, bucket+"/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			prefixSet[prefix+rest[:i+1]] = true
+			continue
+		}
+		list.Items = append(list.Items, gcsObject{Name: name})
+	}
+	for p := range prefixSet {
+		list.Prefixes = append(list.Prefixes, p)
+	}
+	writeJSON(w, list)
+}
+
+func (f *fakeGCSServer) handleUploadChunk(w http.ResponseWriter, r *http.Request, session string) {
+	key, _ := url.PathUnescape(session)
+	received := f.sessions[key]
+	var start, end, size int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &size); err == nil {
+		// Status query
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		data, _ := ioutil.ReadAll(r.Body)
+		if f.failChunks > 0 {
+			f.failChunks--
+			// Only the first half of the chunk has been received
+			received = append(received[:start], data[:len(data)/2]...)
+			f.sessions[key] = received
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if start != int64(len(received)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, data...)
+		f.sessions[key] = received
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(received)) == size {
+		f.objects[key] = received
+		delete(f.sessions, key)
+		writeJSON(w, map[string]string{"name": key})
+		return
+	}
+	if len(received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *TestSuite) SetUpTest(c *check.C) {
+	s.server = newFakeGCSServer()
+	os.Setenv(ENV_EMULATOR_HOST, s.server.URL)
+	os.Unsetenv(ENV_CREDENTIALS)
+}
+
+func (s *TestSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+	os.Unsetenv(ENV_EMULATOR_HOST)
+}
+
+func runInitFunc(destURL string, makeConnectionError bool) (bool, objectstore.ObjectStoreDriver, error) {
+	attemptedConnection := false
+	fakeConnectionTest := func(d objectstore.ObjectStoreDriver) error {
+		attemptedConnection = true
+		if makeConnectionError {
+			return errFakeConnection
+		}
+		return nil
+	}
+
+	driver, err := initFuncWithConnectionCheck(destURL, "", fakeConnectionTest)
+	return attemptedConnection, driver, err
+}
+
+func (s *TestSuite) TestInitFunc(c *check.C) {
+	attemptedConnection, driver, err := runInitFunc("gs://test/path", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(attemptedConnection, check.Equals, true)
+	d := driver.(*GCSObjectStoreDriver)
+	c.Assert(d.GetURL(), check.Equals, "gs://test/path")
+	c.Assert(d.path, check.Equals, "path")
+	c.Assert(d.service.Bucket, check.Equals, "test")
+	c.Assert(d.service.Endpoint, check.Equals, s.server.URL)
+
+	attemptedConnection, driver, err = runInitFunc("gs://test/", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.GetURL(), check.Equals, "gs://test/")
+
+	attemptedConnection, _, err = runInitFunc("gs://test", false)
+	c.Assert(err, check.ErrorMatches, "Invalid URL.*")
+	c.Assert(attemptedConnection, check.Equals, false)
+
+	_, _, err = runInitFunc("gs://test/path", true)
+	c.Assert(err, check.Equals, errFakeConnection)
+}
+
+func (s *TestSuite) TestDriverOperations(c *check.C) {
+	d, err := initFunc("gs://test/backups", "")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(d.FileExists("dir/file1"), check.Equals, false)
+	c.Assert(d.FileSize("dir/file1"), check.Equals, int64(-1))
+	c.Assert(d.Write("dir/file1", bytes.NewReader([]byte("content1"))), check.IsNil)
+	c.Assert(d.Write("dir/sub/file2", bytes.NewReader([]byte("content2"))), check.IsNil)
+	c.Assert(d.FileExists("dir/file1"), check.Equals, true)
+	c.Assert(d.FileSize("dir/file1"), check.Equals, int64(8))
+
+	rc, err := d.Read("dir/file1")
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "content1")
+
+	names, err := d.List("dir")
+	c.Assert(err, check.IsNil)
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"file1", "sub"})
+
+	dir := c.MkDir()
+	c.Assert(d.Download("dir/sub/file2", dir+"/file2"), check.IsNil)
+	data, err = ioutil.ReadFile(dir + "/file2")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "content2")
+	c.Assert(d.Upload(dir+"/file2", "dir/file3"), check.IsNil)
+	c.Assert(d.FileSize("dir/file3"), check.Equals, int64(8))
+
+	c.Assert(d.Remove("dir/sub"), check.IsNil)
+	c.Assert(d.FileExists("dir/sub/file2"), check.Equals, false)
+	c.Assert(d.FileExists("dir/file1"), check.Equals, true)
+	c.Assert(d.Remove("dir"), check.IsNil)
+	names, err = d.List("dir")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+}
+
+func (s *TestSuite) TestResumableUpload(c *check.C) {
+	d, err := initFunc("gs://test/backups", "")
+	c.Assert(err, check.IsNil)
+
+	content := make([]byte, UPLOAD_CHUNK_SIZE*2+1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// Each failed chunk would be resumed from where the server has received
+	s.server.failChunks = 2
+	c.Assert(d.Write("large", bytes.NewReader(content)), check.IsNil)
+	c.Assert(bytes.Equal(s.server.objects["test/backups/large"], content), check.Equals, true)
+
+	s.server.failChunks = UPLOAD_RETRIES + 1
+	err = d.Write("failed", bytes.NewReader(content))
+	c.Assert(err, check.ErrorMatches, "GCS Error: .*")
+	c.Assert(d.FileExists("failed"), check.Equals, false)
+}
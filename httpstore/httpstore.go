@@ -0,0 +1,251 @@
+package httpstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+)
+
+/*
+HttpObjectStoreDriver reads backups published on a web server, with
+destination URL like https://host/path/. It's read-only, so it can only be
+used to inspect and restore backups. Since there is no way to list directories
+through plain HTTP, List relies on the index file generated by publisher, which
+is located at the destination path, contains the path of every file relative to
+the destination path, one per line.
+*/
+type HttpObjectStoreDriver struct {
+	destURL string
+	kind    string
+	base    url.URL
+	client  *http.Client
+	// Loaded from INDEX_FILE when List is called first time
+	index []string
+}
+
+const (
+	KIND_HTTP  = "http"
+	KIND_HTTPS = "https"
+
+	INDEX_FILE = "convoy.index"
+
+	CONNECT_TIMEOUT = 30 * time.Second
+	// Only the response header is waited for, since the body of a large file
+	// may take long to download
+	RESPONSE_TIMEOUT = 60 * time.Second
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "httpstore"})
+
+	// Shared by drivers, so the connections to the same server can be reused
+	client = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   CONNECT_TIMEOUT,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   CONNECT_TIMEOUT,
+			ResponseHeaderTimeout: RESPONSE_TIMEOUT,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+)
+
+func init() {
+	capabilities := objectstore.Capabilities{
+		ReadOnly: true,
+	}
+	if err := objectstore.RegisterDriver(KIND_HTTP, initFunc, capabilities); err != nil {
+		panic(err)
+	}
+	if err := objectstore.RegisterDriver(KIND_HTTPS, initFunc, capabilities); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL, endpoint string) (objectstore.ObjectStoreDriver, error) {
+	b := &HttpObjectStoreDriver{}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND_HTTP && u.Scheme != KIND_HTTPS {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v or %v?", u.Scheme, KIND_HTTP, KIND_HTTPS)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid URL. Must be %v://host/path/", u.Scheme)
+	}
+
+	b.kind = u.Scheme
+	b.base = url.URL{
+		Scheme: u.Scheme,
+		User:   u.User,
+		Host:   u.Host,
+		Path:   u.Path,
+	}
+	if b.base.Path == "" {
+		b.base.Path = "/"
+	}
+	b.client = client
+
+	// Don't test the connection here, the web server may refuse to serve the
+	// directory itself
+	b.destURL = b.kind + "://" + b.base.Host + b.base.Path
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (s *HttpObjectStoreDriver) Kind() string {
+	return s.kind
+}
+
+func (s *HttpObjectStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *HttpObjectStoreDriver) fileURL(filePath string) string {
+	u := s.base
+	u.Path = path.Join(s.base.Path, filePath)
+	return u.String()
+}
+
+func (s *HttpObjectStoreDriver) readOnlyError(filePath string) error {
+	return fmt.Errorf("Objectstore %v is read-only, cannot write %v", s.destURL, filePath)
+}
+
+func (s *HttpObjectStoreDriver) head(filePath string) (*http.Response, error) {
+	resp, err := s.client.Head(s.fileURL(filePath))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (s *HttpObjectStoreDriver) FileSize(filePath string) int64 {
+	resp, err := s.head(filePath)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	// The size would be -1 as well if it's unknown
+	return resp.ContentLength
+}
+
+func (s *HttpObjectStoreDriver) FileExists(filePath string) bool {
+	resp, err := s.head(filePath)
+	if err != nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusOK
+}
+
+func (s *HttpObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	fileURL := s.fileURL(src)
+	resp, err := s.client.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to get %v: %v", fileURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *HttpObjectStoreDriver) Download(src, dst string) error {
+	rc, err := s.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *HttpObjectStoreDriver) loadIndex() error {
+	if s.index != nil {
+		return nil
+	}
+	rc, err := s.Read(INDEX_FILE)
+	if err != nil {
+		return fmt.Errorf("Cannot list %v without index file %v: %v", s.destURL, INDEX_FILE, err)
+	}
+	defer rc.Close()
+
+	index := []string{}
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Output of "find ." works as well
+		index = append(index, path.Clean(strings.TrimPrefix(line, "./")))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.index = index
+	return nil
+}
+
+// List returns the files and directories directly under listPath, according to the index
+func (s *HttpObjectStoreDriver) List(listPath string) ([]string, error) {
+	var result []string
+	if err := s.loadIndex(); err != nil {
+		return result, err
+	}
+
+	prefix := path.Clean(strings.Trim(listPath, "/")) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	names := map[string]bool{}
+	for _, file := range s.index {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(file, prefix), "/", 2)[0]
+		if name == "" || name == "." || names[name] {
+			continue
+		}
+		names[name] = true
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+func (s *HttpObjectStoreDriver) Remove(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	return s.readOnlyError(names[0])
+}
+
+func (s *HttpObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	return s.readOnlyError(dst)
+}
+
+func (s *HttpObjectStoreDriver) Upload(src, dst string) error {
+	return s.readOnlyError(dst)
+}
@@ -0,0 +1,152 @@
+package httpstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rancher/convoy/objectstore"
+	"gopkg.in/check.v1"
+
+	// Backups to be published are created by vfs
+	_ "github.com/rancher/convoy/vfs"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type TestSuite struct {
+	dir    string
+	server *httptest.Server
+}
+
+var _ = check.Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.server = httptest.NewServer(http.FileServer(http.Dir(s.dir)))
+}
+
+func (s *TestSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *TestSuite) writeFile(c *check.C, name, content string) {
+	file := filepath.Join(s.dir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(file), 0700), check.IsNil)
+	c.Assert(ioutil.WriteFile(file, []byte(content), 0600), check.IsNil)
+}
+
+// generateIndex does the same as "find . -type f > convoy.index"
+func (s *TestSuite) generateIndex(c *check.C) {
+	files := []string{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() != INDEX_FILE {
+			files = append(files, "./"+strings.TrimPrefix(path, s.dir+"/"))
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	s.writeFile(c, INDEX_FILE, strings.Join(files, "\n")+"\n")
+}
+
+func (s *TestSuite) TestInitFunc(c *check.C) {
+	driver, err := initFunc("https://example.com/images/?backup=b1&volume=v1", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.Kind(), check.Equals, KIND_HTTPS)
+	c.Assert(driver.GetURL(), check.Equals, "https://example.com/images/")
+	d := driver.(*HttpObjectStoreDriver)
+	c.Assert(d.fileURL("dir/file 1"), check.Equals, "https://example.com/images/dir/file%201")
+	// Unresponsive servers won't block forever
+	transport := d.client.Transport.(*http.Transport)
+	c.Assert(transport.TLSHandshakeTimeout, check.Equals, CONNECT_TIMEOUT)
+	c.Assert(transport.ResponseHeaderTimeout, check.Equals, RESPONSE_TIMEOUT)
+
+	driver, err = initFunc("http://example.com", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.Kind(), check.Equals, KIND_HTTP)
+	c.Assert(driver.(*HttpObjectStoreDriver).fileURL("file"), check.Equals, "http://example.com/file")
+
+	_, err = initFunc("http:///path", "")
+	c.Assert(err, check.ErrorMatches, "Invalid URL.*")
+}
+
+func (s *TestSuite) TestDriverOperations(c *check.C) {
+	s.writeFile(c, "images/dir/file1", "content1")
+	s.writeFile(c, "images/dir/sub/file2", "content2")
+	d, err := initFunc(s.server.URL+"/images/", "")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(d.FileExists("dir/file1"), check.Equals, true)
+	c.Assert(d.FileSize("dir/file1"), check.Equals, int64(8))
+	c.Assert(d.FileExists("dir/nonexistent"), check.Equals, false)
+	c.Assert(d.FileSize("dir/nonexistent"), check.Equals, int64(-1))
+
+	rc, err := d.Read("dir/file1")
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "content1")
+	_, err = d.Read("dir/nonexistent")
+	c.Assert(err, check.ErrorMatches, ".*404 Not Found")
+
+	dir := c.MkDir()
+	c.Assert(d.Download("dir/sub/file2", dir+"/file2"), check.IsNil)
+	data, err = ioutil.ReadFile(dir + "/file2")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "content2")
+
+	_, err = d.List("dir")
+	c.Assert(err, check.ErrorMatches, "Cannot list .* without index file.*")
+	s.writeFile(c, "images/"+INDEX_FILE, "./dir/file1\n\ndir/sub/file2\n")
+	names, err := d.List("dir")
+	c.Assert(err, check.IsNil)
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"file1", "sub"})
+	names, err = d.List("")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"dir"})
+	names, err = d.List("nonexistent")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+
+	c.Assert(d.Write("dir/file3", bytes.NewReader([]byte("content3"))), check.ErrorMatches, ".* is read-only.*")
+	c.Assert(d.Upload(dir+"/file2", "dir/file3"), check.ErrorMatches, ".* is read-only.*")
+	c.Assert(d.Remove("dir/file1"), check.ErrorMatches, ".* is read-only.*")
+	c.Assert(d.FileExists("dir/file1"), check.Equals, true)
+}
+
+func (s *TestSuite) TestRestorePublishedBackup(c *check.C) {
+	srcFile := filepath.Join(c.MkDir(), "volume.img")
+	content := []byte("golden image content")
+	c.Assert(ioutil.WriteFile(srcFile, content, 0600), check.IsNil)
+
+	volume := &objectstore.Volume{Name: "golden", Driver: "vfs"}
+	backupURL, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: "snap1"}, srcFile, "vfs://"+s.dir, "", nil)
+	c.Assert(err, check.IsNil)
+	s.generateIndex(c)
+
+	httpURL := s.server.URL + strings.TrimPrefix(backupURL, "vfs://"+s.dir)
+	restoreDir := c.MkDir()
+	restored, err := objectstore.RestoreSingleFileBackup(httpURL, "", restoreDir, nil)
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.DeepEquals, content)
+
+	list, err := objectstore.List("golden", s.server.URL+"/", "", "vfs")
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 1)
+
+	_, err = objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: "snap2"}, srcFile, s.server.URL+"/", "", nil)
+	c.Assert(err, check.ErrorMatches, "(?s).*is read-only.*")
+}
@@ -0,0 +1,462 @@
+package objectstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+A backup can be exported to a tar archive containing everything needed to
+restore it, and imported to any destination, e.g. for transferring backups to
+sites without network access:
+
+	convoy-backup/manifest.cfg
+	convoy-backup/volume.cfg
+	convoy-backup/backup.cfg
+	convoy-backup/blocks/<checksum>.blk
+	convoy-backup/backup.bak
+
+The volume and backup configs are sealed the same way as in objectstore, and
+the blocks or the backup file are stored as they are, the same as copying a
+backup. So the archive is encrypted if the backup is, and must be imported
+with the same encryption key. The manifest is plain JSON, so the content of
+an archive can be told without the key.
+*/
+
+const (
+	ARCHIVE_DIRECTORY     = "convoy-backup"
+	ARCHIVE_MANIFEST      = "manifest.cfg"
+	ARCHIVE_VOLUME_CONFIG = "volume.cfg"
+	ARCHIVE_BACKUP_CONFIG = "backup.cfg"
+	ARCHIVE_BACKUP_FILE   = "backup.bak"
+
+	ARCHIVE_VERSION = 1
+)
+
+type archiveManifest struct {
+	Version     int
+	VolumeName  string
+	BackupName  string
+	Encrypted   bool
+	Blocks      int
+	CreatedTime string
+	// Needed to derive the same key from passphrase in destination
+	Encryption *encryptionConfig `json:",omitempty"`
+}
+
+func getArchivePath(name string) string {
+	return path.Join(ARCHIVE_DIRECTORY, name)
+}
+
+func getArchiveBlockPath(checksum string) string {
+	return path.Join(ARCHIVE_DIRECTORY, BLOCKS_DIRECTORY, checksum+BLOCK_SUFFIX)
+}
+
+func isValidChecksum(checksum string) bool {
+	if len(checksum) != util.PRESERVED_CHECKSUM_LENGTH {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+	return err == nil
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("Size of %v changed during exporting, expect %v, got %v", name, size, n)
+	}
+	return nil
+}
+
+// writeArchiveConfig writes v as JSON, sealed the same way as configs in driver if seal is true
+func writeArchiveConfig(tw *tar.Writer, name string, v interface{}, driver ObjectStoreDriver, seal bool) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if seal {
+		rs, err := sealData(j, driver)
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(rs); err != nil {
+			return err
+		}
+	} else {
+		data = j
+	}
+	return writeArchiveFile(tw, getArchivePath(name), int64(len(data)), bytes.NewReader(data))
+}
+
+func readArchiveConfig(tr *tar.Reader, name string, v interface{}, driver ObjectStoreDriver, sealed bool) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("Invalid archive, cannot read %v: %v", name, err)
+	}
+	if hdr.Name != getArchivePath(name) {
+		return fmt.Errorf("Invalid archive, expect %v, got %v", getArchivePath(name), hdr.Name)
+	}
+	var r io.Reader = tr
+	if sealed {
+		if r, err = openData(tr, driver, plainAllowed(nil)); err != nil {
+			return fmt.Errorf("Cannot load %v from archive: %v", name, err)
+		}
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+/*
+ExportBackup writes the backup to w as a tar archive, which can be imported
+to any destination by ImportBackup. progress can be nil.
+*/
+func ExportBackup(backupURL, endpointURL string, w io.Writer, progress *Progress) error {
+	driver, err := GetObjectStoreDriver(backupURL, endpointURL)
+	if err != nil {
+		return err
+	}
+	driver = throttleDriver(driver, progress)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return generateError(logrus.Fields{
+			LOG_FIELD_VOLUME:     volumeName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}, "Volume doesn't exist in objectstore: %v", err)
+	}
+	// Configs would be sealed again with the current key
+	if err := checkVolumeEncryption(volume); err != nil {
+		return err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+
+	checksums := getBlockChecksums(backup.Blocks)
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debug("Exporting backup")
+	manifest := &archiveManifest{
+		Version:     ARCHIVE_VERSION,
+		VolumeName:  volume.Name,
+		BackupName:  backup.Name,
+		Encrypted:   volume.Encrypted,
+		Blocks:      len(checksums),
+		CreatedTime: util.Now(),
+	}
+	if volume.Encrypted {
+		if manifest.Encryption, err = loadEncryptionConfig(driver); err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(w)
+	if err := writeArchiveConfig(tw, ARCHIVE_MANIFEST, manifest, driver, false); err != nil {
+		return err
+	}
+	// Blocks would be stored in the way of the destination
+	exportVolume := *volume
+	exportVolume.BlockPool = ""
+	if err := writeArchiveConfig(tw, ARCHIVE_VOLUME_CONFIG, &exportVolume, driver, true); err != nil {
+		return err
+	}
+	if err := writeArchiveConfig(tw, ARCHIVE_BACKUP_CONFIG, backup, driver, true); err != nil {
+		return err
+	}
+
+	if backup.SingleFile.FilePath != "" {
+		filePath := backup.SingleFile.FilePath
+		size := driver.FileSize(filePath)
+		if size < 0 {
+			return fmt.Errorf("Cannot find backup file %v in objectstore", filePath)
+		}
+		progress.setTotal(1, size)
+		rc, err := driver.Read(filePath)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if err := writeArchiveFile(tw, getArchivePath(ARCHIVE_BACKUP_FILE), size, rc); err != nil {
+			return err
+		}
+		progress.addProcessed(1, size)
+	} else {
+		blockSize := backup.getBlockSize()
+		progress.setTotal(len(checksums), int64(len(checksums))*blockSize)
+		for _, checksum := range checksums {
+			if err := progress.checkCancelled(); err != nil {
+				return err
+			}
+			rc, err := driver.Read(volume.getBlockFilePath(checksum))
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := writeArchiveFile(tw, getArchiveBlockPath(checksum), int64(len(data)), bytes.NewReader(data)); err != nil {
+				return err
+			}
+			progress.addProcessed(1, blockSize)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debugf("Exported backup with %v blocks", len(checksums))
+	return nil
+}
+
+/*
+ImportBackup loads the backup from the archive created by ExportBackup to
+destURL, keeping the names of the volume and the backup, the same as
+CopyBackup. Blocks already exist in destURL would be skipped. Every block and
+the backup file are verified before being saved, and the backup would only be
+saved if the archive is complete. progress can be nil.
+*/
+func ImportBackup(r io.Reader, destURL, endpointURL string, progress *Progress) (*BackupCopyResult, error) {
+	driver, err := getWritableObjectStoreDriver(destURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	manifest := &archiveManifest{}
+	if err := readArchiveConfig(tr, ARCHIVE_MANIFEST, manifest, driver, false); err != nil {
+		return nil, err
+	}
+	if manifest.Version != ARCHIVE_VERSION {
+		return nil, fmt.Errorf("Unsupported version %v of archive", manifest.Version)
+	}
+	if manifest.Encrypted {
+		if !encryptionEnabled() {
+			return nil, fmt.Errorf("Backup %v in archive is encrypted, but no encryption key was configured", manifest.BackupName)
+		}
+		if err := inheritEncryptionConfig(manifest.Encryption, driver); err != nil {
+			return nil, err
+		}
+	}
+	srcVolume := &Volume{}
+	if err := readArchiveConfig(tr, ARCHIVE_VOLUME_CONFIG, srcVolume, driver, true); err != nil {
+		return nil, err
+	}
+	if err := checkVolumeEncryption(srcVolume); err != nil {
+		return nil, err
+	}
+	backup := &Backup{}
+	if err := readArchiveConfig(tr, ARCHIVE_BACKUP_CONFIG, backup, driver, true); err != nil {
+		return nil, err
+	}
+	if !util.ValidateName(srcVolume.Name) || !util.ValidateName(backup.Name) || backup.VolumeName != srcVolume.Name {
+		return nil, fmt.Errorf("Invalid archive, got backup %v of volume %v", backup.Name, srcVolume.Name)
+	}
+	blockSet := make(map[string]bool)
+	for _, blk := range backup.Blocks {
+		if blk.isZero() {
+			continue
+		}
+		if !isValidChecksum(blk.BlockChecksum) {
+			return nil, fmt.Errorf("Invalid archive, got block %v", blk.BlockChecksum)
+		}
+		blockSet[blk.BlockChecksum] = false
+	}
+	if backup.SingleFile.FilePath != "" {
+		// Backup file is always saved in the same place
+		if backup.SingleFile.FilePath != getSingleFileBackupFilePath(backup) {
+			return nil, fmt.Errorf("Invalid archive, got backup file %v", backup.SingleFile.FilePath)
+		}
+	}
+
+	lock, err := lockVolume(srcVolume.Name, "import", driver)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+	driver = throttleDriver(driver, progress)
+
+	result := &BackupCopyResult{
+		BackupURL: encodeBackupURL(backup.Name, backup.VolumeName, destURL),
+	}
+	if backupExists(backup.Name, backup.VolumeName, driver) {
+		log.Debugf("Backup %v already exists in %v", backup.Name, driver.GetURL())
+		return result, nil
+	}
+	dstVolume, err := addCopyVolume(srcVolume, driver)
+	if err != nil {
+		return nil, err
+	}
+	poolLock, err := lockBlockPool(dstVolume.BlockPool, false, "import", driver)
+	if err != nil {
+		return nil, err
+	}
+	defer poolLock.unlock()
+	// Record the references first, the same as copying
+	if dstVolume.BlockPool != "" {
+		if err := addBlockPoolRefs(dstVolume, backup.Blocks, driver); err != nil {
+			return nil, err
+		}
+	}
+	codec, err := getCodec(backup.CompressionMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:   srcVolume.Name,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debugf("Importing backup %v", backup.Name)
+	blockSize := backup.getBlockSize()
+	progress.setTotal(len(blockSet), int64(len(blockSet))*blockSize)
+	fileImported := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid archive: %v", err)
+		}
+		if err := progress.checkCancelled(); err != nil {
+			return nil, err
+		}
+		if hdr.Name == getArchivePath(ARCHIVE_BACKUP_FILE) && backup.SingleFile.FilePath != "" {
+			progress.setTotal(1, hdr.Size)
+			if err := importBackupFile(tr, srcVolume, backup, driver); err != nil {
+				return nil, err
+			}
+			fileImported = true
+			progress.addProcessed(1, hdr.Size)
+			continue
+		}
+		checksum := strings.TrimSuffix(path.Base(hdr.Name), BLOCK_SUFFIX)
+		imported, exists := blockSet[checksum]
+		if !exists || hdr.Name != getArchiveBlockPath(checksum) {
+			return nil, fmt.Errorf("Invalid archive, unexpected file %v", hdr.Name)
+		}
+		if imported {
+			continue
+		}
+		blockSet[checksum] = true
+		dst := dstVolume.getBlockFilePath(checksum)
+		if driver.FileExists(dst) {
+			result.ExistingBlocks++
+			progress.addProcessed(1, blockSize)
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := openBlock(bytes.NewReader(data), srcVolume, driver, checksum, codec, blockSize); err != nil {
+			return nil, fmt.Errorf("Invalid block %v in archive: %v", checksum, err)
+		}
+		if err := driver.Write(dst, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		result.CopiedBlocks++
+		progress.addProcessed(1, blockSize)
+	}
+
+	for checksum, imported := range blockSet {
+		if !imported {
+			return nil, fmt.Errorf("Incomplete archive, block %v is missing", checksum)
+		}
+	}
+	if backup.SingleFile.FilePath != "" && !fileImported {
+		return nil, fmt.Errorf("Incomplete archive, backup file is missing")
+	}
+	if err := lock.check(); err != nil {
+		return nil, err
+	}
+	if err := poolLock.check(); err != nil {
+		return nil, err
+	}
+	if err := saveCopiedBackup(srcVolume, dstVolume, backup, driver); err != nil {
+		return nil, err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:   srcVolume.Name,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debugf("Imported backup %v, %v blocks copied, %v blocks already existed", backup.Name, result.CopiedBlocks, result.ExistingBlocks)
+	return result, nil
+}
+
+// importBackupFile saves the backup file through a temporary local file, since driver needs to seek it
+func importBackupFile(r io.Reader, volume *Volume, backup *Backup, driver ObjectStoreDriver) error {
+	f, err := ioutil.TempFile(stateDir, "import_")
+	if err != nil {
+		return err
+	}
+	tmpFile := f.Name()
+	defer os.Remove(tmpFile)
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Checksum is of the plain content
+	if f, err = os.Open(tmpFile); err != nil {
+		return err
+	}
+	h := sha512.New()
+	err = copyData(h, f, driver, plainAllowed(volume))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Invalid backup file in archive: %v", err)
+	}
+	if backup.SingleFile.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != backup.SingleFile.Checksum {
+		return fmt.Errorf("Checksum verification failed for backup file in archive")
+	}
+	return driver.Upload(tmpFile, backup.SingleFile.FilePath)
+}
@@ -0,0 +1,102 @@
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestExportImportDeltaBlockBackup(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	ops := newFakeDeltaOps()
+	image1 := generateImage(4)
+	ops.snapshots["snap1"] = image1
+	image2 := make([]byte, len(image1))
+	copy(image2, image1)
+	copy(image2[DEFAULT_BLOCK_SIZE:], []byte("changed block"))
+	ops.snapshots["snap2"] = image2
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image1))}
+	backupURL1, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	var archive1 bytes.Buffer
+	c.Assert(ExportBackup(backupURL1, "", &archive1, nil), check.IsNil)
+	result, err := ImportBackup(bytes.NewReader(archive1.Bytes()), dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 3)
+	c.Assert(result.ExistingBlocks, check.Equals, 0)
+	checkRestore(c, result.BackupURL, image1)
+
+	// Only the changed block is missing in destination
+	var archive2 bytes.Buffer
+	c.Assert(ExportBackup(backupURL2, "", &archive2, nil), check.IsNil)
+	result, err = ImportBackup(bytes.NewReader(archive2.Bytes()), dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 1)
+	c.Assert(result.ExistingBlocks, check.Equals, 2)
+	checkRestore(c, result.BackupURL, image2)
+
+	// Importing again changes nothing
+	result, err = ImportBackup(bytes.NewReader(archive2.Bytes()), dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 0)
+
+	infos, err := List("vol1", dst.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 2)
+	verify, err := VerifyObjectStore(dst.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(verify.Consistent(), check.Equals, true)
+}
+
+func (s *TestSuite) TestImportIncompleteArchive(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	var archive bytes.Buffer
+	c.Assert(ExportBackup(backupURL, "", &archive, nil), check.IsNil)
+	truncated := archive.Bytes()[:archive.Len()/2]
+	_, err = ImportBackup(bytes.NewReader(truncated), dst.GetURL(), "", nil)
+	c.Assert(err, check.NotNil)
+	backupNames, err := getBackupNamesForVolume("vol1", dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupNames, check.HasLen, 0)
+
+	_, err = ImportBackup(bytes.NewReader([]byte("not an archive")), dst.GetURL(), "", nil)
+	c.Assert(err, check.ErrorMatches, "Invalid archive.*")
+	_, err = ImportBackup(bytes.NewReader(archive.Bytes()), "memro:///"+c.TestName(), "", nil)
+	c.Assert(err, check.ErrorMatches, ".*read-only")
+}
+
+func (s *TestSuite) TestExportImportSingleFileBackup(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	content := []byte("single file backup content")
+	c.Assert(ioutil.WriteFile(srcFile, content, 0600), check.IsNil)
+
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	backupURL, err := CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, src.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	var archive bytes.Buffer
+	c.Assert(ExportBackup(backupURL, "", &archive, nil), check.IsNil)
+	result, err := ImportBackup(&archive, dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	var b bytes.Buffer
+	c.Assert(StreamSingleFileBackup(result.BackupURL, "", &b, nil), check.IsNil)
+	c.Assert(b.Bytes(), check.DeepEquals, content)
+}
@@ -0,0 +1,405 @@
+package objectstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+Blocks of volumes using a shared block pool are stored once per destination,
+no matter how many volumes contain them:
+
+	convoy-objectstore/blockpools/<pool>/blocks/<lv1>/<lv2>/<checksum>.blk
+	convoy-objectstore/blockpools/<pool>/refs/<volume>.cfg
+
+Blocks can only be shared if they're in the same format, so the pool is
+decided by the compression method and the encryption key of the volume. Each
+member volume of the pool records the blocks referenced by its backups in its
+refs file, which is checked before a block is removed from the pool.
+*/
+
+const (
+	OBJECTSTORE_SHARED_BLOCKS = "objectstore.sharedblocks"
+
+	BLOCK_POOL_DIRECTORY = "blockpools"
+	BLOCK_POOL_REFS      = "refs"
+)
+
+var (
+	sharedBlocks = false
+)
+
+type blockPoolRefs struct {
+	VolumeName string
+	Blocks     []string
+}
+
+type BlockPoolMigrateResult struct {
+	DestURL        string
+	Volumes        []string
+	CopiedBlocks   int
+	ExistingBlocks int
+}
+
+func initSharedBlocks(value string) error {
+	sharedBlocks = false
+	if value == "" {
+		return nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("Invalid value %v for %v, must be true or false", value, OBJECTSTORE_SHARED_BLOCKS)
+	}
+	sharedBlocks = enabled
+	return nil
+}
+
+// getBlockPoolName returns the pool for blocks compressed by method and encrypted by the key of driver
+func getBlockPoolName(method string, driver ObjectStoreDriver) (string, error) {
+	if method == "" {
+		method = COMPRESSION_GZIP
+	}
+	key, err := getEncryptionKey(driver, true)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return method, nil
+	}
+	return method + "-" + hex.EncodeToString(key.id), nil
+}
+
+func getBlockPoolPath(pool string) string {
+	return filepath.Join(OBJECTSTORE_BASE, BLOCK_POOL_DIRECTORY, pool)
+}
+
+func getBlockPoolRefsFilePath(pool, volumeName string) string {
+	return filepath.Join(getBlockPoolPath(pool), BLOCK_POOL_REFS, volumeName+CFG_SUFFIX)
+}
+
+func getPoolBlockPath(pool string) string {
+	return filepath.Join(getBlockPoolPath(pool), BLOCKS_DIRECTORY) + "/"
+}
+
+// getBlockPath returns the directory containing blocks of the volume
+func (v *Volume) getBlockPath() string {
+	if v.BlockPool != "" {
+		return getPoolBlockPath(v.BlockPool)
+	}
+	return getBlockPath(v.Name)
+}
+
+func (v *Volume) getBlockFilePath(checksum string) string {
+	return getBlockFilePathInDir(v.getBlockPath(), checksum)
+}
+
+func getBlockPoolNames(driver ObjectStoreDriver) ([]string, error) {
+	names, err := driver.List(filepath.Join(OBJECTSTORE_BASE, BLOCK_POOL_DIRECTORY))
+	if err != nil {
+		// Directory doesn't exist
+		return []string{}, nil
+	}
+	return names, nil
+}
+
+// getBlockPoolMembers returns the volumes using the pool
+func getBlockPoolMembers(pool string, driver ObjectStoreDriver) ([]string, error) {
+	fileList, err := driver.List(filepath.Join(getBlockPoolPath(pool), BLOCK_POOL_REFS))
+	if err != nil {
+		// Directory doesn't exist
+		return []string{}, nil
+	}
+	names := []string{}
+	for _, f := range fileList {
+		if strings.HasSuffix(f, CFG_SUFFIX) {
+			names = append(names, strings.TrimSuffix(f, CFG_SUFFIX))
+		}
+	}
+	return names, nil
+}
+
+func loadBlockPoolRefs(pool, volumeName string, driver ObjectStoreDriver) (map[string]bool, error) {
+	refs := &blockPoolRefs{}
+	filePath := getBlockPoolRefsFilePath(pool, volumeName)
+	if err := loadConfigInObjectStore(filePath, driver, refs); err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool)
+	for _, checksum := range refs.Blocks {
+		result[checksum] = true
+	}
+	return result, nil
+}
+
+func saveBlockPoolRefs(pool, volumeName string, blocks map[string]bool, driver ObjectStoreDriver) error {
+	refs := &blockPoolRefs{
+		VolumeName: volumeName,
+		Blocks:     []string{},
+	}
+	for checksum := range blocks {
+		refs.Blocks = append(refs.Blocks, checksum)
+	}
+	sort.Strings(refs.Blocks)
+	return saveConfigInObjectStore(getBlockPoolRefsFilePath(pool, volumeName), driver, refs)
+}
+
+// addBlockPoolRefs records blocks as referenced by the volume, it must be done before the backup is saved
+func addBlockPoolRefs(volume *Volume, blocks []BlockMapping, driver ObjectStoreDriver) error {
+	refs := make(map[string]bool)
+	if driver.FileExists(getBlockPoolRefsFilePath(volume.BlockPool, volume.Name)) {
+		var err error
+		if refs, err = loadBlockPoolRefs(volume.BlockPool, volume.Name, driver); err != nil {
+			return err
+		}
+	}
+	for _, checksum := range getBlockChecksums(blocks) {
+		refs[checksum] = true
+	}
+	return saveBlockPoolRefs(volume.BlockPool, volume.Name, refs, driver)
+}
+
+/*
+removePoolBlocks stops the volume referencing the discarded blocks, and
+removes the ones which are not referenced by other volumes of the pool
+either, including the blocks of their in-progress backups. The refs file of
+the volume would be removed if removeRefs is true. The pool must have been
+locked exclusively by poolLock.
+*/
+func removePoolBlocks(volume *Volume, discardBlockSet map[string]bool, removeRefs bool, poolLock *blockPoolLock, driver ObjectStoreDriver) error {
+	pool := volume.BlockPool
+	refs, err := loadBlockPoolRefs(pool, volume.Name, driver)
+	if err != nil {
+		return err
+	}
+	for checksum := range discardBlockSet {
+		delete(refs, checksum)
+	}
+	if removeRefs {
+		if err := driver.Remove(getBlockPoolRefsFilePath(pool, volume.Name)); err != nil {
+			return err
+		}
+	} else {
+		if err := saveBlockPoolRefs(pool, volume.Name, refs, driver); err != nil {
+			return err
+		}
+	}
+
+	members, err := getBlockPoolMembers(pool, driver)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member == volume.Name || len(discardBlockSet) == 0 {
+			continue
+		}
+		memberRefs, err := loadBlockPoolRefs(pool, member, driver)
+		if err != nil {
+			return err
+		}
+		for checksum := range memberRefs {
+			delete(discardBlockSet, checksum)
+		}
+		partials, err := loadPartialBackupsForVolume(member, driver)
+		if err != nil {
+			return err
+		}
+		for _, partial := range partials {
+			for _, blk := range partial.Blocks {
+				delete(discardBlockSet, blk.BlockChecksum)
+			}
+		}
+	}
+
+	var blkFileList []string
+	for blk := range discardBlockSet {
+		blkFileList = append(blkFileList, volume.getBlockFilePath(blk))
+		log.Debugf("Found unused blocks %v in block pool %v", blk, pool)
+	}
+	if err := poolLock.check(); err != nil {
+		return err
+	}
+	if err := driver.Remove(blkFileList...); err != nil {
+		return err
+	}
+	log.Debugf("Removed %v unused blocks from block pool %v", len(blkFileList), pool)
+	return nil
+}
+
+/*
+MigrateToBlockPool moves the blocks of volumes in destURL from the per-volume
+layout to the shared block pool of the destination, so identical blocks of
+different volumes would be stored only once. All the volumes using per-volume
+layout would be migrated if volumeName is empty. It's safe to run again if
+interrupted. Each volume would be locked while being migrated.
+*/
+func MigrateToBlockPool(volumeName, destURL, endpointURL string) (*BlockPoolMigrateResult, error) {
+	driver, err := getWritableObjectStoreDriver(destURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	driver = throttleDriver(driver, nil)
+
+	volumeNames := []string{volumeName}
+	if volumeName == "" {
+		volumeNames, err = getVolumeNames(driver)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &BlockPoolMigrateResult{
+		DestURL: driver.GetURL(),
+		Volumes: []string{},
+	}
+	for _, name := range volumeNames {
+		migrated, err := migrateLockedVolume(name, volumeName != "", driver, result)
+		if err != nil {
+			return nil, err
+		}
+		if migrated {
+			result.Volumes = append(result.Volumes, name)
+		}
+	}
+	return result, nil
+}
+
+// migrateLockedVolume returns false if the volume is already using block pool and wasn't specified
+func migrateLockedVolume(volumeName string, specified bool, driver ObjectStoreDriver, result *BlockPoolMigrateResult) (bool, error) {
+	lock, err := lockVolume(volumeName, "migrate", driver)
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return false, err
+	}
+	if volume.BlockPool != "" {
+		if specified {
+			return false, fmt.Errorf("Volume %v is already using block pool %v", volumeName, volume.BlockPool)
+		}
+		return false, nil
+	}
+	if err := checkVolumeEncryption(volume); err != nil {
+		return false, err
+	}
+	if err := migrateVolumeToBlockPool(volume, driver, result); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func migrateVolumeToBlockPool(volume *Volume, driver ObjectStoreDriver, result *BlockPoolMigrateResult) error {
+	pool, err := getBlockPoolName(volume.CompressionMethod, driver)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME:   volume.Name,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debugf("Migrating blocks to block pool %v", pool)
+
+	backupNames, err := getBackupNamesForVolume(volume.Name, driver)
+	if err != nil {
+		return err
+	}
+	partials, err := loadPartialBackupsForVolume(volume.Name, driver)
+	if err != nil {
+		return err
+	}
+	blocks := []BlockMapping{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(backupName, volume.Name, driver)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, backup.Blocks...)
+	}
+	for _, partial := range partials {
+		blocks = append(blocks, partial.Blocks...)
+	}
+
+	poolLock, err := lockBlockPool(pool, false, "migrate", driver)
+	if err != nil {
+		return err
+	}
+	defer poolLock.unlock()
+
+	pooled := &Volume{
+		Name:      volume.Name,
+		BlockPool: pool,
+	}
+	// Record the references first, so the blocks won't be removed by other
+	// volumes once copied
+	if err := addBlockPoolRefs(pooled, blocks, driver); err != nil {
+		return err
+	}
+
+	checksums, err := listBlockChecksums(getBlockPath(volume.Name), driver)
+	if err != nil {
+		return err
+	}
+	copied := make([]bool, len(checksums))
+	err = RunParallel(len(checksums), concurrency, func(i int) error {
+		dst := pooled.getBlockFilePath(checksums[i])
+		if driver.FileExists(dst) {
+			return nil
+		}
+		// Blocks are in the same format, no need to decode them
+		rc, err := driver.Read(getBlockFilePath(volume.Name, checksums[i]))
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		if err := driver.Write(dst, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		copied[i] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range copied {
+		if c {
+			result.CopiedBlocks++
+		} else {
+			result.ExistingBlocks++
+		}
+	}
+
+	if err := poolLock.check(); err != nil {
+		return err
+	}
+	volume.BlockPool = pool
+	if err := saveVolume(volume, driver); err != nil {
+		return err
+	}
+	if err := driver.Remove(getBlockPath(volume.Name)); err != nil {
+		log.Warnf("Failed to remove per-volume blocks of volume %v: %v", volume.Name, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME:   volume.Name,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debugf("Migrated blocks to block pool %v", pool)
+	return nil
+}
@@ -0,0 +1,192 @@
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func backupVolumes(c *check.C, d ObjectStoreDriver, ops *fakeDeltaOps, volumeNames ...string) []string {
+	backupURLs := []string{}
+	for _, name := range volumeNames {
+		volume := &Volume{Name: name, Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+		backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+		c.Assert(err, check.IsNil)
+		backupURLs = append(backupURLs, backupURL)
+	}
+	return backupURLs
+}
+
+func checkRestore(c *check.C, backupURL string, image []byte) {
+	restored := filepath.Join(c.MkDir(), "restored.img")
+	c.Assert(RestoreDeltaBlockBackup(backupURL, "", restored, nil), check.IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(data, image), check.Equals, true)
+}
+
+func (s *TestSuite) TestBlockPool(c *check.C) {
+	c.Assert(initSharedBlocks("true"), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	backupURLs := backupVolumes(c, d, ops, "vol1", "vol2")
+
+	pool, err := getBlockPoolName(COMPRESSION_GZIP, d)
+	c.Assert(err, check.IsNil)
+	blocks, err := listBlockChecksums(getPoolBlockPath(pool), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.HasLen, 3)
+	blocks, err = listBlockChecksums(getBlockPath("vol1"), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.HasLen, 0)
+	members, err := getBlockPoolMembers(pool, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.DeepEquals, []string{"vol1", "vol2"})
+
+	result, err := VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Consistent(), check.Equals, true)
+	c.Assert(result.ReferencedBlocks, check.Equals, 3)
+	c.Assert(result.UnreferencedBlocks, check.HasLen, 0)
+
+	// Blocks are still used by vol2
+	c.Assert(DeleteDeltaBlockBackup(backupURLs[0], ""), check.IsNil)
+	blocks, err = listBlockChecksums(getPoolBlockPath(pool), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.HasLen, 3)
+	checkRestore(c, backupURLs[1], ops.snapshots["snap1"])
+
+	c.Assert(DeleteDeltaBlockBackup(backupURLs[1], ""), check.IsNil)
+	blocks, err = listBlockChecksums(getPoolBlockPath(pool), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.HasLen, 0)
+	members, err = getBlockPoolMembers(pool, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(members, check.HasLen, 0)
+}
+
+func (s *TestSuite) TestBlockPoolCollectGarbage(c *check.C) {
+	c.Assert(initSharedBlocks("true"), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	backupVolumes(c, d, ops, "vol1", "vol2")
+
+	pool, err := getBlockPoolName("", d)
+	c.Assert(err, check.IsNil)
+	orphan := getBlockFilePathInDir(getPoolBlockPath(pool), "0123456789abcdef")
+	c.Assert(d.Write(orphan, bytes.NewReader([]byte("orphan"))), check.IsNil)
+	result, err := CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.UnreferencedBlocks, check.DeepEquals, []string{orphan})
+	c.Assert(result.RemovedBlocks, check.Equals, 1)
+	c.Assert(result.ReferencedBlocks, check.Equals, 3)
+}
+
+func (s *TestSuite) TestBlockPoolCollectGarbageNewVolume(c *check.C) {
+	c.Assert(initSharedBlocks("true"), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	backupVolumes(c, d, ops, "vol1")
+
+	// Volume backed up right after volumes were listed by garbage collection
+	newOps := newFakeDeltaOps()
+	image := generateImage(4)
+	copy(image, []byte("only in vol2"))
+	newOps.snapshots["snap1"] = image
+	var backupURLs []string
+	d.listHook = func(path string) {
+		// The last directory listed for volume names
+		if path == filepath.Dir(getVolumePath("vol1")) {
+			d.listHook = nil
+			backupURLs = backupVolumes(c, d, newOps, "vol2")
+		}
+	}
+	result, err := CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupURLs, check.HasLen, 1)
+	c.Assert(result.Volumes, check.Equals, 2)
+	c.Assert(result.RemovedBlocks, check.Equals, 0)
+	checkRestore(c, backupURLs[0], image)
+}
+
+func (s *TestSuite) TestBlockPoolLockedByBackup(c *check.C) {
+	c.Assert(initSharedBlocks("true"), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	backupURLs := backupVolumes(c, d, ops, "vol1")
+	pool, err := getBlockPoolName("", d)
+	c.Assert(err, check.IsNil)
+
+	// Another daemon is backing up a volume into the pool, which may take the
+	// blocks of vol1 before recording its references
+	saveOtherPoolLease(c, pool, false, time.Now().Add(time.Minute), d)
+	c.Assert(DeleteDeltaBlockBackup(backupURLs[0], ""), check.FitsTypeOf, &BlockPoolLockedError{})
+	_, err = CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.FitsTypeOf, &BlockPoolLockedError{})
+	// Nothing was removed
+	blocks, err := listBlockChecksums(getPoolBlockPath(pool), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(blocks, check.HasLen, 3)
+	checkRestore(c, backupURLs[0], ops.snapshots["snap1"])
+	// Backups into the pool are not affected
+	backupVolumes(c, d, ops, "vol2")
+
+	saveOtherPoolLease(c, pool, true, time.Now().Add(time.Minute), d)
+	_, err = CreateDeltaBlockBackup(&Volume{Name: "vol3", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))},
+		&Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.FitsTypeOf, &BlockPoolLockedError{})
+
+	c.Assert(d.Remove(filepath.Join(getBlockPoolLockPath(pool), "other"+LOCK_SUFFIX)), check.IsNil)
+	c.Assert(DeleteDeltaBlockBackup(backupURLs[0], ""), check.IsNil)
+	_, err = CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *TestSuite) TestMigrateToBlockPool(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	backupURLs := backupVolumes(c, d, ops, "vol1", "vol2")
+
+	_, err := MigrateToBlockPool("vol3", d.GetURL(), "")
+	c.Assert(err, check.NotNil)
+
+	result, err := MigrateToBlockPool("vol1", d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Volumes, check.DeepEquals, []string{"vol1"})
+	c.Assert(result.CopiedBlocks, check.Equals, 3)
+	_, err = MigrateToBlockPool("vol1", d.GetURL(), "")
+	c.Assert(err, check.ErrorMatches, ".*already using block pool.*")
+
+	result, err = MigrateToBlockPool("", d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Volumes, check.DeepEquals, []string{"vol2"})
+	c.Assert(result.CopiedBlocks, check.Equals, 0)
+	c.Assert(result.ExistingBlocks, check.Equals, 3)
+
+	for _, name := range []string{"vol1", "vol2"} {
+		blocks, err := listBlockChecksums(getBlockPath(name), d)
+		c.Assert(err, check.IsNil)
+		c.Assert(blocks, check.HasLen, 0)
+	}
+	verifyResult, err := VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(verifyResult.Consistent(), check.Equals, true)
+	for _, backupURL := range backupURLs {
+		checkRestore(c, backupURL, ops.snapshots["snap1"])
+	}
+
+	// New backups of migrated volume go to the pool
+	ops.snapshots["snap2"] = append([]byte("changed"), ops.snapshots["snap1"][7:]...)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap2"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	checkRestore(c, backupURL, ops.snapshots["snap2"])
+}
@@ -0,0 +1,422 @@
+package objectstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+/*
+The catalog records the volumes and backups of a destination in one object:
+
+	convoy-objectstore/catalog.cfg
+	convoy-objectstore/catalog-pending/<volume>_<backup>.cfg
+
+so listing backups doesn't need to walk the volume directories and load every
+backup config, which takes long for a large bucket. The backup configs are
+still the source of truth. Before a backup is saved or removed, a pending
+record is saved for it, and removed after the catalog has been updated with
+the result, so a catalog with pending records may be stale and would not be
+used. Pending records left by interrupted operations would be cleaned up by
+rebuilding the catalog, either by RebuildCatalog or by the next update after
+CATALOG_PENDING_TIMEOUT. Daemons sharing the destination may update the
+catalog at the same time, so an update is verified by reading the catalog
+again, and the pending record is only removed after that.
+*/
+
+const (
+	CATALOG_FILE              = "catalog" + CFG_SUFFIX
+	CATALOG_PENDING_DIRECTORY = "catalog-pending"
+
+	CATALOG_VERSION = 1
+
+	// Pending records older than this are left by interrupted operations
+	CATALOG_PENDING_TIMEOUT = 10 * time.Minute
+	// Attempts of an update overwritten by other daemons
+	CATALOG_UPDATE_RETRIES = 3
+)
+
+var (
+	// Updates of catalogs are serialized in the daemon
+	catalogLock sync.Mutex
+)
+
+type Catalog struct {
+	Version     int
+	UpdatedTime string
+	Volumes     map[string]*CatalogVolume
+}
+
+type CatalogVolume struct {
+	Name        string
+	Driver      string
+	Size        int64
+	CreatedTime string
+	Backups     map[string]*CatalogBackup
+}
+
+type CatalogBackup struct {
+	Name              string
+	SnapshotName      string
+	SnapshotCreatedAt string
+	CreatedTime       string
+	Labels            map[string]string `json:",omitempty"`
+	Description       string            `json:",omitempty"`
+}
+
+type catalogPending struct {
+	VolumeName  string
+	BackupName  string
+	CreatedTime string
+}
+
+type CatalogRebuildResult struct {
+	DestURL string
+	Volumes int
+	Backups int
+}
+
+func getCatalogFilePath() string {
+	return filepath.Join(OBJECTSTORE_BASE, CATALOG_FILE)
+}
+
+func getCatalogPendingPath() string {
+	return filepath.Join(OBJECTSTORE_BASE, CATALOG_PENDING_DIRECTORY)
+}
+
+func getCatalogPendingFilePath(volumeName, backupName string) string {
+	return filepath.Join(getCatalogPendingPath(), volumeName+"_"+backupName+CFG_SUFFIX)
+}
+
+func getCatalogPendingFiles(driver ObjectStoreDriver) []string {
+	fileList, err := driver.List(getCatalogPendingPath())
+	if err != nil {
+		// Directory doesn't exist
+		return []string{}
+	}
+	files := []string{}
+	for _, f := range fileList {
+		if strings.HasSuffix(f, CFG_SUFFIX) {
+			files = append(files, filepath.Join(getCatalogPendingPath(), f))
+		}
+	}
+	return files
+}
+
+func newCatalog() *Catalog {
+	return &Catalog{
+		Version: CATALOG_VERSION,
+		Volumes: make(map[string]*CatalogVolume),
+	}
+}
+
+/*
+loadCatalog returns the catalog of the destination, or nil if it's missing or
+may be stale, in which case the volume directories need to be walked instead.
+*/
+func loadCatalog(driver ObjectStoreDriver) *Catalog {
+	if !driver.FileExists(getCatalogFilePath()) {
+		return nil
+	}
+	if len(getCatalogPendingFiles(driver)) != 0 {
+		log.Debugf("Catalog of %v has pending updates, ignore it", driver.GetURL())
+		return nil
+	}
+	catalog := &Catalog{}
+	if err := loadConfigInObjectStore(getCatalogFilePath(), driver, catalog); err != nil {
+		log.Warnf("Failed to load catalog of %v, ignore it: %v", driver.GetURL(), err)
+		return nil
+	}
+	if catalog.Version != CATALOG_VERSION || catalog.Volumes == nil {
+		log.Warnf("Unsupported version %v of catalog of %v, ignore it", catalog.Version, driver.GetURL())
+		return nil
+	}
+	return catalog
+}
+
+func saveCatalog(catalog *Catalog, driver ObjectStoreDriver) error {
+	catalog.UpdatedTime = util.Now()
+	return saveConfigInObjectStore(getCatalogFilePath(), driver, catalog)
+}
+
+func (c *Catalog) setBackup(volume *Volume, backup *Backup) {
+	v := c.Volumes[volume.Name]
+	if v == nil {
+		v = &CatalogVolume{
+			Backups: make(map[string]*CatalogBackup),
+		}
+		c.Volumes[volume.Name] = v
+	}
+	v.Name = volume.Name
+	v.Driver = volume.Driver
+	v.Size = volume.Size
+	v.CreatedTime = volume.CreatedTime
+	v.Backups[backup.Name] = &CatalogBackup{
+		Name:              backup.Name,
+		SnapshotName:      backup.SnapshotName,
+		SnapshotCreatedAt: backup.SnapshotCreatedAt,
+		CreatedTime:       backup.CreatedTime,
+		Labels:            backup.Labels,
+		Description:       backup.Description,
+	}
+}
+
+func (c *Catalog) hasBackup(volumeName, backupName string) bool {
+	v := c.Volumes[volumeName]
+	return v != nil && v.Backups[backupName] != nil
+}
+
+func (c *Catalog) removeBackup(volumeName, backupName string) {
+	v := c.Volumes[volumeName]
+	if v == nil {
+		return
+	}
+	delete(v.Backups, backupName)
+	// Volume would be removed from objectstore with the last backup
+	if len(v.Backups) == 0 {
+		delete(c.Volumes, volumeName)
+	}
+}
+
+// getBackupInfo returns the same info as fillBackupInfo, or nil if not found
+func (c *Catalog) getBackupInfo(volumeName, backupName, destURL string) map[string]string {
+	v := c.Volumes[volumeName]
+	if v == nil || v.Backups[backupName] == nil {
+		return nil
+	}
+	b := v.Backups[backupName]
+	volume := &Volume{
+		Name:        v.Name,
+		Driver:      v.Driver,
+		Size:        v.Size,
+		CreatedTime: v.CreatedTime,
+	}
+	backup := &Backup{
+		Name:              b.Name,
+		VolumeName:        v.Name,
+		SnapshotName:      b.SnapshotName,
+		SnapshotCreatedAt: b.SnapshotCreatedAt,
+		CreatedTime:       b.CreatedTime,
+		Labels:            b.Labels,
+		Description:       b.Description,
+	}
+	return fillBackupInfo(backup, volume, destURL)
+}
+
+// buildCatalog walks through all the volumes of the destination
+func buildCatalog(driver ObjectStoreDriver) (*Catalog, error) {
+	catalog := newCatalog()
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	for _, volumeName := range volumeNames {
+		backupNames, err := getBackupNamesForVolume(volumeName, driver)
+		if err != nil {
+			return nil, err
+		}
+		if len(backupNames) == 0 {
+			continue
+		}
+		volume, err := loadVolume(volumeName, driver)
+		if err != nil {
+			return nil, err
+		}
+		for _, backupName := range backupNames {
+			backup, err := loadBackup(backupName, volumeName, driver)
+			if err != nil {
+				return nil, err
+			}
+			catalog.setBackup(volume, backup)
+		}
+	}
+	return catalog, nil
+}
+
+// beginCatalogUpdate must be called before the backup is saved or removed
+func beginCatalogUpdate(volumeName, backupName string, driver ObjectStoreDriver) error {
+	pending := &catalogPending{
+		VolumeName:  volumeName,
+		BackupName:  backupName,
+		CreatedTime: util.Now(),
+	}
+	return saveConfigInObjectStore(getCatalogPendingFilePath(volumeName, backupName), driver, pending)
+}
+
+/*
+finishCatalogUpdate updates the catalog with the backup in objectstore, no
+matter whether it was saved or removed successfully. The operation on the
+backup is already done, so failures would only be logged, and the pending
+record would be kept to prevent the catalog being used.
+*/
+func finishCatalogUpdate(volumeName, backupName string, driver ObjectStoreDriver) {
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+
+	if err := updateCatalog(volumeName, backupName, driver); err != nil {
+		log.Warnf("Failed to update catalog of %v for backup %v of volume %v, rebuild it later: %v",
+			driver.GetURL(), backupName, volumeName, err)
+		return
+	}
+	if err := driver.Remove(getCatalogPendingFilePath(volumeName, backupName)); err != nil {
+		log.Warnf("Failed to remove pending record of catalog of %v: %v", driver.GetURL(), err)
+	}
+}
+
+/*
+updateCatalog updates the catalog with the backup. Objectstores provide no
+conditional write, so the catalog is read again after lockSettleTime, and the
+update is retried if it was overwritten by another daemon updating the catalog
+at the same time. It fails if the update is still missing after
+CATALOG_UPDATE_RETRIES attempts.
+*/
+func updateCatalog(volumeName, backupName string, driver ObjectStoreDriver) error {
+	for attempt := 1; ; attempt++ {
+		exists, err := applyCatalogUpdate(volumeName, backupName, driver)
+		if err != nil {
+			return err
+		}
+		time.Sleep(lockSettleTime)
+		updated, err := catalogHasUpdate(volumeName, backupName, exists, driver)
+		if err != nil {
+			return err
+		}
+		if updated {
+			return nil
+		}
+		if attempt == CATALOG_UPDATE_RETRIES {
+			return fmt.Errorf("Catalog was overwritten by others %v times", attempt)
+		}
+		log.Debugf("Catalog of %v was overwritten by others, retry updating backup %v of volume %v",
+			driver.GetURL(), backupName, volumeName)
+	}
+}
+
+// applyCatalogUpdate saves the catalog with the backup, and returns whether the backup exists
+func applyCatalogUpdate(volumeName, backupName string, driver ObjectStoreDriver) (bool, error) {
+	exists := backupExists(backupName, volumeName, driver)
+	if !driver.FileExists(getCatalogFilePath()) || hasStaleCatalogPending(volumeName, backupName, driver) {
+		log.Infof("Building catalog of %v", driver.GetURL())
+		catalog, err := rebuildCatalog(driver, false)
+		if err != nil {
+			return false, err
+		}
+		return catalog.hasBackup(volumeName, backupName), nil
+	}
+	catalog := &Catalog{}
+	if err := loadConfigInObjectStore(getCatalogFilePath(), driver, catalog); err != nil {
+		return false, err
+	}
+	if catalog.Version != CATALOG_VERSION || catalog.Volumes == nil {
+		catalog, err := rebuildCatalog(driver, false)
+		if err != nil {
+			return false, err
+		}
+		return catalog.hasBackup(volumeName, backupName), nil
+	}
+	if exists {
+		volume, err := loadVolume(volumeName, driver)
+		if err != nil {
+			return false, err
+		}
+		backup, err := loadBackup(backupName, volumeName, driver)
+		if err != nil {
+			return false, err
+		}
+		catalog.setBackup(volume, backup)
+	} else {
+		catalog.removeBackup(volumeName, backupName)
+	}
+	return exists, saveCatalog(catalog, driver)
+}
+
+// catalogHasUpdate returns whether the saved catalog has the backup as expected
+func catalogHasUpdate(volumeName, backupName string, exists bool, driver ObjectStoreDriver) (bool, error) {
+	if !driver.FileExists(getCatalogFilePath()) {
+		return false, nil
+	}
+	catalog := &Catalog{}
+	if err := loadConfigInObjectStore(getCatalogFilePath(), driver, catalog); err != nil {
+		return false, err
+	}
+	return catalog.hasBackup(volumeName, backupName) == exists, nil
+}
+
+// hasStaleCatalogPending returns true if other operations left pending records
+func hasStaleCatalogPending(volumeName, backupName string, driver ObjectStoreDriver) bool {
+	for _, file := range getCatalogPendingFiles(driver) {
+		if file != getCatalogPendingFilePath(volumeName, backupName) && isStaleCatalogPending(file, driver) {
+			return true
+		}
+	}
+	return false
+}
+
+func isStaleCatalogPending(file string, driver ObjectStoreDriver) bool {
+	pending := &catalogPending{}
+	if err := loadConfigInObjectStore(file, driver, pending); err != nil {
+		return true
+	}
+	createdTime, err := time.Parse(time.RubyDate, pending.CreatedTime)
+	return err != nil || time.Since(createdTime) > CATALOG_PENDING_TIMEOUT
+}
+
+/*
+rebuildCatalog builds the catalog, and removes the pending records existed
+before. The ones of operations may be still running would be kept unless
+removeAll is true.
+*/
+func rebuildCatalog(driver ObjectStoreDriver, removeAll bool) (*Catalog, error) {
+	pendingFiles := []string{}
+	for _, file := range getCatalogPendingFiles(driver) {
+		if removeAll || isStaleCatalogPending(file, driver) {
+			pendingFiles = append(pendingFiles, file)
+		}
+	}
+	catalog, err := buildCatalog(driver)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCatalog(catalog, driver); err != nil {
+		return nil, err
+	}
+	if len(pendingFiles) != 0 {
+		if err := driver.Remove(pendingFiles...); err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
+
+/*
+RebuildCatalog builds the catalog of destURL from the backups in it, for the
+catalog missing or stale, e.g. after backups were created by an older version
+of Convoy. It should not be run when backups are being created or deleted in
+the same destURL.
+*/
+func RebuildCatalog(destURL, endpointURL string) (*CatalogRebuildResult, error) {
+	driver, err := getWritableObjectStoreDriver(destURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+
+	catalog, err := rebuildCatalog(driver, true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to rebuild catalog of %v: %v", driver.GetURL(), err)
+	}
+	result := &CatalogRebuildResult{
+		DestURL: driver.GetURL(),
+		Volumes: len(catalog.Volumes),
+	}
+	for _, v := range catalog.Volumes {
+		result.Backups += len(v.Backups)
+	}
+	return result, nil
+}
@@ -0,0 +1,169 @@
+package objectstore
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func loadCatalogFile(c *check.C, d *memDriver) *Catalog {
+	catalog := &Catalog{}
+	c.Assert(loadConfigInObjectStore(getCatalogFilePath(), d, catalog), check.IsNil)
+	return catalog
+}
+
+func (s *TestSuite) TestCatalog(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	ops.snapshots["snap2"] = generateImage(2)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL1, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1", Description: "first"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	c.Assert(ioutil.WriteFile(srcFile, []byte("single file backup content"), 0600), check.IsNil)
+	_, err = CreateSingleFileBackup(&Volume{Name: "vol2", Driver: "vfs"}, &Snapshot{Name: "snap1"}, srcFile, d.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	catalog := loadCatalogFile(c, d)
+	c.Assert(catalog.Volumes, check.HasLen, 2)
+	c.Assert(catalog.Volumes["vol1"].Backups, check.HasLen, 2)
+	c.Assert(catalog.Volumes["vol1"].Size, check.Equals, volume.Size)
+	c.Assert(catalog.Volumes["vol2"].Driver, check.Equals, "vfs")
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 0)
+
+	// Listing by catalog gives the same result as walking through volumes
+	infos, err := List("", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 2)
+	info, err := GetBackupInfo(backupURL1, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos[backupURL1], check.DeepEquals, info)
+	c.Assert(info["Description"], check.Equals, "first")
+	catalogInfos := infos
+	c.Assert(d.Remove(getCatalogFilePath()), check.IsNil)
+	infos, err = List("", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.DeepEquals, catalogInfos)
+	infos, err = List("vol2", d.GetURL(), "", "vfs")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 1)
+
+	// Deleting a backup builds the missing catalog
+	c.Assert(DeleteDeltaBlockBackup(backupURL1, ""), check.IsNil)
+	catalog = loadCatalogFile(c, d)
+	c.Assert(catalog.Volumes["vol1"].Backups, check.HasLen, 1)
+	infos, err = List("vol1", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 1)
+	c.Assert(infos[backupURL2], check.NotNil)
+
+	// Catalog with pending update is not used
+	catalog.Volumes["vol1"].Backups["stale"] = &CatalogBackup{Name: "stale"}
+	c.Assert(saveCatalog(catalog, d), check.IsNil)
+	infos, err = List("vol1", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 2)
+	c.Assert(beginCatalogUpdate("vol1", "other", d), check.IsNil)
+	infos, err = List("vol1", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 1)
+	finishCatalogUpdate("vol1", "other", d)
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 0)
+
+	c.Assert(DeleteDeltaBlockBackup(backupURL2, ""), check.IsNil)
+	catalog = loadCatalogFile(c, d)
+	c.Assert(catalog.Volumes["vol1"].Backups, check.HasLen, 1)
+	c.Assert(catalog.Volumes["vol1"].Backups["stale"], check.NotNil)
+	c.Assert(catalog.Volumes["vol2"], check.NotNil)
+}
+
+func (s *TestSuite) TestRebuildCatalog(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	// Left by an interrupted backup
+	c.Assert(saveConfigInObjectStore(getCatalogPendingFilePath("vol1", "interrupted"), d, &catalogPending{
+		VolumeName:  "vol1",
+		BackupName:  "interrupted",
+		CreatedTime: time.Now().Add(-CATALOG_PENDING_TIMEOUT * 2).Format(time.RubyDate),
+	}), check.IsNil)
+	c.Assert(d.Remove(getCatalogFilePath()), check.IsNil)
+	result, err := RebuildCatalog(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Volumes, check.Equals, 1)
+	c.Assert(result.Backups, check.Equals, 1)
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 0)
+	c.Assert(loadCatalog(d), check.NotNil)
+
+	// Stale pending records are cleaned up by rebuilding on the next update
+	c.Assert(saveConfigInObjectStore(getCatalogPendingFilePath("vol1", "interrupted"), d, &catalogPending{
+		VolumeName:  "vol1",
+		BackupName:  "interrupted",
+		CreatedTime: time.Now().Add(-CATALOG_PENDING_TIMEOUT * 2).Format(time.RubyDate),
+	}), check.IsNil)
+	c.Assert(loadCatalog(d), check.IsNil)
+	_, err = CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 0)
+	catalog := loadCatalog(d)
+	c.Assert(catalog, check.NotNil)
+	c.Assert(catalog.Volumes["vol1"].Backups, check.HasLen, 2)
+
+	_, err = RebuildCatalog("memro:///"+c.TestName(), "")
+	c.Assert(err, check.ErrorMatches, ".*read-only")
+}
+
+func (s *TestSuite) TestConcurrentCatalogUpdate(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	// Another daemon saves the catalog loaded before the update
+	stale := d.files[getCatalogFilePath()]
+	overwrites := 0
+	d.writeHook = func(path string) {
+		if filepath.Clean(path) == getCatalogFilePath() && overwrites > 0 {
+			overwrites--
+			d.lock.Lock()
+			d.files[getCatalogFilePath()] = stale
+			d.lock.Unlock()
+		}
+	}
+	defer func() { d.writeHook = nil }()
+
+	overwrites = 1
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(overwrites, check.Equals, 0)
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 0)
+	catalog := loadCatalog(d)
+	c.Assert(catalog, check.NotNil)
+	c.Assert(catalog.Volumes["vol1"].Backups, check.HasLen, 2)
+
+	// The pending record is kept if the update keeps being overwritten
+	stale = d.files[getCatalogFilePath()]
+	overwrites = CATALOG_UPDATE_RETRIES
+	backupURL3, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(overwrites, check.Equals, 0)
+	c.Assert(getCatalogPendingFiles(d), check.HasLen, 1)
+	c.Assert(loadCatalog(d), check.IsNil)
+	infos, err := List("vol1", d.GetURL(), "", "devicemapper")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 3)
+	c.Assert(infos[backupURL2], check.NotNil)
+	c.Assert(infos[backupURL3], check.NotNil)
+}
@@ -0,0 +1,166 @@
+package objectstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	OBJECTSTORE_BLOCK_SIZE  = "objectstore.blocksize"
+	OBJECTSTORE_COMPRESSION = "objectstore.compression"
+
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_LZ4  = "lz4"
+	COMPRESSION_ZSTD = "zstd"
+
+	DEFAULT_COMPRESSION = COMPRESSION_GZIP
+
+	MIN_BLOCK_SIZE       = 4096
+	MAX_BLOCK_SIZE       = 67108864
+	BLOCK_SIZE_ALIGNMENT = 4096
+)
+
+type compressionCodec struct {
+	compress func(data []byte) ([]byte, error)
+	// decompress returns at most maxSize bytes, to protect from corrupted data
+	decompress func(src io.Reader, maxSize int64) ([]byte, error)
+}
+
+var (
+	blockSize         int64 = DEFAULT_BLOCK_SIZE
+	compressionMethod       = DEFAULT_COMPRESSION
+
+	codecs = map[string]*compressionCodec{
+		COMPRESSION_NONE: {
+			compress:   func(data []byte) ([]byte, error) { return data, nil },
+			decompress: readLimited,
+		},
+		COMPRESSION_GZIP: {
+			compress:   gzipCompress,
+			decompress: gzipDecompress,
+		},
+		COMPRESSION_LZ4: {
+			compress:   lz4Compress,
+			decompress: lz4Decompress,
+		},
+		COMPRESSION_ZSTD: {
+			compress:   zstdCompress,
+			decompress: zstdDecompress,
+		},
+	}
+
+	// zstdEncoder is safe for concurrent EncodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+func initBlockSize(size string) error {
+	blockSize = DEFAULT_BLOCK_SIZE
+	if size == "" {
+		return nil
+	}
+	value, err := util.ParseSize(size)
+	if err != nil || value < MIN_BLOCK_SIZE || value > MAX_BLOCK_SIZE || value%BLOCK_SIZE_ALIGNMENT != 0 {
+		return fmt.Errorf("Invalid value %v for %v, must be multiples of %v between %v and %v",
+			size, OBJECTSTORE_BLOCK_SIZE, BLOCK_SIZE_ALIGNMENT, MIN_BLOCK_SIZE, MAX_BLOCK_SIZE)
+	}
+	blockSize = value
+	return nil
+}
+
+func initCompression(method string) error {
+	compressionMethod = DEFAULT_COMPRESSION
+	if method == "" {
+		return nil
+	}
+	if _, err := getCodec(method); err != nil {
+		return fmt.Errorf("Invalid value %v for %v: %v", method, OBJECTSTORE_COMPRESSION, err)
+	}
+	compressionMethod = method
+	return nil
+}
+
+// getCodec returns the codec of method, empty method means gzip used by older versions
+func getCodec(method string) (*compressionCodec, error) {
+	if method == "" {
+		method = COMPRESSION_GZIP
+	}
+	codec, exists := codecs[method]
+	if !exists {
+		return nil, fmt.Errorf("Unknown compression method %v", method)
+	}
+	return codec, nil
+}
+
+func readLimited(src io.Reader, maxSize int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("Decompressed data exceeds block size %v", maxSize)
+	}
+	return data, nil
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func gzipDecompress(src io.Reader, maxSize int64) ([]byte, error) {
+	r, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// lz4Compress encodes data as a standard LZ4 frame
+func lz4Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := lz4.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func lz4Decompress(src io.Reader, maxSize int64) ([]byte, error) {
+	return readLimited(lz4.NewReader(src), maxSize)
+}
+
+// zstdCompress encodes data as a standard zstd frame
+func zstdCompress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func zstdDecompress(src io.Reader, maxSize int64) ([]byte, error) {
+	// Frames claiming a window larger than any block are refused
+	r, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MAX_BLOCK_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
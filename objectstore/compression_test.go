@@ -0,0 +1,162 @@
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/rancher/convoy/metadata"
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCompressionCodecs(c *check.C) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	repeated := bytes.Repeat([]byte("convoy block "), 10000)
+	mixed := append(append([]byte{}, random[:3000]...), make([]byte, 70000)...)
+	mixed = append(mixed, repeated[:5000]...)
+
+	for _, method := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_LZ4, COMPRESSION_ZSTD} {
+		codec, err := getCodec(method)
+		c.Assert(err, check.IsNil)
+		for _, data := range [][]byte{{}, []byte("short"), random, repeated, mixed} {
+			compressed, err := codec.compress(data)
+			c.Assert(err, check.IsNil)
+			decompressed, err := codec.decompress(bytes.NewReader(compressed), int64(len(data)))
+			c.Assert(err, check.IsNil, check.Commentf("method %v", method))
+			c.Assert(bytes.Equal(decompressed, data), check.Equals, true, check.Commentf("method %v", method))
+		}
+
+		compressed, err := codec.compress(repeated)
+		c.Assert(err, check.IsNil)
+		if method != COMPRESSION_NONE {
+			c.Assert(len(compressed) < len(repeated)/10, check.Equals, true)
+		}
+		_, err = codec.decompress(bytes.NewReader(compressed), int64(len(repeated)-1))
+		c.Assert(err, check.NotNil)
+	}
+
+	codec, err := getCodec("")
+	c.Assert(err, check.IsNil)
+	c.Assert(codec, check.Equals, codecs[COMPRESSION_GZIP])
+	_, err = getCodec("bzip2")
+	c.Assert(err, check.ErrorMatches, "Unknown compression method bzip2")
+}
+
+func (s *TestSuite) TestCompressionCorruptedData(c *check.C) {
+	data := bytes.Repeat([]byte("abcdefgh"), 1000)
+	for _, method := range []string{COMPRESSION_GZIP, COMPRESSION_LZ4, COMPRESSION_ZSTD} {
+		codec, err := getCodec(method)
+		c.Assert(err, check.IsNil)
+		compressed, err := codec.compress(data)
+		c.Assert(err, check.IsNil)
+
+		flipped := append([]byte{}, compressed...)
+		flipped[len(flipped)/2] ^= 0xff
+		for _, corrupted := range [][]byte{compressed[:len(compressed)-3], flipped} {
+			_, err := codec.decompress(bytes.NewReader(corrupted), int64(len(data)))
+			c.Assert(err, check.NotNil, check.Commentf("method %v", method))
+		}
+	}
+}
+
+func (s *TestSuite) TestCompressionStandardFrames(c *check.C) {
+	data := bytes.Repeat([]byte("convoy block "), 1000)
+
+	compressed, err := lz4Compress(data)
+	c.Assert(err, check.IsNil)
+	decompressed, err := ioutil.ReadAll(lz4.NewReader(bytes.NewReader(compressed)))
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(decompressed, data), check.Equals, true)
+
+	compressed, err = zstdCompress(data)
+	c.Assert(err, check.IsNil)
+	r, err := zstd.NewReader(bytes.NewReader(compressed))
+	c.Assert(err, check.IsNil)
+	defer r.Close()
+	decompressed, err = ioutil.ReadAll(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(decompressed, data), check.Equals, true)
+}
+
+func (s *TestSuite) TestInitBlockSizeAndCompression(c *check.C) {
+	c.Assert(initBlockSize("64k"), check.IsNil)
+	c.Assert(blockSize, check.Equals, int64(65536))
+	c.Assert(initBlockSize(""), check.IsNil)
+	c.Assert(blockSize, check.Equals, int64(DEFAULT_BLOCK_SIZE))
+	for _, size := range []string{"abc", "1000", "0", "128m"} {
+		c.Assert(initBlockSize(size), check.ErrorMatches, "Invalid value .* for objectstore.blocksize.*")
+	}
+
+	c.Assert(initCompression(COMPRESSION_LZ4), check.IsNil)
+	c.Assert(compressionMethod, check.Equals, COMPRESSION_LZ4)
+	c.Assert(initCompression(COMPRESSION_ZSTD), check.IsNil)
+	c.Assert(compressionMethod, check.Equals, COMPRESSION_ZSTD)
+	c.Assert(initCompression("bzip2"), check.NotNil)
+}
+
+func (s *TestSuite) TestGetBackupBlockOffsets(c *check.C) {
+	mappings := []metadata.Mapping{
+		{Offset: 0, Size: 4096},
+		{Offset: 8192, Size: 4096},
+		{Offset: 65536, Size: 131072},
+		{Offset: 327680, Size: 65536},
+	}
+	// Multiple driver chunks fall into the same backup block
+	c.Assert(getBackupBlockOffsets(mappings, 65536, 0), check.DeepEquals, []int64{0, 65536, 131072, 327680})
+	c.Assert(getBackupBlockOffsets(mappings, 262144, 0), check.DeepEquals, []int64{0, 262144})
+	// Blocks beyond the volume are skipped
+	c.Assert(getBackupBlockOffsets(mappings, 65536, 131072), check.DeepEquals, []int64{0, 65536})
+}
+
+func (s *TestSuite) TestDeltaBlockBackupBlockSizeAndCompression(c *check.C) {
+	c.Assert(initBlockSize("64k"), check.IsNil)
+	c.Assert(initCompression(COMPRESSION_LZ4), check.IsNil)
+
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	// Volume size is not multiples of block size
+	image := append(generateImage(2), []byte("the tail")...)
+	ops.snapshots["snap1"] = image
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	// Changing the options won't affect the existed volume
+	c.Assert(initBlockSize(""), check.IsNil)
+	c.Assert(initCompression(""), check.IsNil)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.BlockSize, check.Equals, int64(65536))
+	c.Assert(backup.CompressionMethod, check.Equals, COMPRESSION_LZ4)
+	c.Assert(backup.Blocks, check.HasLen, 2*DEFAULT_BLOCK_SIZE/65536+1)
+
+	ops.snapshots["snap2"] = image
+	ops.blockSize = 4096
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	backupName, volumeName, err = decodeBackupURL(backupURL2)
+	c.Assert(err, check.IsNil)
+	backup, err = loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.BlockSize, check.Equals, int64(65536))
+
+	for _, url := range []string{backupURL, backupURL2} {
+		restored := filepath.Join(c.MkDir(), "restored.img")
+		c.Assert(RestoreDeltaBlockBackup(url, "", restored, nil), check.IsNil)
+		data, err := ioutil.ReadFile(restored)
+		c.Assert(err, check.IsNil)
+		c.Assert(bytes.Equal(data, image), check.Equals, true)
+
+		result, err := VerifyBackup(url, "")
+		c.Assert(err, check.IsNil)
+		c.Assert(result.Intact, check.Equals, true)
+	}
+}
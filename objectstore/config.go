@@ -1,10 +1,10 @@
 package objectstore
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/util"
@@ -25,6 +25,21 @@ const (
 	CFG_SUFFIX = ".cfg"
 )
 
+// NotFoundError is returned if the config of a volume or backup doesn't exist in objectstore
+type NotFoundError struct {
+	FilePath string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("cannot find %v in objectstore", e.FilePath)
+}
+
+// IsNotFound returns true if err means the volume or backup doesn't exist in objectstore
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
 func getBackupConfigName(id string) string {
 	return BACKUP_CONFIG_PREFIX + id + CFG_SUFFIX
 }
@@ -32,7 +47,7 @@ func getBackupConfigName(id string) string {
 func loadConfigInObjectStore(filePath string, driver ObjectStoreDriver, v interface{}) error {
 	size := driver.FileSize(filePath)
 	if size < 0 {
-		return fmt.Errorf("cannot find %v in objectstore", filePath)
+		return &NotFoundError{FilePath: filePath}
 	}
 	rc, err := driver.Read(filePath)
 	if err != nil {
@@ -46,7 +61,13 @@ func loadConfigInObjectStore(filePath string, driver ObjectStoreDriver, v interf
 		LOG_FIELD_KIND:     driver.Kind(),
 		LOG_FIELD_FILEPATH: filePath,
 	}).Debug()
-	if err := json.NewDecoder(rc).Decode(v); err != nil {
+	r, err := openData(rc, driver, plainAllowed(nil))
+	if err != nil {
+		return generateError(logrus.Fields{
+			LOG_FIELD_FILEPATH: filePath,
+		}, "Cannot load %v from objectstore: %v", filePath, err)
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
 		return err
 	}
 	log.WithFields(logrus.Fields{
@@ -63,13 +84,17 @@ func saveConfigInObjectStore(filePath string, driver ObjectStoreDriver, v interf
 	if err != nil {
 		return err
 	}
+	rs, err := sealData(j, driver)
+	if err != nil {
+		return err
+	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_START,
 		LOG_FIELD_OBJECT:   LOG_OBJECT_CONFIG,
 		LOG_FIELD_KIND:     driver.Kind(),
 		LOG_FIELD_FILEPATH: filePath,
 	}).Debug()
-	if err := driver.Write(filePath, bytes.NewReader(j)); err != nil {
+	if err := driver.Write(filePath, rs); err != nil {
 		return err
 	}
 	log.WithFields(logrus.Fields{
@@ -154,7 +179,14 @@ func getBackupNamesForVolume(volumeName string, driver ObjectStoreDriver) ([]str
 		// path doesn't exist
 		return result, nil
 	}
-	return util.ExtractNames(fileList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX)
+	// Skip in-progress and temporary files
+	cfgList := []string{}
+	for _, f := range fileList {
+		if strings.HasSuffix(f, CFG_SUFFIX) {
+			cfgList = append(cfgList, f)
+		}
+	}
+	return util.ExtractNames(cfgList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX)
 }
 
 func getBackupPath(volumeName string) string {
@@ -182,11 +214,10 @@ func loadBackup(backupName, volumeName string, bsDriver ObjectStoreDriver) (*Bac
 func saveBackup(backup *Backup, bsDriver ObjectStoreDriver) error {
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
 	if bsDriver.FileExists(filePath) {
-		log.Warnf("Snapshot configuration file %v already exists, would remove it\n", filePath)
-		if err := bsDriver.Remove(filePath); err != nil {
-			return err
-		}
+		log.Warnf("Snapshot configuration file %v already exists, would overwrite it\n", filePath)
 	}
+	// Driver would replace the file atomically, so a backup is either
+	// complete or absent
 	if err := saveConfigInObjectStore(filePath, bsDriver, backup); err != nil {
 		return err
 	}
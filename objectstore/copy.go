@@ -0,0 +1,340 @@
+package objectstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+A backup can be copied to another destination as it is, so the copy can be
+restored, listed or deleted there the same way as the original one. Blocks
+and backup files are copied without being decoded, which means both
+destinations must be accessed with the same encryption key. Only the blocks
+missing in the destination would be copied.
+*/
+
+const (
+	OBJECTSTORE_MIRRORS = "objectstore.mirrors"
+)
+
+var (
+	mirrorURLs = []string{}
+)
+
+type BackupCopyResult struct {
+	BackupURL      string
+	CopiedBlocks   int
+	ExistingBlocks int
+}
+
+func initMirrors(value string) error {
+	mirrorURLs = []string{}
+	if value == "" {
+		return nil
+	}
+	for _, mirror := range strings.Split(value, ",") {
+		mirror = strings.TrimSpace(mirror)
+		if !strings.Contains(mirror, "://") && util.ValidateName(mirror) {
+			// Name of target, resolved by the daemon
+			mirrorURLs = append(mirrorURLs, mirror)
+			continue
+		}
+		u, err := url.Parse(mirror)
+		if err != nil || initializers[u.Scheme] == nil || driverCapabilities[u.Scheme].ReadOnly {
+			return fmt.Errorf("Invalid value %v for %v, must be comma separated writable objectstore URLs or target names", value, OBJECTSTORE_MIRRORS)
+		}
+		mirrorURLs = append(mirrorURLs, mirror)
+	}
+	return nil
+}
+
+// GetMirrorURLs returns the destinations every new backup should be copied to, either URLs or names of targets
+func GetMirrorURLs() []string {
+	return mirrorURLs
+}
+
+func normalizeCompressionMethod(method string) string {
+	if method == "" {
+		return COMPRESSION_GZIP
+	}
+	return method
+}
+
+// checkCopyVolume makes sure blocks of srcVolume can be used by dstVolume as they are
+func checkCopyVolume(srcVolume, dstVolume *Volume) error {
+	if srcVolume.Driver != dstVolume.Driver {
+		return fmt.Errorf("Volume %v in destination was created by driver %v, cannot copy backups of driver %v to it",
+			dstVolume.Name, dstVolume.Driver, srcVolume.Driver)
+	}
+	if srcVolume.Encrypted != dstVolume.Encrypted {
+		return fmt.Errorf("Volume %v in destination doesn't match the encryption of the source", dstVolume.Name)
+	}
+	if srcVolume.getBlockSize() != dstVolume.getBlockSize() ||
+		normalizeCompressionMethod(srcVolume.CompressionMethod) != normalizeCompressionMethod(dstVolume.CompressionMethod) {
+		return fmt.Errorf("Volume %v in destination uses different block size or compression method from the source", dstVolume.Name)
+	}
+	return nil
+}
+
+/*
+addCopyVolume creates the volume in destination with the same format of
+blocks as srcVolume, or loads the existing one.
+*/
+func addCopyVolume(srcVolume *Volume, driver ObjectStoreDriver) (*Volume, error) {
+	if volumeExists(srcVolume.Name, driver) {
+		volume, err := loadVolume(srcVolume.Name, driver)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCopyVolume(srcVolume, volume); err != nil {
+			return nil, err
+		}
+		return volume, nil
+	}
+
+	volume := &Volume{
+		Name:              srcVolume.Name,
+		Driver:            srcVolume.Driver,
+		Size:              srcVolume.Size,
+		CreatedTime:       srcVolume.CreatedTime,
+		Encrypted:         srcVolume.Encrypted,
+		BlockSize:         srcVolume.BlockSize,
+		CompressionMethod: srcVolume.CompressionMethod,
+	}
+	if sharedBlocks {
+		pool, err := getBlockPoolName(volume.CompressionMethod, driver)
+		if err != nil {
+			return nil, err
+		}
+		volume.BlockPool = pool
+	}
+	if err := saveVolume(volume, driver); err != nil {
+		return nil, err
+	}
+	if volume.BlockPool != "" {
+		if err := addBlockPoolRefs(volume, nil, driver); err != nil {
+			return nil, err
+		}
+	}
+	log.Debug("Added objectstore volume ", volume.Name)
+	return volume, nil
+}
+
+/*
+CopyBackup copies the backup to destURL, keeping the names of the volume and
+the backup. If it's the latest backup of the volume in the source, it would
+become the last backup of the volume in destURL as well, so the next
+incremental backup can be created directly in destURL. Copying a backup
+already exists in destURL does nothing. progress can be nil.
+*/
+func CopyBackup(backupURL, endpointURL, destURL, destEndpointURL string, progress *Progress) (*BackupCopyResult, error) {
+	srcDriver, err := GetObjectStoreDriver(backupURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	srcDriver = throttleDriver(srcDriver, progress)
+	dstDriver, err := getWritableObjectStoreDriver(destURL, destEndpointURL)
+	if err != nil {
+		return nil, err
+	}
+	if srcDriver.GetURL() == dstDriver.GetURL() {
+		return nil, fmt.Errorf("Cannot copy backup %v to the same destination", backupURL)
+	}
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	srcVolume, err := loadVolume(volumeName, srcDriver)
+	if err != nil {
+		return nil, generateError(logrus.Fields{
+			LOG_FIELD_VOLUME:     volumeName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}, "Volume doesn't exist in objectstore: %v", err)
+	}
+	if err := checkVolumeEncryption(srcVolume); err != nil {
+		return nil, err
+	}
+	if srcVolume.Encrypted {
+		config, err := loadEncryptionConfig(srcDriver)
+		if err != nil {
+			return nil, err
+		}
+		if err := inheritEncryptionConfig(config, dstDriver); err != nil {
+			return nil, err
+		}
+	}
+	backup, err := loadBackup(backupName, volumeName, srcDriver)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockVolume(volumeName, "copy", dstDriver)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	result := &BackupCopyResult{
+		BackupURL: encodeBackupURL(backup.Name, backup.VolumeName, destURL),
+	}
+	if backupExists(backup.Name, backup.VolumeName, dstDriver) {
+		log.Debugf("Backup %v already exists in %v", backup.Name, dstDriver.GetURL())
+		return result, nil
+	}
+	dstVolume, err := addCopyVolume(srcVolume, dstDriver)
+	if err != nil {
+		return nil, err
+	}
+	poolLock, err := lockBlockPool(dstVolume.BlockPool, false, "copy", dstDriver)
+	if err != nil {
+		return nil, err
+	}
+	defer poolLock.unlock()
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_DEST_URL:   dstDriver.GetURL(),
+	}).Debug("Copying backup")
+	// Record the references first, so the blocks won't be removed by other
+	// volumes once copied
+	if dstVolume.BlockPool != "" {
+		if err := addBlockPoolRefs(dstVolume, backup.Blocks, dstDriver); err != nil {
+			return nil, err
+		}
+	}
+	if backup.SingleFile.FilePath != "" {
+		err = copySingleFile(backup, srcDriver, dstDriver, progress)
+	} else {
+		err = copyBlocks(srcVolume, dstVolume, backup, srcDriver, dstDriver, progress, result)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lock.check(); err != nil {
+		return nil, err
+	}
+	if err := poolLock.check(); err != nil {
+		return nil, err
+	}
+	if err := saveCopiedBackup(srcVolume, dstVolume, backup, dstDriver); err != nil {
+		return nil, err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_DEST_URL:   dstDriver.GetURL(),
+	}).Debugf("Copied backup, %v blocks copied", result.CopiedBlocks)
+	return result, nil
+}
+
+// saveCopiedBackup saves the backup after its blocks or file have been copied to driver
+func saveCopiedBackup(srcVolume, dstVolume *Volume, backup *Backup, driver ObjectStoreDriver) error {
+	if err := beginCatalogUpdate(dstVolume.Name, backup.Name, driver); err != nil {
+		return err
+	}
+	defer finishCatalogUpdate(dstVolume.Name, backup.Name, driver)
+	if err := saveBackup(backup, driver); err != nil {
+		return err
+	}
+	if srcVolume.LastBackupName == backup.Name || dstVolume.LastBackupName == "" {
+		dstVolume.LastBackupName = backup.Name
+		if err := saveVolume(dstVolume, driver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyBlocks(srcVolume, dstVolume *Volume, backup *Backup, srcDriver, dstDriver ObjectStoreDriver, progress *Progress, result *BackupCopyResult) error {
+	checksums := getBlockChecksums(backup.Blocks)
+
+	blockSize := backup.getBlockSize()
+	progress.setTotal(len(checksums), int64(len(checksums))*blockSize)
+	copied := make([]bool, len(checksums))
+	err := RunParallel(len(checksums), concurrency, func(i int) error {
+		if err := progress.checkCancelled(); err != nil {
+			return err
+		}
+		dst := dstVolume.getBlockFilePath(checksums[i])
+		if dstDriver.FileExists(dst) {
+			progress.addProcessed(1, blockSize)
+			return nil
+		}
+		rc, err := srcDriver.Read(srcVolume.getBlockFilePath(checksums[i]))
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		if err := dstDriver.Write(dst, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		copied[i] = true
+		progress.addProcessed(1, blockSize)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range copied {
+		if c {
+			result.CopiedBlocks++
+		} else {
+			result.ExistingBlocks++
+		}
+	}
+	return nil
+}
+
+// copySingleFile copies the backup file through a temporary local file, since driver needs to seek it
+func copySingleFile(backup *Backup, srcDriver, dstDriver ObjectStoreDriver, progress *Progress) error {
+	filePath := backup.SingleFile.FilePath
+	size := srcDriver.FileSize(filePath)
+	if size < 0 {
+		return fmt.Errorf("Cannot find backup file %v in objectstore", filePath)
+	}
+	progress.setTotal(1, size)
+	if err := progress.checkCancelled(); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(stateDir, "copy_")
+	if err != nil {
+		return err
+	}
+	tmpFile := f.Name()
+	f.Close()
+	defer os.Remove(tmpFile)
+
+	if err := srcDriver.Download(filePath, tmpFile); err != nil {
+		return err
+	}
+	if err := progress.checkCancelled(); err != nil {
+		return err
+	}
+	if err := dstDriver.Upload(tmpFile, filePath); err != nil {
+		return err
+	}
+	progress.addProcessed(1, size)
+	return nil
+}
@@ -0,0 +1,119 @@
+package objectstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func newMirrorMemDriver(c *check.C) *memDriver {
+	destURL := fmt.Sprintf("mem:///%v-mirror", c.TestName())
+	delete(memStores, destURL)
+	d, err := GetObjectStoreDriver(destURL, "")
+	c.Assert(err, check.IsNil)
+	return d.(*memDriver)
+}
+
+func (s *TestSuite) TestCopyDeltaBlockBackup(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	ops := newFakeDeltaOps()
+	image1 := generateImage(4)
+	ops.snapshots["snap1"] = image1
+	image2 := make([]byte, len(image1))
+	copy(image2, image1)
+	copy(image2[DEFAULT_BLOCK_SIZE:], []byte("changed block"))
+	ops.snapshots["snap2"] = image2
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image1))}
+	backupURL1, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	result, err := CopyBackup(backupURL1, "", dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 3)
+	c.Assert(result.ExistingBlocks, check.Equals, 0)
+	checkRestore(c, result.BackupURL, image1)
+
+	// Only the changed block is missing in destination
+	result, err = CopyBackup(backupURL2, "", dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 1)
+	c.Assert(result.ExistingBlocks, check.Equals, 2)
+	checkRestore(c, result.BackupURL, image2)
+
+	backupName2, _, err := decodeBackupURL(backupURL2)
+	c.Assert(err, check.IsNil)
+	dstVolume, err := loadVolume("vol1", dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(dstVolume.LastBackupName, check.Equals, backupName2)
+	c.Assert(dstVolume.Driver, check.Equals, "devicemapper")
+
+	// Copying again changes nothing
+	result, err = CopyBackup(backupURL2, "", dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 0)
+
+	_, err = CopyBackup(backupURL1, "", src.GetURL(), "", nil)
+	c.Assert(err, check.ErrorMatches, ".*to the same destination.*")
+
+	verify, err := VerifyObjectStore(dst.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(verify.Consistent(), check.Equals, true)
+}
+
+func (s *TestSuite) TestCopyBackupMismatchedVolume(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, src.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	compressionMethod = COMPRESSION_LZ4
+	volume = &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err = CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, dst.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = CopyBackup(backupURL, "", dst.GetURL(), "", nil)
+	c.Assert(err, check.ErrorMatches, ".*different block size or compression method.*")
+}
+
+func (s *TestSuite) TestCopySingleFileBackup(c *check.C) {
+	src := newMemDriver(c)
+	dst := newMirrorMemDriver(c)
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	content := []byte("single file backup content")
+	c.Assert(ioutil.WriteFile(srcFile, content, 0600), check.IsNil)
+
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	backupURL, err := CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, src.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	result, err := CopyBackup(backupURL, "", dst.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	var b bytes.Buffer
+	c.Assert(StreamSingleFileBackup(result.BackupURL, "", &b, nil), check.IsNil)
+	c.Assert(b.Bytes(), check.DeepEquals, content)
+}
+
+func (s *TestSuite) TestInitMirrors(c *check.C) {
+	c.Assert(initMirrors(""), check.IsNil)
+	c.Assert(GetMirrorURLs(), check.HasLen, 0)
+	c.Assert(initMirrors("mem:///mirror1, mem:///mirror2"), check.IsNil)
+	c.Assert(GetMirrorURLs(), check.DeepEquals, []string{"mem:///mirror1", "mem:///mirror2"})
+	c.Assert(initMirrors("unknown:///mirror"), check.ErrorMatches, "Invalid value .*")
+	// Names of targets are resolved by the daemon
+	c.Assert(initMirrors("mem:///mirror1,offsite"), check.IsNil)
+	c.Assert(GetMirrorURLs(), check.DeepEquals, []string{"mem:///mirror1", "offsite"})
+	c.Assert(initMirrors("mem:///mirror1,off site"), check.ErrorMatches, "Invalid value .*")
+	c.Assert(initMirrors(""), check.IsNil)
+}
@@ -0,0 +1,50 @@
+package objectstore
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	// Keys of credentials, e.g. access key of S3
+	CREDENTIAL_ACCESS_KEY = "accesskey"
+	CREDENTIAL_SECRET_KEY = "secretkey"
+)
+
+var (
+	// Credentials of destinations, used by drivers instead of the ones from environment
+	credentials     = map[string]map[string]string{}
+	credentialsLock sync.RWMutex
+)
+
+/*
+GetDestination returns destURL without query and trailing slash, which
+identifies the destination, e.g. backup URLs in the destination would have
+the same destination.
+*/
+func GetDestination(destURL string) string {
+	if i := strings.Index(destURL, "?"); i >= 0 {
+		destURL = destURL[:i]
+	}
+	return strings.TrimSuffix(destURL, "/")
+}
+
+// SetCredentials sets the credentials for destURL and the backups in it
+func SetCredentials(destURL string, creds map[string]string) {
+	credentialsLock.Lock()
+	defer credentialsLock.Unlock()
+	credentials[GetDestination(destURL)] = creds
+}
+
+func RemoveCredentials(destURL string) {
+	credentialsLock.Lock()
+	defer credentialsLock.Unlock()
+	delete(credentials, GetDestination(destURL))
+}
+
+// GetCredentials returns the credentials for destURL, or nil if not set
+func GetCredentials(destURL string) map[string]string {
+	credentialsLock.RLock()
+	defer credentialsLock.RUnlock()
+	return credentials[GetDestination(destURL)]
+}
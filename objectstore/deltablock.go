@@ -1,10 +1,13 @@
 package objectstore
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/metadata"
@@ -18,6 +21,11 @@ type BlockMapping struct {
 	BlockChecksum string
 }
 
+// isZero returns true if the block is all zeros, which has no block file
+func (b BlockMapping) isZero() bool {
+	return b.BlockChecksum == ZERO_BLOCK_CHECKSUM
+}
+
 type DeltaBlockBackupOperations interface {
 	HasSnapshot(id, volumeID string) bool
 	CompareSnapshot(id, compareID, volumeID string) (*metadata.Mappings, error)
@@ -30,19 +38,39 @@ const (
 	DEFAULT_BLOCK_SIZE = 2097152
 
 	BLOCKS_DIRECTORY      = "blocks"
+	BLOCK_SUFFIX          = ".blk"
 	BLOCK_SEPARATE_LAYER1 = 2
 	BLOCK_SEPARATE_LAYER2 = 4
+
+	// Recorded instead of the checksum for blocks of all zeros, e.g. the
+	// unused space of thin volumes, which are not uploaded
+	ZERO_BLOCK_CHECKSUM = "zero"
+)
+
+var (
+	zeroBuffer = make([]byte, 64*1024)
 )
 
-func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoint string, deltaOps DeltaBlockBackupOperations) (string, error) {
+/*
+CreateDeltaBlockBackup backups the blocks of snapshot changed since the last
+backup of the volume. progress can be nil if the backup doesn't need to be
+tracked or cancelled.
+*/
+func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoint string, deltaOps DeltaBlockBackupOperations, progress *Progress) (string, error) {
 	if deltaOps == nil {
 		return "", fmt.Errorf("Missing DeltaBlockBackupOperations")
 	}
 
-	bsDriver, err := GetObjectStoreDriver(destURL, endpoint)
+	bsDriver, err := getWritableObjectStoreDriver(destURL, endpoint)
 	if err != nil {
 		return "", err
 	}
+	lock, err := lockVolume(volume.Name, "backup", bsDriver)
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	bsDriver = throttleDriver(bsDriver, progress)
 
 	if err := addVolume(volume, bsDriver); err != nil {
 		return "", err
@@ -53,6 +81,20 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoin
 	if err != nil {
 		return "", err
 	}
+	if err := checkVolumeEncryption(volume); err != nil {
+		return "", err
+	}
+	// Blocks found in the pool shouldn't be removed before being referenced
+	poolLock, err := lockBlockPool(volume.BlockPool, false, "backup", bsDriver)
+	if err != nil {
+		return "", err
+	}
+	defer poolLock.unlock()
+	blockSize := volume.getBlockSize()
+	codec, err := getCodec(volume.CompressionMethod)
+	if err != nil {
+		return "", err
+	}
 
 	lastBackupName := volume.LastBackupName
 
@@ -99,9 +141,6 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoin
 	if err != nil {
 		return "", err
 	}
-	if delta.BlockSize != DEFAULT_BLOCK_SIZE {
-		return "", fmt.Errorf("Currently doesn't support different block sizes driver other than %v", DEFAULT_BLOCK_SIZE)
-	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:        LOG_REASON_COMPLETE,
 		LOG_FIELD_OBJECT:        LOG_OBJECT_SNAPSHOT,
@@ -117,55 +156,88 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoin
 		LOG_FIELD_SNAPSHOT: snapshot.Name,
 	}).Debug("Creating backup")
 
-	deltaBackup := &Backup{
-		Name:         util.GenerateName("backup"),
-		VolumeName:   volume.Name,
-		SnapshotName: snapshot.Name,
-		Blocks:       []BlockMapping{},
-	}
-	mCounts := len(delta.Mappings)
-	for m, d := range delta.Mappings {
-		if d.Size%delta.BlockSize != 0 {
-			return "", fmt.Errorf("Mapping's size %v is not multiples of backup block size %v",
-				d.Size, delta.BlockSize)
-		}
-		block := make([]byte, DEFAULT_BLOCK_SIZE)
-		blkCounts := d.Size / delta.BlockSize
-		for i := int64(0); i < blkCounts; i++ {
-			offset := d.Offset + i*delta.BlockSize
-			log.Debugf("Backup for %v: segment %v/%v, blocks %v/%v", snapshot.Name, m+1, mCounts, i+1, blkCounts)
-			err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, offset, block)
-			if err != nil {
-				return "", err
-			}
-			checksum := util.GetChecksum(block)
-			blkFile := getBlockFilePath(volume.Name, checksum)
-			if bsDriver.FileSize(blkFile) >= 0 {
-				blockMapping := BlockMapping{
-					Offset:        offset,
-					BlockChecksum: checksum,
-				}
-				deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
-				log.Debugf("Found existed block match at %v", blkFile)
-				continue
-			}
-
-			rs, err := util.CompressData(block)
-			if err != nil {
-				return "", err
-			}
+	partial := findPartialBackup(volume, snapshot.Name, destURL, bsDriver)
+	if partial == nil {
+		partial = &partialBackup{
+			Backup: Backup{
+				Name:              util.GenerateName("backup"),
+				VolumeName:        volume.Name,
+				SnapshotName:      snapshot.Name,
+				BlockSize:         volume.BlockSize,
+				CompressionMethod: volume.CompressionMethod,
+				Blocks:            []BlockMapping{},
+			},
+			LastBackupName: lastBackupName,
+		}
+		if err := startPartialBackup(partial, destURL, bsDriver); err != nil {
+			return "", err
+		}
+	}
+	tracker := newPartialTracker(partial, bsDriver)
 
-			if err := bsDriver.Write(blkFile, rs); err != nil {
-				return "", err
+	deltaBackup := &Backup{
+		Name:              partial.Name,
+		VolumeName:        volume.Name,
+		SnapshotName:      snapshot.Name,
+		BlockSize:         volume.BlockSize,
+		CompressionMethod: volume.CompressionMethod,
+		Blocks:            []BlockMapping{},
+	}
+	offsets := getBackupBlockOffsets(delta.Mappings, blockSize, volume.Size)
+
+	deltaBackup.Blocks = make([]BlockMapping, len(offsets))
+	uploader := &blockUploader{
+		driver:   bsDriver,
+		codec:    codec,
+		inflight: make(map[string]*blockUpload),
+	}
+	blkCounts := len(offsets)
+	progress.setTotal(blkCounts, int64(blkCounts)*blockSize)
+	iops := progress.getIOPSLimiter()
+	err = RunParallel(blkCounts, concurrency, func(i int) error {
+		offset := offsets[i]
+		length := blockSize
+		if volume.Size > 0 && offset+length > volume.Size {
+			length = volume.Size - offset
+		}
+		if b, exists := tracker.get(offset); exists {
+			// The block may have been removed since the progress was saved
+			if b.isZero() || bsDriver.FileSize(volume.getBlockFilePath(b.BlockChecksum)) >= 0 {
+				deltaBackup.Blocks[i] = b
+				progress.addProcessed(1, length)
+				return nil
 			}
-			log.Debugf("Created new block file at %v", blkFile)
-
-			blockMapping := BlockMapping{
-				Offset:        offset,
-				BlockChecksum: checksum,
+			log.Debugf("Block %v of the saved progress is missing, upload it again", b.BlockChecksum)
+		}
+		if err := progress.checkCancelled(); err != nil {
+			return err
+		}
+		log.Debugf("Backup for %v: block %v/%v", snapshot.Name, i+1, blkCounts)
+		iops.wait(1)
+		block := make([]byte, length)
+		if err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, offset, block); err != nil {
+			return err
+		}
+		checksum := ZERO_BLOCK_CHECKSUM
+		if !isZeroBlock(block) {
+			checksum = util.GetChecksum(block)
+			if err := uploader.upload(volume, checksum, block); err != nil {
+				return err
 			}
-			deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
 		}
+		deltaBackup.Blocks[i] = BlockMapping{
+			Offset:        offset,
+			BlockChecksum: checksum,
+		}
+		progress.addProcessed(1, length)
+		return tracker.add(deltaBackup.Blocks[i])
+	})
+	if err != nil {
+		// Keep the progress so the next attempt can resume from here
+		if saveErr := tracker.save(); saveErr != nil {
+			log.Warnf("Failed to save progress of backup %v: %v", partial.Name, saveErr)
+		}
+		return "", err
 	}
 
 	log.WithFields(logrus.Fields{
@@ -178,8 +250,25 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoin
 	backup := mergeSnapshotMap(deltaBackup, lastBackup)
 	backup.SnapshotName = snapshot.Name
 	backup.SnapshotCreatedAt = snapshot.CreatedTime
+	backup.Labels = snapshot.Labels
+	backup.Description = snapshot.Description
 	backup.CreatedTime = util.Now()
 
+	if volume.BlockPool != "" {
+		if err := addBlockPoolRefs(volume, deltaBackup.Blocks, bsDriver); err != nil {
+			return "", err
+		}
+	}
+	if err := lock.check(); err != nil {
+		return "", err
+	}
+	if err := poolLock.check(); err != nil {
+		return "", err
+	}
+	if err := beginCatalogUpdate(volume.Name, backup.Name, bsDriver); err != nil {
+		return "", err
+	}
+	defer finishCatalogUpdate(volume.Name, backup.Name, bsDriver)
 	if err := saveBackup(backup, bsDriver); err != nil {
 		return "", err
 	}
@@ -188,19 +277,89 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL, endpoin
 	if err := saveVolume(volume, bsDriver); err != nil {
 		return "", err
 	}
+	finishPartialBackup(partial, destURL, bsDriver)
 
 	return encodeBackupURL(backup.Name, volume.Name, destURL), nil
 }
 
+// blockUploader makes sure the same block won't be uploaded twice at the same time
+type blockUploader struct {
+	driver   ObjectStoreDriver
+	codec    *compressionCodec
+	inflight map[string]*blockUpload
+	lock     sync.Mutex
+}
+
+// blockUpload is the upload of a block, done is closed once err is set
+type blockUpload struct {
+	done chan struct{}
+	err  error
+}
+
+/*
+upload uploads block unless it already exists. If the same block is being
+uploaded, it waits for that upload and returns its result, so a block won't
+be taken as uploaded before it's actually written.
+*/
+func (u *blockUploader) upload(volume *Volume, checksum string, block []byte) error {
+	blkFile := volume.getBlockFilePath(checksum)
+
+	u.lock.Lock()
+	if inflight, exists := u.inflight[checksum]; exists {
+		u.lock.Unlock()
+		log.Debugf("Found same block being uploaded at %v", blkFile)
+		<-inflight.done
+		return inflight.err
+	}
+	current := &blockUpload{
+		done: make(chan struct{}),
+	}
+	u.inflight[checksum] = current
+	u.lock.Unlock()
+
+	current.err = u.write(blkFile, block)
+	if current.err != nil {
+		// Let the next one try again
+		u.lock.Lock()
+		delete(u.inflight, checksum)
+		u.lock.Unlock()
+	}
+	close(current.done)
+	return current.err
+}
+
+func (u *blockUploader) write(blkFile string, block []byte) error {
+	if u.driver.FileSize(blkFile) >= 0 {
+		log.Debugf("Found existed block match at %v", blkFile)
+		return nil
+	}
+
+	compressed, err := u.codec.compress(block)
+	if err != nil {
+		return err
+	}
+	rs, err := sealData(compressed, u.driver)
+	if err != nil {
+		return err
+	}
+	if err := u.driver.Write(blkFile, rs); err != nil {
+		return err
+	}
+	log.Debugf("Created new block file at %v", blkFile)
+	return nil
+}
+
 func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 	if lastBackup == nil {
 		return deltaBackup
 	}
 	backup := &Backup{
-		Name:         deltaBackup.Name,
-		VolumeName:   deltaBackup.VolumeName,
-		SnapshotName: deltaBackup.SnapshotName,
-		Blocks:       []BlockMapping{},
+		Name:              deltaBackup.Name,
+		VolumeName:        deltaBackup.VolumeName,
+		SnapshotName:      deltaBackup.SnapshotName,
+		BlockSize:         deltaBackup.BlockSize,
+		CompressionMethod: deltaBackup.CompressionMethod,
+		Blocks:            []BlockMapping{},
 	}
 	var d, l int
 	for d, l = 0, 0; d < len(deltaBackup.Blocks) && l < len(lastBackup.Blocks); {
@@ -229,11 +388,13 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 	return backup
 }
 
-func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string) error {
+// RestoreDeltaBlockBackup writes the backup to volDevName, progress can be nil
+func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string, progress *Progress) error {
 	bsDriver, err := GetObjectStoreDriver(backupURL, endpoint)
 	if err != nil {
 		return err
 	}
+	bsDriver = throttleDriver(bsDriver, progress)
 
 	srcBackupName, srcVolumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
@@ -248,7 +409,7 @@ func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string) error {
 		}, "Volume doesn't exist in objectstore: %v", err)
 	}
 
-	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
+	if vol.Size <= 0 {
 		return fmt.Errorf("Read invalid volume size %v", vol.Size)
 	}
 
@@ -267,6 +428,10 @@ func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string) error {
 	if err != nil {
 		return err
 	}
+	codec, err := getCodec(backup.CompressionMethod)
+	if err != nil {
+		return err
+	}
 
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:      LOG_REASON_START,
@@ -278,24 +443,52 @@ func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string) error {
 		LOG_FIELD_BACKUP_URL:  backupURL,
 	}).Debug()
 	blkCounts := len(backup.Blocks)
-	for i, block := range backup.Blocks {
+	progress.setTotal(blkCounts, int64(blkCounts)*backup.getBlockSize())
+	iops := progress.getIOPSLimiter()
+	// The regular file was just created, so zero blocks can be left as holes
+	sparse := stat.Mode()&os.ModeType == 0
+	err = RunParallel(blkCounts, concurrency, func(i int) error {
+		if err := progress.checkCancelled(); err != nil {
+			return err
+		}
+		block := backup.Blocks[i]
+		if block.isZero() {
+			length := backup.getBlockSize()
+			if block.Offset+length > vol.Size {
+				length = vol.Size - block.Offset
+			}
+			if !sparse {
+				iops.wait(1)
+				if err := restoreZeroBlock(volDev, block.Offset, length); err != nil {
+					return err
+				}
+			}
+			progress.addProcessed(1, length)
+			return nil
+		}
 		log.Debugf("Restore for %v: block %v, %v/%v", volDevName, block.BlockChecksum, i+1, blkCounts)
-		blkFile := getBlockFilePath(srcVolumeName, block.BlockChecksum)
+		blkFile := vol.getBlockFilePath(block.BlockChecksum)
 		rc, err := bsDriver.Read(blkFile)
 		if err != nil {
 			return err
 		}
-		r, err := util.DecompressAndVerify(rc, block.BlockChecksum)
+		data, err := openBlock(rc, vol, bsDriver, block.BlockChecksum, codec, backup.getBlockSize())
 		rc.Close()
 		if err != nil {
-			return err
+			return generateError(logrus.Fields{
+				LOG_FIELD_VOLUME:     srcVolumeName,
+				LOG_FIELD_BACKUP_URL: backupURL,
+			}, "Failed to restore block %v: %v", block.BlockChecksum, err)
 		}
-		if _, err := volDev.Seek(block.Offset, 0); err != nil {
-			return err
-		}
-		if _, err := io.CopyN(volDev, r, DEFAULT_BLOCK_SIZE); err != nil {
+		iops.wait(1)
+		if _, err := volDev.WriteAt(data, block.Offset); err != nil {
 			return err
 		}
+		progress.addProcessed(1, int64(len(data)))
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// We want to truncate regular files, but not device
@@ -310,7 +503,7 @@ func RestoreDeltaBlockBackup(backupURL, endpoint, volDevName string) error {
 }
 
 func DeleteDeltaBlockBackup(backupURL, endpoint string) error {
-	bsDriver, err := GetObjectStoreDriver(backupURL, endpoint)
+	bsDriver, err := getWritableObjectStoreDriver(backupURL, endpoint)
 	if err != nil {
 		return err
 	}
@@ -319,23 +512,42 @@ func DeleteDeltaBlockBackup(backupURL, endpoint string) error {
 	if err != nil {
 		return err
 	}
+	lock, err := lockVolume(volumeName, "delete", bsDriver)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
 
 	v, err := loadVolume(volumeName, bsDriver)
 	if err != nil {
-		return fmt.Errorf("Cannot find volume %v in objectstore", volumeName, err)
+		if IsNotFound(err) {
+			return err
+		}
+		return fmt.Errorf("Cannot load volume %v in objectstore: %v", volumeName, err)
+	}
+	// Blocks to be removed from the pool shouldn't be taken by backups of other volumes
+	poolLock, err := lockBlockPool(v.BlockPool, true, "delete", bsDriver)
+	if err != nil {
+		return err
 	}
+	defer poolLock.unlock()
 
 	backup, err := loadBackup(backupName, volumeName, bsDriver)
 	if err != nil {
 		return err
 	}
 	discardBlockSet := make(map[string]bool)
-	for _, blk := range backup.Blocks {
-		discardBlockSet[blk.BlockChecksum] = true
+	for _, checksum := range getBlockChecksums(backup.Blocks) {
+		discardBlockSet[checksum] = true
 	}
 	discardBlockCounts := len(discardBlockSet)
 
-	if err := removeBackup(backup, bsDriver); err != nil {
+	if err := beginCatalogUpdate(volumeName, backupName, bsDriver); err != nil {
+		return err
+	}
+	err = removeBackup(backup, bsDriver)
+	finishCatalogUpdate(volumeName, backupName, bsDriver)
+	if err != nil {
 		return err
 	}
 
@@ -350,8 +562,19 @@ func DeleteDeltaBlockBackup(backupURL, endpoint string) error {
 	if err != nil {
 		return err
 	}
-	if len(backupNames) == 0 {
+	// Blocks uploaded by in-progress backups are referenced as well
+	partials, err := loadPartialBackupsForVolume(volumeName, bsDriver)
+	if err != nil {
+		return err
+	}
+	if len(backupNames) == 0 && len(partials) == 0 {
 		log.Debugf("No snapshot existed for the volume %v, removing volume", volumeName)
+		// Blocks in the pool may still be used by other volumes
+		if v.BlockPool != "" {
+			if err := removePoolBlocks(v, discardBlockSet, true, poolLock, bsDriver); err != nil {
+				return err
+			}
+		}
 		if err := removeVolume(volumeName, bsDriver); err != nil {
 			log.Warningf("Failed to remove volume %v due to: %v", volumeName, err.Error())
 		}
@@ -377,6 +600,20 @@ func DeleteDeltaBlockBackup(backupURL, endpoint string) error {
 			break
 		}
 	}
+	for _, partial := range partials {
+		for _, blk := range partial.Blocks {
+			delete(discardBlockSet, blk.BlockChecksum)
+		}
+	}
+
+	if v.BlockPool != "" {
+		if err := removePoolBlocks(v, discardBlockSet, false, poolLock, bsDriver); err != nil {
+			return err
+		}
+		log.Debug("GC completed")
+		log.Debug("Removed objectstore backup ", backupName)
+		return nil
+	}
 
 	var blkFileList []string
 	for blk := range discardBlockSet {
@@ -394,15 +631,110 @@ func DeleteDeltaBlockBackup(backupURL, endpoint string) error {
 	return nil
 }
 
+/*
+getBackupBlockOffsets returns the sorted offsets of backup blocks covering the
+changed mappings. Driver may report mappings in its own chunk size, so one
+mapping can span multiple backup blocks, or multiple mappings can fall into
+the same backup block.
+*/
+func getBackupBlockOffsets(mappings []metadata.Mapping, blockSize, volumeSize int64) []int64 {
+	offsetSet := make(map[int64]bool)
+	offsets := []int64{}
+	for _, m := range mappings {
+		for offset := m.Offset / blockSize * blockSize; offset < m.Offset+m.Size; offset += blockSize {
+			if volumeSize > 0 && offset >= volumeSize {
+				break
+			}
+			if !offsetSet[offset] {
+				offsetSet[offset] = true
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	return offsets
+}
+
+func isZeroBlock(data []byte) bool {
+	for len(data) > 0 {
+		n := len(data)
+		if n > len(zeroBuffer) {
+			n = len(zeroBuffer)
+		}
+		if !bytes.Equal(data[:n], zeroBuffer[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// getBlockChecksums returns the checksums of the block files referenced by blocks, once each
+func getBlockChecksums(blocks []BlockMapping) []string {
+	checksums := []string{}
+	blockSet := make(map[string]bool)
+	for _, blk := range blocks {
+		if !blk.isZero() && !blockSet[blk.BlockChecksum] {
+			blockSet[blk.BlockChecksum] = true
+			checksums = append(checksums, blk.BlockChecksum)
+		}
+	}
+	return checksums
+}
+
+/*
+restoreZeroBlock makes the range of volDev read back zeros. Nothing would be
+written if it already does, e.g. the unused space of thin devices, otherwise a
+hole would be punched if supported.
+*/
+func restoreZeroBlock(volDev *os.File, offset, length int64) error {
+	data := make([]byte, length)
+	if _, err := volDev.ReadAt(data, offset); err == nil && isZeroBlock(data) {
+		return nil
+	}
+	err := punchHole(volDev, offset, length)
+	if err == nil {
+		return nil
+	}
+	log.Debugf("Failed to punch hole in %v, write zeros instead: %v", volDev.Name(), err)
+	for i := range data {
+		data[i] = 0
+	}
+	_, err = volDev.WriteAt(data, offset)
+	return err
+}
+
+// openBlock returns the verified content of block of volume in driver, which is at most blockSize
+func openBlock(rc io.Reader, volume *Volume, driver ObjectStoreDriver, checksum string, codec *compressionCodec, blockSize int64) ([]byte, error) {
+	r, err := openData(rc, driver, plainAllowed(volume))
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.decompress(r, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if util.GetChecksum(data) != checksum {
+		return nil, fmt.Errorf("Checksum verification failed for block!")
+	}
+	return data, nil
+}
+
 func getBlockPath(volumeName string) string {
 	return filepath.Join(getVolumePath(volumeName), BLOCKS_DIRECTORY) + "/"
 }
 
 func getBlockFilePath(volumeName, checksum string) string {
+	return getBlockFilePathInDir(getBlockPath(volumeName), checksum)
+}
+
+func getBlockFilePathInDir(blockPath, checksum string) string {
 	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
 	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
-	path := filepath.Join(getBlockPath(volumeName), blockSubDirLayer1, blockSubDirLayer2)
-	fileName := checksum + ".blk"
+	path := filepath.Join(blockPath, blockSubDirLayer1, blockSubDirLayer2)
+	fileName := checksum + BLOCK_SUFFIX
 
 	return filepath.Join(path, fileName)
 }
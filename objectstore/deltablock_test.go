@@ -0,0 +1,386 @@
+package objectstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher/convoy/metadata"
+	"github.com/rancher/convoy/util"
+	"gopkg.in/check.v1"
+)
+
+// fakeDeltaOps provides snapshots as in-memory images, every block of the
+// snapshot would be treated as changed
+type fakeDeltaOps struct {
+	snapshots map[string][]byte
+	blockSize int64
+	failAt    int64
+	reads     int32
+}
+
+func newFakeDeltaOps() *fakeDeltaOps {
+	return &fakeDeltaOps{
+		snapshots: map[string][]byte{},
+		blockSize: DEFAULT_BLOCK_SIZE,
+		failAt:    -1,
+	}
+}
+
+func (f *fakeDeltaOps) HasSnapshot(id, volumeID string) bool {
+	_, exists := f.snapshots[id]
+	return exists
+}
+
+func (f *fakeDeltaOps) CompareSnapshot(id, compareID, volumeID string) (*metadata.Mappings, error) {
+	return &metadata.Mappings{
+		Mappings: []metadata.Mapping{
+			{
+				Offset: 0,
+				Size:   int64(len(f.snapshots[id])),
+			},
+		},
+		BlockSize: f.blockSize,
+	}, nil
+}
+
+func (f *fakeDeltaOps) OpenSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (f *fakeDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	atomic.AddInt32(&f.reads, 1)
+	if start == f.failAt {
+		return fmt.Errorf("Simulated read failure at %v", start)
+	}
+	copy(data, f.snapshots[id][start:start+int64(len(data))])
+	return nil
+}
+
+func (f *fakeDeltaOps) CloseSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func generateImage(blocks int) []byte {
+	image := make([]byte, blocks*DEFAULT_BLOCK_SIZE)
+	for i := 0; i < blocks; i++ {
+		// Make two of the blocks identical
+		copy(image[i*DEFAULT_BLOCK_SIZE:], []byte(fmt.Sprintf("block %v", i%(blocks-1))))
+	}
+	return image
+}
+
+func (s *TestSuite) TestRunParallel(c *check.C) {
+	var count int32
+	err := RunParallel(100, 4, func(i int) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int32(100))
+
+	count = 0
+	err = RunParallel(100, 4, func(i int) error {
+		atomic.AddInt32(&count, 1)
+		if i == 10 {
+			return fmt.Errorf("failure")
+		}
+		return nil
+	})
+	c.Assert(err, check.ErrorMatches, "failure")
+	c.Assert(count < 100, check.Equals, true)
+
+	c.Assert(RunParallel(0, 4, nil), check.IsNil)
+
+	// No more than workers calls at the same time
+	var running, maxRunning int32
+	err = RunParallel(20, 2, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(maxRunning, check.Equals, int32(2))
+}
+
+func (s *TestSuite) TestDeltaBlockBackupAndRestore(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	blocks := 9
+	image := generateImage(blocks)
+	ops.snapshots["snap1"] = image
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.Blocks, check.HasLen, blocks)
+	for i, b := range backup.Blocks {
+		c.Assert(b.Offset, check.Equals, int64(i*DEFAULT_BLOCK_SIZE))
+	}
+	blkFiles, err := d.List(getBlockPath("vol1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(len(blkFiles) > 0, check.Equals, true)
+
+	restored := filepath.Join(c.MkDir(), "restored.img")
+	c.Assert(RestoreDeltaBlockBackup(backupURL, "", restored, nil), check.IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(data, image), check.Equals, true)
+}
+
+func (s *TestSuite) TestDeltaBlockBackupFailure(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(8)
+	ops.failAt = 3 * DEFAULT_BLOCK_SIZE
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.ErrorMatches, ".*Simulated read failure.*")
+
+	backupNames, err := getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupNames, check.HasLen, 0)
+}
+
+func (s *TestSuite) TestDeltaBlockBackupResume(c *check.C) {
+	c.Assert(initStateDir(c.MkDir()), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	blocks := PARTIAL_CHECKPOINT_BLOCKS + 8
+	image := generateImage(blocks)
+	ops.snapshots["snap1"] = image
+	ops.failAt = int64(blocks-1) * DEFAULT_BLOCK_SIZE
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.ErrorMatches, ".*Simulated read failure.*")
+
+	files, err := d.List(getBackupPath("vol1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+	c.Assert(strings.HasSuffix(files[0], PARTIAL_SUFFIX), check.Equals, true)
+	backupNames, err := getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupNames, check.HasLen, 0)
+
+	ops.failAt = -1
+	ops.reads = 0
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	// Blocks uploaded by the failed attempt shouldn't be read again
+	c.Assert(ops.reads < int32(blocks), check.Equals, true)
+
+	files, err = d.List(getBackupPath("vol1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+	c.Assert(strings.HasSuffix(files[0], CFG_SUFFIX), check.Equals, true)
+
+	restored := filepath.Join(c.MkDir(), "restored.img")
+	c.Assert(RestoreDeltaBlockBackup(backupURL, "", restored, nil), check.IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(data, image), check.Equals, true)
+}
+
+// blockingWriteDriver fails every Write once released
+type blockingWriteDriver struct {
+	ObjectStoreDriver
+	writes  int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingWriteDriver) Write(dst string, rs io.ReadSeeker) error {
+	if atomic.AddInt32(&d.writes, 1) == 1 {
+		close(d.started)
+	}
+	<-d.release
+	return fmt.Errorf("Simulated write failure of %v", dst)
+}
+
+func (s *TestSuite) TestBlockUploaderInflightFailure(c *check.C) {
+	d := &blockingWriteDriver{
+		ObjectStoreDriver: newMemDriver(c),
+		started:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	codec, err := getCodec(DEFAULT_COMPRESSION)
+	c.Assert(err, check.IsNil)
+	u := &blockUploader{
+		driver:   d,
+		codec:    codec,
+		inflight: make(map[string]*blockUpload),
+	}
+	volume := &Volume{Name: "vol1"}
+	block := []byte("block")
+	checksum := util.GetChecksum(block)
+
+	first := make(chan error)
+	go func() {
+		first <- u.upload(volume, checksum, block)
+	}()
+	<-d.started
+	// The duplicate must wait for the result of the block being uploaded
+	second := make(chan error)
+	go func() {
+		second <- u.upload(volume, checksum, block)
+	}()
+	select {
+	case err := <-second:
+		c.Fatalf("Duplicate upload returned %v before the upload finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(d.release)
+	c.Assert(<-first, check.ErrorMatches, "Simulated write failure.*")
+	c.Assert(<-second, check.ErrorMatches, "Simulated write failure.*")
+	c.Assert(atomic.LoadInt32(&d.writes), check.Equals, int32(1))
+
+	// Failed upload would be tried again
+	c.Assert(u.upload(volume, checksum, block), check.ErrorMatches, "Simulated write failure.*")
+	c.Assert(atomic.LoadInt32(&d.writes), check.Equals, int32(2))
+}
+
+func (s *TestSuite) TestDeltaBlockBackupResumeMissingBlock(c *check.C) {
+	c.Assert(initStateDir(c.MkDir()), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	blocks := PARTIAL_CHECKPOINT_BLOCKS + 8
+	image := generateImage(blocks)
+	ops.snapshots["snap1"] = image
+	ops.failAt = int64(blocks-1) * DEFAULT_BLOCK_SIZE
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.NotNil)
+
+	// Block recorded in the saved progress is gone, e.g. collected as garbage
+	checksum := util.GetChecksum(image[:DEFAULT_BLOCK_SIZE])
+	blkFile := getBlockFilePath("vol1", checksum)
+	c.Assert(d.FileExists(blkFile), check.Equals, true)
+	c.Assert(d.Remove(blkFile), check.IsNil)
+
+	ops.failAt = -1
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.FileExists(blkFile), check.Equals, true)
+	checkRestore(c, backupURL, image)
+}
+
+func (s *TestSuite) TestDeltaBlockBackupDiscardStale(c *check.C) {
+	c.Assert(initStateDir(c.MkDir()), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	ops.snapshots["snap2"] = generateImage(4)
+	ops.failAt = 2 * DEFAULT_BLOCK_SIZE
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.NotNil)
+
+	ops.failAt = -1
+	_, err = CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	files, err := d.List(getBackupPath("vol1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+	c.Assert(strings.HasSuffix(files[0], CFG_SUFFIX), check.Equals, true)
+}
+
+func (s *TestSuite) TestDeltaBlockBackupZeroBlocks(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	// Only the first of 4 blocks is used, the last one is partial
+	image1 := make([]byte, 3*DEFAULT_BLOCK_SIZE+4096)
+	copy(image1, []byte("used block"))
+	ops.snapshots["snap1"] = image1
+	// The used block is discarded later
+	image2 := make([]byte, len(image1))
+	copy(image2[DEFAULT_BLOCK_SIZE:], []byte("another block"))
+	ops.snapshots["snap2"] = image2
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(image1))}
+	backupURL1, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	backupName, _, err := decodeBackupURL(backupURL1)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, "vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backup.Blocks, check.HasLen, 4)
+	for i, b := range backup.Blocks {
+		c.Assert(b.isZero(), check.Equals, i != 0)
+	}
+	checksums, err := listBlockChecksums(getBlockPath("vol1"), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(checksums, check.HasLen, 1)
+	checkRestore(c, backupURL1, image1)
+
+	backupURL2, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap2"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	checkRestore(c, backupURL2, image2)
+
+	// Zero blocks have nothing to be copied
+	result, err := CopyBackup(backupURL2, "", newMirrorMemDriver(c).GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 1)
+	checkRestore(c, result.BackupURL, image2)
+	var archive bytes.Buffer
+	c.Assert(ExportBackup(backupURL1, "", &archive, nil), check.IsNil)
+	result, err = ImportBackup(&archive, "mem:///"+c.TestName()+"-import", "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.CopiedBlocks, check.Equals, 1)
+	checkRestore(c, result.BackupURL, image1)
+
+	verify, err := VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(verify.Consistent(), check.Equals, true)
+	c.Assert(verify.UnreferencedBlocks, check.HasLen, 0)
+	c.Assert(DeleteDeltaBlockBackup(backupURL1, ""), check.IsNil)
+	checksums, err = listBlockChecksums(getBlockPath("vol1"), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(checksums, check.HasLen, 1)
+	checkRestore(c, backupURL2, image2)
+}
+
+func (s *TestSuite) TestRestoreZeroBlock(c *check.C) {
+	// Stands for a device with existing data
+	f, err := os.Create(filepath.Join(c.MkDir(), "device.img"))
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	data := bytes.Repeat([]byte("x"), 3*4096)
+	_, err = f.WriteAt(data, 0)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(restoreZeroBlock(f, 4096, 4096), check.IsNil)
+	// Already zeros
+	c.Assert(restoreZeroBlock(f, 4096, 4096), check.IsNil)
+	result := make([]byte, len(data))
+	_, err = f.ReadAt(result, 0)
+	c.Assert(err, check.IsNil)
+	copy(data[4096:], make([]byte, 4096))
+	c.Assert(bytes.Equal(result, data), check.Equals, true)
+
+	c.Assert(isZeroBlock(make([]byte, DEFAULT_BLOCK_SIZE)), check.Equals, true)
+	c.Assert(isZeroBlock(append(make([]byte, DEFAULT_BLOCK_SIZE), 1)), check.Equals, false)
+	c.Assert(isZeroBlock([]byte{}), check.Equals, true)
+}
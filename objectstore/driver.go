@@ -25,8 +25,37 @@ type ObjectStoreDriver interface {
 	Download(src, dst string) error
 }
 
+/*
+FileTransferDriver is implemented by drivers transferring files differently
+from Read and Write, e.g. in parallel parts. Upload and Download of them are
+done by UploadFrom and DownloadTo with the opened file, so the file can be
+wrapped by the caller, e.g. to be throttled.
+*/
+type FileTransferDriver interface {
+	UploadFrom(rs io.ReadSeeker, dst string) error
+	DownloadTo(src string, w io.WriterAt) error
+}
+
+/*
+Capabilities describes what an objectstore driver supports. It's declared by
+the driver when registering, so the callers can check it without knowing the
+kind of driver.
+*/
+type Capabilities struct {
+	// Custom endpoint can be specified, e.g. for S3 compatible services
+	Endpoint bool
+	// Large objects are transferred in multiple parts, so the driver has to
+	// be a FileTransferDriver
+	Multipart bool
+	// Nothing can be written, so backups can only be inspected and restored
+	ReadOnly bool
+}
+
 var (
-	initializers map[string]InitFunc
+	initializers       map[string]InitFunc
+	driverCapabilities map[string]Capabilities
+	// Objectstore options from daemon, also used by drivers for their settings
+	options = map[string]string{}
 )
 
 var (
@@ -34,21 +63,82 @@ var (
 )
 
 func generateError(fields logrus.Fields, format string, v ...interface{}) error {
-	return ErrorWithFields("objectstore", fields, format, v)
+	return ErrorWithFields("objectstore", fields, format, v...)
 }
 
 func init() {
 	initializers = make(map[string]InitFunc)
+	driverCapabilities = make(map[string]Capabilities)
+}
+
+/*
+Init configures the objectstore with options from daemon, e.g. the key used
+for encrypting all the data written to objectstore. Local states, e.g. the
+progress of in-progress backups, would be saved under root. Backups cannot be
+resumed if root is empty.
+*/
+func Init(root string, opts map[string]string) error {
+	options = map[string]string{}
+	for k, v := range opts {
+		// Secret is only used for encryption
+		if k != OBJECTSTORE_PASSPHRASE {
+			options[k] = v
+		}
+	}
+	if err := initStateDir(root); err != nil {
+		return err
+	}
+	if err := initEncryption(opts[OBJECTSTORE_KEYFILE], opts[OBJECTSTORE_PASSPHRASE]); err != nil {
+		return err
+	}
+	if err := initConcurrency(opts[OBJECTSTORE_CONCURRENCY]); err != nil {
+		return err
+	}
+	if err := initBlockSize(opts[OBJECTSTORE_BLOCK_SIZE]); err != nil {
+		return err
+	}
+	if err := initCompression(opts[OBJECTSTORE_COMPRESSION]); err != nil {
+		return err
+	}
+	if err := initSharedBlocks(opts[OBJECTSTORE_SHARED_BLOCKS]); err != nil {
+		return err
+	}
+	if err := initThrottle(opts[OBJECTSTORE_BANDWIDTH_LIMIT], opts[OBJECTSTORE_IOPS_LIMIT]); err != nil {
+		return err
+	}
+	if err := initMirrors(opts[OBJECTSTORE_MIRRORS]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetOption returns the value of objectstore option name, or empty if not specified
+func GetOption(name string) string {
+	return options[name]
 }
 
-func RegisterDriver(kind string, initFunc InitFunc) error {
+func RegisterDriver(kind string, initFunc InitFunc, capabilities Capabilities) error {
 	if _, exists := initializers[kind]; exists {
 		return fmt.Errorf("%s has already been registered", kind)
 	}
 	initializers[kind] = initFunc
+	driverCapabilities[kind] = capabilities
 	return nil
 }
 
+// GetCapabilities returns the capabilities of the driver handling destURL
+func GetCapabilities(destURL string) (Capabilities, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	capabilities, exists := driverCapabilities[u.Scheme]
+	if !exists {
+		return Capabilities{}, fmt.Errorf("Driver %v is not supported!", u.Scheme)
+	}
+	return capabilities, nil
+}
+
 func GetObjectStoreDriver(destURL, endpoint string) (ObjectStoreDriver, error) {
 	if destURL == "" {
 		return nil, fmt.Errorf("Destination URL hasn't been specified")
@@ -61,13 +151,40 @@ func GetObjectStoreDriver(destURL, endpoint string) (ObjectStoreDriver, error) {
 		return nil, fmt.Errorf("Driver %v is not supported!", u.Scheme)
 	}
 	if endpoint != "" {
-		if u.Scheme != "s3" { // TODO change "s3" to use s3.KIND somehow? this causes import cycle at time of writing
-			// only the S3 driver supports custom endpoints
+		if !driverCapabilities[u.Scheme].Endpoint {
 			return nil, fmt.Errorf("Driver %v does not support custom endpoints", u.Scheme)
 		}
 		if _, err := url.Parse(endpoint); err != nil {
 			return nil, err
 		}
 	}
-	return initializers[u.Scheme](destURL, endpoint)
+	driver, err := initializers[u.Scheme](destURL, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := driver.(FileTransferDriver); driverCapabilities[u.Scheme].Multipart && !ok {
+		return nil, fmt.Errorf("BUG: Driver %v supports multipart but cannot transfer files in parts", u.Scheme)
+	}
+	return driver, nil
+}
+
+// getFileTransferDriver returns nil if driver doesn't transfer files in parts
+func getFileTransferDriver(driver ObjectStoreDriver) FileTransferDriver {
+	if !driverCapabilities[driver.Kind()].Multipart {
+		return nil
+	}
+	t, _ := driver.(FileTransferDriver)
+	return t
+}
+
+// getWritableObjectStoreDriver fails early if nothing can be written to destURL
+func getWritableObjectStoreDriver(destURL, endpoint string) (ObjectStoreDriver, error) {
+	capabilities, err := GetCapabilities(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if capabilities.ReadOnly {
+		return nil, fmt.Errorf("Objectstore %v is read-only", destURL)
+	}
+	return GetObjectStoreDriver(destURL, endpoint)
 }
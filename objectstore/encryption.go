@@ -0,0 +1,613 @@
+package objectstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OBJECTSTORE_KEYFILE    = "objectstore.keyfile"
+	OBJECTSTORE_PASSPHRASE = "objectstore.passphrase"
+
+	ENCRYPTION_KEY_SIZE   = 32
+	ENCRYPTION_CHUNK_SIZE = 1048576
+
+	// Saved in plain at the base of each destination
+	ENCRYPTION_CONFIG_FILE = "encryption.cfg"
+
+	encryptionMagic        = "CVYENC01"
+	encryptionKeyIDSize    = 8
+	encryptionPrefixSize   = 8
+	encryptionHeaderSize   = len(encryptionMagic) + encryptionKeyIDSize + encryptionPrefixSize
+	encryptionKDF          = "pbkdf2-sha256"
+	encryptionKDFIteration = 100000
+	encryptionSaltSize     = 16
+)
+
+/*
+encryptionConfig records how the key is derived from the passphrase for a
+destination. The salt is generated randomly when the destination is first
+written with a passphrase, so the same passphrase results in different keys
+for different destinations.
+*/
+type encryptionConfig struct {
+	KDF        string
+	Iterations int
+	Salt       string
+}
+
+type encryptionKey struct {
+	key []byte
+	id  []byte
+}
+
+var (
+	// Either the key from key file, or the passphrase to derive the key of each destination
+	encryptionRawKey     *encryptionKey
+	encryptionPassphrase []byte
+
+	// Keys derived from passphrase by destination URL
+	encryptionKeys     = map[string]*encryptionKey{}
+	encryptionKeysLock sync.Mutex
+)
+
+func initEncryption(keyFile, passphrase string) error {
+	setEncryptionKey(nil)
+
+	if keyFile != "" && passphrase != "" {
+		return fmt.Errorf("Only one of %v and %v can be specified", OBJECTSTORE_KEYFILE, OBJECTSTORE_PASSPHRASE)
+	}
+
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read encryption key file %v: %v", keyFile, err)
+		}
+		key, err := parseEncryptionKey(content)
+		if err != nil {
+			return fmt.Errorf("Invalid encryption key file %v: %v", keyFile, err)
+		}
+		setEncryptionKey(key)
+	} else if passphrase != "" {
+		encryptionPassphrase = []byte(passphrase)
+	} else {
+		return nil
+	}
+
+	log.Debug("Objectstore encryption enabled")
+	return nil
+}
+
+// setEncryptionKey uses key for all destinations, nil disables encryption
+func setEncryptionKey(key []byte) {
+	encryptionPassphrase = nil
+	encryptionKeysLock.Lock()
+	encryptionKeys = map[string]*encryptionKey{}
+	encryptionKeysLock.Unlock()
+
+	encryptionRawKey = nil
+	if key != nil {
+		encryptionRawKey = newEncryptionKey(key)
+	}
+}
+
+func newEncryptionKey(key []byte) *encryptionKey {
+	// Key ID is only used to detect the wrong key, it must not reveal the key
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encryptionMagic))
+	return &encryptionKey{
+		key: key,
+		id:  mac.Sum(nil)[:encryptionKeyIDSize],
+	}
+}
+
+func getEncryptionConfigPath() string {
+	return filepath.Join(OBJECTSTORE_BASE, ENCRYPTION_CONFIG_FILE)
+}
+
+// loadEncryptionConfig returns nil if the destination has no encryption config
+func loadEncryptionConfig(driver ObjectStoreDriver) (*encryptionConfig, error) {
+	filePath := getEncryptionConfigPath()
+	if !driver.FileExists(filePath) {
+		return nil, nil
+	}
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	config := &encryptionConfig{}
+	if err := json.NewDecoder(rc).Decode(config); err != nil {
+		return nil, fmt.Errorf("Invalid encryption config in %v: %v", driver.GetURL(), err)
+	}
+	return config, nil
+}
+
+/*
+saveEncryptionConfig saves config to the destination if it has none. Objectstores
+provide no conditional write, so the config is read again after lockSettleTime,
+and the one saved by the last writer would be used by everyone.
+*/
+func saveEncryptionConfig(config *encryptionConfig, driver ObjectStoreDriver) (*encryptionConfig, error) {
+	existing, err := loadEncryptionConfig(driver)
+	if err != nil || existing != nil {
+		return existing, err
+	}
+	j, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := driver.Write(getEncryptionConfigPath(), bytes.NewReader(j)); err != nil {
+		return nil, err
+	}
+	time.Sleep(lockSettleTime)
+	saved, err := loadEncryptionConfig(driver)
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil {
+		return nil, fmt.Errorf("Encryption config in %v was lost after saving", driver.GetURL())
+	}
+	return saved, nil
+}
+
+func newEncryptionConfig() (*encryptionConfig, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &encryptionConfig{
+		KDF:        encryptionKDF,
+		Iterations: encryptionKDFIteration,
+		Salt:       hex.EncodeToString(salt),
+	}, nil
+}
+
+func (c *encryptionConfig) deriveKey(passphrase []byte) (*encryptionKey, error) {
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("Invalid encryption salt %v", c.Salt)
+	}
+	if c.KDF != encryptionKDF || c.Iterations <= 0 {
+		return nil, fmt.Errorf("Unsupported key derivation %v with %v iterations", c.KDF, c.Iterations)
+	}
+	return newEncryptionKey(pbkdf2(passphrase, salt, c.Iterations, ENCRYPTION_KEY_SIZE, sha256.New)), nil
+}
+
+/*
+getEncryptionKey returns the key used for driver, or nil if encryption is
+disabled. The salt for passphrase would be created in the destination if
+create is true and there is none yet, otherwise it's an error.
+*/
+func getEncryptionKey(driver ObjectStoreDriver, create bool) (*encryptionKey, error) {
+	if encryptionRawKey != nil || encryptionPassphrase == nil {
+		return encryptionRawKey, nil
+	}
+
+	encryptionKeysLock.Lock()
+	defer encryptionKeysLock.Unlock()
+	if key, exists := encryptionKeys[driver.GetURL()]; exists {
+		return key, nil
+	}
+	config, err := loadEncryptionConfig(driver)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		if !create {
+			return nil, fmt.Errorf("Cannot find encryption config in %v, data cannot be decrypted", driver.GetURL())
+		}
+		if config, err = newEncryptionConfig(); err != nil {
+			return nil, err
+		}
+		if config, err = saveEncryptionConfig(config, driver); err != nil {
+			return nil, err
+		}
+		log.Debugf("Created encryption config in %v", driver.GetURL())
+	}
+	key, err := config.deriveKey(encryptionPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKeys[driver.GetURL()] = key
+	return key, nil
+}
+
+/*
+inheritEncryptionConfig makes driver, the destination of copying, use config
+of the source, so the same key would be derived from passphrase and the
+encrypted data can be copied as is. It fails if driver already uses a
+different key.
+*/
+func inheritEncryptionConfig(config *encryptionConfig, driver ObjectStoreDriver) error {
+	srcKey := encryptionRawKey
+	if encryptionPassphrase != nil {
+		if config == nil {
+			return fmt.Errorf("Cannot find encryption config of the source")
+		}
+		var err error
+		if srcKey, err = config.deriveKey(encryptionPassphrase); err != nil {
+			return err
+		}
+		if _, err := saveEncryptionConfig(config, driver); err != nil {
+			return err
+		}
+	}
+	dstKey, err := getEncryptionKey(driver, true)
+	if err != nil {
+		return err
+	}
+	if srcKey == nil || dstKey == nil || !hmac.Equal(srcKey.id, dstKey.id) {
+		return fmt.Errorf("Data in %v is encrypted with a different key, encrypted backups cannot be copied to it", driver.GetURL())
+	}
+	return nil
+}
+
+func parseEncryptionKey(content []byte) ([]byte, error) {
+	if len(content) == ENCRYPTION_KEY_SIZE {
+		return content, nil
+	}
+	trimmed := strings.TrimSpace(string(content))
+	if len(trimmed) == ENCRYPTION_KEY_SIZE*2 {
+		key, err := hex.DecodeString(trimmed)
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key must be %v raw bytes or %v hex characters", ENCRYPTION_KEY_SIZE, ENCRYPTION_KEY_SIZE*2)
+}
+
+func encryptionEnabled() bool {
+	return encryptionRawKey != nil || encryptionPassphrase != nil
+}
+
+// plainAllowed returns true if unencrypted data can be trusted for volume, which can be nil for data not belonging to any volume
+func plainAllowed(volume *Volume) bool {
+	return !encryptionEnabled() && (volume == nil || !volume.Encrypted)
+}
+
+// pbkdf2 derives key from password as defined in RFC 2898
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+func newEncryptionAEAD(key *encryptionKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptionNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], counter)
+	return nonce
+}
+
+func encryptionAdditionalData(header []byte, final bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if final {
+		ad[len(header)] = 1
+	}
+	return ad
+}
+
+/*
+encryptStream writes src to dst with AES-GCM. Data is sealed in chunks so large
+files don't need to be held in memory. Each chunk uses its own nonce, and the
+last chunk is marked in the additional data so truncation can be detected.
+*/
+func encryptStream(dst io.Writer, src io.Reader, key *encryptionKey) error {
+	aead, err := newEncryptionAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, key.id...)
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, ENCRYPTION_CHUNK_SIZE)
+	chunk := make([]byte, ENCRYPTION_CHUNK_SIZE)
+	var lenBuf [4]byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+
+		sealed := aead.Seal(nil, encryptionNonce(prefix, counter), chunk[:n], encryptionAdditionalData(header, final))
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(sealed)))
+		if _, err := dst.Write(lenBuf[:]); err != nil {
+			return err
+		}
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func decryptStream(dst io.Writer, src io.Reader, key *encryptionKey) error {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("Cannot read encryption header: %v", err)
+	}
+	if !isEncryptedHeader(header) {
+		return fmt.Errorf("BUG: Data is not encrypted")
+	}
+	if key == nil {
+		return fmt.Errorf("Data in objectstore is encrypted, but no encryption key was configured")
+	}
+	keyID := header[len(encryptionMagic) : len(encryptionMagic)+encryptionKeyIDSize]
+	if !hmac.Equal(keyID, key.id) {
+		return fmt.Errorf("Data in objectstore was encrypted with a different key, refuse to continue")
+	}
+	prefix := header[len(encryptionMagic)+encryptionKeyIDSize:]
+
+	aead, err := newEncryptionAEAD(key)
+	if err != nil {
+		return err
+	}
+	maxSealedSize := uint32(ENCRYPTION_CHUNK_SIZE + aead.Overhead())
+	var lenBuf [4]byte
+	sealed := make([]byte, maxSealedSize)
+	r := bufio.NewReader(src)
+	for counter := uint32(0); ; counter++ {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return fmt.Errorf("Encrypted data was truncated")
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size > maxSealedSize {
+			return fmt.Errorf("Invalid encrypted chunk size %v", size)
+		}
+		if _, err := io.ReadFull(r, sealed[:size]); err != nil {
+			return fmt.Errorf("Encrypted data was truncated")
+		}
+		// Same as encryptStream, only the chunk at the end is final
+		_, peekErr := r.Peek(1)
+		if peekErr != nil && peekErr != io.EOF {
+			return peekErr
+		}
+		final := peekErr == io.EOF
+		nonce := encryptionNonce(prefix, counter)
+		plain, err := aead.Open(nil, nonce, sealed[:size], encryptionAdditionalData(header, final))
+		if err != nil {
+			// Tell truncated or appended data from corrupted one
+			if _, e := aead.Open(nil, nonce, sealed[:size], encryptionAdditionalData(header, !final)); e == nil {
+				if final {
+					return fmt.Errorf("Encrypted data was truncated")
+				}
+				return fmt.Errorf("Unexpected data found after the end of encrypted data")
+			}
+			return fmt.Errorf("Failed to authenticate encrypted data, it's corrupted or the key is wrong")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+func isEncryptedHeader(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(encryptionMagic))
+}
+
+// sealData returns data ready to be written to driver
+func sealData(data []byte, driver ObjectStoreDriver) (io.ReadSeeker, error) {
+	key, err := getEncryptionKey(driver, true)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return bytes.NewReader(data), nil
+	}
+	var b bytes.Buffer
+	if err := encryptStream(&b, bytes.NewReader(data), key); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b.Bytes()), nil
+}
+
+var errPlainData = fmt.Errorf("Data in objectstore is not encrypted, refuse to load it")
+
+/*
+openData returns the plain content read from driver. Unencrypted objects are
+only accepted if plain is true, see plainAllowed(), otherwise anyone able to
+write to objectstore could replace the encrypted data.
+*/
+func openData(src io.Reader, driver ObjectStoreDriver, plain bool) (io.Reader, error) {
+	r := bufio.NewReader(src)
+	header, err := r.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !isEncryptedHeader(header) {
+		if !plain {
+			return nil, errPlainData
+		}
+		return r, nil
+	}
+	key, err := getEncryptionKey(driver, false)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := decryptStream(&b, r, key); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// copyData copies the plain content read from driver to dst without holding it in memory
+func copyData(dst io.Writer, src io.Reader, driver ObjectStoreDriver, plain bool) error {
+	r := bufio.NewReader(src)
+	header, err := r.Peek(len(encryptionMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !isEncryptedHeader(header) {
+		if !plain {
+			return errPlainData
+		}
+		_, err := io.Copy(dst, r)
+		return err
+	}
+	key, err := getEncryptionKey(driver, false)
+	if err != nil {
+		return err
+	}
+	return decryptStream(dst, r, key)
+}
+
+// uploadFile uploads local file src to dst in objectstore, encrypted if needed
+func uploadFile(driver ObjectStoreDriver, src, dst string) error {
+	key, err := getEncryptionKey(driver, true)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return driver.Upload(src, dst)
+	}
+
+	encFile := src + ".enc"
+	if err := encryptFile(src, encFile, key); err != nil {
+		os.Remove(encFile)
+		return err
+	}
+	defer os.Remove(encFile)
+	return driver.Upload(encFile, dst)
+}
+
+// downloadFile downloads src from objectstore to local file dst, and decrypt it if needed
+func downloadFile(driver ObjectStoreDriver, src, dst string, plain bool) error {
+	if err := driver.Download(src, dst); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(encryptionMagic))
+	n, _ := io.ReadFull(f, header)
+	f.Close()
+	if !isEncryptedHeader(header[:n]) {
+		if !plain {
+			os.Remove(dst)
+			return errPlainData
+		}
+		return nil
+	}
+
+	key, err := getEncryptionKey(driver, false)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	decFile := dst + ".dec"
+	if err := decryptFile(dst, decFile, key); err != nil {
+		os.Remove(decFile)
+		os.Remove(dst)
+		return err
+	}
+	return os.Rename(decFile, dst)
+}
+
+func encryptFile(src, dst string, key *encryptionKey) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := encryptStream(out, in, key); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func decryptFile(src, dst string, key *encryptionKey) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := decryptStream(out, in, key); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,205 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func testKey(c byte) []byte {
+	return bytes.Repeat([]byte{c}, ENCRYPTION_KEY_SIZE)
+}
+
+func (s *TestSuite) TestEncryptionRoundTrip(c *check.C) {
+	d := newMemDriver(c)
+	setEncryptionKey(testKey(1))
+
+	for _, size := range []int{0, 1, ENCRYPTION_CHUNK_SIZE - 1, ENCRYPTION_CHUNK_SIZE, ENCRYPTION_CHUNK_SIZE*2 + 7} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		c.Assert(err, check.IsNil)
+
+		rs, err := sealData(data, d)
+		c.Assert(err, check.IsNil)
+		sealed, err := ioutil.ReadAll(rs)
+		c.Assert(err, check.IsNil)
+		if size > 16 {
+			c.Assert(bytes.Contains(sealed, data[:16]), check.Equals, false)
+		}
+
+		r, err := openData(bytes.NewReader(sealed), d, false)
+		c.Assert(err, check.IsNil)
+		plain, err := ioutil.ReadAll(r)
+		c.Assert(err, check.IsNil)
+		c.Assert(bytes.Equal(plain, data), check.Equals, true)
+	}
+}
+
+func (s *TestSuite) TestEncryptionWrongKey(c *check.C) {
+	d := newMemDriver(c)
+	setEncryptionKey(testKey(1))
+	rs, err := sealData([]byte("secret volume data"), d)
+	c.Assert(err, check.IsNil)
+	sealed, err := ioutil.ReadAll(rs)
+	c.Assert(err, check.IsNil)
+
+	setEncryptionKey(testKey(2))
+	_, err = openData(bytes.NewReader(sealed), d, false)
+	c.Assert(err, check.ErrorMatches, ".*different key.*")
+
+	setEncryptionKey(nil)
+	_, err = openData(bytes.NewReader(sealed), d, true)
+	c.Assert(err, check.ErrorMatches, ".*no encryption key.*")
+}
+
+func (s *TestSuite) TestEncryptionTamper(c *check.C) {
+	d := newMemDriver(c)
+	setEncryptionKey(testKey(1))
+	data := make([]byte, ENCRYPTION_CHUNK_SIZE*2)
+	rs, err := sealData(data, d)
+	c.Assert(err, check.IsNil)
+	sealed, err := ioutil.ReadAll(rs)
+	c.Assert(err, check.IsNil)
+
+	corrupted := append([]byte{}, sealed...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	_, err = openData(bytes.NewReader(corrupted), d, false)
+	c.Assert(err, check.ErrorMatches, ".*corrupted.*")
+
+	// Drop the last chunk
+	truncated := sealed[:encryptionHeaderSize+4+ENCRYPTION_CHUNK_SIZE+16]
+	_, err = openData(bytes.NewReader(truncated), d, false)
+	c.Assert(err, check.ErrorMatches, ".*truncated.*")
+
+	appended := append(append([]byte{}, sealed...), 0)
+	_, err = openData(bytes.NewReader(appended), d, false)
+	c.Assert(err, check.ErrorMatches, "Unexpected data found after the end .*")
+}
+
+func (s *TestSuite) TestEncryptionPlainData(c *check.C) {
+	d := newMemDriver(c)
+	r, err := openData(bytes.NewReader([]byte("{}")), d, plainAllowed(&Volume{}))
+	c.Assert(err, check.IsNil)
+	plain, err := ioutil.ReadAll(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(plain), check.Equals, "{}")
+
+	// Plain data cannot replace the encrypted one
+	_, err = openData(bytes.NewReader([]byte("{}")), d, plainAllowed(&Volume{Encrypted: true}))
+	c.Assert(err, check.ErrorMatches, ".*not encrypted.*")
+	setEncryptionKey(testKey(1))
+	_, err = openData(bytes.NewReader([]byte("{}")), d, plainAllowed(nil))
+	c.Assert(err, check.ErrorMatches, ".*not encrypted.*")
+
+	// Backup of encrypted volume replaced by plain one
+	setEncryptionKey(nil)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	loaded, err := loadVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	loaded.Encrypted = true
+	c.Assert(saveVolume(loaded, d), check.IsNil)
+	err = RestoreDeltaBlockBackup(backupURL, "", filepath.Join(c.MkDir(), "restored"), nil)
+	c.Assert(err, check.ErrorMatches, ".*not encrypted.*")
+}
+
+func (s *TestSuite) TestEncryptionConfigAndFile(c *check.C) {
+	d := newMemDriver(c)
+	setEncryptionKey(testKey(1))
+
+	volume := &Volume{Name: "vol1", Driver: "vfs", Size: 1024}
+	c.Assert(addVolume(volume, d), check.IsNil)
+	raw, exists := d.files[getVolumeFilePath("vol1")]
+	c.Assert(exists, check.Equals, true)
+	c.Assert(bytes.Contains(raw, []byte("vfs")), check.Equals, false)
+
+	loaded, err := loadVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(loaded.Encrypted, check.Equals, true)
+	c.Assert(loaded.Size, check.Equals, int64(1024))
+
+	dir := c.MkDir()
+	src := filepath.Join(dir, "src")
+	content := []byte("single file backup content")
+	c.Assert(ioutil.WriteFile(src, content, 0600), check.IsNil)
+	c.Assert(uploadFile(d, src, "file.bak"), check.IsNil)
+	c.Assert(bytes.Contains(d.files["file.bak"], content), check.Equals, false)
+	_, err = os.Stat(src + ".enc")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	dst := filepath.Join(dir, "dst")
+	c.Assert(downloadFile(d, "file.bak", dst, false), check.IsNil)
+	downloaded, err := ioutil.ReadFile(dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(downloaded, check.DeepEquals, content)
+
+	setEncryptionKey(testKey(2))
+	c.Assert(downloadFile(d, "file.bak", dst, false), check.NotNil)
+	_, err = loadVolume("vol1", d)
+	c.Assert(err, check.NotNil)
+
+	setEncryptionKey(nil)
+	c.Assert(checkVolumeEncryption(loaded), check.NotNil)
+}
+
+func (s *TestSuite) TestEncryptionKeyFile(c *check.C) {
+	dir := c.MkDir()
+	keyFile := filepath.Join(dir, "key")
+
+	c.Assert(ioutil.WriteFile(keyFile, []byte("too short"), 0600), check.IsNil)
+	c.Assert(initEncryption(keyFile, ""), check.NotNil)
+
+	c.Assert(ioutil.WriteFile(keyFile, []byte("0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20\n"), 0600), check.IsNil)
+	c.Assert(initEncryption(keyFile, ""), check.IsNil)
+	c.Assert(encryptionEnabled(), check.Equals, true)
+	c.Assert(encryptionRawKey.key[0], check.Equals, byte(1))
+
+	c.Assert(initEncryption(keyFile, "passphrase"), check.NotNil)
+
+	c.Assert(initEncryption("", "passphrase"), check.IsNil)
+	c.Assert(encryptionEnabled(), check.Equals, true)
+
+	c.Assert(initEncryption("", ""), check.IsNil)
+	c.Assert(encryptionEnabled(), check.Equals, false)
+}
+
+func (s *TestSuite) TestEncryptionPassphraseSalt(c *check.C) {
+	d1 := newMemDriver(c)
+	d2 := newMirrorMemDriver(c)
+	c.Assert(initEncryption("", "passphrase"), check.IsNil)
+
+	_, err := getEncryptionKey(d1, false)
+	c.Assert(err, check.ErrorMatches, "Cannot find encryption config.*")
+	key1, err := getEncryptionKey(d1, true)
+	c.Assert(err, check.IsNil)
+	key2, err := getEncryptionKey(d2, true)
+	c.Assert(err, check.IsNil)
+	// Same passphrase results in different keys for different destinations
+	c.Assert(key1.key, check.Not(check.DeepEquals), key2.key)
+	config1, err := loadEncryptionConfig(d1)
+	c.Assert(err, check.IsNil)
+	config2, err := loadEncryptionConfig(d2)
+	c.Assert(err, check.IsNil)
+	c.Assert(config1.Salt, check.Not(check.Equals), config2.Salt)
+
+	// Same key would be derived again from the saved salt
+	c.Assert(initEncryption("", "passphrase"), check.IsNil)
+	key, err := getEncryptionKey(d1, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.key, check.DeepEquals, key1.key)
+
+	c.Assert(inheritEncryptionConfig(config1, d2), check.ErrorMatches, ".*different key.*")
+	d3, err := GetObjectStoreDriver("mem:///"+c.TestName()+"-copy", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(inheritEncryptionConfig(config1, d3), check.IsNil)
+	key3, err := getEncryptionKey(d3, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(key3.key, check.DeepEquals, key1.key)
+}
@@ -0,0 +1,305 @@
+package objectstore
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+CheckResult is the result of checking the consistency of an objectstore.
+UnreferencedBlocks are the block files not referenced by any backup, including
+the in-progress ones. MissingBlocks are the block checksums referenced by a
+backup but not found in objectstore, indexed by backup URL.
+*/
+type CheckResult struct {
+	DestURL            string
+	Volumes            int
+	Backups            int
+	ReferencedBlocks   int
+	UnreferencedBlocks []string
+	RemovedBlocks      int
+	MissingBlocks      map[string][]string
+	MissingFiles       map[string]string
+}
+
+func (r *CheckResult) Consistent() bool {
+	return len(r.MissingBlocks) == 0 && len(r.MissingFiles) == 0
+}
+
+/*
+VerifyObjectStore walks through all the volumes in destURL, reports the blocks
+not referenced by any backup, and the backups referencing blocks or files
+missing in objectstore. Nothing would be changed.
+*/
+func VerifyObjectStore(destURL, endpointURL string) (*CheckResult, error) {
+	return checkObjectStore(destURL, endpointURL, false)
+}
+
+/*
+CollectGarbage removes the blocks not referenced by any backup in destURL. It
+only reports the blocks to be removed if dryRun is true. All the volumes would
+be locked, so it fails if backups are being created or deleted in destURL.
+*/
+func CollectGarbage(destURL, endpointURL string, dryRun bool) (*CheckResult, error) {
+	return checkObjectStore(destURL, endpointURL, !dryRun)
+}
+
+// blockSet tracks the existing and referenced blocks in a block directory
+type blockSet struct {
+	path       string
+	existing   []string
+	referenced map[string]bool
+}
+
+func newBlockSet(path string, driver ObjectStoreDriver) (*blockSet, error) {
+	existing, err := listBlockChecksums(path, driver)
+	if err != nil {
+		return nil, err
+	}
+	return &blockSet{
+		path:       path,
+		existing:   existing,
+		referenced: make(map[string]bool),
+	}, nil
+}
+
+func checkObjectStore(destURL, endpointURL string, removeUnreferenced bool) (*CheckResult, error) {
+	getDriver := GetObjectStoreDriver
+	if removeUnreferenced {
+		getDriver = getWritableObjectStoreDriver
+	}
+	driver, err := getDriver(destURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	locks := []*volumeLock{}
+	defer func() {
+		unlockVolumes(locks)
+	}()
+	if removeUnreferenced {
+		if locks, err = lockVolumes(volumeNames, "gc", driver); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &CheckResult{
+		DestURL:            driver.GetURL(),
+		UnreferencedBlocks: []string{},
+		MissingBlocks:      make(map[string][]string),
+		MissingFiles:       make(map[string]string),
+	}
+	// Blocks in a pool can only be collected after all the volumes were checked
+	pools := make(map[string]*blockSet)
+	poolNames, err := getBlockPoolNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range poolNames {
+		if pools[pool], err = newBlockSet(getPoolBlockPath(pool), driver); err != nil {
+			return nil, err
+		}
+	}
+
+	checked := make(map[string]bool)
+	poolLocks := []*blockPoolLock{}
+	defer func() {
+		unlockBlockPools(poolLocks)
+	}()
+	for {
+		for _, volumeName := range volumeNames {
+			if err := checkVolume(volumeName, destURL, driver, result, pools, removeUnreferenced); err != nil {
+				return nil, err
+			}
+			checked[volumeName] = true
+		}
+		// Volumes created after being listed may use blocks of the pools as well
+		if volumeNames, err = getNewVolumeNames(checked, driver); err != nil {
+			return nil, err
+		}
+		if removeUnreferenced && len(volumeNames) == 0 {
+			// New volumes can no longer take blocks from the pools once
+			// locked, but may have done so before. Pools are locked after
+			// volumes, so they're released before locking the new volumes.
+			if poolLocks, err = lockBlockPools(poolNames, "gc", driver); err != nil {
+				return nil, err
+			}
+			if volumeNames, err = getNewVolumeNames(checked, driver); err != nil {
+				return nil, err
+			}
+			if len(volumeNames) != 0 {
+				unlockBlockPools(poolLocks)
+				poolLocks = nil
+			}
+		}
+		if len(volumeNames) == 0 {
+			break
+		}
+		if !removeUnreferenced {
+			continue
+		}
+		newLocks, err := lockVolumes(volumeNames, "gc", driver)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, newLocks...)
+	}
+	for _, pool := range poolNames {
+		if err := collectBlocks(pools[pool], driver, result, removeUnreferenced); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(result.UnreferencedBlocks)
+	return result, nil
+}
+
+// getNewVolumeNames returns the volumes in driver not in checked
+func getNewVolumeNames(checked map[string]bool, driver ObjectStoreDriver) ([]string, error) {
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, volumeName := range volumeNames {
+		if !checked[volumeName] {
+			result = append(result, volumeName)
+		}
+	}
+	return result, nil
+}
+
+func checkVolume(volumeName, destURL string, driver ObjectStoreDriver, result *CheckResult, pools map[string]*blockSet, removeUnreferenced bool) error {
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_LIST,
+		LOG_FIELD_VOLUME:   volumeName,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debug("Checking objectstore volume")
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	backupNames, err := getBackupNamesForVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	partials, err := loadPartialBackupsForVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	blocks := pools[volume.BlockPool]
+	if blocks == nil {
+		if blocks, err = newBlockSet(volume.getBlockPath(), driver); err != nil {
+			return err
+		}
+	}
+	result.Volumes++
+
+	existingBlocks := make(map[string]bool)
+	for _, checksum := range blocks.existing {
+		existingBlocks[checksum] = true
+	}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(backupName, volumeName, driver)
+		if err != nil {
+			return err
+		}
+		result.Backups++
+		backupURL := encodeBackupURL(backup.Name, backup.VolumeName, destURL)
+
+		if backup.SingleFile.FilePath != "" {
+			if !driver.FileExists(backup.SingleFile.FilePath) {
+				result.MissingFiles[backupURL] = backup.SingleFile.FilePath
+			}
+			continue
+		}
+
+		missing := []string{}
+		for _, checksum := range getBlockChecksums(backup.Blocks) {
+			blocks.referenced[checksum] = true
+			if !existingBlocks[checksum] {
+				missing = append(missing, checksum)
+			}
+		}
+		if len(missing) != 0 {
+			sort.Strings(missing)
+			result.MissingBlocks[backupURL] = missing
+		}
+	}
+	for _, partial := range partials {
+		for _, blk := range partial.Blocks {
+			blocks.referenced[blk.BlockChecksum] = true
+		}
+	}
+	if volume.BlockPool != "" {
+		return nil
+	}
+	return collectBlocks(blocks, driver, result, removeUnreferenced)
+}
+
+func collectBlocks(blocks *blockSet, driver ObjectStoreDriver, result *CheckResult, removeUnreferenced bool) error {
+	unreferenced := []string{}
+	for _, checksum := range blocks.existing {
+		if blocks.referenced[checksum] {
+			result.ReferencedBlocks++
+		} else {
+			unreferenced = append(unreferenced, getBlockFilePathInDir(blocks.path, checksum))
+		}
+	}
+	result.UnreferencedBlocks = append(result.UnreferencedBlocks, unreferenced...)
+	if !removeUnreferenced || len(unreferenced) == 0 {
+		return nil
+	}
+	if err := driver.Remove(unreferenced...); err != nil {
+		return err
+	}
+	result.RemovedBlocks += len(unreferenced)
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
+		LOG_FIELD_DEST_URL: driver.GetURL(),
+	}).Debugf("Removed %v unreferenced blocks in %v", len(unreferenced), blocks.path)
+	return nil
+}
+
+// listBlockChecksums returns the checksums of all block files in blockPath
+func listBlockChecksums(blockPath string, driver ObjectStoreDriver) ([]string, error) {
+	result := []string{}
+	lv1Dirs, err := driver.List(blockPath)
+	// Directory doesn't exist
+	if err != nil {
+		return result, nil
+	}
+	for _, lv1 := range lv1Dirs {
+		lv1Path := filepath.Join(blockPath, lv1)
+		lv2Dirs, err := driver.List(lv1Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, lv2 := range lv2Dirs {
+			lv2Path := filepath.Join(lv1Path, lv2)
+			files, err := driver.List(lv2Path)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				// Skip temporary files left by driver
+				if !strings.HasSuffix(f, BLOCK_SUFFIX) {
+					continue
+				}
+				result = append(result, strings.TrimSuffix(f, BLOCK_SUFFIX))
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package objectstore
+
+import (
+	"bytes"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCollectGarbage(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	result, err := VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Consistent(), check.Equals, true)
+	c.Assert(result.Volumes, check.Equals, 1)
+	c.Assert(result.Backups, check.Equals, 1)
+	c.Assert(result.ReferencedBlocks, check.Equals, 3)
+	c.Assert(result.UnreferencedBlocks, check.HasLen, 0)
+
+	// Orphan block left by a failed backup, and temporary file left by driver
+	orphan := getBlockFilePath("vol1", "0123456789abcdef")
+	c.Assert(d.Write(orphan, bytes.NewReader([]byte("orphan"))), check.IsNil)
+	c.Assert(d.Write(orphan+".tmp", bytes.NewReader([]byte("orphan"))), check.IsNil)
+
+	result, err = CollectGarbage(d.GetURL(), "", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.UnreferencedBlocks, check.DeepEquals, []string{orphan})
+	c.Assert(result.RemovedBlocks, check.Equals, 0)
+	c.Assert(d.FileExists(orphan), check.Equals, true)
+
+	result, err = CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.RemovedBlocks, check.Equals, 1)
+	c.Assert(d.FileExists(orphan), check.Equals, false)
+
+	// Remove a referenced block
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	checksum := backup.Blocks[0].BlockChecksum
+	c.Assert(d.Remove(getBlockFilePath("vol1", checksum)), check.IsNil)
+
+	result, err = VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Consistent(), check.Equals, false)
+	c.Assert(result.MissingBlocks[backupURL], check.DeepEquals, []string{checksum})
+}
+
+func (s *TestSuite) TestCollectGarbageKeepPartial(c *check.C) {
+	c.Assert(initStateDir(c.MkDir()), check.IsNil)
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+	ops.failAt = 3 * DEFAULT_BLOCK_SIZE
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.NotNil)
+
+	blocks, err := listBlockChecksums(getBlockPath("vol1"), d)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(blocks) > 0, check.Equals, true)
+
+	result, err := CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.RemovedBlocks, check.Equals, 0)
+
+	ops.failAt = -1
+	_, err = CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	result, err = VerifyObjectStore(d.GetURL(), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Consistent(), check.Equals, true)
+}
@@ -0,0 +1,535 @@
+package objectstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+/*
+A volume in objectstore is locked while its backups are being created or
+deleted, or its blocks are being collected, so daemons on different hosts
+sharing a destination won't break the incremental chain of each other:
+
+	convoy-objectstore/locks/<volume>.lock
+
+The lock is a lease, renewed by the holder every LOCK_RENEW_INTERVAL, and can
+be broken by others once expired, e.g. if the holder crashed. Objectstores
+provide no conditional write, so the lock is written and read again after
+lockSettleTime to make sure no one else took it at the same time. The lease
+is plain JSON, so it can be read without the encryption key.
+
+Operations on the same volume in one daemon wait for each other instead of
+failing.
+
+Volumes sharing a block pool don't lock each other, so the pool is locked as
+well while blocks are added to or removed from it:
+
+	convoy-objectstore/locks/blockpools/<pool>/<id>.lock
+
+Backups, copies and imports into the pool take shared locks, while removing
+blocks from the pool takes an exclusive lock, so a block found in the pool
+won't be removed before it's recorded in the refs of the volume. Each holder
+writes its own lease, which is renewed and broken the same as the lock of a
+volume. Pools are always locked after volumes.
+*/
+
+const (
+	LOCK_DIRECTORY = "locks"
+	LOCK_SUFFIX    = ".lock"
+
+	LOCK_LEASE_DURATION = 5 * time.Minute
+	LOCK_RENEW_INTERVAL = time.Minute
+)
+
+var (
+	// Long enough for the concurrent writes of the lock to be visible
+	lockSettleTime = time.Second
+	lockOwner      = getLockOwner()
+
+	localLocks     = make(map[string]*sync.Mutex)
+	localPoolLocks = make(map[string]*sync.RWMutex)
+	localLocksLock sync.Mutex
+)
+
+type volumeLease struct {
+	ID           string
+	Owner        string
+	Operation    string
+	AcquiredTime string
+	ExpireTime   string
+	// Only used by the locks of block pools
+	Exclusive bool `json:",omitempty"`
+}
+
+func (l *volumeLease) expired() bool {
+	expireTime, err := time.Parse(time.RubyDate, l.ExpireTime)
+	return err != nil || time.Now().After(expireTime)
+}
+
+// VolumeLockedError is returned if the volume is locked by another daemon
+type VolumeLockedError struct {
+	VolumeName string
+	DestURL    string
+	Owner      string
+	Operation  string
+	ExpireTime string
+}
+
+func (e *VolumeLockedError) Error() string {
+	return fmt.Sprintf("Volume %v in %v is locked by %v for %v, the lock would expire at %v if not renewed",
+		e.VolumeName, e.DestURL, e.Owner, e.Operation, e.ExpireTime)
+}
+
+type volumeLock struct {
+	volumeName string
+	driver     ObjectStoreDriver
+	lease      volumeLease
+	local      *sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func getLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v(pid %v)", hostname, os.Getpid())
+}
+
+func getLockFilePath(volumeName string) string {
+	return filepath.Join(OBJECTSTORE_BASE, LOCK_DIRECTORY, volumeName+LOCK_SUFFIX)
+}
+
+func getLocalLock(volumeName string, driver ObjectStoreDriver) *sync.Mutex {
+	localLocksLock.Lock()
+	defer localLocksLock.Unlock()
+
+	key := driver.GetURL() + "|" + volumeName
+	if localLocks[key] == nil {
+		localLocks[key] = &sync.Mutex{}
+	}
+	return localLocks[key]
+}
+
+func newLease(operation string, exclusive bool) volumeLease {
+	now := time.Now()
+	return volumeLease{
+		ID:           util.NewUUID(),
+		Owner:        lockOwner,
+		Operation:    operation,
+		AcquiredTime: now.Format(time.RubyDate),
+		ExpireTime:   now.Add(LOCK_LEASE_DURATION).Format(time.RubyDate),
+		Exclusive:    exclusive,
+	}
+}
+
+// loadVolumeLease returns nil if the volume isn't locked
+func loadVolumeLease(volumeName string, driver ObjectStoreDriver) (*volumeLease, error) {
+	return loadLease(getLockFilePath(volumeName), driver)
+}
+
+// loadLease returns nil if filePath doesn't exist
+func loadLease(filePath string, driver ObjectStoreDriver) (*volumeLease, error) {
+	if !driver.FileExists(filePath) {
+		return nil, nil
+	}
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	lease := &volumeLease{}
+	if err := json.NewDecoder(rc).Decode(lease); err != nil {
+		// Taken as expired, so it can be broken
+		log.Warnf("Invalid lock %v in %v: %v", filePath, driver.GetURL(), err)
+		return &volumeLease{}, nil
+	}
+	return lease, nil
+}
+
+func saveVolumeLease(volumeName string, lease *volumeLease, driver ObjectStoreDriver) error {
+	return saveLease(getLockFilePath(volumeName), lease, driver)
+}
+
+func saveLease(filePath string, lease *volumeLease, driver ObjectStoreDriver) error {
+	j, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return driver.Write(filePath, bytes.NewReader(j))
+}
+
+func (l *volumeLock) lockedError(lease *volumeLease) error {
+	return &VolumeLockedError{
+		VolumeName: l.volumeName,
+		DestURL:    l.driver.GetURL(),
+		Owner:      lease.Owner,
+		Operation:  lease.Operation,
+		ExpireTime: lease.ExpireTime,
+	}
+}
+
+/*
+lockVolume acquires the lock of the volume in driver for operation, waiting
+for the other operations on the volume in this daemon. It fails with
+VolumeLockedError if the volume is locked by another daemon. The lock must be
+released by unlock.
+*/
+func lockVolume(volumeName, operation string, driver ObjectStoreDriver) (*volumeLock, error) {
+	capabilities, err := GetCapabilities(driver.GetURL())
+	if err != nil {
+		return nil, err
+	}
+	if capabilities.ReadOnly {
+		return nil, fmt.Errorf("Objectstore %v is read-only", driver.GetURL())
+	}
+	l := &volumeLock{
+		volumeName: volumeName,
+		driver:     driver,
+		local:      getLocalLock(volumeName, driver),
+	}
+	l.local.Lock()
+	if err := l.acquire(operation); err != nil {
+		l.local.Unlock()
+		return nil, err
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.renew()
+	return l, nil
+}
+
+func (l *volumeLock) acquire(operation string) error {
+	lease, err := loadVolumeLease(l.volumeName, l.driver)
+	if err != nil {
+		return err
+	}
+	if lease != nil {
+		if !lease.expired() {
+			return l.lockedError(lease)
+		}
+		log.Warnf("Breaking expired lock of volume %v in %v held by %v for %v",
+			l.volumeName, l.driver.GetURL(), lease.Owner, lease.Operation)
+	}
+
+	l.lease = newLease(operation, false)
+	if err := saveVolumeLease(l.volumeName, &l.lease, l.driver); err != nil {
+		return err
+	}
+	time.Sleep(lockSettleTime)
+	if err := l.check(); err != nil {
+		return err
+	}
+	log.Debugf("Locked volume %v in %v for %v", l.volumeName, l.driver.GetURL(), operation)
+	return nil
+}
+
+// check makes sure the lock is still held, before anything is committed
+func (l *volumeLock) check() error {
+	lease, err := loadVolumeLease(l.volumeName, l.driver)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return fmt.Errorf("Lock of volume %v in %v was lost", l.volumeName, l.driver.GetURL())
+	}
+	if lease.ID != l.lease.ID {
+		return l.lockedError(lease)
+	}
+	return nil
+}
+
+func (l *volumeLock) renew() {
+	renewLease(getLockFilePath(l.volumeName), "volume "+l.volumeName, &l.lease, l.check, l.driver, l.stop, l.done)
+}
+
+// renewLease renews lease in filePath until stop is closed, or check failed
+func renewLease(filePath, name string, lease *volumeLease, check func() error, driver ObjectStoreDriver, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(LOCK_RENEW_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := check(); err != nil {
+			// The operation would fail by check before committing
+			log.Errorf("Failed to renew lock of %v in %v: %v", name, driver.GetURL(), err)
+			return
+		}
+		lease.ExpireTime = time.Now().Add(LOCK_LEASE_DURATION).Format(time.RubyDate)
+		if err := saveLease(filePath, lease, driver); err != nil {
+			log.Warnf("Failed to renew lock of %v in %v, retry later: %v", name, driver.GetURL(), err)
+		}
+	}
+}
+
+// unlock releases the lock, failures would only be logged since the lock would expire anyway
+func (l *volumeLock) unlock() {
+	defer l.local.Unlock()
+
+	close(l.stop)
+	<-l.done
+	if err := l.check(); err != nil {
+		log.Warnf("Lock of volume %v in %v was not held when releasing: %v", l.volumeName, l.driver.GetURL(), err)
+		return
+	}
+	if err := l.driver.Remove(getLockFilePath(l.volumeName)); err != nil {
+		log.Warnf("Failed to release lock of volume %v in %v: %v", l.volumeName, l.driver.GetURL(), err)
+		return
+	}
+	log.Debugf("Unlocked volume %v in %v", l.volumeName, l.driver.GetURL())
+}
+
+// lockVolumes locks the volumes in order, nothing would be locked if any of them failed
+func lockVolumes(volumeNames []string, operation string, driver ObjectStoreDriver) ([]*volumeLock, error) {
+	names := make([]string, len(volumeNames))
+	copy(names, volumeNames)
+	sort.Strings(names)
+	locks := []*volumeLock{}
+	for _, name := range names {
+		l, err := lockVolume(name, operation, driver)
+		if err != nil {
+			unlockVolumes(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+func unlockVolumes(locks []*volumeLock) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		locks[i].unlock()
+	}
+}
+
+// BlockPoolLockedError is returned if the block pool is locked by another daemon in a conflicting mode
+type BlockPoolLockedError struct {
+	BlockPool  string
+	DestURL    string
+	Owner      string
+	Operation  string
+	ExpireTime string
+}
+
+func (e *BlockPoolLockedError) Error() string {
+	return fmt.Sprintf("Block pool %v in %v is locked by %v for %v, the lock would expire at %v if not renewed",
+		e.BlockPool, e.DestURL, e.Owner, e.Operation, e.ExpireTime)
+}
+
+type blockPoolLock struct {
+	pool   string
+	driver ObjectStoreDriver
+	lease  volumeLease
+	local  *sync.RWMutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func getBlockPoolLockPath(pool string) string {
+	return filepath.Join(OBJECTSTORE_BASE, LOCK_DIRECTORY, BLOCK_POOL_DIRECTORY, pool)
+}
+
+func (l *blockPoolLock) getLeaseFilePath() string {
+	return filepath.Join(getBlockPoolLockPath(l.pool), l.lease.ID+LOCK_SUFFIX)
+}
+
+func getLocalBlockPoolLock(pool string, driver ObjectStoreDriver) *sync.RWMutex {
+	localLocksLock.Lock()
+	defer localLocksLock.Unlock()
+
+	key := driver.GetURL() + "|" + pool
+	if localPoolLocks[key] == nil {
+		localPoolLocks[key] = &sync.RWMutex{}
+	}
+	return localPoolLocks[key]
+}
+
+/*
+lockBlockPool acquires the lock of the block pool in driver for operation,
+exclusive or shared, waiting for the conflicting operations on the pool in
+this daemon. It fails with BlockPoolLockedError if a conflicting lock is held
+by another daemon. It returns nil if pool is empty, which is fine to be
+checked or unlocked.
+*/
+func lockBlockPool(pool string, exclusive bool, operation string, driver ObjectStoreDriver) (*blockPoolLock, error) {
+	if pool == "" {
+		return nil, nil
+	}
+	capabilities, err := GetCapabilities(driver.GetURL())
+	if err != nil {
+		return nil, err
+	}
+	if capabilities.ReadOnly {
+		return nil, fmt.Errorf("Objectstore %v is read-only", driver.GetURL())
+	}
+	l := &blockPoolLock{
+		pool:   pool,
+		driver: driver,
+		local:  getLocalBlockPoolLock(pool, driver),
+		lease:  newLease(operation, exclusive),
+	}
+	l.lockLocal()
+	if err := l.acquire(); err != nil {
+		l.unlockLocal()
+		return nil, err
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go renewLease(l.getLeaseFilePath(), "block pool "+l.pool, &l.lease, l.check, l.driver, l.stop, l.done)
+	return l, nil
+}
+
+func (l *blockPoolLock) lockLocal() {
+	if l.lease.Exclusive {
+		l.local.Lock()
+	} else {
+		l.local.RLock()
+	}
+}
+
+func (l *blockPoolLock) unlockLocal() {
+	if l.lease.Exclusive {
+		l.local.Unlock()
+	} else {
+		l.local.RUnlock()
+	}
+}
+
+func (l *blockPoolLock) lockedError(lease *volumeLease) error {
+	return &BlockPoolLockedError{
+		BlockPool:  l.pool,
+		DestURL:    l.driver.GetURL(),
+		Owner:      lease.Owner,
+		Operation:  lease.Operation,
+		ExpireTime: lease.ExpireTime,
+	}
+}
+
+func (l *blockPoolLock) acquire() error {
+	if err := l.checkConflict(); err != nil {
+		return err
+	}
+	if err := saveLease(l.getLeaseFilePath(), &l.lease, l.driver); err != nil {
+		return err
+	}
+	time.Sleep(lockSettleTime)
+	if err := l.checkConflict(); err != nil {
+		// Both would back off if locked by others at the same time
+		if removeErr := l.driver.Remove(l.getLeaseFilePath()); removeErr != nil {
+			log.Warnf("Failed to remove lock of block pool %v in %v: %v", l.pool, l.driver.GetURL(), removeErr)
+		}
+		return err
+	}
+	log.Debugf("Locked block pool %v in %v for %v, exclusive %v", l.pool, l.driver.GetURL(), l.lease.Operation, l.lease.Exclusive)
+	return nil
+}
+
+// checkConflict fails if others hold the lock of the pool in a conflicting mode, expired locks would be broken
+func (l *blockPoolLock) checkConflict() error {
+	lockPath := getBlockPoolLockPath(l.pool)
+	fileList, err := l.driver.List(lockPath)
+	if err != nil {
+		// Directory doesn't exist
+		return nil
+	}
+	for _, f := range fileList {
+		if !strings.HasSuffix(f, LOCK_SUFFIX) || strings.TrimSuffix(f, LOCK_SUFFIX) == l.lease.ID {
+			continue
+		}
+		filePath := filepath.Join(lockPath, f)
+		lease, err := loadLease(filePath, l.driver)
+		if err != nil {
+			return err
+		}
+		if lease == nil {
+			// Released
+			continue
+		}
+		if lease.expired() {
+			log.Warnf("Breaking expired lock of block pool %v in %v held by %v for %v",
+				l.pool, l.driver.GetURL(), lease.Owner, lease.Operation)
+			if err := l.driver.Remove(filePath); err != nil {
+				return err
+			}
+			continue
+		}
+		if l.lease.Exclusive || lease.Exclusive {
+			return l.lockedError(lease)
+		}
+	}
+	return nil
+}
+
+// check makes sure the lock is still held, before anything is committed
+func (l *blockPoolLock) check() error {
+	if l == nil {
+		return nil
+	}
+	lease, err := loadLease(l.getLeaseFilePath(), l.driver)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return fmt.Errorf("Lock of block pool %v in %v was lost", l.pool, l.driver.GetURL())
+	}
+	return nil
+}
+
+// unlock releases the lock, failures would only be logged since the lock would expire anyway
+func (l *blockPoolLock) unlock() {
+	if l == nil {
+		return
+	}
+	defer l.unlockLocal()
+
+	close(l.stop)
+	<-l.done
+	if err := l.check(); err != nil {
+		log.Warnf("Lock of block pool %v in %v was not held when releasing: %v", l.pool, l.driver.GetURL(), err)
+		return
+	}
+	if err := l.driver.Remove(l.getLeaseFilePath()); err != nil {
+		log.Warnf("Failed to release lock of block pool %v in %v: %v", l.pool, l.driver.GetURL(), err)
+		return
+	}
+	log.Debugf("Unlocked block pool %v in %v", l.pool, l.driver.GetURL())
+}
+
+// lockBlockPools locks the pools exclusively in order, nothing would be locked if any of them failed
+func lockBlockPools(pools []string, operation string, driver ObjectStoreDriver) ([]*blockPoolLock, error) {
+	names := make([]string, len(pools))
+	copy(names, pools)
+	sort.Strings(names)
+	locks := []*blockPoolLock{}
+	for _, name := range names {
+		l, err := lockBlockPool(name, true, operation, driver)
+		if err != nil {
+			unlockBlockPools(locks)
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+func unlockBlockPools(locks []*blockPoolLock) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		locks[i].unlock()
+	}
+}
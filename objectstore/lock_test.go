@@ -0,0 +1,210 @@
+package objectstore
+
+import (
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func saveOtherLease(c *check.C, volumeName string, expireTime time.Time, d ObjectStoreDriver) {
+	c.Assert(saveVolumeLease(volumeName, &volumeLease{
+		ID:         "other",
+		Owner:      "otherhost(pid 1)",
+		Operation:  "backup",
+		ExpireTime: expireTime.Format(time.RubyDate),
+	}, d), check.IsNil)
+}
+
+func saveOtherPoolLease(c *check.C, pool string, exclusive bool, expireTime time.Time, d ObjectStoreDriver) string {
+	filePath := filepath.Join(getBlockPoolLockPath(pool), "other"+LOCK_SUFFIX)
+	c.Assert(saveLease(filePath, &volumeLease{
+		ID:         "other",
+		Owner:      "otherhost(pid 1)",
+		Operation:  "backup",
+		ExpireTime: expireTime.Format(time.RubyDate),
+		Exclusive:  exclusive,
+	}, d), check.IsNil)
+	return filePath
+}
+
+func (s *TestSuite) TestVolumeLock(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.FileExists(getLockFilePath("vol1")), check.Equals, false)
+
+	// Locked by another daemon
+	saveOtherLease(c, "vol1", time.Now().Add(time.Minute), d)
+	_, err = CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.ErrorMatches, "Volume vol1 in .* is locked by otherhost\\(pid 1\\) for backup.*")
+	_, ok := err.(*VolumeLockedError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(DeleteDeltaBlockBackup(backupURL, ""), check.FitsTypeOf, &VolumeLockedError{})
+	_, err = CollectGarbage(d.GetURL(), "", false)
+	c.Assert(err, check.FitsTypeOf, &VolumeLockedError{})
+	// Dry run doesn't need the lock
+	_, err = CollectGarbage(d.GetURL(), "", true)
+	c.Assert(err, check.IsNil)
+	// Other volumes are not affected
+	_, err = CreateDeltaBlockBackup(&Volume{Name: "vol2", Driver: "devicemapper", Size: volume.Size},
+		&Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	// Expired lock is broken
+	saveOtherLease(c, "vol1", time.Now().Add(-time.Minute), d)
+	c.Assert(DeleteDeltaBlockBackup(backupURL, ""), check.IsNil)
+	c.Assert(d.FileExists(getLockFilePath("vol1")), check.Equals, false)
+}
+
+func (s *TestSuite) TestVolumeLockLost(c *check.C) {
+	d := newMemDriver(c)
+	lock, err := lockVolume("vol1", "backup", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.check(), check.IsNil)
+
+	// Broken by another daemon, e.g. after being expired
+	saveOtherLease(c, "vol1", time.Now().Add(time.Minute), d)
+	c.Assert(lock.check(), check.FitsTypeOf, &VolumeLockedError{})
+	lock.unlock()
+	lease, err := loadVolumeLease("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(lease.ID, check.Equals, "other")
+
+	c.Assert(d.Remove(getLockFilePath("vol1")), check.IsNil)
+	lock, err = lockVolume("vol1", "backup", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.Remove(getLockFilePath("vol1")), check.IsNil)
+	c.Assert(lock.check(), check.ErrorMatches, "Lock of volume vol1 .* was lost")
+	lock.unlock()
+
+	ro, err := GetObjectStoreDriver("memro:///"+c.TestName(), "")
+	c.Assert(err, check.IsNil)
+	_, err = lockVolume("vol1", "backup", ro)
+	c.Assert(err, check.ErrorMatches, ".*read-only")
+}
+
+func (s *TestSuite) TestVolumeLockLocal(c *check.C) {
+	d := newMemDriver(c)
+	lock, err := lockVolume("vol1", "backup", d)
+	c.Assert(err, check.IsNil)
+
+	// Operations on the same volume in this daemon wait for each other
+	locked := make(chan *volumeLock)
+	go func() {
+		l, err := lockVolume("vol1", "delete", d)
+		c.Check(err, check.IsNil)
+		locked <- l
+	}()
+	select {
+	case <-locked:
+		c.Fatal("Volume was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.unlock()
+	l := <-locked
+	c.Assert(l, check.NotNil)
+	c.Assert(l.lease.Operation, check.Equals, "delete")
+	l.unlock()
+
+	locks, err := lockVolumes([]string{"vol2", "vol1"}, "gc", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(locks, check.HasLen, 2)
+	saveOtherLease(c, "vol3", time.Now().Add(time.Minute), d)
+	_, err = lockVolumes([]string{"vol3", "vol4"}, "gc", d)
+	c.Assert(err, check.FitsTypeOf, &VolumeLockedError{})
+	unlockVolumes(locks)
+	c.Assert(d.FileExists(getLockFilePath("vol1")), check.Equals, false)
+	c.Assert(d.FileExists(getLockFilePath("vol2")), check.Equals, false)
+	c.Assert(d.FileExists(getLockFilePath("vol4")), check.Equals, false)
+}
+
+func (s *TestSuite) TestBlockPoolLock(c *check.C) {
+	d := newMemDriver(c)
+	nilLock, err := lockBlockPool("", true, "delete", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(nilLock.check(), check.IsNil)
+	nilLock.unlock()
+
+	// Shared locks don't conflict with each other
+	otherLease := saveOtherPoolLease(c, "gzip", false, time.Now().Add(time.Minute), d)
+	lock, err := lockBlockPool("gzip", false, "backup", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.check(), check.IsNil)
+	lock.unlock()
+	c.Assert(d.FileExists(lock.getLeaseFilePath()), check.Equals, false)
+
+	_, err = lockBlockPool("gzip", true, "delete", d)
+	c.Assert(err, check.ErrorMatches, "Block pool gzip in .* is locked by otherhost\\(pid 1\\) for backup.*")
+	c.Assert(err, check.FitsTypeOf, &BlockPoolLockedError{})
+	fileList, err := d.List(getBlockPoolLockPath("gzip"))
+	c.Assert(err, check.IsNil)
+	c.Assert(fileList, check.DeepEquals, []string{"other" + LOCK_SUFFIX})
+
+	saveOtherPoolLease(c, "gzip", true, time.Now().Add(time.Minute), d)
+	_, err = lockBlockPool("gzip", false, "backup", d)
+	c.Assert(err, check.FitsTypeOf, &BlockPoolLockedError{})
+	// Other pools are not affected
+	lock, err = lockBlockPool("lz4", true, "delete", d)
+	c.Assert(err, check.IsNil)
+	lock.unlock()
+
+	// Expired lock is broken
+	saveOtherPoolLease(c, "gzip", true, time.Now().Add(-time.Minute), d)
+	lock, err = lockBlockPool("gzip", true, "delete", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.FileExists(otherLease), check.Equals, false)
+
+	c.Assert(d.Remove(lock.getLeaseFilePath()), check.IsNil)
+	c.Assert(lock.check(), check.ErrorMatches, "Lock of block pool gzip .* was lost")
+	lock.unlock()
+
+	ro, err := GetObjectStoreDriver("memro:///"+c.TestName(), "")
+	c.Assert(err, check.IsNil)
+	_, err = lockBlockPool("gzip", false, "backup", ro)
+	c.Assert(err, check.ErrorMatches, ".*read-only")
+}
+
+func (s *TestSuite) TestBlockPoolLockLocal(c *check.C) {
+	d := newMemDriver(c)
+	lock1, err := lockBlockPool("gzip", false, "backup", d)
+	c.Assert(err, check.IsNil)
+	lock2, err := lockBlockPool("gzip", false, "backup", d)
+	c.Assert(err, check.IsNil)
+
+	// Removing blocks waits for the backups into the pool in this daemon
+	locked := make(chan *blockPoolLock)
+	go func() {
+		l, err := lockBlockPool("gzip", true, "delete", d)
+		c.Check(err, check.IsNil)
+		locked <- l
+	}()
+	lock1.unlock()
+	select {
+	case <-locked:
+		c.Fatal("Block pool was locked exclusively while shared")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock2.unlock()
+	l := <-locked
+	c.Assert(l, check.NotNil)
+	c.Assert(l.lease.Exclusive, check.Equals, true)
+	l.unlock()
+
+	locks, err := lockBlockPools([]string{"lz4", "gzip"}, "gc", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(locks, check.HasLen, 2)
+	saveOtherPoolLease(c, "zstd", false, time.Now().Add(time.Minute), d)
+	_, err = lockBlockPools([]string{"none", "zstd"}, "gc", d)
+	c.Assert(err, check.FitsTypeOf, &BlockPoolLockedError{})
+	unlockBlockPools(locks)
+	for _, pool := range []string{"gzip", "lz4", "none"} {
+		fileList, err := d.List(getBlockPoolLockPath(pool))
+		if err == nil {
+			c.Assert(fileList, check.HasLen, 0)
+		}
+	}
+}
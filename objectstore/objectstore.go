@@ -4,21 +4,41 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/rancher/convoy/util"
 )
 
+const (
+	BACKUP_FORMAT_DELTA_BLOCK = "deltablock"
+	BACKUP_FORMAT_SINGLE_FILE = "singlefile"
+
+	// Labels of backup are shown as BACKUP_LABEL_PREFIX + key in backup info
+	BACKUP_LABEL_PREFIX = "Label."
+)
+
 type Volume struct {
 	Name           string
 	Driver         string
 	Size           int64
 	CreatedTime    string
 	LastBackupName string
+	Encrypted      bool `json:",omitempty"`
+
+	// Decided when the volume was added to objectstore, empty for 2MB and gzip
+	BlockSize         int64  `json:",omitempty"`
+	CompressionMethod string `json:",omitempty"`
+	// Empty if blocks are stored under the volume
+	BlockPool string `json:",omitempty"`
 }
 
 type Snapshot struct {
 	Name        string
 	CreatedTime string
+
+	// Recorded in the backup of the snapshot
+	Labels      map[string]string
+	Description string
 }
 
 type Backup struct {
@@ -28,9 +48,13 @@ type Backup struct {
 	SnapshotName      string
 	SnapshotCreatedAt string
 	CreatedTime       string
+	Labels            map[string]string `json:",omitempty"`
+	Description       string            `json:",omitempty"`
 
-	Blocks     []BlockMapping `json:",omitempty"`
-	SingleFile BackupFile     `json:",omitempty"`
+	BlockSize         int64          `json:",omitempty"`
+	CompressionMethod string         `json:",omitempty"`
+	Blocks            []BlockMapping `json:",omitempty"`
+	SingleFile        BackupFile     `json:",omitempty"`
 }
 
 func addVolume(volume *Volume, driver ObjectStoreDriver) error {
@@ -38,15 +62,59 @@ func addVolume(volume *Volume, driver ObjectStoreDriver) error {
 		return nil
 	}
 
+	volume.Encrypted = encryptionEnabled()
+	// Blocks are shared between backups of the volume, so the format cannot be
+	// changed afterwards
+	volume.BlockSize = blockSize
+	volume.CompressionMethod = compressionMethod
+	if sharedBlocks {
+		pool, err := getBlockPoolName(compressionMethod, driver)
+		if err != nil {
+			return err
+		}
+		volume.BlockPool = pool
+	}
+
 	if err := saveVolume(volume, driver); err != nil {
 		log.Error("Fail add volume ", volume.Name)
 		return err
 	}
+	if volume.BlockPool != "" {
+		// Join the pool before any block is uploaded
+		if err := addBlockPoolRefs(volume, nil, driver); err != nil {
+			return err
+		}
+	}
 	log.Debug("Added objectstore volume ", volume.Name)
 
 	return nil
 }
 
+// checkVolumeEncryption prevents mixing encrypted and plain data of a volume
+func checkVolumeEncryption(volume *Volume) error {
+	if volume.Encrypted != encryptionEnabled() {
+		if volume.Encrypted {
+			return fmt.Errorf("Volume %v in objectstore is encrypted, but no encryption key was configured", volume.Name)
+		}
+		return fmt.Errorf("Volume %v in objectstore was backed up without encryption, cannot add encrypted backup to it", volume.Name)
+	}
+	return nil
+}
+
+func (v *Volume) getBlockSize() int64 {
+	if v.BlockSize == 0 {
+		return DEFAULT_BLOCK_SIZE
+	}
+	return v.BlockSize
+}
+
+func (b *Backup) getBlockSize() int64 {
+	if b.BlockSize == 0 {
+		return DEFAULT_BLOCK_SIZE
+	}
+	return b.BlockSize
+}
+
 func removeVolume(volumeName string, driver ObjectStoreDriver) error {
 	if !volumeExists(volumeName, driver) {
 		return fmt.Errorf("Volume %v doesn't exist in objectstore", volumeName)
@@ -62,10 +130,21 @@ func removeVolume(volumeName string, driver ObjectStoreDriver) error {
 	return nil
 }
 
+/*
+encodeBackupURL keeps the options in the query of destURL, e.g. for encryption
+of S3, so destURL should be the one given by the caller rather than GetURL() of
+the driver, which doesn't have them. destURL can be a backup URL as well.
+*/
 func encodeBackupURL(backupName, volumeName, destURL string) string {
 	v := url.Values{}
-	v.Add("volume", volumeName)
-	v.Add("backup", backupName)
+	if i := strings.Index(destURL, "?"); i >= 0 {
+		if query, err := url.ParseQuery(destURL[i+1:]); err == nil {
+			v = query
+		}
+		destURL = destURL[:i]
+	}
+	v.Set("volume", volumeName)
+	v.Set("backup", backupName)
 	return destURL + "?" + v.Encode()
 }
 
@@ -83,7 +162,7 @@ func decodeBackupURL(backupURL string) (string, string, error) {
 	return backupName, volumeName, nil
 }
 
-func addListVolume(resp map[string]map[string]string, volumeName string, driver ObjectStoreDriver, storageDriverName string) error {
+func addListVolume(resp map[string]map[string]string, volumeName, destURL string, driver ObjectStoreDriver, storageDriverName string) error {
 	if volumeName == "" {
 		return fmt.Errorf("Invalid empty volume Name")
 	}
@@ -107,7 +186,7 @@ func addListVolume(resp map[string]map[string]string, volumeName string, driver
 		if err != nil {
 			return err
 		}
-		r := fillBackupInfo(backup, volume, driver.GetURL())
+		r := fillBackupInfo(backup, volume, destURL)
 		resp[r["BackupURL"]] = r
 	}
 	return nil
@@ -119,8 +198,27 @@ func List(volumeName, destURL, endpointURL, storageDriverName string) (map[strin
 		return nil, err
 	}
 	resp := make(map[string]map[string]string)
+	if catalog := loadCatalog(driver); catalog != nil {
+		// Volume not in catalog may still exist without backups
+		if volumeName != "" && catalog.Volumes[volumeName] == nil {
+			if err = addListVolume(resp, volumeName, destURL, driver, storageDriverName); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+		for _, v := range catalog.Volumes {
+			if (volumeName != "" && v.Name != volumeName) || v.Driver != storageDriverName {
+				continue
+			}
+			for backupName := range v.Backups {
+				r := catalog.getBackupInfo(v.Name, backupName, destURL)
+				resp[r["BackupURL"]] = r
+			}
+		}
+		return resp, nil
+	}
 	if volumeName != "" {
-		if err = addListVolume(resp, volumeName, driver, storageDriverName); err != nil {
+		if err = addListVolume(resp, volumeName, destURL, driver, storageDriverName); err != nil {
 			return nil, err
 		}
 	} else {
@@ -129,7 +227,7 @@ func List(volumeName, destURL, endpointURL, storageDriverName string) (map[strin
 			return nil, err
 		}
 		for _, volumeName := range volumeNames {
-			if err := addListVolume(resp, volumeName, driver, storageDriverName); err != nil {
+			if err := addListVolume(resp, volumeName, destURL, driver, storageDriverName); err != nil {
 				return nil, err
 			}
 		}
@@ -138,7 +236,7 @@ func List(volumeName, destURL, endpointURL, storageDriverName string) (map[strin
 }
 
 func fillBackupInfo(backup *Backup, volume *Volume, destURL string) map[string]string {
-	return map[string]string{
+	info := map[string]string{
 		"BackupName":        backup.Name,
 		"BackupURL":         encodeBackupURL(backup.Name, backup.VolumeName, destURL),
 		"DriverName":        volume.Driver,
@@ -148,7 +246,12 @@ func fillBackupInfo(backup *Backup, volume *Volume, destURL string) map[string]s
 		"SnapshotName":      backup.SnapshotName,
 		"SnapshotCreatedAt": backup.SnapshotCreatedAt,
 		"CreatedTime":       backup.CreatedTime,
+		"Description":       backup.Description,
 	}
+	for k, v := range backup.Labels {
+		info[BACKUP_LABEL_PREFIX+k] = v
+	}
+	return info
 }
 
 func GetBackupInfo(backupURL, endpointURL string) (map[string]string, error) {
@@ -160,6 +263,11 @@ func GetBackupInfo(backupURL, endpointURL string) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if catalog := loadCatalog(driver); catalog != nil {
+		if info := catalog.getBackupInfo(volumeName, backupName, backupURL); info != nil {
+			return info, nil
+		}
+	}
 
 	volume, err := loadVolume(volumeName, driver)
 	if err != nil {
@@ -170,7 +278,27 @@ func GetBackupInfo(backupURL, endpointURL string) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return fillBackupInfo(backup, volume, driver.GetURL()), nil
+	return fillBackupInfo(backup, volume, backupURL), nil
+}
+
+// GetBackupFormat returns whether the backup is a delta block backup or a single file backup
+func GetBackupFormat(backupURL, endpointURL string) (string, error) {
+	driver, err := GetObjectStoreDriver(backupURL, endpointURL)
+	if err != nil {
+		return "", err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return "", err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return "", err
+	}
+	if backup.SingleFile.FilePath != "" {
+		return BACKUP_FORMAT_SINGLE_FILE, nil
+	}
+	return BACKUP_FORMAT_DELTA_BLOCK, nil
 }
 
 func LoadVolume(backupURL, endpointURL string) (*Volume, error) {
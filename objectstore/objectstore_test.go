@@ -0,0 +1,361 @@
+package objectstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type TestSuite struct{}
+
+var _ = check.Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpSuite(c *check.C) {
+	// Locks are only written by this process in tests
+	lockSettleTime = 0
+}
+
+func (s *TestSuite) TearDownTest(c *check.C) {
+	setEncryptionKey(nil)
+	stateDir = ""
+	blockSize = DEFAULT_BLOCK_SIZE
+	compressionMethod = DEFAULT_COMPRESSION
+	sharedBlocks = false
+	bandwidthLimiter = nil
+	iopsLimiter = nil
+	mirrorURLs = []string{}
+}
+
+const (
+	memKind = "mem"
+	// Multipart driver kind, see transferDriver
+	memMultipartKind = "memmp"
+	// Same as mem, but declared as read-only and supporting endpoint
+	memReadOnlyKind = "memro"
+)
+
+var (
+	memStores = map[string]*memDriver{}
+)
+
+// memDriver is an in-memory ObjectStoreDriver used for testing
+type memDriver struct {
+	destURL string
+	files   map[string][]byte
+	lock    sync.RWMutex
+
+	// Called after path was listed, e.g. for changing files in the middle
+	listHook func(path string)
+	// Called after path was written
+	writeHook func(path string)
+}
+
+func init() {
+	if err := RegisterDriver(memKind, memInitFunc, Capabilities{}); err != nil {
+		panic(err)
+	}
+	if err := RegisterDriver(memMultipartKind, memInitFunc, Capabilities{
+		Multipart: true,
+	}); err != nil {
+		panic(err)
+	}
+	if err := RegisterDriver(memReadOnlyKind, memInitFunc, Capabilities{
+		Endpoint: true,
+		ReadOnly: true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func memInitFunc(destURL, endpoint string) (ObjectStoreDriver, error) {
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = ""
+	destURL = u.String()
+	d, exists := memStores[destURL]
+	if !exists {
+		d = &memDriver{
+			destURL: destURL,
+			files:   map[string][]byte{},
+		}
+		memStores[destURL] = d
+	}
+	return d, nil
+}
+
+func newMemDriver(c *check.C) *memDriver {
+	destURL := fmt.Sprintf("mem:///%v", c.TestName())
+	delete(memStores, destURL)
+	d, err := GetObjectStoreDriver(destURL, "")
+	c.Assert(err, check.IsNil)
+	return d.(*memDriver)
+}
+
+func (m *memDriver) Kind() string {
+	return memKind
+}
+
+func (m *memDriver) GetURL() string {
+	return m.destURL
+}
+
+func (m *memDriver) FileExists(filePath string) bool {
+	return m.FileSize(filePath) >= 0
+}
+
+func (m *memDriver) FileSize(filePath string) int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, exists := m.files[filepath.Clean(filePath)]
+	if !exists {
+		return -1
+	}
+	return int64(len(data))
+}
+
+func (m *memDriver) Remove(names ...string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, name := range names {
+		name = filepath.Clean(name)
+		for f := range m.files {
+			if f == name || strings.HasPrefix(f, name+"/") {
+				delete(m.files, f)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memDriver) Read(src string) (io.ReadCloser, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data, exists := m.files[filepath.Clean(src)]
+	if !exists {
+		return nil, fmt.Errorf("%v doesn't exist", src)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memDriver) Write(dst string, rs io.ReadSeeker) error {
+	data, err := ioutil.ReadAll(rs)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.files[filepath.Clean(dst)] = data
+	m.lock.Unlock()
+	if hook := m.writeHook; hook != nil {
+		hook(dst)
+	}
+	return nil
+}
+
+func (m *memDriver) List(path string) ([]string, error) {
+	result, err := m.list(path)
+	if hook := m.listHook; hook != nil {
+		hook(path)
+	}
+	return result, err
+}
+
+func (m *memDriver) list(path string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	prefix := filepath.Clean(path) + "/"
+	if path == "" {
+		prefix = ""
+	}
+	found := map[string]bool{}
+	for f := range m.files {
+		if !strings.HasPrefix(f, prefix) {
+			continue
+		}
+		found[strings.SplitN(strings.TrimPrefix(f, prefix), "/", 2)[0]] = true
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%v doesn't exist", path)
+	}
+	result := []string{}
+	for f := range found {
+		result = append(result, f)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *memDriver) Upload(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return m.Write(dst, bytes.NewReader(data))
+}
+
+func (m *memDriver) Download(src, dst string) error {
+	rc, err := m.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+func (s *TestSuite) TestEncodeBackupURL(c *check.C) {
+	c.Assert(encodeBackupURL("backup-1", "vol1", "s3://bucket@us-east-1/path"), check.Equals,
+		"s3://bucket@us-east-1/path?backup=backup-1&volume=vol1")
+	// Options of destination are kept
+	backupURL := encodeBackupURL("backup-1", "vol1", "s3://bucket@us-east-1/path?sse=AES256")
+	c.Assert(backupURL, check.Equals, "s3://bucket@us-east-1/path?backup=backup-1&sse=AES256&volume=vol1")
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupName, check.Equals, "backup-1")
+	c.Assert(volumeName, check.Equals, "vol1")
+}
+
+func (s *TestSuite) TestDriverCapabilities(c *check.C) {
+	capabilities, err := GetCapabilities("memro:///capabilities")
+	c.Assert(err, check.IsNil)
+	c.Assert(capabilities.ReadOnly, check.Equals, true)
+	c.Assert(capabilities.Endpoint, check.Equals, true)
+	_, err = GetCapabilities("unknown:///capabilities")
+	c.Assert(err, check.ErrorMatches, "Driver unknown is not supported!")
+
+	_, err = GetObjectStoreDriver("mem:///capabilities", "http://localhost:9000")
+	c.Assert(err, check.ErrorMatches, "Driver mem does not support custom endpoints")
+	_, err = GetObjectStoreDriver("memro:///capabilities", "http://localhost:9000")
+	c.Assert(err, check.IsNil)
+
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	c.Assert(ioutil.WriteFile(srcFile, []byte("content"), 0600), check.IsNil)
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	_, err = CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, "memro:///capabilities", "", nil)
+	c.Assert(err, check.ErrorMatches, "Objectstore .* is read-only")
+	err = DeleteSingleFileBackup("memro:///capabilities?backup=backup-1&volume=vol1", "")
+	c.Assert(err, check.ErrorMatches, "Objectstore .* is read-only")
+	c.Assert(initMirrors("memro:///mirror"), check.ErrorMatches, "Invalid value .*")
+}
+
+func (s *TestSuite) TestBackupLabels(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	snapshot := &Snapshot{
+		Name:        "snap1",
+		Labels:      map[string]string{"env": "prod"},
+		Description: "before upgrade",
+	}
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, snapshot, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+	info, err := GetBackupInfo(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(info["Description"], check.Equals, "before upgrade")
+	c.Assert(info[BACKUP_LABEL_PREFIX+"env"], check.Equals, "prod")
+
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	c.Assert(ioutil.WriteFile(srcFile, []byte("single file backup content"), 0600), check.IsNil)
+	volume = &Volume{Name: "vol2", Driver: "vfs"}
+	_, err = CreateSingleFileBackup(volume, snapshot, srcFile, d.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+	infos, err := List("vol2", d.GetURL(), "", "vfs")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos, check.HasLen, 1)
+	for _, info := range infos {
+		c.Assert(info["Description"], check.Equals, "before upgrade")
+		c.Assert(info[BACKUP_LABEL_PREFIX+"env"], check.Equals, "prod")
+	}
+}
+
+func (s *TestSuite) TestCredentials(c *check.C) {
+	c.Assert(GetCredentials("mem:///credentials"), check.IsNil)
+	SetCredentials("mem:///credentials/", map[string]string{
+		CREDENTIAL_ACCESS_KEY: "access",
+		CREDENTIAL_SECRET_KEY: "secret",
+	})
+	defer RemoveCredentials("mem:///credentials")
+
+	// Backups in the destination share the credentials
+	creds := GetCredentials("mem:///credentials?backup=backup-1&volume=vol1")
+	c.Assert(creds[CREDENTIAL_ACCESS_KEY], check.Equals, "access")
+	c.Assert(creds[CREDENTIAL_SECRET_KEY], check.Equals, "secret")
+	c.Assert(GetCredentials("mem:///credentials2"), check.IsNil)
+
+	RemoveCredentials("mem:///credentials/")
+	c.Assert(GetCredentials("mem:///credentials"), check.IsNil)
+}
+
+func (s *TestSuite) TestNotFound(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = LoadVolume(encodeBackupURL("backup-1", "vol2", d.GetURL()), "")
+	c.Assert(IsNotFound(err), check.Equals, true)
+	c.Assert(DeleteDeltaBlockBackup(backupURL, ""), check.IsNil)
+	err = DeleteDeltaBlockBackup(backupURL, "")
+	c.Assert(IsNotFound(err), check.Equals, true)
+
+	// Other failures are not taken as not found
+	d.files[getVolumeFilePath("vol1")] = []byte("invalid")
+	_, err = LoadVolume(backupURL, "")
+	c.Assert(err, check.NotNil)
+	c.Assert(IsNotFound(err), check.Equals, false)
+}
+
+func (s *TestSuite) TestBackupURLOptions(c *check.C) {
+	d := newMemDriver(c)
+	destURL := d.GetURL() + "?sse=AES256&storage-class=STANDARD_IA"
+	srcFile := filepath.Join(c.MkDir(), "snapshot.img")
+	c.Assert(ioutil.WriteFile(srcFile, []byte("single file backup content"), 0600), check.IsNil)
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	backupURL, err := CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, destURL, "", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupURL, check.Matches, ".*sse=AES256.*")
+
+	// The options of the URL given are kept, with or without catalog
+	info, err := GetBackupInfo(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(info["BackupURL"], check.Equals, backupURL)
+	infos, err := List("", destURL, "", "vfs")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos[backupURL], check.NotNil)
+	c.Assert(d.Remove(getCatalogFilePath()), check.IsNil)
+	info, err = GetBackupInfo(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(info["BackupURL"], check.Equals, backupURL)
+	infos, err = List("vol1", destURL, "", "vfs")
+	c.Assert(err, check.IsNil)
+	c.Assert(infos[backupURL], check.NotNil)
+
+	result, err := VerifyBackup(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.BackupURL, check.Equals, backupURL)
+	backup, err := loadBackup(info["BackupName"], "vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.Remove(backup.SingleFile.FilePath), check.IsNil)
+	checkResult, err := VerifyObjectStore(destURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(checkResult.MissingFiles[backupURL], check.Equals, backup.SingleFile.FilePath)
+}
@@ -0,0 +1,253 @@
+package objectstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	PARTIAL_SUFFIX = ".partial"
+
+	PARTIAL_STATE_PREFIX = "partial_"
+	PARTIAL_STATE_SUFFIX = ".json"
+
+	// Save progress to objectstore every PARTIAL_CHECKPOINT_BLOCKS blocks
+	PARTIAL_CHECKPOINT_BLOCKS = 64
+)
+
+var (
+	stateDir string
+)
+
+/*
+partialBackup is the in-progress record of a backup, saved as
+backup_<name>.cfg.partial in objectstore. Blocks contains the blocks which
+have already been uploaded, not necessarily in order.
+*/
+type partialBackup struct {
+	Backup
+	LastBackupName string
+}
+
+/*
+partialState is saved under daemon root, pointing to the in-progress backup of
+a volume in a certain destination.
+*/
+type partialState struct {
+	DestURL      string
+	VolumeName   string
+	SnapshotName string
+	BackupName   string
+}
+
+func (s *partialState) ConfigFile() (string, error) {
+	if stateDir == "" {
+		return "", fmt.Errorf("BUG: Invalid empty objectstore state directory")
+	}
+	if s.VolumeName == "" || s.DestURL == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name or destination for partial backup state")
+	}
+	checksum := sha256.Sum256([]byte(s.DestURL))
+	id := s.VolumeName + "_" + hex.EncodeToString(checksum[:])[:16]
+	return filepath.Join(stateDir, PARTIAL_STATE_PREFIX+id+PARTIAL_STATE_SUFFIX), nil
+}
+
+func initStateDir(root string) error {
+	stateDir = ""
+	if root == "" {
+		return nil
+	}
+	dir := filepath.Join(root, "objectstore")
+	if err := util.MkdirIfNotExists(dir); err != nil {
+		return err
+	}
+	stateDir = dir
+	return nil
+}
+
+func getPartialBackupConfigPath(backupName, volumeName string) string {
+	return getBackupConfigPath(backupName, volumeName) + PARTIAL_SUFFIX
+}
+
+func loadPartialBackup(backupName, volumeName string, driver ObjectStoreDriver) (*partialBackup, error) {
+	partial := &partialBackup{}
+	if err := loadConfigInObjectStore(getPartialBackupConfigPath(backupName, volumeName), driver, partial); err != nil {
+		return nil, err
+	}
+	return partial, nil
+}
+
+func savePartialBackup(partial *partialBackup, driver ObjectStoreDriver) error {
+	return saveConfigInObjectStore(getPartialBackupConfigPath(partial.Name, partial.VolumeName), driver, partial)
+}
+
+func removePartialBackup(backupName, volumeName string, driver ObjectStoreDriver) error {
+	filePath := getPartialBackupConfigPath(backupName, volumeName)
+	if !driver.FileExists(filePath) {
+		return nil
+	}
+	return driver.Remove(filePath)
+}
+
+/*
+findPartialBackup looks for the in-progress backup left by the previous
+attempt of backing up the same snapshot. Stale records would be cleaned up.
+The uploaded blocks of the stale record would be left for GC.
+*/
+func findPartialBackup(volume *Volume, snapshotName, destURL string, driver ObjectStoreDriver) *partialBackup {
+	if stateDir == "" {
+		return nil
+	}
+	state := &partialState{
+		DestURL:    destURL,
+		VolumeName: volume.Name,
+	}
+	exists, err := util.ObjectExists(state)
+	if err != nil || !exists {
+		return nil
+	}
+	if err := util.ObjectLoad(state); err != nil {
+		log.Warnf("Failed to load partial backup state for volume %v: %v", volume.Name, err)
+		util.ObjectDelete(state)
+		return nil
+	}
+
+	partial, err := loadPartialBackup(state.BackupName, state.VolumeName, driver)
+	if err == nil && state.SnapshotName == snapshotName && partial.LastBackupName == volume.LastBackupName {
+		log.Debugf("Resuming backup %v of snapshot %v, %v blocks have been uploaded",
+			partial.Name, snapshotName, len(partial.Blocks))
+		return partial
+	}
+
+	log.Debugf("Discarding stale partial backup %v of volume %v", state.BackupName, volume.Name)
+	if err := removePartialBackup(state.BackupName, state.VolumeName, driver); err != nil {
+		log.Warnf("Failed to remove stale partial backup %v: %v", state.BackupName, err)
+	}
+	util.ObjectDelete(state)
+	return nil
+}
+
+func startPartialBackup(partial *partialBackup, destURL string, driver ObjectStoreDriver) error {
+	if err := savePartialBackup(partial, driver); err != nil {
+		return err
+	}
+	if stateDir == "" {
+		return nil
+	}
+	state := &partialState{
+		DestURL:      destURL,
+		VolumeName:   partial.VolumeName,
+		SnapshotName: partial.SnapshotName,
+		BackupName:   partial.Name,
+	}
+	return util.ObjectSave(state)
+}
+
+func finishPartialBackup(partial *partialBackup, destURL string, driver ObjectStoreDriver) {
+	if err := removePartialBackup(partial.Name, partial.VolumeName, driver); err != nil {
+		log.Warnf("Failed to remove partial backup %v: %v", partial.Name, err)
+	}
+	if stateDir == "" {
+		return
+	}
+	state := &partialState{
+		DestURL:    destURL,
+		VolumeName: partial.VolumeName,
+	}
+	if err := util.ObjectDelete(state); err != nil {
+		log.Warnf("Failed to remove partial backup state for %v: %v", partial.Name, err)
+	}
+}
+
+// partialTracker records uploaded blocks and saves the progress periodically
+type partialTracker struct {
+	partial  *partialBackup
+	driver   ObjectStoreDriver
+	uploaded map[int64]BlockMapping
+	pending  int
+	lock     sync.Mutex
+}
+
+func newPartialTracker(partial *partialBackup, driver ObjectStoreDriver) *partialTracker {
+	t := &partialTracker{
+		partial:  partial,
+		driver:   driver,
+		uploaded: make(map[int64]BlockMapping),
+	}
+	for _, b := range partial.Blocks {
+		t.uploaded[b.Offset] = b
+	}
+	return t
+}
+
+func (t *partialTracker) get(offset int64) (BlockMapping, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b, exists := t.uploaded[offset]
+	return b, exists
+}
+
+func (t *partialTracker) add(b BlockMapping) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.uploaded[b.Offset] = b
+	t.pending++
+	if t.pending < PARTIAL_CHECKPOINT_BLOCKS {
+		return nil
+	}
+	return t.checkpoint()
+}
+
+func (t *partialTracker) save() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending == 0 {
+		return nil
+	}
+	return t.checkpoint()
+}
+
+func (t *partialTracker) checkpoint() error {
+	blocks := make([]BlockMapping, 0, len(t.uploaded))
+	for _, b := range t.uploaded {
+		blocks = append(blocks, b)
+	}
+	t.partial.Blocks = blocks
+	if err := savePartialBackup(t.partial, t.driver); err != nil {
+		return err
+	}
+	t.pending = 0
+	return nil
+}
+
+// loadPartialBackupsForVolume loads all the in-progress backups of the volume
+func loadPartialBackupsForVolume(volumeName string, driver ObjectStoreDriver) ([]*partialBackup, error) {
+	result := []*partialBackup{}
+	fileList, err := driver.List(getBackupPath(volumeName))
+	if err != nil {
+		// path doesn't exist
+		return result, nil
+	}
+	partialSuffix := CFG_SUFFIX + PARTIAL_SUFFIX
+	for _, f := range fileList {
+		if !strings.HasSuffix(f, partialSuffix) {
+			continue
+		}
+		names, err := util.ExtractNames([]string{f}, BACKUP_CONFIG_PREFIX, partialSuffix)
+		if err != nil {
+			return nil, err
+		}
+		partial, err := loadPartialBackup(names[0], volumeName, driver)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, partial)
+	}
+	return result, nil
+}
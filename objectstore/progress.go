@@ -0,0 +1,140 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+Progress tracks the blocks and bytes transferred by a backup or restore, and
+stops it if cancelled. Progress is registered by ID, so drivers can find the
+one created by daemon with the ID passed in options. The rate limits of the
+operation can be set on it as well. All the methods are safe to call on a nil
+Progress.
+*/
+type Progress struct {
+	lock            sync.Mutex
+	totalBlocks     int
+	processedBlocks int
+	totalBytes      int64
+	processedBytes  int64
+	cancelled       bool
+
+	bandwidthLimiter *rateLimiter
+	iopsLimiter      *rateLimiter
+}
+
+type ProgressStatus struct {
+	TotalBlocks     int
+	ProcessedBlocks int
+	TotalBytes      int64
+	ProcessedBytes  int64
+}
+
+var (
+	ErrCancelled = fmt.Errorf("Operation was cancelled")
+
+	progresses     = make(map[string]*Progress)
+	progressesLock sync.Mutex
+)
+
+// NewProgress creates and registers a progress as id
+func NewProgress(id string) *Progress {
+	p := &Progress{}
+	progressesLock.Lock()
+	progresses[id] = p
+	progressesLock.Unlock()
+	return p
+}
+
+// GetProgress returns the progress registered as id, or nil if there is none
+func GetProgress(id string) *Progress {
+	if id == "" {
+		return nil
+	}
+	progressesLock.Lock()
+	defer progressesLock.Unlock()
+	return progresses[id]
+}
+
+func RemoveProgress(id string) {
+	progressesLock.Lock()
+	delete(progresses, id)
+	progressesLock.Unlock()
+}
+
+// Cancel stops the operation at the next block, or the next read of data
+func (p *Progress) Cancel() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.cancelled = true
+	p.lock.Unlock()
+}
+
+func (p *Progress) Cancelled() bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cancelled
+}
+
+func (p *Progress) Status() ProgressStatus {
+	if p == nil {
+		return ProgressStatus{}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return ProgressStatus{
+		TotalBlocks:     p.totalBlocks,
+		ProcessedBlocks: p.processedBlocks,
+		TotalBytes:      p.totalBytes,
+		ProcessedBytes:  p.processedBytes,
+	}
+}
+
+func (p *Progress) setTotal(blocks int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.totalBlocks = blocks
+	p.totalBytes = bytes
+	p.lock.Unlock()
+}
+
+func (p *Progress) addProcessed(blocks int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.processedBlocks += blocks
+	p.processedBytes += bytes
+	p.lock.Unlock()
+}
+
+func (p *Progress) checkCancelled() error {
+	if p.Cancelled() {
+		return ErrCancelled
+	}
+	return nil
+}
+
+// progressReader counts the bytes read, and fails once the progress is cancelled
+type progressReader struct {
+	r        io.Reader
+	progress *Progress
+}
+
+func (pr *progressReader) Read(data []byte) (int, error) {
+	if err := pr.progress.checkCancelled(); err != nil {
+		return 0, err
+	}
+	n, err := pr.r.Read(data)
+	pr.progress.addProcessed(0, int64(n))
+	return n, err
+}
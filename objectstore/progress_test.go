@@ -0,0 +1,57 @@
+package objectstore
+
+import (
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestProgress(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	blocks := 4
+	ops.snapshots["snap1"] = generateImage(blocks)
+
+	progress := NewProgress("job-1")
+	defer RemoveProgress("job-1")
+	c.Assert(GetProgress("job-1"), check.Equals, progress)
+	c.Assert(GetProgress(""), check.IsNil)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, progress)
+	c.Assert(err, check.IsNil)
+	size := int64(blocks * DEFAULT_BLOCK_SIZE)
+	c.Assert(progress.Status(), check.Equals, ProgressStatus{
+		TotalBlocks:     blocks,
+		ProcessedBlocks: blocks,
+		TotalBytes:      size,
+		ProcessedBytes:  size,
+	})
+
+	restoreProgress := &Progress{}
+	restored := filepath.Join(c.MkDir(), "restored.img")
+	c.Assert(RestoreDeltaBlockBackup(backupURL, "", restored, restoreProgress), check.IsNil)
+	c.Assert(restoreProgress.Status().ProcessedBytes, check.Equals, size)
+
+	// Methods of nil progress are no-op
+	var none *Progress
+	none.Cancel()
+	c.Assert(none.Cancelled(), check.Equals, false)
+	c.Assert(none.Status(), check.Equals, ProgressStatus{})
+}
+
+func (s *TestSuite) TestProgressCancel(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	progress := &Progress{}
+	progress.Cancel()
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	_, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, progress)
+	c.Assert(err, check.Equals, ErrCancelled)
+
+	backupNames, err := getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(backupNames, check.HasLen, 0)
+}
@@ -0,0 +1,225 @@
+package objectstore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+RetentionPolicy decides which backups of a volume would be kept. A backup is
+kept if it's one of the latest KeepLast backups, or the latest backup of one
+of the latest KeepDaily days, KeepWeekly weeks or KeepMonthly months which
+have backups. Backups older than MaxAge would be removed regardless. The
+latest backup of the volume is always kept.
+*/
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      time.Duration
+}
+
+type RetentionResult struct {
+	Kept    []string
+	Removed []string
+}
+
+type retentionBackup struct {
+	backup      *Backup
+	createdTime time.Time
+}
+
+/*
+ParseRetentionAge parses the max age of backups. Besides the format accepted
+by time.ParseDuration, number of days can be specified as e.g. "30d".
+*/
+func ParseRetentionAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("Invalid max age %v", age)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid max age %v", age)
+	}
+	return d, nil
+}
+
+func (p *RetentionPolicy) Validate() error {
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("Invalid negative value in retention policy")
+	}
+	if p.KeepLast == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.MaxAge == 0 {
+		return fmt.Errorf("Empty retention policy, at least one rule need to be specified")
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast != 0 || p.KeepDaily != 0 || p.KeepWeekly != 0 || p.KeepMonthly != 0
+}
+
+/*
+ApplyRetention removes the backups of the volume in destURL not kept by the
+policy. All the volumes in destURL would be processed if volumeName is empty,
+each according to its own backups. Backups would only be listed if dryRun is
+true.
+*/
+func ApplyRetention(volumeName, destURL, endpointURL string, policy *RetentionPolicy, dryRun bool) (*RetentionResult, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	getDriver := GetObjectStoreDriver
+	if !dryRun {
+		getDriver = getWritableObjectStoreDriver
+	}
+	driver, err := getDriver(destURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeNames := []string{volumeName}
+	if volumeName == "" {
+		volumeNames, err = getVolumeNames(driver)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &RetentionResult{
+		Kept:    []string{},
+		Removed: []string{},
+	}
+	now := time.Now()
+	for _, name := range volumeNames {
+		backups, err := loadRetentionBackups(name, driver)
+		if err != nil {
+			return nil, err
+		}
+		kept, removed := policy.apply(backups, now)
+		for _, b := range kept {
+			result.Kept = append(result.Kept, encodeBackupURL(b.Name, b.VolumeName, destURL))
+		}
+		for _, b := range removed {
+			backupURL := encodeBackupURL(b.Name, b.VolumeName, destURL)
+			if !dryRun {
+				log.WithFields(logrus.Fields{
+					LOG_FIELD_REASON:     LOG_REASON_START,
+					LOG_FIELD_EVENT:      LOG_EVENT_REMOVE,
+					LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+					LOG_FIELD_VOLUME:     b.VolumeName,
+					LOG_FIELD_BACKUP_URL: backupURL,
+				}).Debug("Removing backup according to retention policy")
+				if err := deleteBackup(b, backupURL, endpointURL); err != nil {
+					// Removed in the meantime, e.g. by user
+					if IsNotFound(err) {
+						log.Debugf("Backup %v has been removed already: %v", backupURL, err)
+						continue
+					}
+					return nil, err
+				}
+			}
+			result.Removed = append(result.Removed, backupURL)
+		}
+	}
+	return result, nil
+}
+
+func deleteBackup(backup *Backup, backupURL, endpointURL string) error {
+	if backup.SingleFile.FilePath != "" {
+		return DeleteSingleFileBackup(backupURL, endpointURL)
+	}
+	return DeleteDeltaBlockBackup(backupURL, endpointURL)
+}
+
+// loadRetentionBackups returns backups of the volume, the latest first
+func loadRetentionBackups(volumeName string, driver ObjectStoreDriver) ([]retentionBackup, error) {
+	backupNames, err := getBackupNamesForVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	backups := []retentionBackup{}
+	for _, backupName := range backupNames {
+		backup, err := loadBackup(backupName, volumeName, driver)
+		if err != nil {
+			// Backups are listed without the volume lock, so it may have
+			// been removed since then
+			if IsNotFound(err) {
+				log.Debugf("Backup %v of volume %v has been removed already: %v", backupName, volumeName, err)
+				continue
+			}
+			return nil, err
+		}
+		createdTime, err := time.Parse(time.RubyDate, backup.CreatedTime)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid created time %v of backup %v: %v", backup.CreatedTime, backup.Name, err)
+		}
+		backups = append(backups, retentionBackup{
+			backup:      backup,
+			createdTime: createdTime,
+		})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].createdTime.After(backups[j].createdTime)
+	})
+	return backups, nil
+}
+
+func (p *RetentionPolicy) apply(backups []retentionBackup, now time.Time) ([]*Backup, []*Backup) {
+	kept := []*Backup{}
+	removed := []*Backup{}
+
+	type rule struct {
+		count   int
+		period  func(t time.Time) string
+		periods map[string]bool
+	}
+	rules := []*rule{
+		{count: p.KeepDaily, period: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{count: p.KeepWeekly, period: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04d-%02d", year, week)
+		}},
+		{count: p.KeepMonthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, r := range rules {
+		r.periods = make(map[string]bool)
+	}
+
+	for i, b := range backups {
+		keep := i == 0 || !p.hasKeepRules()
+		if i < p.KeepLast {
+			keep = true
+		}
+		for _, r := range rules {
+			period := r.period(b.createdTime)
+			if len(r.periods) < r.count && !r.periods[period] {
+				r.periods[period] = true
+				keep = true
+			}
+		}
+		if i != 0 && p.MaxAge != 0 && now.Sub(b.createdTime) > p.MaxAge {
+			keep = false
+		}
+		if keep {
+			kept = append(kept, b.backup)
+		} else {
+			removed = append(removed, b.backup)
+		}
+	}
+	return kept, removed
+}
@@ -0,0 +1,155 @@
+package objectstore
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func retentionBackups(now time.Time, ages ...time.Duration) []retentionBackup {
+	backups := []retentionBackup{}
+	for i, age := range ages {
+		backups = append(backups, retentionBackup{
+			backup:      &Backup{Name: fmt.Sprintf("backup-%v", i)},
+			createdTime: now.Add(-age),
+		})
+	}
+	return backups
+}
+
+func backupNames(backups []*Backup) []string {
+	names := []string{}
+	for _, b := range backups {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+func (s *TestSuite) TestRetentionPolicy(c *check.C) {
+	day := 24 * time.Hour
+	now := time.Date(2016, 3, 15, 12, 0, 0, 0, time.UTC)
+	// Two backups per day for 60 days, the latest first
+	ages := []time.Duration{}
+	for i := 0; i < 120; i++ {
+		ages = append(ages, time.Duration(i)*12*time.Hour)
+	}
+	backups := retentionBackups(now, ages...)
+
+	policy := &RetentionPolicy{KeepLast: 3}
+	kept, removed := policy.apply(backups, now)
+	c.Assert(backupNames(kept), check.DeepEquals, []string{"backup-0", "backup-1", "backup-2"})
+	c.Assert(removed, check.HasLen, 117)
+
+	policy = &RetentionPolicy{KeepDaily: 3}
+	kept, _ = policy.apply(backups, now)
+	c.Assert(backupNames(kept), check.DeepEquals, []string{"backup-0", "backup-2", "backup-4"})
+
+	policy = &RetentionPolicy{KeepLast: 1, KeepMonthly: 3}
+	kept, _ = policy.apply(backups, now)
+	// The latest of March, February and January
+	c.Assert(backupNames(kept), check.DeepEquals, []string{"backup-0", "backup-30", "backup-88"})
+
+	policy = &RetentionPolicy{MaxAge: 10 * day}
+	kept, _ = policy.apply(backups, now)
+	c.Assert(kept, check.HasLen, 21)
+
+	policy = &RetentionPolicy{KeepDaily: 30, MaxAge: 10 * day}
+	kept, _ = policy.apply(backups, now)
+	c.Assert(kept, check.HasLen, 11)
+
+	// The latest backup is always kept
+	backups = retentionBackups(now, 100*day, 200*day)
+	policy = &RetentionPolicy{MaxAge: 10 * day}
+	kept, removed = policy.apply(backups, now)
+	c.Assert(backupNames(kept), check.DeepEquals, []string{"backup-0"})
+	c.Assert(backupNames(removed), check.DeepEquals, []string{"backup-1"})
+
+	c.Assert((&RetentionPolicy{}).Validate(), check.NotNil)
+	c.Assert((&RetentionPolicy{KeepLast: -1}).Validate(), check.NotNil)
+}
+
+func (s *TestSuite) TestParseRetentionAge(c *check.C) {
+	age, err := ParseRetentionAge("30d")
+	c.Assert(err, check.IsNil)
+	c.Assert(age, check.Equals, 30*24*time.Hour)
+	age, err = ParseRetentionAge("12h")
+	c.Assert(err, check.IsNil)
+	c.Assert(age, check.Equals, 12*time.Hour)
+	age, err = ParseRetentionAge("")
+	c.Assert(err, check.IsNil)
+	c.Assert(age, check.Equals, time.Duration(0))
+	_, err = ParseRetentionAge("xd")
+	c.Assert(err, check.NotNil)
+	_, err = ParseRetentionAge("-1h")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *TestSuite) TestApplyRetention(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURLs := []string{}
+	for i := 0; i < 3; i++ {
+		backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+		c.Assert(err, check.IsNil)
+		backupName, volumeName, err := decodeBackupURL(backupURL)
+		c.Assert(err, check.IsNil)
+		backup, err := loadBackup(backupName, volumeName, d)
+		c.Assert(err, check.IsNil)
+		backup.CreatedTime = time.Now().Add(time.Duration(i-3) * time.Hour).Format(time.RubyDate)
+		c.Assert(saveBackup(backup, d), check.IsNil)
+		backupURLs = append(backupURLs, backupURL)
+	}
+
+	policy := &RetentionPolicy{KeepLast: 1}
+	result, err := ApplyRetention("vol1", d.GetURL(), "", policy, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Kept, check.DeepEquals, []string{backupURLs[2]})
+	c.Assert(result.Removed, check.DeepEquals, []string{backupURLs[1], backupURLs[0]})
+	names, err := getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 3)
+
+	result, err = ApplyRetention("", d.GetURL(), "", policy, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Removed, check.HasLen, 2)
+	names, err = getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 1)
+
+	verify, err := VerifyBackup(backupURLs[2], "")
+	c.Assert(err, check.IsNil)
+	c.Assert(verify.Intact, check.Equals, true)
+}
+
+func (s *TestSuite) TestApplyRetentionConcurrentDelete(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURLs := []string{}
+	for i := 0; i < 3; i++ {
+		backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+		c.Assert(err, check.IsNil)
+		backupURLs = append(backupURLs, backupURL)
+	}
+
+	// Backup removed by user right after backups were listed
+	d.listHook = func(path string) {
+		if path == getBackupPath("vol1") {
+			d.listHook = nil
+			c.Assert(DeleteDeltaBlockBackup(backupURLs[1], ""), check.IsNil)
+		}
+	}
+	result, err := ApplyRetention("vol1", d.GetURL(), "", &RetentionPolicy{KeepLast: 1}, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Kept, check.HasLen, 1)
+	c.Assert(result.Removed, check.HasLen, 1)
+	names, err := getBackupNamesForVolume("vol1", d)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 1)
+}
@@ -1,7 +1,11 @@
 package objectstore
 
 import (
+	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 
 	"github.com/Sirupsen/logrus"
@@ -16,6 +20,7 @@ const (
 
 type BackupFile struct {
 	FilePath string
+	Checksum string `json:",omitempty"`
 }
 
 func getSingleFileBackupFilePath(sfBackup *Backup) string {
@@ -23,11 +28,21 @@ func getSingleFileBackupFilePath(sfBackup *Backup) string {
 	return filepath.Join(getVolumePath(sfBackup.VolumeName), BACKUP_FILES_DIRECTORY, backupFileName)
 }
 
-func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destURL, endpoint string) (string, error) {
-	driver, err := GetObjectStoreDriver(destURL, endpoint)
+/*
+CreateSingleFileBackup uploads filePath as the backup of snapshot. progress
+can be nil, otherwise it would be updated once the file has been uploaded.
+*/
+func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destURL, endpoint string, progress *Progress) (string, error) {
+	driver, err := getWritableObjectStoreDriver(destURL, endpoint)
 	if err != nil {
 		return "", err
 	}
+	lock, err := lockVolume(volume.Name, "backup", driver)
+	if err != nil {
+		return "", err
+	}
+	defer lock.unlock()
+	driver = throttleDriver(driver, progress)
 
 	if err := addVolume(volume, driver); err != nil {
 		return "", err
@@ -37,6 +52,9 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 	if err != nil {
 		return "", err
 	}
+	if err := checkVolumeEncryption(volume); err != nil {
+		return "", err
+	}
 
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_START,
@@ -51,14 +69,36 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 		VolumeName:        volume.Name,
 		SnapshotName:      snapshot.Name,
 		SnapshotCreatedAt: snapshot.CreatedTime,
+		Labels:            snapshot.Labels,
+		Description:       snapshot.Description,
 	}
 	backup.SingleFile.FilePath = getSingleFileBackupFilePath(backup)
+	backup.SingleFile.Checksum, err = util.GetFileChecksum(filePath)
+	if err != nil {
+		return "", err
+	}
 
-	if err := driver.Upload(filePath, backup.SingleFile.FilePath); err != nil {
+	st, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	progress.setTotal(1, st.Size())
+	if err := progress.checkCancelled(); err != nil {
 		return "", err
 	}
+	if err := uploadFile(driver, filePath, backup.SingleFile.FilePath); err != nil {
+		return "", err
+	}
+	progress.addProcessed(1, st.Size())
 
 	backup.CreatedTime = util.Now()
+	if err := lock.check(); err != nil {
+		return "", err
+	}
+	if err := beginCatalogUpdate(volume.Name, backup.Name, driver); err != nil {
+		return "", err
+	}
+	defer finishCatalogUpdate(volume.Name, backup.Name, driver)
 	if err := saveBackup(backup, driver); err != nil {
 		return "", err
 	}
@@ -73,18 +113,21 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 	return encodeBackupURL(backup.Name, volume.Name, destURL), nil
 }
 
-func RestoreSingleFileBackup(backupURL, endpoint, path string) (string, error) {
+// RestoreSingleFileBackup downloads the backup file to path, progress can be nil
+func RestoreSingleFileBackup(backupURL, endpoint, path string, progress *Progress) (string, error) {
 	driver, err := GetObjectStoreDriver(backupURL, endpoint)
 	if err != nil {
 		return "", err
 	}
+	driver = throttleDriver(driver, progress)
 
 	srcBackupName, srcVolumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return "", err
 	}
 
-	if _, err := loadVolume(srcVolumeName, driver); err != nil {
+	volume, err := loadVolume(srcVolumeName, driver)
+	if err != nil {
 		return "", generateError(logrus.Fields{
 			LOG_FIELD_VOLUME:     srcVolumeName,
 			LOG_FIELD_BACKUP_URL: backupURL,
@@ -97,27 +140,107 @@ func RestoreSingleFileBackup(backupURL, endpoint, path string) (string, error) {
 	}
 
 	dstFile := filepath.Join(path, filepath.Base(backup.SingleFile.FilePath))
-	if err := driver.Download(backup.SingleFile.FilePath, dstFile); err != nil {
+	size := driver.FileSize(backup.SingleFile.FilePath)
+	progress.setTotal(1, size)
+	if err := progress.checkCancelled(); err != nil {
 		return "", err
 	}
+	if err := downloadFile(driver, backup.SingleFile.FilePath, dstFile, plainAllowed(volume)); err != nil {
+		return "", err
+	}
+	progress.addProcessed(1, size)
+	// Backups created by older versions don't have checksum
+	if backup.SingleFile.Checksum != "" {
+		checksum, err := util.GetFileChecksum(dstFile)
+		if err != nil {
+			return "", err
+		}
+		if checksum != backup.SingleFile.Checksum {
+			os.Remove(dstFile)
+			return "", generateError(logrus.Fields{
+				LOG_FIELD_VOLUME:     srcVolumeName,
+				LOG_FIELD_BACKUP_URL: backupURL,
+			}, "Checksum verification failed for backup file %v", backup.SingleFile.FilePath)
+		}
+	}
 
 	return dstFile, nil
 }
 
-func DeleteSingleFileBackup(backupURL, endpoint string) error {
+/*
+StreamSingleFileBackup writes the content of the backup file to w without
+saving it locally. The content is verified against the checksum recorded in
+the backup after all of it has been written, so caller should discard the
+data if it failed. progress can be nil.
+*/
+func StreamSingleFileBackup(backupURL, endpoint string, w io.Writer, progress *Progress) error {
 	driver, err := GetObjectStoreDriver(backupURL, endpoint)
 	if err != nil {
 		return err
 	}
+	driver = throttleDriver(driver, progress)
+
+	srcBackupName, srcVolumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+
+	volume, err := loadVolume(srcVolumeName, driver)
+	if err != nil {
+		return err
+	}
+	backup, err := loadBackup(srcBackupName, srcVolumeName, driver)
+	if err != nil {
+		return err
+	}
+	if backup.SingleFile.FilePath == "" {
+		return fmt.Errorf("Backup %v is not a single file backup", backupURL)
+	}
+
+	rc, err := driver.Read(backup.SingleFile.FilePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	progress.setTotal(1, driver.FileSize(backup.SingleFile.FilePath))
+	h := sha512.New()
+	if err := copyData(io.MultiWriter(w, h), &progressReader{r: rc, progress: progress}, driver, plainAllowed(volume)); err != nil {
+		return err
+	}
+	progress.addProcessed(1, 0)
+	// Backups created by older versions don't have checksum
+	if backup.SingleFile.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != backup.SingleFile.Checksum {
+		return generateError(logrus.Fields{
+			LOG_FIELD_VOLUME:     srcVolumeName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}, "Checksum verification failed for backup file %v", backup.SingleFile.FilePath)
+	}
+	return nil
+}
+
+func DeleteSingleFileBackup(backupURL, endpoint string) error {
+	driver, err := getWritableObjectStoreDriver(backupURL, endpoint)
+	if err != nil {
+		return err
+	}
 
 	backupName, volumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return err
 	}
+	lock, err := lockVolume(volumeName, "delete", driver)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
 
 	_, err = loadVolume(volumeName, driver)
 	if err != nil {
-		return fmt.Errorf("Cannot find volume %v in objectstore", volumeName, err)
+		if IsNotFound(err) {
+			return err
+		}
+		return fmt.Errorf("Cannot load volume %v in objectstore: %v", volumeName, err)
 	}
 
 	backup, err := loadBackup(backupName, volumeName, driver)
@@ -129,9 +252,10 @@ func DeleteSingleFileBackup(backupURL, endpoint string) error {
 		return err
 	}
 
-	if err := removeBackup(backup, driver); err != nil {
+	if err := beginCatalogUpdate(volumeName, backupName, driver); err != nil {
 		return err
 	}
-
-	return nil
+	err = removeBackup(backup, driver)
+	finishCatalogUpdate(volumeName, backupName, driver)
+	return err
 }
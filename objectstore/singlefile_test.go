@@ -0,0 +1,56 @@
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestStreamSingleFileBackup(c *check.C) {
+	d := newMemDriver(c)
+	dir := c.MkDir()
+	srcFile := filepath.Join(dir, "snapshot.img")
+	content := []byte("single file backup content")
+	c.Assert(ioutil.WriteFile(srcFile, content, 0600), check.IsNil)
+
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	backupURL, err := CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, d.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	format, err := GetBackupFormat(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, BACKUP_FORMAT_SINGLE_FILE)
+
+	var b bytes.Buffer
+	c.Assert(StreamSingleFileBackup(backupURL, "", &b, nil), check.IsNil)
+	c.Assert(b.Bytes(), check.DeepEquals, content)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.Write(backup.SingleFile.FilePath, bytes.NewReader([]byte("corrupted"))), check.IsNil)
+
+	b.Reset()
+	err = StreamSingleFileBackup(backupURL, "", &b, nil)
+	c.Assert(err, check.ErrorMatches, ".*Checksum verification failed.*")
+}
+
+func (s *TestSuite) TestGetBackupFormatDeltaBlock(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(2)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	format, err := GetBackupFormat(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, BACKUP_FORMAT_DELTA_BLOCK)
+
+	err = StreamSingleFileBackup(backupURL, "", ioutil.Discard, nil)
+	c.Assert(err, check.ErrorMatches, ".*is not a single file backup.*")
+}
@@ -0,0 +1,18 @@
+// +build linux
+
+package objectstore
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+)
+
+// punchHole deallocates the range of f, which would read back zeros afterwards
+func punchHole(f *os.File, offset, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, length)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package objectstore
+
+import (
+	"fmt"
+	"os"
+)
+
+func punchHole(f *os.File, offset, length int64) error {
+	return fmt.Errorf("Punching hole is not supported")
+}
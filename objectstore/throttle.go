@@ -0,0 +1,355 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+/*
+Backups and restores can be throttled so they won't saturate the network or
+starve other I/O of the host. The bandwidth limit applies to all the data
+transferred from or to the objectstore by the operation, and the IOPS limit
+applies to the blocks read from the snapshot during backup, or written to the
+volume during restore. The limits are shared by all the operations in
+progress, unless overridden for an operation by Progress.SetLimits().
+*/
+
+const (
+	OBJECTSTORE_BANDWIDTH_LIMIT = "objectstore.bandwidthlimit"
+	OBJECTSTORE_IOPS_LIMIT      = "objectstore.iopslimit"
+
+	// Max size of data read or written at a time when throttled
+	THROTTLE_CHUNK_SIZE = 65536
+)
+
+var (
+	bandwidthLimiter *rateLimiter
+	iopsLimiter      *rateLimiter
+)
+
+// rateLimiter allows rate units per second on average, nil means unlimited
+type rateLimiter struct {
+	rate int64
+	next time.Time
+	lock sync.Mutex
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate: rate,
+	}
+}
+
+// wait blocks until n units can be consumed
+func (l *rateLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(n * int64(time.Second) / l.rate))
+	l.lock.Unlock()
+	time.Sleep(start.Sub(now))
+}
+
+func parseBandwidthLimit(value string) (*rateLimiter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	rate, err := util.ParseSize(value)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("Invalid value %v for %v, must be a positive size per second, like 10m", value, OBJECTSTORE_BANDWIDTH_LIMIT)
+	}
+	return newRateLimiter(rate), nil
+}
+
+func parseIOPSLimit(value string) (*rateLimiter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("Invalid value %v for %v, must be a positive integer", value, OBJECTSTORE_IOPS_LIMIT)
+	}
+	return newRateLimiter(rate), nil
+}
+
+func initThrottle(bandwidth, iops string) error {
+	var err error
+	bandwidthLimiter, iopsLimiter = nil, nil
+	if bandwidthLimiter, err = parseBandwidthLimit(bandwidth); err != nil {
+		return err
+	}
+	if iopsLimiter, err = parseIOPSLimit(iops); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+SetLimits overrides the bandwidth and IOPS limits for the operation, in the
+format of objectstore options. Empty value means using the limit of
+objectstore options.
+*/
+func (p *Progress) SetLimits(bandwidth, iops string) error {
+	bw, err := parseBandwidthLimit(bandwidth)
+	if err != nil {
+		return err
+	}
+	ops, err := parseIOPSLimit(iops)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("BUG: Cannot set limits without progress")
+	}
+	p.lock.Lock()
+	p.bandwidthLimiter = bw
+	p.iopsLimiter = ops
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *Progress) getBandwidthLimiter() *rateLimiter {
+	if p == nil {
+		return bandwidthLimiter
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.bandwidthLimiter != nil {
+		return p.bandwidthLimiter
+	}
+	return bandwidthLimiter
+}
+
+func (p *Progress) getIOPSLimiter() *rateLimiter {
+	if p == nil {
+		return iopsLimiter
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.iopsLimiter != nil {
+		return p.iopsLimiter
+	}
+	return iopsLimiter
+}
+
+// throttleDriver returns driver limited by the bandwidth limit of progress
+func throttleDriver(driver ObjectStoreDriver, progress *Progress) ObjectStoreDriver {
+	limiter := progress.getBandwidthLimiter()
+	if limiter == nil {
+		return driver
+	}
+	return &throttledDriver{
+		ObjectStoreDriver: driver,
+		limiter:           limiter,
+	}
+}
+
+type throttledDriver struct {
+	ObjectStoreDriver
+	limiter *rateLimiter
+}
+
+func (d *throttledDriver) Read(src string) (io.ReadCloser, error) {
+	rc, err := d.ObjectStoreDriver.Read(src)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReadCloser{
+		ReadCloser: rc,
+		limiter:    d.limiter,
+	}, nil
+}
+
+func (d *throttledDriver) Write(dst string, rs io.ReadSeeker) error {
+	return d.ObjectStoreDriver.Write(dst, &throttledReadSeeker{
+		ReadSeeker: rs,
+		limiter:    d.limiter,
+	})
+}
+
+/*
+Upload and Download pass the throttled file to the driver if it supports
+multipart, so the driver can still transfer it in parts. Otherwise they're
+done by Write and Read, since the file is transferred by the driver as a whole.
+*/
+func (d *throttledDriver) Upload(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rs := &throttledReadSeeker{
+		ReadSeeker: f,
+		limiter:    d.limiter,
+	}
+	if t := getFileTransferDriver(d.ObjectStoreDriver); t != nil {
+		return t.UploadFrom(rs, dst)
+	}
+	return d.ObjectStoreDriver.Write(dst, rs)
+}
+
+func (d *throttledDriver) Download(src, dst string) error {
+	if t := getFileTransferDriver(d.ObjectStoreDriver); t != nil {
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		if err := t.DownloadTo(src, &throttledWriterAt{
+			WriterAt: f,
+			limiter:  d.limiter,
+		}); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	rc, err := d.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func throttledRead(r io.Reader, limiter *rateLimiter, data []byte) (int, error) {
+	if len(data) > THROTTLE_CHUNK_SIZE {
+		data = data[:THROTTLE_CHUNK_SIZE]
+	}
+	n, err := r.Read(data)
+	limiter.wait(int64(n))
+	return n, err
+}
+
+// Nothing can be read again from throttledReadCloser, so every read is charged
+type throttledReadCloser struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+func (r *throttledReadCloser) Read(data []byte) (int, error) {
+	return throttledRead(r.ReadCloser, r.limiter, data)
+}
+
+/*
+throttledReadSeeker only charges the bytes read for the first time. The same
+bytes would be read again if the caller seeks back, e.g. the upload of a part
+retried by the SDK, but they have been charged already.
+*/
+type throttledReadSeeker struct {
+	io.ReadSeeker
+	limiter *rateLimiter
+	offset  int64
+	read    readRanges
+}
+
+func (r *throttledReadSeeker) Read(data []byte) (int, error) {
+	if len(data) > THROTTLE_CHUNK_SIZE {
+		data = data[:THROTTLE_CHUNK_SIZE]
+	}
+	n, err := r.ReadSeeker.Read(data)
+	r.limiter.wait(r.read.add(r.offset, r.offset+int64(n)))
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	offset, err := r.ReadSeeker.Seek(offset, whence)
+	if err != nil {
+		return offset, err
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// readRanges are the sorted and non-overlapping ranges of bytes read
+type readRanges []readRange
+
+type readRange struct {
+	start, end int64
+}
+
+// add returns the number of bytes in [start, end) not read before
+func (rs *readRanges) add(start, end int64) int64 {
+	if start >= end {
+		return 0
+	}
+	unread := end - start
+	merged := readRange{start, end}
+	result := readRanges{}
+	for _, r := range *rs {
+		if r.end < start || r.start > end {
+			result = append(result, r)
+			continue
+		}
+		// Overlapping or adjacent
+		if overlap := minInt64(r.end, end) - maxInt64(r.start, start); overlap > 0 {
+			unread -= overlap
+		}
+		merged.start = minInt64(merged.start, r.start)
+		merged.end = maxInt64(merged.end, r.end)
+	}
+	result = append(result, merged)
+	sort.Slice(result, func(i, j int) bool { return result[i].start < result[j].start })
+	*rs = result
+	return unread
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+type throttledWriterAt struct {
+	io.WriterAt
+	limiter *rateLimiter
+}
+
+func (w *throttledWriterAt) WriteAt(data []byte, off int64) (int, error) {
+	written := 0
+	for written < len(data) {
+		chunk := data[written:]
+		if len(chunk) > THROTTLE_CHUNK_SIZE {
+			chunk = chunk[:THROTTLE_CHUNK_SIZE]
+		}
+		w.limiter.wait(int64(len(chunk)))
+		n, err := w.WriterAt.WriteAt(chunk, off+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,191 @@
+package objectstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRateLimiter(c *check.C) {
+	var unlimited *rateLimiter
+	unlimited.wait(1000)
+	c.Assert(newRateLimiter(0), check.IsNil)
+
+	l := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.wait(10)
+	}
+	// The first wait doesn't block
+	c.Assert(time.Since(start) >= 400*time.Millisecond, check.Equals, true)
+}
+
+func (s *TestSuite) TestInitThrottle(c *check.C) {
+	c.Assert(initThrottle("", ""), check.IsNil)
+	c.Assert(bandwidthLimiter, check.IsNil)
+	c.Assert(iopsLimiter, check.IsNil)
+
+	c.Assert(initThrottle("10m", "100"), check.IsNil)
+	c.Assert(bandwidthLimiter.rate, check.Equals, int64(10*1024*1024))
+	c.Assert(iopsLimiter.rate, check.Equals, int64(100))
+
+	c.Assert(initThrottle("fast", ""), check.ErrorMatches, "Invalid value fast for objectstore.bandwidthlimit.*")
+	c.Assert(initThrottle("", "-1"), check.ErrorMatches, "Invalid value -1 for objectstore.iopslimit.*")
+
+	progress := &Progress{}
+	c.Assert(progress.SetLimits("", "10"), check.IsNil)
+	c.Assert(progress.getIOPSLimiter().rate, check.Equals, int64(10))
+	c.Assert(progress.getBandwidthLimiter(), check.IsNil)
+	c.Assert(progress.SetLimits("0", ""), check.NotNil)
+}
+
+func (s *TestSuite) TestReadRanges(c *check.C) {
+	var rs readRanges
+	c.Assert(rs.add(10, 20), check.Equals, int64(10))
+	c.Assert(rs.add(10, 20), check.Equals, int64(0))
+	c.Assert(rs.add(30, 40), check.Equals, int64(10))
+	c.Assert(rs.add(0, 5), check.Equals, int64(5))
+	c.Assert(rs.add(15, 35), check.Equals, int64(10))
+	c.Assert(rs.add(5, 5), check.Equals, int64(0))
+	c.Assert(rs, check.DeepEquals, readRanges{{0, 5}, {10, 40}})
+	c.Assert(rs.add(5, 10), check.Equals, int64(5))
+	c.Assert(rs, check.DeepEquals, readRanges{{0, 40}})
+}
+
+func (s *TestSuite) TestThrottledReadSeeker(c *check.C) {
+	l := newRateLimiter(1000)
+	r := &throttledReadSeeker{
+		ReadSeeker: bytes.NewReader(make([]byte, 300)),
+		limiter:    l,
+	}
+	data := make([]byte, 100)
+	_, err := io.ReadFull(r, data)
+	c.Assert(err, check.IsNil)
+	next := l.next
+
+	// Read again, e.g. by retry, isn't charged
+	_, err = r.Seek(0, io.SeekStart)
+	c.Assert(err, check.IsNil)
+	_, err = io.ReadFull(r, data)
+	c.Assert(err, check.IsNil)
+	c.Assert(l.next, check.Equals, next)
+
+	// Only the bytes not read yet are charged
+	_, err = r.Seek(-50, io.SeekCurrent)
+	c.Assert(err, check.IsNil)
+	_, err = io.ReadFull(r, data)
+	c.Assert(err, check.IsNil)
+	c.Assert(l.next, check.Equals, next.Add(50*time.Millisecond))
+}
+
+func (s *TestSuite) TestThrottledDriver(c *check.C) {
+	d := newMemDriver(c)
+	c.Assert(throttleDriver(d, nil), check.Equals, ObjectStoreDriver(d))
+
+	progress := &Progress{}
+	c.Assert(progress.SetLimits("4m", ""), check.IsNil)
+	driver := throttleDriver(d, progress)
+	data := generateImage(2)[:THROTTLE_CHUNK_SIZE*3]
+	c.Assert(driver.Write("file", bytes.NewReader(data)), check.IsNil)
+	rc, err := driver.Read("file")
+	c.Assert(err, check.IsNil)
+	read, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(read, data), check.Equals, true)
+
+	dst := filepath.Join(c.MkDir(), "file")
+	c.Assert(driver.Download("file", dst), check.IsNil)
+	c.Assert(driver.Upload(dst, "file2"), check.IsNil)
+	c.Assert(bytes.Equal(d.files["file2"], data), check.Equals, true)
+}
+
+// transferDriver transfers files by UploadFrom and DownloadTo, like S3
+type transferDriver struct {
+	*memDriver
+	uploads   int
+	downloads int
+}
+
+func (d *transferDriver) Kind() string {
+	return memMultipartKind
+}
+
+func (d *transferDriver) UploadFrom(rs io.ReadSeeker, dst string) error {
+	d.uploads++
+	return d.Write(dst, rs)
+}
+
+func (d *transferDriver) DownloadTo(src string, w io.WriterAt) error {
+	d.downloads++
+	data := d.files[src]
+	// Written in parts out of order
+	half := len(data) / 2
+	if _, err := w.WriteAt(data[half:], int64(half)); err != nil {
+		return err
+	}
+	_, err := w.WriteAt(data[:half], 0)
+	return err
+}
+
+func (s *TestSuite) TestThrottledFileTransfer(c *check.C) {
+	d := &transferDriver{memDriver: newMemDriver(c)}
+	progress := &Progress{}
+	c.Assert(progress.SetLimits("1m", ""), check.IsNil)
+	driver := throttleDriver(d, progress)
+	data := generateImage(2)[:THROTTLE_CHUNK_SIZE*3+100]
+	src := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(src, data, 0644), check.IsNil)
+
+	start := time.Now()
+	c.Assert(driver.Upload(src, "file"), check.IsNil)
+	c.Assert(d.uploads, check.Equals, 1)
+	c.Assert(bytes.Equal(d.files["file"], data), check.Equals, true)
+
+	dst := filepath.Join(c.MkDir(), "file")
+	c.Assert(driver.Download("file", dst), check.IsNil)
+	c.Assert(d.downloads, check.Equals, 1)
+	downloaded, err := ioutil.ReadFile(dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(downloaded, data), check.Equals, true)
+	// Both are throttled, the first wait doesn't block
+	c.Assert(time.Since(start) >= 300*time.Millisecond, check.Equals, true)
+}
+
+// singleTransferDriver can transfer files in parts, but doesn't support multipart
+type singleTransferDriver struct {
+	*transferDriver
+}
+
+func (d *singleTransferDriver) Kind() string {
+	return memKind
+}
+
+func (s *TestSuite) TestThrottledFileTransferWithoutMultipart(c *check.C) {
+	d := &singleTransferDriver{&transferDriver{memDriver: newMemDriver(c)}}
+	progress := &Progress{}
+	c.Assert(progress.SetLimits("10m", ""), check.IsNil)
+	driver := throttleDriver(d, progress)
+	data := generateImage(2)
+	src := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(src, data, 0644), check.IsNil)
+
+	c.Assert(driver.Upload(src, "file"), check.IsNil)
+	dst := filepath.Join(c.MkDir(), "file")
+	c.Assert(driver.Download("file", dst), check.IsNil)
+	c.Assert(d.uploads, check.Equals, 0)
+	c.Assert(d.downloads, check.Equals, 0)
+	downloaded, err := ioutil.ReadFile(dst)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(downloaded, data), check.Equals, true)
+}
+
+func (s *TestSuite) TestMultipartDriver(c *check.C) {
+	// memDriver cannot transfer files in parts
+	_, err := GetObjectStoreDriver("memmp:///multipart", "")
+	c.Assert(err, check.ErrorMatches, "BUG: .* cannot transfer files in parts")
+}
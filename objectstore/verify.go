@@ -0,0 +1,176 @@
+package objectstore
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+BackupVerifyResult is the result of verifying the content of a backup.
+MissingBlocks and CorruptBlocks are block checksums, MissingFiles and
+CorruptFiles are paths of single file backups in objectstore.
+*/
+type BackupVerifyResult struct {
+	BackupURL     string
+	BackupName    string
+	VolumeName    string
+	Blocks        int
+	MissingBlocks []string
+	CorruptBlocks []string
+	MissingFiles  []string
+	CorruptFiles  []string
+	Intact        bool
+}
+
+func IsBackupURL(backupURL string) bool {
+	_, _, err := decodeBackupURL(backupURL)
+	return err == nil
+}
+
+/*
+VerifyBackup reads every object referenced by the backup, and checks it
+against the checksum recorded in the backup. Nothing would be written to local
+storage.
+*/
+func VerifyBackup(backupURL, endpointURL string) (*BackupVerifyResult, error) {
+	driver, err := GetObjectStoreDriver(backupURL, endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	driver = throttleDriver(driver, nil)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, generateError(logrus.Fields{
+			LOG_FIELD_VOLUME:     volumeName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}, "Volume doesn't exist in objectstore: %v", err)
+	}
+	// Otherwise every object would be reported as corrupted
+	if volume.Encrypted && !encryptionEnabled() {
+		return nil, fmt.Errorf("Volume %v in objectstore is encrypted, but no encryption key was configured", volumeName)
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BackupVerifyResult{
+		BackupURL:     encodeBackupURL(backup.Name, backup.VolumeName, backupURL),
+		BackupName:    backup.Name,
+		VolumeName:    backup.VolumeName,
+		MissingBlocks: []string{},
+		CorruptBlocks: []string{},
+		MissingFiles:  []string{},
+		CorruptFiles:  []string{},
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_LOAD,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debug("Verifying backup")
+	if backup.SingleFile.FilePath != "" {
+		if err := verifySingleFile(volume, backup, driver, result); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := verifyBlocks(volume, backup, driver, result); err != nil {
+			return nil, err
+		}
+	}
+	result.Intact = len(result.MissingBlocks) == 0 && len(result.CorruptBlocks) == 0 &&
+		len(result.MissingFiles) == 0 && len(result.CorruptFiles) == 0
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_LOAD,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debugf("Verified backup, intact: %v", result.Intact)
+	return result, nil
+}
+
+func verifyBlocks(volume *Volume, backup *Backup, driver ObjectStoreDriver, result *BackupVerifyResult) error {
+	checksums := getBlockChecksums(backup.Blocks)
+	result.Blocks = len(checksums)
+	codec, err := getCodec(backup.CompressionMethod)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	err = RunParallel(len(checksums), concurrency, func(i int) error {
+		checksum := checksums[i]
+		blkFile := volume.getBlockFilePath(checksum)
+		if !driver.FileExists(blkFile) {
+			lock.Lock()
+			result.MissingBlocks = append(result.MissingBlocks, checksum)
+			lock.Unlock()
+			return nil
+		}
+		rc, err := driver.Read(blkFile)
+		if err != nil {
+			return err
+		}
+		_, err = openBlock(rc, volume, driver, checksum, codec, backup.getBlockSize())
+		rc.Close()
+		if err != nil {
+			log.Warnf("Block %v of backup %v is corrupted: %v", checksum, backup.Name, err)
+			lock.Lock()
+			result.CorruptBlocks = append(result.CorruptBlocks, checksum)
+			lock.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(result.MissingBlocks)
+	sort.Strings(result.CorruptBlocks)
+	return nil
+}
+
+func verifySingleFile(volume *Volume, backup *Backup, driver ObjectStoreDriver, result *BackupVerifyResult) error {
+	filePath := backup.SingleFile.FilePath
+	if !driver.FileExists(filePath) {
+		result.MissingFiles = append(result.MissingFiles, filePath)
+		return nil
+	}
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	h := sha512.New()
+	if err := copyData(h, rc, driver, plainAllowed(volume)); err != nil {
+		log.Warnf("Backup file %v is corrupted: %v", filePath, err)
+		result.CorruptFiles = append(result.CorruptFiles, filePath)
+		return nil
+	}
+	// Backups created by older versions don't have checksum
+	if backup.SingleFile.Checksum == "" {
+		log.Warnf("No checksum recorded for backup file %v, only checked it's readable", filePath)
+		return nil
+	}
+	if hex.EncodeToString(h.Sum(nil)) != backup.SingleFile.Checksum {
+		log.Warnf("Backup file %v is corrupted: checksum mismatch", filePath)
+		result.CorruptFiles = append(result.CorruptFiles, filePath)
+	}
+	return nil
+}
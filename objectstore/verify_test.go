@@ -0,0 +1,73 @@
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVerifyDeltaBlockBackup(c *check.C) {
+	d := newMemDriver(c)
+	ops := newFakeDeltaOps()
+	ops.snapshots["snap1"] = generateImage(4)
+
+	volume := &Volume{Name: "vol1", Driver: "devicemapper", Size: int64(len(ops.snapshots["snap1"]))}
+	backupURL, err := CreateDeltaBlockBackup(volume, &Snapshot{Name: "snap1"}, d.GetURL(), "", ops, nil)
+	c.Assert(err, check.IsNil)
+
+	result, err := VerifyBackup(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Intact, check.Equals, true)
+	c.Assert(result.Blocks, check.Equals, 3)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	missing := backup.Blocks[0].BlockChecksum
+	corrupt := backup.Blocks[1].BlockChecksum
+	c.Assert(d.Remove(getBlockFilePath("vol1", missing)), check.IsNil)
+	// Valid compressed data but for a different block
+	other, err := d.Read(getBlockFilePath("vol1", backup.Blocks[2].BlockChecksum))
+	c.Assert(err, check.IsNil)
+	otherData, err := ioutil.ReadAll(other)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.Write(getBlockFilePath("vol1", corrupt), bytes.NewReader(otherData)), check.IsNil)
+
+	result, err = VerifyBackup(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Intact, check.Equals, false)
+	c.Assert(result.MissingBlocks, check.DeepEquals, []string{missing})
+	c.Assert(result.CorruptBlocks, check.DeepEquals, []string{corrupt})
+}
+
+func (s *TestSuite) TestVerifySingleFileBackup(c *check.C) {
+	d := newMemDriver(c)
+	dir := c.MkDir()
+	srcFile := filepath.Join(dir, "snapshot.img")
+	c.Assert(ioutil.WriteFile(srcFile, []byte("single file backup content"), 0600), check.IsNil)
+
+	volume := &Volume{Name: "vol1", Driver: "vfs"}
+	backupURL, err := CreateSingleFileBackup(volume, &Snapshot{Name: "snap1"}, srcFile, d.GetURL(), "", nil)
+	c.Assert(err, check.IsNil)
+
+	result, err := VerifyBackup(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Intact, check.Equals, true)
+
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	c.Assert(err, check.IsNil)
+	backup, err := loadBackup(backupName, volumeName, d)
+	c.Assert(err, check.IsNil)
+	c.Assert(d.Write(backup.SingleFile.FilePath, bytes.NewReader([]byte("corrupted"))), check.IsNil)
+
+	result, err = VerifyBackup(backupURL, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Intact, check.Equals, false)
+	c.Assert(result.CorruptFiles, check.DeepEquals, []string{backup.SingleFile.FilePath})
+
+	_, err = RestoreSingleFileBackup(backupURL, "", c.MkDir(), nil)
+	c.Assert(err, check.ErrorMatches, ".*Checksum verification failed.*")
+}
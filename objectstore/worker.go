@@ -0,0 +1,79 @@
+package objectstore
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const (
+	OBJECTSTORE_CONCURRENCY = "objectstore.concurrency"
+
+	DEFAULT_CONCURRENCY = 4
+)
+
+var (
+	concurrency = DEFAULT_CONCURRENCY
+)
+
+func initConcurrency(value string) error {
+	concurrency = DEFAULT_CONCURRENCY
+	if value == "" {
+		return nil
+	}
+	c, err := strconv.Atoi(value)
+	if err != nil || c <= 0 {
+		return fmt.Errorf("Invalid value %v for %v, must be a positive integer", value, OBJECTSTORE_CONCURRENCY)
+	}
+	concurrency = c
+	return nil
+}
+
+/*
+RunParallel calls f for each of the index in [0, count) with at most workers
+number of calls running at the same time. It stops dispatching new calls as
+soon as one of the calls failed, and returns the first error.
+*/
+func RunParallel(count, workers int, f func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+
+	if workers > count {
+		workers = count
+	}
+
+	tasks := make(chan int)
+	stop := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				if err := f(i); err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+						close(stop)
+					}
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < count; i++ {
+		select {
+		case tasks <- i:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	return firstErr
+}
@@ -24,10 +24,16 @@ type S3ObjectStoreDriver struct {
 
 const (
 	KIND = "s3"
+
+	S3_PART_SIZE        = "objectstore.s3.partsize"
+	S3_PART_CONCURRENCY = "objectstore.s3.partconcurrency"
 )
 
 func init() {
-	if err := objectstore.RegisterDriver(KIND, initFunc); err != nil {
+	if err := objectstore.RegisterDriver(KIND, initFunc, objectstore.Capabilities{
+		Endpoint:  true,
+		Multipart: true,
+	}); err != nil {
 		panic(err)
 	}
 }
@@ -71,6 +77,17 @@ func initFuncWithConnectionCheck(destURL, endpoint string, connectionTest func(d
 	//Leading '/' can cause mystery problems for s3
 	b.path = strings.TrimLeft(b.path, "/")
 
+	if err := b.service.initMultipart(objectstore.GetOption(S3_PART_SIZE), objectstore.GetOption(S3_PART_CONCURRENCY)); err != nil {
+		return nil, err
+	}
+	if err := b.service.initOptions(u.Query()); err != nil {
+		return nil, err
+	}
+	if creds := objectstore.GetCredentials(destURL); creds != nil {
+		b.service.AccessKey = creds[objectstore.CREDENTIAL_ACCESS_KEY]
+		b.service.SecretKey = creds[objectstore.CREDENTIAL_SECRET_KEY]
+	}
+
 	//Test connection
 	if err := connectionTest(b); err != nil {
 		return nil, err
@@ -175,11 +192,10 @@ func (s *S3ObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
 func (s *S3ObjectStoreDriver) Upload(src, dst string) error {
 	file, err := os.Open(src)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer file.Close()
-	path := s.updatePath(dst)
-	return s.service.PutObject(path, file)
+	return s.UploadFrom(file, dst)
 }
 
 func (s *S3ObjectStoreDriver) Download(src, dst string) error {
@@ -191,16 +207,17 @@ func (s *S3ObjectStoreDriver) Download(src, dst string) error {
 		return err
 	}
 	defer f.Close()
-	path := s.updatePath(src)
-	rc, err := s.service.GetObject(path)
-	if err != nil {
-		return err
-	}
-	defer rc.Close()
+	return s.DownloadTo(src, f)
+}
 
-	_, err = io.Copy(f, rc)
-	if err != nil {
-		return err
-	}
-	return nil
+// UploadFrom uploads rs in parts if it's large enough
+func (s *S3ObjectStoreDriver) UploadFrom(rs io.ReadSeeker, dst string) error {
+	path := s.updatePath(dst)
+	return s.service.PutObject(path, rs)
+}
+
+// DownloadTo downloads src in ranges in parallel if it's large enough
+func (s *S3ObjectStoreDriver) DownloadTo(src string, w io.WriterAt) error {
+	path := s.updatePath(src)
+	return s.service.DownloadObject(path, w)
 }
@@ -0,0 +1,300 @@
+package s3
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	DEFAULT_PART_SIZE        = 64 * 1024 * 1024
+	MIN_PART_SIZE            = 5 * 1024 * 1024
+	MAX_PART_SIZE            = 5 * 1024 * 1024 * 1024
+	DEFAULT_PART_CONCURRENCY = 4
+
+	// S3 allows at most 10000 parts for an object
+	MAX_PARTS = 10000
+	// Number of attempts for a part, in addition to the retries of AWS SDK
+	PART_RETRIES = 3
+	// Unfinished uploads older than it are considered left by crashed daemons
+	STALE_UPLOAD_AGE = 24 * time.Hour
+)
+
+func (s *S3Service) initMultipart(partSize, partConcurrency string) error {
+	if partSize != "" {
+		size, err := util.ParseSize(partSize)
+		if err != nil || size < MIN_PART_SIZE || size > MAX_PART_SIZE {
+			return fmt.Errorf("Invalid value %v for %v, must be between %v and %v",
+				partSize, S3_PART_SIZE, MIN_PART_SIZE, MAX_PART_SIZE)
+		}
+		s.PartSize = size
+	}
+	if partConcurrency != "" {
+		c, err := strconv.Atoi(partConcurrency)
+		if err != nil || c <= 0 {
+			return fmt.Errorf("Invalid value %v for %v, must be a positive integer", partConcurrency, S3_PART_CONCURRENCY)
+		}
+		s.PartConcurrency = c
+	}
+	return nil
+}
+
+/*
+getPartSize returns the size of parts for an object of size. Objects no larger
+than it would be uploaded or downloaded as a whole.
+*/
+func (s *S3Service) getPartSize(size int64) int64 {
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = DEFAULT_PART_SIZE
+	}
+	if minSize := (size + MAX_PARTS - 1) / MAX_PARTS; partSize < minSize {
+		partSize = minSize
+	}
+	return partSize
+}
+
+func (s *S3Service) partConcurrency() int {
+	if s.PartConcurrency == 0 {
+		return DEFAULT_PART_CONCURRENCY
+	}
+	return s.PartConcurrency
+}
+
+// retryPart calls f until it succeeded or PART_RETRIES attempts have failed
+func retryPart(description string, f func() error) error {
+	var err error
+	for attempt := 1; attempt <= PART_RETRIES; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		log.Warnf("Failed to %v, attempt %v of %v: %v", description, attempt, PART_RETRIES, err)
+	}
+	return err
+}
+
+// lockedReaderAt allows parts of a ReadSeeker to be read in parallel
+type lockedReaderAt struct {
+	rs   io.ReadSeeker
+	lock sync.Mutex
+}
+
+func (r *lockedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func toReaderAt(rs io.ReadSeeker) io.ReaderAt {
+	if r, ok := rs.(io.ReaderAt); ok {
+		return r
+	}
+	return &lockedReaderAt{rs: rs}
+}
+
+/*
+abortStaleUploads aborts the unfinished multipart uploads of key initiated
+more than STALE_UPLOAD_AGE ago, e.g. left by daemon crashed in the middle,
+otherwise their parts would be kept and charged forever. Recent uploads may
+still be in progress, e.g. by another daemon, so they are left alone.
+*/
+func (s *S3Service) abortStaleUploads(svc *s3.S3, key string) error {
+	params := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(key),
+	}
+	for {
+		resp, err := svc.ListMultipartUploads(params)
+		if err != nil {
+			return parseAwsError(resp.String(), err)
+		}
+		for _, upload := range resp.Uploads {
+			if aws.StringValue(upload.Key) != key {
+				continue
+			}
+			initiated := aws.TimeValue(upload.Initiated)
+			if initiated.IsZero() || time.Since(initiated) < STALE_UPLOAD_AGE {
+				continue
+			}
+			log.Debugf("Aborting stale multipart upload %v of %v initiated at %v", aws.StringValue(upload.UploadId), key, initiated)
+			if err := s.abortUpload(svc, key, aws.StringValue(upload.UploadId)); err != nil {
+				return err
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return nil
+		}
+		params.KeyMarker = resp.NextKeyMarker
+		params.UploadIdMarker = resp.NextUploadIdMarker
+	}
+}
+
+func (s *S3Service) abortUpload(svc *s3.S3, key, uploadID string) error {
+	resp, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return parseAwsError(resp.String(), err)
+	}
+	return nil
+}
+
+/*
+putObjectMultipart uploads reader of size in parts, with at most
+PartConcurrency parts uploading at the same time. Each part would be retried
+separately, and the upload would be aborted if any part failed eventually.
+*/
+func (s *S3Service) putObjectMultipart(svc *s3.S3, key string, reader io.ReadSeeker, size int64) error {
+	if err := s.abortStaleUploads(svc, key); err != nil {
+		return err
+	}
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	params.ServerSideEncryption, params.SSEKMSKeyId, params.StorageClass = s.writeOptions()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
+	req, createResp := svc.CreateMultipartUploadRequest(params)
+	err := s.sendWithTagging(req)
+	if err != nil {
+		return parseAwsError(createResp.String(), err)
+	}
+	uploadID := aws.StringValue(createResp.UploadId)
+
+	partSize := s.getPartSize(size)
+	count := int((size + partSize - 1) / partSize)
+	parts := make([]*s3.CompletedPart, count)
+	readerAt := toReaderAt(reader)
+	err = objectstore.RunParallel(count, s.partConcurrency(), func(i int) error {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		partNumber := int64(i + 1)
+		return retryPart(fmt.Sprintf("upload part %v of %v", partNumber, key), func() error {
+			params := &s3.UploadPartInput{
+				Bucket:        aws.String(s.Bucket),
+				Key:           aws.String(key),
+				UploadId:      aws.String(uploadID),
+				PartNumber:    aws.Int64(partNumber),
+				ContentLength: aws.Int64(length),
+				Body:          io.NewSectionReader(readerAt, offset, length),
+			}
+			params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
+			resp, err := svc.UploadPart(params)
+			if err != nil {
+				return parseAwsError(resp.String(), err)
+			}
+			parts[i] = &s3.CompletedPart{
+				ETag:       resp.ETag,
+				PartNumber: aws.Int64(partNumber),
+			}
+			return nil
+		})
+	})
+	if err == nil {
+		var resp *s3.CompleteMultipartUploadOutput
+		resp, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.Bucket),
+			Key:             aws.String(key),
+			UploadId:        aws.String(uploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			err = parseAwsError(resp.String(), err)
+		}
+	}
+	if err != nil {
+		if abortErr := s.abortUpload(svc, key, uploadID); abortErr != nil {
+			log.Errorf("Failed to abort multipart upload %v of %v: %v", uploadID, key, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// offsetWriter writes to w sequentially from offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (s *S3Service) getObjectRange(svc *s3.S3, key string, offset, length int64, w io.WriterAt) error {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
+	resp, err := svc.GetObject(params)
+	if err != nil {
+		return parseAwsError(resp.String(), err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(&offsetWriter{w: w, offset: offset}, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("Incomplete range of %v from %v, expect %v bytes, got %v", key, offset, length, n)
+	}
+	return nil
+}
+
+/*
+DownloadObject writes the object of key to w. Objects larger than part size
+would be downloaded by ranges in parallel, each of them retried separately.
+*/
+func (s *S3Service) DownloadObject(key string, w io.WriterAt) error {
+	head, err := s.HeadObject(key)
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if size == 0 {
+		return nil
+	}
+	partSize := s.getPartSize(size)
+	count := int((size + partSize - 1) / partSize)
+	return objectstore.RunParallel(count, s.partConcurrency(), func(i int) error {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		return retryPart(fmt.Sprintf("download range %v-%v of %v", offset, offset+length-1, key), func() error {
+			return s.getObjectRange(svc, key, offset, length, w)
+		})
+	})
+}
@@ -0,0 +1,288 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type MultipartTestSuite struct {
+	server  *fakeS3Server
+	service S3Service
+}
+
+var _ = check.Suite(&MultipartTestSuite{})
+
+/*
+fakeS3Server implements the part of S3 API used by uploading and downloading
+objects, with path style requests.
+*/
+type fakeS3Server struct {
+	*httptest.Server
+	objects map[string][]byte
+	// Parts of unfinished multipart uploads
+	uploads      map[string]map[int][]byte
+	uploadKeys   map[string]string
+	uploadTimes  map[string]time.Time
+	nextUploadID int
+	// Number of part uploads and range gets to fail
+	failParts int
+	failGets  int
+	rangeGets int
+	// Headers of the requests creating objects, by key
+	writeHeaders map[string]http.Header
+	lock         sync.Mutex
+}
+
+type fakeCompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type fakeCompleteUpload struct {
+	XMLName xml.Name            `xml:"CompleteMultipartUpload"`
+	Parts   []fakeCompletedPart `xml:"Part"`
+}
+
+func newFakeS3Server() *fakeS3Server {
+	f := &fakeS3Server{
+		objects:      map[string][]byte{},
+		uploads:      map[string]map[int][]byte{},
+		uploadKeys:   map[string]string{},
+		uploadTimes:  map[string]time.Time{},
+		writeHeaders: map[string]http.Header{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message></Error>", code, code)
+}
+
+func (f *fakeS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = bucket + "/" + parts[1]
+	}
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case r.Method == "GET" && key == "" && uploads:
+		fmt.Fprintf(w, "<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>")
+		for id, k := range f.uploadKeys {
+			if k == bucket+"/"+query.Get("prefix") {
+				fmt.Fprintf(w, "<Upload><Key>%v</Key><UploadId>%v</UploadId><Initiated>%v</Initiated></Upload>",
+					strings.TrimPrefix(k, bucket+"/"), id, f.uploadTimes[id].UTC().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprintf(w, "</ListMultipartUploadsResult>")
+	case r.Method == "POST" && uploads:
+		f.writeHeaders[key] = r.Header
+		f.nextUploadID++
+		id := fmt.Sprintf("upload-%v", f.nextUploadID)
+		f.uploads[id] = map[int][]byte{}
+		f.uploadKeys[id] = key
+		f.uploadTimes[id] = time.Now()
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && uploadID != "":
+		data, _ := ioutil.ReadAll(r.Body)
+		if f.failParts > 0 {
+			f.failParts--
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		var number int
+		fmt.Sscanf(query.Get("partNumber"), "%d", &number)
+		f.uploads[uploadID][number] = data
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%v\"", number))
+	case r.Method == "POST" && uploadID != "":
+		complete := &fakeCompleteUpload{}
+		if err := xml.NewDecoder(r.Body).Decode(complete); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf("\"etag-%v\"", i+1) {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, f.uploads[uploadID][part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, uploadID)
+		delete(f.uploadKeys, uploadID)
+		delete(f.uploadTimes, uploadID)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%v</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == "DELETE" && uploadID != "":
+		delete(f.uploads, uploadID)
+		delete(f.uploadKeys, uploadID)
+		delete(f.uploadTimes, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		f.writeHeaders[key] = r.Header
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == "HEAD" || r.Method == "GET":
+		data, exists := f.objects[key]
+		if !exists {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(data)))
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			w.Write(data)
+			return
+		}
+		f.rangeGets++
+		if f.failGets > 0 {
+			f.failGets--
+			writeS3Error(w, http.StatusBadRequest, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+	default:
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+	}
+}
+
+func (s *MultipartTestSuite) SetUpSuite(c *check.C) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+}
+
+func (s *MultipartTestSuite) SetUpTest(c *check.C) {
+	s.server = newFakeS3Server()
+	s.service = S3Service{
+		Region:          "us-east-1",
+		Bucket:          "test",
+		Endpoint:        s.server.URL,
+		PartSize:        1000,
+		PartConcurrency: 3,
+	}
+}
+
+func (s *MultipartTestSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func generateContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func (s *MultipartTestSuite) TestInitMultipart(c *check.C) {
+	service := S3Service{}
+	c.Assert(service.initMultipart("", ""), check.IsNil)
+	c.Assert(service.PartSize, check.Equals, int64(0))
+	c.Assert(service.getPartSize(1024), check.Equals, int64(DEFAULT_PART_SIZE))
+	// Part size grows to keep the number of parts in limit
+	c.Assert(service.getPartSize(DEFAULT_PART_SIZE*MAX_PARTS*2), check.Equals, int64(DEFAULT_PART_SIZE*2))
+
+	c.Assert(service.initMultipart("16m", "8"), check.IsNil)
+	c.Assert(service.PartSize, check.Equals, int64(16*1024*1024))
+	c.Assert(service.PartConcurrency, check.Equals, 8)
+	c.Assert(service.initMultipart("1m", ""), check.ErrorMatches, "Invalid value 1m for "+S3_PART_SIZE+".*")
+	c.Assert(service.initMultipart("", "0"), check.ErrorMatches, "Invalid value 0 for "+S3_PART_CONCURRENCY+".*")
+}
+
+func (s *MultipartTestSuite) TestMultipartUpload(c *check.C) {
+	content := generateContent(3500)
+	// Left by previous upload interrupted
+	s.server.uploadKeys["stale"] = "test/backups/large"
+	s.server.uploads["stale"] = map[int][]byte{}
+	s.server.uploadTimes["stale"] = time.Now().Add(-STALE_UPLOAD_AGE - time.Hour)
+	// Recent upload could be still in progress
+	s.server.uploadKeys["recent"] = "test/backups/large"
+	s.server.uploads["recent"] = map[int][]byte{}
+	s.server.uploadTimes["recent"] = time.Now().Add(-time.Hour)
+
+	// Each failed part would be retried alone
+	s.server.failParts = 2
+	c.Assert(s.service.PutObject("backups/large", bytes.NewReader(content)), check.IsNil)
+	c.Assert(bytes.Equal(s.server.objects["test/backups/large"], content), check.Equals, true)
+	c.Assert(s.server.uploads, check.HasLen, 1)
+	c.Assert(s.server.uploads["recent"], check.NotNil)
+	c.Assert(s.server.nextUploadID, check.Equals, 1)
+	delete(s.server.uploads, "recent")
+	delete(s.server.uploadKeys, "recent")
+
+	// Parts can be read from ReadSeeker without ReadAt as well
+	reader := struct{ io.ReadSeeker }{bytes.NewReader(content)}
+	c.Assert(s.service.PutObject("backups/large2", reader), check.IsNil)
+	c.Assert(bytes.Equal(s.server.objects["test/backups/large2"], content), check.Equals, true)
+
+	// Small object is uploaded as a whole
+	c.Assert(s.service.PutObject("backups/small", bytes.NewReader(content[:1000])), check.IsNil)
+	c.Assert(bytes.Equal(s.server.objects["test/backups/small"], content[:1000]), check.Equals, true)
+	c.Assert(s.server.nextUploadID, check.Equals, 2)
+
+	// Failed upload would be aborted
+	s.server.failParts = 100
+	err := s.service.PutObject("backups/failed", bytes.NewReader(content))
+	c.Assert(err, check.ErrorMatches, "(?s).*BadDigest.*")
+	c.Assert(s.server.uploads, check.HasLen, 0)
+	_, exists := s.server.objects["test/backups/failed"]
+	c.Assert(exists, check.Equals, false)
+}
+
+func (s *MultipartTestSuite) TestRangedDownload(c *check.C) {
+	content := generateContent(3500)
+	s.server.objects["test/backups/large"] = content
+	s.server.objects["test/backups/empty"] = []byte{}
+	dir := c.MkDir()
+
+	s.server.failGets = 2
+	driver := &S3ObjectStoreDriver{path: "backups", service: s.service}
+	c.Assert(driver.Download("large", filepath.Join(dir, "large")), check.IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "large"))
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(data, content), check.Equals, true)
+	// 4 ranges, 2 of them retried
+	c.Assert(s.server.rangeGets, check.Equals, 6)
+
+	c.Assert(driver.Download("empty", filepath.Join(dir, "empty")), check.IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "empty"))
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.HasLen, 0)
+
+	s.server.failGets = 100
+	err = driver.Download("large", filepath.Join(dir, "failed"))
+	c.Assert(err, check.ErrorMatches, "(?s).*InvalidRange.*")
+
+	keys := []string{}
+	for key := range s.server.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	c.Assert(keys, check.DeepEquals, []string{"test/backups/empty", "test/backups/large"})
+}
@@ -0,0 +1,135 @@
+package s3
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+/*
+Options of destination, specified in the query of URL, e.g.
+s3://bucket@region/path/?sse=aws:kms&sse-kms-key-id=alias/convoy&tag=team=ops
+They're applied to every object written to the destination.
+*/
+const (
+	OPT_SSE            = "sse"
+	OPT_SSE_KMS_KEY_ID = "sse-kms-key-id"
+	OPT_SSE_C_KEY_FILE = "sse-c-key-file"
+	OPT_STORAGE_CLASS  = "storage-class"
+	OPT_TAG            = "tag"
+
+	SSE_S3  = "AES256"
+	SSE_KMS = "aws:kms"
+
+	SSE_C_ALGORITHM = "AES256"
+	SSE_C_KEY_SIZE  = 32
+
+	// S3 allows at most 10 tags for an object
+	MAX_TAGS = 10
+
+	HEADER_TAGGING = "X-Amz-Tagging"
+)
+
+var (
+	// The classes require objects to be restored before reading are excluded
+	supportedStorageClasses = []string{
+		"STANDARD",
+		"REDUCED_REDUNDANCY",
+		"STANDARD_IA",
+		"ONEZONE_IA",
+		"INTELLIGENT_TIERING",
+		"GLACIER_IR",
+	}
+)
+
+func (s *S3Service) initOptions(query url.Values) error {
+	if sse := query.Get(OPT_SSE); sse != "" {
+		if sse != SSE_S3 && sse != SSE_KMS {
+			return fmt.Errorf("Invalid value %v for %v, must be %v or %v", sse, OPT_SSE, SSE_S3, SSE_KMS)
+		}
+		s.SSE = sse
+	}
+	if keyID := query.Get(OPT_SSE_KMS_KEY_ID); keyID != "" {
+		if s.SSE != SSE_KMS {
+			return fmt.Errorf("%v can only be used with %v=%v", OPT_SSE_KMS_KEY_ID, OPT_SSE, SSE_KMS)
+		}
+		s.SSEKMSKeyID = keyID
+	}
+	if keyFile := query.Get(OPT_SSE_C_KEY_FILE); keyFile != "" {
+		if s.SSE != "" {
+			return fmt.Errorf("%v cannot be used with %v", OPT_SSE_C_KEY_FILE, OPT_SSE)
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read SSE-C key file %v: %v", keyFile, err)
+		}
+		if len(key) != SSE_C_KEY_SIZE {
+			return fmt.Errorf("Invalid SSE-C key file %v, must contain exactly %v bytes", keyFile, SSE_C_KEY_SIZE)
+		}
+		s.SSECustomerKey = string(key)
+	}
+	if class := query.Get(OPT_STORAGE_CLASS); class != "" {
+		class = strings.ToUpper(class)
+		supported := false
+		for _, c := range supportedStorageClasses {
+			if class == c {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("Invalid value %v for %v, must be one of %v",
+				class, OPT_STORAGE_CLASS, strings.Join(supportedStorageClasses, ", "))
+		}
+		s.StorageClass = class
+	}
+	if tags := query[OPT_TAG]; len(tags) != 0 {
+		if len(tags) > MAX_TAGS {
+			return fmt.Errorf("Too many tags, at most %v tags are allowed", MAX_TAGS)
+		}
+		tagging := url.Values{}
+		for _, tag := range tags {
+			parts := strings.SplitN(tag, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return fmt.Errorf("Invalid value %v for %v, must be key=value", tag, OPT_TAG)
+			}
+			tagging.Set(parts[0], parts[1])
+		}
+		s.Tagging = tagging.Encode()
+	}
+	return nil
+}
+
+// sseCustomerKey returns the algorithm and key for SSE-C, which are needed for reading as well
+func (s *S3Service) sseCustomerKey() (*string, *string) {
+	if s.SSECustomerKey == "" {
+		return nil, nil
+	}
+	return aws.String(SSE_C_ALGORITHM), aws.String(s.SSECustomerKey)
+}
+
+// writeOptions returns the encryption and storage class for the objects written
+func (s *S3Service) writeOptions() (sse, kmsKeyID, storageClass *string) {
+	if s.SSE != "" {
+		sse = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		kmsKeyID = aws.String(s.SSEKMSKeyID)
+	}
+	if s.StorageClass != "" {
+		storageClass = aws.String(s.StorageClass)
+	}
+	return
+}
+
+// sendWithTagging sends req with the tags of objects, which is not supported by the AWS SDK in use
+func (s *S3Service) sendWithTagging(req *request.Request) error {
+	if s.Tagging != "" {
+		req.HTTPRequest.Header.Set(HEADER_TAGGING, s.Tagging)
+	}
+	return req.Send()
+}
@@ -0,0 +1,104 @@
+package s3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/convoy/objectstore"
+	"gopkg.in/check.v1"
+)
+
+func (s *MultipartTestSuite) TestInitOptions(c *check.C) {
+	_, driver, err := runInitFunc(c, "s3://test@us-east-1/path?sse=aws:kms&sse-kms-key-id=alias/convoy&storage-class=standard_ia&tag=team=ops&tag=env=prod", "", false)
+	c.Assert(err, check.IsNil)
+	service := driver.(*S3ObjectStoreDriver).service
+	c.Assert(service.SSE, check.Equals, SSE_KMS)
+	c.Assert(service.SSEKMSKeyID, check.Equals, "alias/convoy")
+	c.Assert(service.StorageClass, check.Equals, "STANDARD_IA")
+	c.Assert(service.Tagging, check.Equals, "env=prod&team=ops")
+	// Options are not part of the destination
+	c.Assert(driver.GetURL(), check.Equals, "s3://test@us-east-1/path")
+
+	keyFile := filepath.Join(c.MkDir(), "sse-c.key")
+	c.Assert(ioutil.WriteFile(keyFile, bytes.Repeat([]byte{'k'}, SSE_C_KEY_SIZE), 0600), check.IsNil)
+	_, driver, err = runInitFunc(c, "s3://test@us-east-1/path?sse-c-key-file="+keyFile, "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.(*S3ObjectStoreDriver).service.SSECustomerKey, check.Equals, strings.Repeat("k", SSE_C_KEY_SIZE))
+
+	for query, expected := range map[string]string{
+		"sse=none":                                "Invalid value none for sse.*",
+		"sse=AES256&sse-kms-key-id=alias/convoy":  "sse-kms-key-id can only be used with sse=aws:kms",
+		"sse=AES256&sse-c-key-file=" + keyFile:    "sse-c-key-file cannot be used with sse",
+		"sse-c-key-file=" + keyFile + ".missing":  "Cannot read SSE-C key file.*",
+		"sse-c-key-file=" + filepath.Dir(keyFile): "Cannot read SSE-C key file.*",
+		"storage-class=GLACIER":                   "Invalid value GLACIER for storage-class.*",
+		"tag=team":                                "Invalid value team for tag, must be key=value",
+		"tag=a=1&tag=b=2&tag=c=3&tag=d=4&tag=e=5&tag=f=6&tag=g=7&tag=h=8&tag=i=9&tag=j=10&tag=k=11": "Too many tags.*",
+	} {
+		_, _, err = runInitFunc(c, "s3://test@us-east-1/path?"+query, "", false)
+		c.Assert(err, check.ErrorMatches, expected)
+	}
+	c.Assert(ioutil.WriteFile(keyFile, []byte("short"), 0600), check.IsNil)
+	_, _, err = runInitFunc(c, "s3://test@us-east-1/path?sse-c-key-file="+keyFile, "", false)
+	c.Assert(err, check.ErrorMatches, "Invalid SSE-C key file.*")
+}
+
+func (s *MultipartTestSuite) TestWriteOptions(c *check.C) {
+	s.service.SSE = SSE_KMS
+	s.service.SSEKMSKeyID = "alias/convoy"
+	s.service.StorageClass = "GLACIER_IR"
+	s.service.Tagging = "team=ops"
+	content := generateContent(3500)
+
+	// Options apply to both small objects and multipart uploads
+	c.Assert(s.service.PutObject("backups/small", bytes.NewReader(content[:100])), check.IsNil)
+	c.Assert(s.service.PutObject("backups/large", bytes.NewReader(content)), check.IsNil)
+	for _, key := range []string{"test/backups/small", "test/backups/large"} {
+		header := s.server.writeHeaders[key]
+		c.Assert(header, check.NotNil)
+		c.Assert(header.Get("X-Amz-Server-Side-Encryption"), check.Equals, SSE_KMS)
+		c.Assert(header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), check.Equals, "alias/convoy")
+		c.Assert(header.Get("X-Amz-Storage-Class"), check.Equals, "GLACIER_IR")
+		c.Assert(header.Get("X-Amz-Tagging"), check.Equals, "team=ops")
+	}
+	c.Assert(bytes.Equal(s.server.objects["test/backups/large"], content), check.Equals, true)
+
+	// SSE-C key is refused by AWS SDK without TLS
+	s.service = S3Service{
+		Region:         "us-east-1",
+		Bucket:         "test",
+		Endpoint:       s.server.URL,
+		SSECustomerKey: strings.Repeat("k", SSE_C_KEY_SIZE),
+	}
+	err := s.service.PutObject("backups/small", bytes.NewReader(content[:100]))
+	c.Assert(err, check.ErrorMatches, "(?s).*cannot send SSE keys over HTTP.*")
+	_, err = s.service.GetObject("backups/small")
+	c.Assert(err, check.ErrorMatches, "(?s).*cannot send SSE keys over HTTP.*")
+}
+
+func (s *MultipartTestSuite) TestCredentials(c *check.C) {
+	objectstore.SetCredentials("s3://test@us-east-1/path/", map[string]string{
+		objectstore.CREDENTIAL_ACCESS_KEY: "targetkey",
+		objectstore.CREDENTIAL_SECRET_KEY: "targetsecret",
+	})
+	defer objectstore.RemoveCredentials("s3://test@us-east-1/path/")
+
+	// Backups in the destination use the same credentials
+	_, driver, err := runInitFunc(c, "s3://test@us-east-1/path?backup=backup-1&volume=vol1", "", false)
+	c.Assert(err, check.IsNil)
+	service := driver.(*S3ObjectStoreDriver).service
+	c.Assert(service.AccessKey, check.Equals, "targetkey")
+	c.Assert(service.SecretKey, check.Equals, "targetsecret")
+	_, driver, err = runInitFunc(c, "s3://test@us-east-1/other", "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.(*S3ObjectStoreDriver).service.AccessKey, check.Equals, "")
+
+	s.service.AccessKey = "targetkey"
+	s.service.SecretKey = "targetsecret"
+	c.Assert(s.service.PutObject("backups/small", bytes.NewReader([]byte("content"))), check.IsNil)
+	header := s.server.writeHeaders["test/backups/small"]
+	c.Assert(header, check.NotNil)
+	c.Assert(header.Get("Authorization"), check.Matches, ".*Credential=targetkey/.*")
+}
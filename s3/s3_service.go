@@ -6,6 +6,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -14,6 +15,18 @@ type S3Service struct {
 	Region   string
 	Bucket   string
 	Endpoint string
+	// Zero for DEFAULT_PART_SIZE and DEFAULT_PART_CONCURRENCY
+	PartSize        int64
+	PartConcurrency int
+	// Credentials of destination, used instead of the ones from environment if specified
+	AccessKey string
+	SecretKey string
+	// Options of destination, see initOptions
+	SSE            string
+	SSEKMSKeyID    string
+	SSECustomerKey string
+	StorageClass   string
+	Tagging        string
 }
 
 func (s *S3Service) New() (*s3.S3, error) {
@@ -25,6 +38,9 @@ func (s *S3Service) New() (*s3.S3, error) {
 			WithEndpoint(s.Endpoint).
 			WithS3ForcePathStyle(true)
 	}
+	if s.AccessKey != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(s.AccessKey, s.SecretKey, ""))
+	}
 	return s3.New(session.New(), config), nil
 }
 
@@ -73,6 +89,7 @@ func (s *S3Service) HeadObject(key string) (*s3.HeadObjectOutput, error) {
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
 	resp, err := svc.HeadObject(params)
 	if err != nil {
 		return nil, parseAwsError(resp.String(), err)
@@ -80,6 +97,7 @@ func (s *S3Service) HeadObject(key string) (*s3.HeadObjectOutput, error) {
 	return resp, nil
 }
 
+// PutObject uploads reader from the beginning, in parts if it's larger than part size
 func (s *S3Service) PutObject(key string, reader io.ReadSeeker) error {
 	svc, err := s.New()
 	if err != nil {
@@ -87,14 +105,27 @@ func (s *S3Service) PutObject(key string, reader io.ReadSeeker) error {
 	}
 	defer s.Close()
 
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if size > s.getPartSize(size) {
+		return s.putObjectMultipart(svc, key, reader, size)
+	}
+
 	params := &s3.PutObjectInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 		Body:   reader,
 	}
+	params.ServerSideEncryption, params.SSEKMSKeyId, params.StorageClass = s.writeOptions()
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
 
-	resp, err := svc.PutObject(params)
-	if err != nil {
+	req, resp := svc.PutObjectRequest(params)
+	if err := s.sendWithTagging(req); err != nil {
 		return parseAwsError(resp.String(), err)
 	}
 	return nil
@@ -111,6 +142,7 @@ func (s *S3Service) GetObject(key string) (io.ReadCloser, error) {
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
 	}
+	params.SSECustomerAlgorithm, params.SSECustomerKey = s.sseCustomerKey()
 
 	resp, err := svc.GetObject(params)
 	if err != nil {
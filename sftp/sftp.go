@@ -0,0 +1,452 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/sftp"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+SftpObjectStoreDriver stores backups on a remote host reachable by SSH, with
+destination URL like sftp://user@host:port/path/. Files are accessed through
+the SFTP subsystem, so the user doesn't need shell access on the host. The
+SSH connection is shared by all the drivers of the same host and user, and
+reconnected once lost.
+*/
+type SftpObjectStoreDriver struct {
+	destURL    string
+	user       string
+	host       string
+	port       string
+	path       string
+	keyFile    string
+	knownHosts string
+}
+
+const (
+	KIND = "sftp"
+
+	SFTP_KEYFILE    = "objectstore.sftp.keyfile"
+	SFTP_KNOWNHOSTS = "objectstore.sftp.knownhosts"
+
+	DEFAULT_PORT = "22"
+
+	CONNECT_TIMEOUT = 30 * time.Second
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "sftp"})
+
+	// Keys tried in order if no key file is specified, the same as ssh
+	defaultKeyFiles = []string{"id_rsa", "id_ecdsa", "id_ed25519"}
+
+	// connect opens a SFTP session for the driver, replaced by tests
+	connect = sshConnect
+
+	clients     = map[string]*sftp.Client{}
+	clientsLock sync.Mutex
+)
+
+func init() {
+	if err := objectstore.RegisterDriver(KIND, initFunc, objectstore.Capabilities{}); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL, endpoint string) (objectstore.ObjectStoreDriver, error) {
+	b := &SftpObjectStoreDriver{}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("Invalid URL. Must be sftp://[user@]host[:port]/path/")
+	}
+	b.host = u.Hostname()
+	if u.User != nil {
+		b.user = u.User.Username()
+	}
+	b.port = u.Port()
+	if b.port == "" {
+		b.port = DEFAULT_PORT
+	}
+	if _, err := strconv.Atoi(b.port); err != nil {
+		return nil, fmt.Errorf("Invalid port %v in URL %v", b.port, destURL)
+	}
+	b.path = u.Path
+	b.keyFile = objectstore.GetOption(SFTP_KEYFILE)
+	b.knownHosts = objectstore.GetOption(SFTP_KNOWNHOSTS)
+
+	if _, err := b.List(""); err != nil {
+		return nil, fmt.Errorf("SFTP path %v doesn't exist or is not accessible on %v: %v", b.path, b.host, err)
+	}
+
+	b.destURL = KIND + "://"
+	if b.user != "" {
+		b.destURL += b.user + "@"
+	}
+	b.destURL += b.host
+	if b.port != DEFAULT_PORT {
+		b.destURL += ":" + b.port
+	}
+	b.destURL += b.path
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+// getClient returns the SFTP session shared by the drivers connecting the same way
+func (s *SftpObjectStoreDriver) getClient() (*sftp.Client, error) {
+	key := strings.Join([]string{s.user, s.host, s.port, s.keyFile, s.knownHosts}, "|")
+
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	if client := clients[key]; client != nil {
+		return client, nil
+	}
+	client, err := connect(s)
+	if err != nil {
+		return nil, err
+	}
+	clients[key] = client
+	go func() {
+		err := client.Wait()
+		log.Debugf("SFTP connection to %v was closed: %v", s.host, err)
+		clientsLock.Lock()
+		if clients[key] == client {
+			delete(clients, key)
+		}
+		clientsLock.Unlock()
+	}()
+	return client, nil
+}
+
+func sshConnect(s *SftpObjectStoreDriver) (*sftp.Client, error) {
+	var keyring agent.Agent
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && s.keyFile == "" {
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Warnf("Cannot connect to ssh-agent: %v", err)
+		} else {
+			// Only needed for authentication
+			defer agentConn.Close()
+			keyring = agent.NewClient(agentConn)
+		}
+	}
+	config, err := s.getSSHConfig(keyring)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(s.host, s.port), config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to %v as %v: %v", s.host, config.User, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Cannot start SFTP session on %v: %v", s.host, err)
+	}
+	go func() {
+		client.Wait()
+		conn.Close()
+	}()
+	log.Debugf("Connected to %v as %v", s.host, config.User)
+	return client, nil
+}
+
+/*
+getSSHConfig authenticates by the key file if specified, otherwise by the
+keys of ssh-agent, which can be nil, and the default keys of the user running
+the daemon. The host must be listed in the known hosts file.
+*/
+func (s *SftpObjectStoreDriver) getSSHConfig(keyring agent.Agent) (*ssh.ClientConfig, error) {
+	current, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	sshDir := filepath.Join(current.HomeDir, ".ssh")
+	userName := s.user
+	if userName == "" {
+		userName = current.Username
+	}
+
+	knownHostsFile := s.knownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(sshDir, "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load known hosts file %v: %v", knownHostsFile, err)
+	}
+
+	signers := []ssh.Signer{}
+	if s.keyFile != "" {
+		signer, err := loadKeyFile(s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	} else {
+		if keyring != nil {
+			agentSigners, err := keyring.Signers()
+			if err != nil {
+				log.Warnf("Cannot get keys from ssh-agent: %v", err)
+			}
+			signers = append(signers, agentSigners...)
+		}
+		for _, name := range defaultKeyFiles {
+			keyFile := filepath.Join(sshDir, name)
+			if _, err := os.Stat(keyFile); err != nil {
+				continue
+			}
+			signer, err := loadKeyFile(keyFile)
+			if err != nil {
+				log.Warnf("Skip key %v: %v", keyFile, err)
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No key found to log in to %v, specify one by %v", s.host, SFTP_KEYFILE)
+	}
+
+	return &ssh.ClientConfig{
+		User:            userName,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         CONNECT_TIMEOUT,
+	}, nil
+}
+
+func loadKeyFile(keyFile string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse private key %v, keys protected by passphrase are not supported: %v", keyFile, err)
+	}
+	return signer, nil
+}
+
+func (s *SftpObjectStoreDriver) updatePath(path string) string {
+	return filepath.Join(s.path, path)
+}
+
+func (s *SftpObjectStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *SftpObjectStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *SftpObjectStoreDriver) FileSize(filePath string) int64 {
+	client, err := s.getClient()
+	if err != nil {
+		return -1
+	}
+	info, err := client.Stat(s.updatePath(filePath))
+	if err != nil || !info.Mode().IsRegular() {
+		return -1
+	}
+	return info.Size()
+}
+
+func (s *SftpObjectStoreDriver) FileExists(filePath string) bool {
+	return s.FileSize(filePath) >= 0
+}
+
+/*
+Remove removes the files and directories recursively, and the parent
+directories left empty, up to the objectstore base directory, the same as the
+vfs driver.
+*/
+func (s *SftpObjectStoreDriver) Remove(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	dirSet := map[string]bool{}
+	for _, name := range names {
+		file := s.updatePath(name)
+		if err := removeAll(client, file); err != nil {
+			return err
+		}
+		for dir := filepath.Dir(file); dir != s.path && dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			// Don't clean above OBJECTSTORE_BASE
+			if strings.HasSuffix(dir, objectstore.OBJECTSTORE_BASE) {
+				break
+			}
+			dirSet[dir] = true
+		}
+	}
+	// The deeper directories need to be removed first
+	dirs := []string{}
+	for dir := range dirSet {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], "/") > strings.Count(dirs[j], "/")
+	})
+	for _, dir := range dirs {
+		// It fails if the directory is not empty, which is expected
+		client.RemoveDirectory(dir)
+	}
+	return nil
+}
+
+// removeAll behaves like "rm -rf"
+func removeAll(client *sftp.Client, path string) error {
+	info, err := client.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return client.Remove(path)
+	}
+	children, err := client.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := removeAll(client, filepath.Join(path, child.Name())); err != nil {
+			return err
+		}
+	}
+	return client.RemoveDirectory(path)
+}
+
+func (s *SftpObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	file := s.updatePath(src)
+	f, err := client.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Cannot find %v on %v", file, s.host)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+/*
+Write saves the content to a temporary file of unique name first, so
+concurrent writes of the same file won't mix up, then renames it to replace
+dst atomically.
+*/
+func (s *SftpObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	file := s.updatePath(dst)
+	if err := client.MkdirAll(filepath.Dir(file)); err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp-" + util.NewUUID()
+	f, err := client.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rs)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = rename(client, tmpFile, file)
+	}
+	if err != nil {
+		client.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// rename replaces newName atomically, unless the server doesn't support posix-rename
+func rename(client *sftp.Client, oldName, newName string) error {
+	err := client.PosixRename(oldName, newName)
+	if statusErr, ok := err.(*sftp.StatusError); ok && statusErr.Code == uint32(sftp.ErrSshFxOpUnsupported) {
+		// SFTP rename fails if newName exists
+		if err := client.Remove(newName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return client.Rename(oldName, newName)
+	}
+	return err
+}
+
+func (s *SftpObjectStoreDriver) List(path string) ([]string, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := client.ReadDir(s.updatePath(path))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, info := range infos {
+		result = append(result, info.Name())
+	}
+	return result, nil
+}
+
+func (s *SftpObjectStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.Write(dst, file)
+}
+
+func (s *SftpObjectStoreDriver) Download(src, dst string) error {
+	rc, err := s.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
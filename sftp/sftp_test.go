@@ -0,0 +1,264 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rancher/convoy/objectstore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type TestSuite struct {
+	dir         string
+	connections int
+}
+
+var _ = check.Suite(&TestSuite{})
+
+// pipeConnect serves the SFTP session in process on the local filesystem
+func (s *TestSuite) pipeConnect(d *SftpObjectStoreDriver) (*sftp.Client, error) {
+	s.connections++
+	clientConn, serverConn := net.Pipe()
+	server, err := sftp.NewServer(serverConn)
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+	return sftp.NewClientPipe(clientConn, clientConn)
+}
+
+func (s *TestSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.connections = 0
+	connect = s.pipeConnect
+	c.Assert(os.Mkdir(filepath.Join(s.dir, "backups"), 0700), check.IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *check.C) {
+	connect = sshConnect
+	clientsLock.Lock()
+	for key, client := range clients {
+		client.Close()
+		delete(clients, key)
+	}
+	clientsLock.Unlock()
+	c.Assert(objectstore.Init("", map[string]string{}), check.IsNil)
+}
+
+func (s *TestSuite) TestInitFunc(c *check.C) {
+	path := filepath.Join(s.dir, "backups")
+	driver, err := initFunc("sftp://user@localhost:2222"+path, "")
+	c.Assert(err, check.IsNil)
+	d := driver.(*SftpObjectStoreDriver)
+	c.Assert(d.GetURL(), check.Equals, "sftp://user@localhost:2222"+path)
+	c.Assert(d.user, check.Equals, "user")
+	c.Assert(d.host, check.Equals, "localhost")
+	c.Assert(d.port, check.Equals, "2222")
+	c.Assert(d.path, check.Equals, path)
+
+	driver, err = initFunc("sftp://localhost"+path, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(driver.GetURL(), check.Equals, "sftp://localhost"+path)
+	c.Assert(driver.(*SftpObjectStoreDriver).port, check.Equals, DEFAULT_PORT)
+
+	_, err = initFunc("sftp://localhost", "")
+	c.Assert(err, check.ErrorMatches, "Invalid URL.*")
+	_, err = initFunc("sftp://localhost:ssh"+path, "")
+	c.Assert(err, check.NotNil)
+	_, err = initFunc("sftp://localhost"+filepath.Join(s.dir, "nonexistent"), "")
+	c.Assert(err, check.ErrorMatches, "(?s)SFTP path .* doesn't exist or is not accessible.*")
+}
+
+func (s *TestSuite) TestSharedConnection(c *check.C) {
+	path := filepath.Join(s.dir, "backups")
+	d1, err := initFunc("sftp://user@localhost"+path, "")
+	c.Assert(err, check.IsNil)
+	d2, err := initFunc("sftp://user@localhost"+path+"/", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(d1.FileExists("file"), check.Equals, false)
+	c.Assert(d2.FileExists("file"), check.Equals, false)
+	c.Assert(s.connections, check.Equals, 1)
+
+	// Other users have their own connections
+	_, err = initFunc("sftp://other@localhost"+path, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.connections, check.Equals, 2)
+
+	// Reconnected once lost
+	client, err := d1.(*SftpObjectStoreDriver).getClient()
+	c.Assert(err, check.IsNil)
+	c.Assert(client.Close(), check.IsNil)
+	for i := 0; ; i++ {
+		clientsLock.Lock()
+		closed := len(clients) == 1
+		clientsLock.Unlock()
+		if closed {
+			break
+		}
+		c.Assert(i < 1000, check.Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = d2.List("")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.connections, check.Equals, 3)
+}
+
+func generateKeyFile(c *check.C, dir string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	keyFile := filepath.Join(dir, "id_rsa")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	c.Assert(ioutil.WriteFile(keyFile, data, 0600), check.IsNil)
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	c.Assert(err, check.IsNil)
+	return keyFile, pub
+}
+
+func (s *TestSuite) TestSSHConfig(c *check.C) {
+	keyFile, hostKey := generateKeyFile(c, c.MkDir())
+	_, otherKey := generateKeyFile(c, c.MkDir())
+	knownHostsFile := filepath.Join(s.dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("backup-server:2222")}, hostKey)
+	c.Assert(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600), check.IsNil)
+
+	c.Assert(objectstore.Init("", map[string]string{
+		SFTP_KEYFILE:    keyFile,
+		SFTP_KNOWNHOSTS: knownHostsFile,
+	}), check.IsNil)
+	driver, err := initFunc("sftp://backup@backup-server:2222"+filepath.Join(s.dir, "backups"), "")
+	c.Assert(err, check.IsNil)
+	d := driver.(*SftpObjectStoreDriver)
+	config, err := d.getSSHConfig(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.User, check.Equals, "backup")
+	c.Assert(config.Auth, check.HasLen, 1)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 2222}
+	c.Assert(config.HostKeyCallback("backup-server:2222", addr, hostKey), check.IsNil)
+	c.Assert(config.HostKeyCallback("backup-server:2222", addr, otherKey), check.NotNil)
+	c.Assert(config.HostKeyCallback("other-server:2222", addr, hostKey), check.NotNil)
+
+	d.knownHosts = filepath.Join(s.dir, "nonexistent")
+	_, err = d.getSSHConfig(nil)
+	c.Assert(err, check.ErrorMatches, "Cannot load known hosts file .*")
+	d.knownHosts = knownHostsFile
+	c.Assert(ioutil.WriteFile(keyFile, []byte("invalid"), 0600), check.IsNil)
+	_, err = d.getSSHConfig(nil)
+	c.Assert(err, check.ErrorMatches, "Cannot parse private key .*")
+}
+
+func (s *TestSuite) TestDriverOperations(c *check.C) {
+	d, err := initFunc("sftp://localhost"+filepath.Join(s.dir, "backups"), "")
+	c.Assert(err, check.IsNil)
+
+	base := objectstore.OBJECTSTORE_BASE
+	file1 := filepath.Join(base, "dir", "file 1")
+	file2 := filepath.Join(base, "dir", "sub", "file2")
+	c.Assert(d.FileExists(file1), check.Equals, false)
+	c.Assert(d.FileSize(file1), check.Equals, int64(-1))
+	c.Assert(d.Write(file1, bytes.NewReader([]byte("content1"))), check.IsNil)
+	c.Assert(d.Write(file2, bytes.NewReader([]byte("content2"))), check.IsNil)
+	c.Assert(d.FileExists(file1), check.Equals, true)
+	c.Assert(d.FileSize(file1), check.Equals, int64(8))
+	c.Assert(d.FileSize(filepath.Join(base, "dir")), check.Equals, int64(-1))
+
+	rc, err := d.Read(file1)
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+	c.Assert(string(data), check.Equals, "content1")
+
+	// Stop reading in the middle
+	rc, err = d.Read(file1)
+	c.Assert(err, check.IsNil)
+	c.Assert(rc.Close(), check.IsNil)
+
+	_, err = d.Read(filepath.Join(base, "nonexistent"))
+	c.Assert(err, check.ErrorMatches, "Cannot find .*")
+
+	names, err := d.List(filepath.Join(base, "dir"))
+	c.Assert(err, check.IsNil)
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"file 1", "sub"})
+
+	dir := c.MkDir()
+	c.Assert(d.Download(file2, dir+"/file2"), check.IsNil)
+	data, err = ioutil.ReadFile(dir + "/file2")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "content2")
+	c.Assert(d.Upload(dir+"/file2", filepath.Join(base, "dir", "file3")), check.IsNil)
+	c.Assert(d.FileSize(filepath.Join(base, "dir", "file3")), check.Equals, int64(8))
+
+	// The empty parent directories are removed as well, but not the base
+	c.Assert(d.Remove(file2), check.IsNil)
+	c.Assert(d.FileExists(file2), check.Equals, false)
+	_, err = os.Stat(filepath.Join(s.dir, "backups", base, "dir", "sub"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(d.Remove(file1, filepath.Join(base, "dir", "file3"), filepath.Join(base, "nonexistent")), check.IsNil)
+	names, err = d.List(base)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+
+	// Directories are removed recursively
+	c.Assert(d.Write(file2, bytes.NewReader([]byte("content2"))), check.IsNil)
+	c.Assert(d.Remove(filepath.Join(base, "dir")), check.IsNil)
+	names, err = d.List(base)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+}
+
+func (s *TestSuite) TestConcurrentWrite(c *check.C) {
+	d, err := initFunc("sftp://localhost"+filepath.Join(s.dir, "backups"), "")
+	c.Assert(err, check.IsNil)
+
+	file := filepath.Join(objectstore.OBJECTSTORE_BASE, "file")
+	contents := []string{}
+	for i := 0; i < 8; i++ {
+		contents = append(contents, strings.Repeat(fmt.Sprintf("content%v", i), 10000))
+	}
+	var wg sync.WaitGroup
+	for _, content := range contents {
+		wg.Add(1)
+		go func(content string) {
+			defer wg.Done()
+			c.Check(d.Write(file, strings.NewReader(content)), check.IsNil)
+		}(content)
+	}
+	wg.Wait()
+
+	// One of them wins as a whole, no temporary file is left
+	rc, err := d.Read(file)
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, check.IsNil)
+	found := false
+	for _, content := range contents {
+		if string(data) == content {
+			found = true
+		}
+	}
+	c.Assert(found, check.Equals, true)
+	names, err := d.List(objectstore.OBJECTSTORE_BASE)
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"file"})
+}
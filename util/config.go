@@ -31,9 +31,22 @@ func LoadConfig(fileName string, v interface{}) error {
 }
 
 func SaveConfig(fileName string, v interface{}) error {
+	return saveConfig(fileName, v, 0666)
+}
+
+// SaveSecretConfig is the same as SaveConfig, but the file is only accessible by owner
+func SaveSecretConfig(fileName string, v interface{}) error {
+	return saveConfig(fileName, v, 0600)
+}
+
+func saveConfig(fileName string, v interface{}, perm os.FileMode) error {
 	tmpFileName := fileName + ".tmp"
 
-	f, err := os.Create(tmpFileName)
+	// Remove the leftover, whose permission may be different
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
 		return err
 	}
@@ -142,6 +155,14 @@ func ObjectSave(obj interface{}) error {
 	return SaveConfig(config, obj)
 }
 
+func ObjectSaveSecret(obj interface{}) error {
+	config, err := ObjectConfig(obj)
+	if err != nil {
+		return err
+	}
+	return SaveSecretConfig(config, obj)
+}
+
 func ObjectDelete(obj interface{}) error {
 	config, err := ObjectConfig(obj)
 	if err != nil {
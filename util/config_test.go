@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 
 	. "gopkg.in/check.v1"
@@ -58,6 +59,12 @@ func (s *TestSuite) TestSaveLoadConfig(c *C) {
 	c.Assert(err, IsNil)
 
 	c.Assert(dev, DeepEquals, devNew)
+
+	err = SaveSecretConfig("/tmp/cfg", &dev)
+	c.Assert(err, IsNil)
+	st, err := os.Stat("/tmp/cfg")
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0600))
 }
 
 func (d *Device) ConfigFile() (string, error) {
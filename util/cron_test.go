@@ -0,0 +1,43 @@
+package util
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCron(c *C) {
+	base := time.Date(2016, 2, 27, 10, 30, 15, 0, time.UTC)
+
+	cases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2016, 2, 27, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, 2, 27, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2016, 2, 28, 2, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2016, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, 2, 27, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"30 4 * * 1-5", time.Date(2016, 2, 29, 4, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, 2, 28, 0, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week matches
+		{"0 0 1 * 0", time.Date(2016, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"0,30 9-17/4 * * *", time.Date(2016, 2, 27, 13, 0, 0, 0, time.UTC)},
+	}
+	for _, t := range cases {
+		schedule, err := ParseCron(t.spec)
+		c.Assert(err, IsNil)
+		c.Assert(schedule.Next(base), Equals, t.next, Commentf("spec %v", t.spec))
+	}
+
+	schedule, err := ParseCron("0 0 31 2 *")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.Next(base).IsZero(), Equals, true)
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := ParseCron(spec)
+		c.Assert(err, NotNil, Commentf("spec %v", spec))
+	}
+}
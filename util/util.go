@@ -72,6 +72,15 @@ func MkdirIfNotExists(path string) error {
 	return nil
 }
 
+// GetAvailableSpace returns the bytes available to unprivileged users in the filesystem of path
+func GetAvailableSpace(path string) (int64, error) {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
 func GetChecksum(data []byte) string {
 	checksumBytes := sha512.Sum512(data)
 	checksum := hex.EncodeToString(checksumBytes[:])[:PRESERVED_CHECKSUM_LENGTH]
@@ -132,6 +141,54 @@ func SliceToMap(slices []string) map[string]string {
 	return result
 }
 
+// ParseLabels parses labels in the format of key=value, keys must be valid names
+func ParseLabels(labels []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, label := range labels {
+		pair := strings.SplitN(label, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Invalid label %v, must be in the format of key=value", label)
+		}
+		result[pair[0]] = pair[1]
+	}
+	if err := CheckLabels(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func CheckLabels(labels map[string]string) error {
+	for key := range labels {
+		if !ValidateName(key) {
+			return fmt.Errorf("Invalid label key %v", key)
+		}
+	}
+	return nil
+}
+
+// EncodeLabels encodes labels to a string, so they can be passed as an option of driver
+func EncodeLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func DecodeLabels(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &labels); err != nil {
+		return nil, fmt.Errorf("Invalid labels %v: %v", value, err)
+	}
+	return labels, nil
+}
+
 func GetFileChecksum(filePath string) (string, error) {
 	output, err := Execute("sha512sum", []string{"-b", filePath})
 	if err != nil {
@@ -349,6 +406,18 @@ func Execute(binary string, args []string) (string, error) {
 	return string(output), nil
 }
 
+// ExecuteWithStdin feeds stdin to the command. Unlike Execute, it doesn't time
+// out, since the time needed depends on the amount of input
+func ExecuteWithStdin(binary string, args []string, stdin io.Reader) (string, error) {
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = stdin
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Failed to execute: %v %v, output %v, error %v", binary, args, string(output), err)
+	}
+	return string(output), nil
+}
+
 func Now() string {
 	return time.Now().Format(time.RubyDate)
 }
@@ -425,10 +494,15 @@ func GetFlag(v interface{}, key string, required bool, err error) (string, error
 	return value, err
 }
 
+// EscapeURL escapes every "&" in url, so it can be pasted into bash
+func EscapeURL(url string) string {
+	return strings.Replace(url, "&", "\\u0026", -1)
+}
+
 func UnescapeURL(url string) string {
 	// Deal with escape in url inputed from bash
-	result := strings.Replace(url, "\\u0026", "&", 1)
-	result = strings.Replace(result, "u0026", "&", 1)
+	result := strings.Replace(url, "\\u0026", "&", -1)
+	result = strings.Replace(result, "u0026", "&", -1)
 	return result
 }
 
@@ -1,12 +1,14 @@
 package util
 
 import (
+	"bytes"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -124,6 +126,30 @@ func (s *TestSuite) TestSliceToMap(c *C) {
 	c.Assert(m, IsNil)
 }
 
+func (s *TestSuite) TestLabels(c *C) {
+	labels, err := ParseLabels([]string{"env=prod", "note=a=b"})
+	c.Assert(err, IsNil)
+	c.Assert(labels, DeepEquals, map[string]string{"env": "prod", "note": "a=b"})
+
+	_, err = ParseLabels([]string{"env"})
+	c.Assert(err, ErrorMatches, "Invalid label env.*")
+	_, err = ParseLabels([]string{"-env=prod"})
+	c.Assert(err, ErrorMatches, "Invalid label key -env")
+
+	value, err := EncodeLabels(labels)
+	c.Assert(err, IsNil)
+	decoded, err := DecodeLabels(value)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, labels)
+
+	value, err = EncodeLabels(nil)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "")
+	decoded, err = DecodeLabels("")
+	c.Assert(err, IsNil)
+	c.Assert(decoded, IsNil)
+}
+
 func (s *TestSuite) TestChecksum(c *C) {
 	checksum, err := GetFileChecksum(emptyFile)
 	c.Assert(err, IsNil)
@@ -177,6 +203,16 @@ func (s *TestSuite) TestValidateName(c *C) {
 	c.Assert(ValidateName("ubuntu14.04_v1 "), Equals, false)
 }
 
+func (s *TestSuite) TestEscapeURL(c *C) {
+	url := "s3://bucket@us-east-1/path/?backup=backup-1&sse=aws%3Akms&storage-class=STANDARD_IA&volume=vol1"
+	escaped := EscapeURL(url)
+	c.Assert(strings.Contains(escaped, "&"), Equals, false)
+	c.Assert(UnescapeURL(escaped), Equals, url)
+	// Backslashes are removed by bash
+	c.Assert(UnescapeURL(strings.Replace(escaped, "\\", "", -1)), Equals, url)
+	c.Assert(UnescapeURL(url), Equals, url)
+}
+
 func (s *TestSuite) TestParseSize(c *C) {
 	var (
 		value int64
@@ -324,6 +360,37 @@ func (s *TestSuite) TestCompressDir(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *TestSuite) TestDecompressDirFromStream(c *C) {
+	tmpdir := c.MkDir()
+	path := filepath.Join(tmpdir, "path")
+	c.Assert(os.MkdirAll(filepath.Join(path, "dir"), 0700), IsNil)
+	data := []byte("Some random string for file")
+	c.Assert(ioutil.WriteFile(filepath.Join(path, "dir", "file"), data, 0640), IsNil)
+
+	tarFile := filepath.Join(tmpdir, "test.tar.gz")
+	c.Assert(CompressDir(path, tarFile), IsNil)
+	f, err := os.Open(tarFile)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	extracted := filepath.Join(tmpdir, "extracted")
+	c.Assert(os.Mkdir(extracted, 0700), IsNil)
+	c.Assert(DecompressDirFromStream(f, extracted), IsNil)
+	result, err := ioutil.ReadFile(filepath.Join(extracted, "dir", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, data)
+
+	copied := filepath.Join(tmpdir, "copied")
+	c.Assert(os.Mkdir(copied, 0700), IsNil)
+	c.Assert(CopyDir(extracted, copied), IsNil)
+	st, err := os.Stat(filepath.Join(copied, "dir", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0640))
+
+	err = DecompressDirFromStream(bytes.NewReader([]byte("invalid")), extracted)
+	c.Assert(err, NotNil)
+}
+
 var (
 	firstLetters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	letters      = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.-")
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -225,6 +226,24 @@ func callUmount(args []string) error {
 	return nil
 }
 
+// CopyDir copies the content of srcDir to dstDir with ownership and permissions preserved
+func CopyDir(srcDir, dstDir string) error {
+	cmdName, cmdArgs := updateMountNamespace("cp", []string{"-a", srcDir + "/.", dstDir})
+	if _, err := ExecuteWithStdin(cmdName, cmdArgs, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DecompressDirFromStream extracts the content compressed by CompressDir from r to targetDir
+func DecompressDirFromStream(r io.Reader, targetDir string) error {
+	cmdName, cmdArgs := updateMountNamespace("tar", []string{"xzf", "-", "-C", targetDir})
+	if _, err := ExecuteWithStdin(cmdName, cmdArgs, r); err != nil {
+		return err
+	}
+	return nil
+}
+
 func InitMountNamespace(fd string) error {
 	if fd == "" {
 		return nil
@@ -31,7 +31,7 @@ const (
 )
 
 func init() {
-	if err := objectstore.RegisterDriver(KIND, initFunc); err != nil {
+	if err := objectstore.RegisterDriver(KIND, initFunc, objectstore.Capabilities{}); err != nil {
 		panic(err)
 	}
 }
@@ -145,9 +145,7 @@ func (v *VfsObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
 		return err
 	}
 
-	if v.FileExists(dst) {
-		v.Remove(dst)
-	}
+	// Rename would replace dst atomically
 	return os.Rename(v.updatePath(tmpFile), v.updatePath(dst))
 }
 
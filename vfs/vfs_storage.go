@@ -234,7 +234,7 @@ func (d *Driver) CreateVolume(req Request) error {
 	volume.Name = id
 
 	if backupURL != "" {
-		file, err := objectstore.RestoreSingleFileBackup(backupURL, endpointURL, volumePath)
+		file, err := objectstore.RestoreSingleFileBackup(backupURL, endpointURL, volumePath, objectstore.GetProgress(opts[OPT_JOB_ID]))
 		if err != nil {
 			return err
 		}
@@ -567,11 +567,18 @@ func (d *Driver) CreateBackup(snapshotID, volumeID, destURL, endpointURL string,
 		Driver:      d.Name(),
 		CreatedTime: opts[OPT_VOLUME_CREATED_TIME],
 	}
+	labels, err := util.DecodeLabels(opts[OPT_BACKUP_LABELS])
+	if err != nil {
+		return "", err
+	}
 	objSnapshot := &objectstore.Snapshot{
 		Name:        snapshotID,
 		CreatedTime: opts[OPT_SNAPSHOT_CREATED_TIME],
+		Labels:      labels,
+		Description: opts[OPT_BACKUP_DESCRIPTION],
 	}
-	return objectstore.CreateSingleFileBackup(objVolume, objSnapshot, snapshot.FilePath, destURL, endpointURL)
+	return objectstore.CreateSingleFileBackup(objVolume, objSnapshot, snapshot.FilePath, destURL, endpointURL,
+		objectstore.GetProgress(opts[OPT_JOB_ID]))
 }
 
 func (d *Driver) DeleteBackup(backupURL, endpointURL string) error {